@@ -2,10 +2,13 @@ package lantern_cache
 
 import (
 	"bytes"
-	"fmt"
+	"crypto/cipher"
+	"math/bits"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 type bucketConfig struct {
@@ -13,25 +16,84 @@ type bucketConfig struct {
 	initCapacity uint64
 	chunkAlloc   *chunkAllocator
 	statistics   *Stats
+	hash         Hasher
+	events       *notifier
+	checksum     bool
+	cipher       *valueCipher
+	indexPolicy  string
+	optimistic   bool
+	latency      *cacheLatency
+	bigKeys      *bigKeyTracker
+	logger       *eventLogger
 }
 
 type bucket struct {
-	mutex      sync.RWMutex
-	m          map[uint64]uint64
-	offset     uint64
-	loop       uint32
-	chunks     [][]byte
+	// 原子操作的64位字段放在最前面, 保证在32位平台上对齐
+	// seq 开启乐观读时写锁内是奇数, 每次加写锁和解锁都加一
+	seq uint64
+	// counters 没有指定statistics时bucket自己的计数, 每个bucket一份, 写不同bucket时不会竞争同一个计数
+	counters Stats
+	ops      OpStats
+	// locks 开启延迟统计时写锁的次数, 用来采样
+	locks uint64
+	// mask keyHash&mask == id的key属于这个bucket, Rebucket在写锁内修改, 乐观读原子地读
+	mask uint64
+
+	mutex  sync.RWMutex
+	index  bucketIndex
+	offset uint64
+	loop   uint32
+	// chunks 只在写锁内替换, 用setChunks同时更新sharedChunks
+	chunks [][]byte
+	// sharedChunks 指向chunks的*[][]byte, 给不加锁的乐观读用
+	sharedChunks unsafe.Pointer
+	// reserved reserveLocked预留的chunk, 写入需要新的chunk时先用它们
+	reserved   [][]byte
 	chunkAlloc *chunkAllocator
 	statistics *Stats
+	hash       Hasher
+	events     *notifier
+	checksum   bool
+	cipher     *valueCipher
+	// optimistic 读不加锁, 用seq校验读的过程中没有写入, 只有flat索引支持
+	optimistic bool
+	latency    *cacheLatency
+	bigKeys    *bigKeyTracker
+	logger     *eventLogger
+	// id 是bucket在cache里的下标, 和mask一起决定bucket拥有哪些key
+	id int
 }
 
-func newBucket(cfg *bucketConfig) *bucket {
+// newBucket 分配初始的chunk失败时返回错误, 已经分配的chunk放回allocator
+func newBucket(cfg *bucketConfig) (*bucket, error) {
 	ensure(cfg.maxCapacity > 0, "bucket max capacity need > 0")
 	if cfg.initCapacity == 0 {
 		cfg.initCapacity = cfg.maxCapacity / 4
 	}
 	ret := &bucket{}
 	ret.statistics = cfg.statistics
+	if ret.statistics == nil {
+		ret.statistics = &ret.counters
+	}
+	ret.hash = cfg.hash
+	if ret.hash == nil {
+		ret.hash = newFowlerNollVoHasher()
+	}
+	ret.events = cfg.events
+	if ret.events == nil {
+		ret.events = newNotifier()
+	}
+	ret.checksum = cfg.checksum
+	ret.cipher = cfg.cipher
+	ret.logger = cfg.logger
+	ret.latency = cfg.latency
+	if ret.latency == nil {
+		ret.latency = newCacheLatency(0)
+	}
+	ret.bigKeys = cfg.bigKeys
+	if ret.bigKeys == nil {
+		ret.bigKeys = newBigKeyTracker(0)
+	}
 
 	needChunkCount := (cfg.maxCapacity + chunkSize - 1) / chunkSize
 	ensure(needChunkCount > 0, "max bucket chunk count need > 0")
@@ -41,152 +103,574 @@ func newBucket(cfg *bucketConfig) *bucket {
 		initChunkCount = 1
 	}
 
-	ret.chunks = make([][]byte, needChunkCount)
+	ret.setChunks(make([][]byte, needChunkCount))
 	ret.chunkAlloc = cfg.chunkAlloc
 	ret.offset = 0
 	ret.loop = 0
 
-	ret.m = make(map[uint64]uint64)
+	ret.index = newBucketIndex(cfg.indexPolicy)
+	if cfg.optimistic && optimisticSupported {
+		_, ret.optimistic = ret.index.(*flatIndex)
+	}
 
 	for i := uint64(0); i < initChunkCount; i++ {
 		chunk, err := ret.chunkAlloc.getChunk()
 		if err != nil {
-			panic(err)
+			for _, chunk := range ret.chunks[:i] {
+				ret.chunkAlloc.putChunk(chunk)
+			}
+			return nil, err
 		}
 		ret.chunks[i] = chunk
 	}
-	return ret
+	return ret, nil
 }
 
 func (b *bucket) put(keyHash uint64, key, val []byte, expire int64) error {
+	return b.store(keyHash, key, val, expire, b.cipher)
+}
+
+// putRaw val是entry里保存的原样数据, 恢复snapshot时已经加密过的value不再加密
+func (b *bucket) putRaw(keyHash uint64, key, val []byte, expire int64) error {
+	return b.store(keyHash, key, val, expire, nil)
+}
+
+func (b *bucket) store(keyHash uint64, key, val []byte, expire int64, c *valueCipher) error {
+	b.lock()
+	if !b.owns(keyHash) {
+		b.unlock()
+		return errBucketMoved
+	}
 	puts := atomic.AddUint64(&b.statistics.Puts, 1)
+	err := b.storeLocked(keyHash, key, val, expire, c)
+	b.unlock()
 	if puts%(CleanCount) == 0 {
 		b.clean()
 	}
+	return err
+}
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+// owns keyHash是否属于这个bucket, Rebucket迁移走的key返回false
+// 调用方需要持有锁, 或者在乐观读的seq校验之内
+func (b *bucket) owns(keyHash uint64) bool {
+	return keyHash&atomic.LoadUint64(&b.mask) == uint64(b.id)
+}
+
+// putLocked 调用方需要持有写锁
+func (b *bucket) putLocked(keyHash uint64, key, val []byte, expire int64) error {
+	return b.storeLocked(keyHash, key, val, expire, b.cipher)
+}
 
-	entrySize := uint64(EntryHeadFieldSizeOf + len(key) + len(val))
-	if len(key) == 0 || len(val) == 0 || len(key) > MaxKeySize || len(val) > MaxValueSize || entrySize > chunkSize {
+// storeLocked c不为nil时val加密后直接写入chunk
+func (b *bucket) storeLocked(keyHash uint64, key, val []byte, expire int64, c *valueCipher) error {
+	if !validEntry(key, val, c.overhead()) {
 		atomic.AddUint64(&b.statistics.Errors, 1)
 		return ErrorInvalidEntry
 	}
+	var keyID uint32
+	var aead cipher.AEAD
+	if c != nil {
+		var err error
+		if keyID, aead, err = c.current(); err != nil {
+			atomic.AddUint64(&b.statistics.Errors, 1)
+			return err
+		}
+	}
+	return b.writeLocked(keyHash, key, val, expire, c, keyID, aead)
+}
+
+// writeLocked 写入已经检查过的entry, c不为nil时用keyID和aead加密
+// 只有分配chunk会失败, reserveLocked预留过chunk时不会失败
+func (b *bucket) writeLocked(keyHash uint64, key, val []byte, expire int64, c *valueCipher, keyID uint32, aead cipher.AEAD) error {
+	valSize := len(val) + c.overhead()
+	entrySize := uint64(EntryHeadFieldSizeOf + len(key) + valSize)
 
 	offset := b.offset
-	nextOffset := offset + entrySize
 	chunkIndex := offset / chunkSize
-	nextChunkIndex := nextOffset / chunkSize
-
-	if nextChunkIndex > chunkIndex {
-		if int(nextChunkIndex) >= len(b.chunks) {
+	if next, wrapped, moved := placeEntry(offset, entrySize, len(b.chunks)); moved {
+		if b.chunks[chunkIndex] != nil {
+			wrapEndMark(b.chunks[chunkIndex][offset&(chunkSize-1):])
+		}
+		if wrapped {
 			b.loop++
-			fmt.Printf("chunk(%v) need loop:%d offset:%d nextOffset:%d chunkIndex:%d nextChunkIndex:%d len(b.chunks):%d\n", &b, b.loop, offset, nextOffset, chunkIndex, nextChunkIndex, len(b.chunks))
-			chunkIndex = 0
-			offset = 0
-		} else {
-			//b.logger.Printf("bucket chunk[%d] no space to write so jump next chunk[%d] continue loop:%d", chunkIndex, nextChunkIndex, b.loop)
-			chunkIndex = nextChunkIndex
-			offset = chunkIndex * chunkSize
+			if b.logger.enabled(LevelDebug) {
+				b.logger.logLimited(LevelDebug, "ring wrapped", F("bucket", b.id), F("loop", b.loop), F("offset", offset), F("chunks", len(b.chunks)))
+			}
 		}
-		nextOffset = offset + entrySize
+		offset = next
+		chunkIndex = offset / chunkSize
+		b.evictChunk(chunkIndex)
 	}
+	nextOffset := offset + entrySize
 
 	if b.chunks[chunkIndex] == nil {
-		chunk, err := b.chunkAlloc.getChunk()
+		chunk, err := b.newChunkLocked()
 		if err != nil {
 			atomic.AddUint64(&b.statistics.Errors, 1)
+			b.logger.logLimited(LevelError, "bucket write failed", F("bucket", b.id), F("err", err))
 			return ErrorChunkAlloc
 		}
 		b.chunks[chunkIndex] = chunk
 	}
 
 	chunkOffset := offset & (chunkSize - 1)
-	wrapEntry(b.chunks[chunkIndex][chunkOffset:], expire, key, val)
+	entry := b.chunks[chunkIndex][chunkOffset : chunkOffset+entrySize]
+	if c == nil {
+		wrapEntry(entry, expire, key, val)
+	} else {
+		pos := wrapEntryHead(entry, expire, key, valSize)
+		c.seal(entry[pos:pos], keyID, aead, key, val)
+	}
+	if b.checksum {
+		wrapChecksum(entry)
+	}
 
-	b.m[keyHash] = (uint64(b.loop) << OffsetSizeOf) | offset
+	b.setLocked(keyHash, key, (uint64(b.loop)<<OffsetSizeOf)|offset)
 	b.offset = nextOffset
+	b.bigKeys.observe(key, int(entrySize))
 	//fmt.Printf("[%v] key:%s loop:%d offset:%d", &b, key, b.loop, offset)
+	b.events.emit(EventSet, keyHash, key)
 	return nil
 }
 
+// placeEntry 返回从offset开始写size字节的entry时的写入位置, entry不会跨chunk, 也不会正好写到chunk的末尾
+// 放不下时跳到下一个chunk的开头, 已经是最后一个chunk时回到ring的开头, wrapped为true
+func placeEntry(offset, size uint64, chunkCount int) (next uint64, wrapped, moved bool) {
+	nextChunkIndex := (offset + size) / chunkSize
+	if nextChunkIndex == offset/chunkSize {
+		return offset, false, false
+	}
+	if int(nextChunkIndex) >= chunkCount {
+		return 0, true, true
+	}
+	return nextChunkIndex * chunkSize, false, true
+}
+
+// newChunkLocked 先用预留的chunk, 没有时从allocator分配
+func (b *bucket) newChunkLocked() ([]byte, error) {
+	if n := len(b.reserved); n > 0 {
+		chunk := b.reserved[n-1]
+		b.reserved = b.reserved[:n-1]
+		return chunk, nil
+	}
+	start := b.latency.now()
+	chunk, err := b.chunkAlloc.getChunk()
+	b.latency.chunkAlloc.since(start)
+	return chunk, err
+}
+
+// reserveLocked 按顺序写入sizes大小的entry之前调用, 预留写入时需要分配的chunk, 之后的writeLocked不会失败
+// 分配失败时bucket不变, 调用方写完后用releaseLocked放回没有用到的chunk
+func (b *bucket) reserveLocked(sizes []uint64) error {
+	needed := 0
+	entered := make(map[uint64]bool)
+	offset := b.offset
+	for _, size := range sizes {
+		offset, _, _ = placeEntry(offset, size, len(b.chunks))
+		chunkIndex := offset / chunkSize
+		if b.chunks[chunkIndex] == nil && !entered[chunkIndex] {
+			entered[chunkIndex] = true
+			needed++
+		}
+		offset += size
+	}
+	for len(b.reserved) < needed {
+		chunk, err := b.chunkAlloc.getChunk()
+		if err != nil {
+			atomic.AddUint64(&b.statistics.Errors, 1)
+			b.logger.logLimited(LevelError, "bucket write failed", F("bucket", b.id), F("err", err))
+			b.releaseLocked()
+			return ErrorChunkAlloc
+		}
+		b.reserved = append(b.reserved, chunk)
+	}
+	return nil
+}
+
+func (b *bucket) releaseLocked() {
+	for _, chunk := range b.reserved {
+		b.chunkAlloc.putChunk(chunk)
+	}
+	b.reserved = nil
+}
+
+// evictChunk 写入位置进入一个chunk前调用, 这个chunk里是上一轮写入的entry, 马上会被覆盖
+// 把仍然被索引引用的entry从索引中删除
+func (b *bucket) evictChunk(chunkIndex uint64) {
+	chunk := b.chunks[chunkIndex]
+	if chunk == nil || b.loop == 0 {
+		return
+	}
+	base := (uint64(b.loop-1) << OffsetSizeOf) | chunkIndex*chunkSize
+	walkEntries(chunk, func(pos int, entry []byte) bool {
+		key := readKey(entry)
+		keyHash := b.hash.Hash(key)
+		if b.index.remove(keyHash, base+uint64(pos)) {
+			atomic.AddUint64(&b.statistics.Evictions, 1)
+			b.events.emit(EventEvicted, keyHash, key)
+		}
+		return true
+	})
+}
+
 func (b *bucket) get(blob []byte, keyHash uint64, key []byte) ([]byte, error) {
+	if b.optimistic {
+		if ret, ok, err := b.getOptimistic(blob, keyHash, key); ok {
+			return ret, err
+		}
+	}
 	b.mutex.RLock()
 	defer b.mutex.RUnlock()
+	if !b.owns(keyHash) {
+		return nil, errBucketMoved
+	}
+	return b.getLocked(blob, keyHash, key)
+}
 
-	atomic.AddUint64(&b.statistics.Gets, 1)
-	v, ok := b.m[keyHash]
-	if !ok {
-		atomic.AddUint64(&b.statistics.Misses, 1)
-		return nil, ErrorNotFound
+// getLocked 调用方需要持有读锁或写锁
+func (b *bucket) getLocked(blob []byte, keyHash uint64, key []byte) ([]byte, error) {
+	blob, _, err := b.getEntryLocked(blob, keyHash, key)
+	return blob, err
+}
+
+// getEntryLocked 和getLocked一样, 另外返回过期时间, 0表示不过期
+func (b *bucket) getEntryLocked(blob []byte, keyHash uint64, key []byte) ([]byte, int64, error) {
+	value, timestamp, err := b.findLocked(keyHash, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if blob, err = b.openValue(blob, key, value); err != nil {
+		return nil, 0, err
 	}
+	return blob, timestamp, nil
+}
 
-	loop := uint32(v >> OffsetSizeOf)
-	offset := v & 0x000000ffffffffff
+// openValue 把chunk里保存的value追加到blob, 加密时解密, 成功时统计命中
+func (b *bucket) openValue(blob []byte, key, value []byte) ([]byte, error) {
+	if b.cipher == nil {
+		blob = append(blob, value...)
+	} else {
+		var err error
+		if blob, err = b.cipher.open(blob, key, value); err != nil {
+			atomic.AddUint64(&b.statistics.Errors, 1)
+			return nil, err
+		}
+	}
+	atomic.AddUint64(&b.statistics.Hits, 1)
+	return blob, nil
+}
 
-	//b.logger.Printf("[%v] get key:%s loop:%d now loop:%d offset:%d now offset:%d", &b, key, loop, b.loop, offset, b.offset)
+// viewBufferPool 加密时view解密value用的缓冲区
+var viewBufferPool = sync.Pool{New: func() interface{} { return new([]byte) }}
 
-	// 1. loop == b.loop && offset < b.offset
-	// 这种情况发生在写和读没有发生覆盖的情况下, offset记录的是当时写入的offset, b.offset代表已经写入后的offset(可能多次写)
-	// 2.loop+1 == b.loop && offset >= b.offset
-	// 这种情况说明, 在写入后, 发生了一次覆盖, 但幸运的是, 覆盖后的值, 没有覆盖到这个key这里
-	if loop == b.loop && offset < b.offset || (loop+1 == b.loop && offset >= b.offset) {
-		chunkIndex := offset / chunkSize
-		if int(chunkIndex) >= len(b.chunks) {
+// viewLocked 调用方需要持有读锁或写锁, 不加密时fn拿到的是chunk里的value
+func (b *bucket) viewLocked(keyHash uint64, key []byte, fn func(value []byte) error) error {
+	value, _, err := b.findLocked(keyHash, key)
+	if err != nil {
+		return err
+	}
+	return b.viewValue(key, value, fn)
+}
+
+// viewValue 加密时把value解密到pool里的缓冲区再调用fn, 成功时统计命中
+func (b *bucket) viewValue(key, value []byte, fn func(value []byte) error) error {
+	if b.cipher != nil {
+		buf := viewBufferPool.Get().(*[]byte)
+		plain, err := b.cipher.open((*buf)[:0], key, value)
+		if err != nil {
+			viewBufferPool.Put(buf)
 			atomic.AddUint64(&b.statistics.Errors, 1)
-			return nil, ErrorChunkIndexOutOfRange
+			return err
 		}
+		defer func() {
+			// 放回pool前清掉明文
+			for i := range plain {
+				plain[i] = 0
+			}
+			*buf = plain
+			viewBufferPool.Put(buf)
+		}()
+		value = plain
+	}
+	atomic.AddUint64(&b.statistics.Hits, 1)
+	return fn(value)
+}
 
-		chunkOffset := offset & (chunkSize - 1) // or offset % chunkSize
-		timestamp := readTimeStamp(b.chunks[chunkIndex][chunkOffset:])
-		if timestamp > 0 && timestamp < time.Now().Unix() {
-			return nil, ErrorValueExpire
+func (b *bucket) view(keyHash uint64, key []byte, fn func(value []byte) error) error {
+	if b.optimistic {
+		if ok, err := b.viewOptimistic(keyHash, key, fn); ok {
+			return err
 		}
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if !b.owns(keyHash) {
+		return errBucketMoved
+	}
+	return b.viewLocked(keyHash, key, fn)
+}
 
-		readKey := readKey(b.chunks[chunkIndex][chunkOffset:])
-		if !bytes.Equal(readKey, key) {
+// findLocked 返回chunk里保存的value和过期时间, 加密时value是密文, 命中由调用方统计
+func (b *bucket) findLocked(keyHash uint64, key []byte) ([]byte, int64, error) {
+	atomic.AddUint64(&b.statistics.Gets, 1)
+	_, entry, err := b.lookupLocked(keyHash, key)
+	if err == ErrorNotFound {
+		// 只找到了keyHash相同的其它key
+		if b.versionLocked(keyHash) != 0 {
 			atomic.AddUint64(&b.statistics.Collisions, 1)
-			return nil, ErrorNotFound
+		} else {
+			atomic.AddUint64(&b.statistics.Misses, 1)
 		}
-		blob = append(blob, readValue(b.chunks[chunkIndex][chunkOffset:], uint16(len(readKey)))...)
-		atomic.AddUint64(&b.statistics.Hits, 1)
-		return blob, nil
+		return nil, 0, err
+	}
+	if err != nil {
+		atomic.AddUint64(&b.statistics.Errors, 1)
+		return nil, 0, err
 	}
 
-	atomic.AddUint64(&b.statistics.Misses, 1)
-	return nil, ErrorNotFound
+	timestamp := readTimeStamp(entry)
+	if timestamp > 0 && timestamp < time.Now().Unix() {
+		return nil, 0, ErrorValueExpire
+	}
+	return readValue(entry, uint16(len(key))), timestamp, nil
 }
 
-func (b *bucket) clean() {
-	count := 0
-	b.mutex.Lock()
-	for k, v := range b.m {
-		loop := uint32(v >> OffsetSizeOf)
-		offset := v & 0x000000ffffffffff
-		if loop == b.loop && offset < b.offset || (loop+1 == b.loop && offset >= b.offset) {
+// lookupLocked 在keyHash的所有索引值里找到key的entry, 返回索引值和entry
+// 没有找到key并且有entry读不出来时返回读entry的错误, 因为读不出来的可能就是key
+func (b *bucket) lookupLocked(keyHash uint64, key []byte) (uint64, []byte, error) {
+	err := ErrorNotFound
+	for i := 0; ; i++ {
+		v, ok := b.index.get(keyHash, i)
+		if !ok {
+			return 0, nil, err
+		}
+		if !b.validLocked(v) {
+			continue
+		}
+		entry, readErr := b.readEntryLocked(v & 0x000000ffffffffff)
+		if readErr != nil {
+			err = readErr
 			continue
 		}
-		delete(b.m, k)
-		count++
+		if bytes.Equal(readKey(entry), key) {
+			return v, entry, nil
+		}
+	}
+}
+
+// setLocked 让key的索引值指向刚写入的v
+// 优先替换key原来的索引值, 其次是已经失效的索引值, 都没有时新增, keyHash已经被其它key占用时算一次冲突
+func (b *bucket) setLocked(keyHash uint64, key []byte, v uint64) {
+	var old uint64
+	found, stale, n := false, false, 0
+	for ; !found; n++ {
+		cur, ok := b.index.get(keyHash, n)
+		if !ok {
+			break
+		}
+		entry, ok := b.entryLocked(cur)
+		if ok && bytes.Equal(readKey(entry), key) {
+			old, found = cur, true
+		} else if !ok && !stale {
+			old, stale = cur, true
+		}
+	}
+	if found || stale {
+		b.index.replace(keyHash, old, v)
+		return
+	}
+	if n > 0 {
+		atomic.AddUint64(&b.statistics.Collisions, 1)
+	}
+	b.index.add(keyHash, v)
+}
+
+// validLocked 判断索引值指向的entry有没有被覆盖
+// 1. loop == b.loop && offset < b.offset
+// 这种情况发生在写和读没有发生覆盖的情况下, offset记录的是当时写入的offset, b.offset代表已经写入后的offset(可能多次写)
+// 2.loop+1 == b.loop && offset >= b.offset
+// 这种情况说明, 在写入后, 发生了一次覆盖, 但幸运的是, 覆盖后的值, 没有覆盖到这个key这里
+func (b *bucket) validLocked(v uint64) bool {
+	loop := uint32(v >> OffsetSizeOf)
+	offset := v & 0x000000ffffffffff
+	return loop == b.loop && offset < b.offset || (loop+1 == b.loop && offset >= b.offset)
+}
+
+// readEntryLocked 读取offset处的entry, 越界或者checksum不对时返回ErrorCorruptEntry
+func (b *bucket) readEntryLocked(offset uint64) ([]byte, error) {
+	chunkIndex := offset / chunkSize
+	if int(chunkIndex) >= len(b.chunks) {
+		return nil, ErrorChunkIndexOutOfRange
+	}
+	if b.chunks[chunkIndex] == nil {
+		return nil, ErrorCorruptEntry
+	}
+	entry, ok := entryAt(b.chunks[chunkIndex][offset&(chunkSize-1):])
+	if !ok || !verifyEntry(entry, b.checksum) {
+		return nil, ErrorCorruptEntry
+	}
+	return entry, nil
+}
+
+// delCorrupt get发现entry损坏后调用, 再次确认后从索引中删除
+func (b *bucket) delCorrupt(keyHash uint64) {
+	b.lock()
+	defer b.unlock()
+	if !b.owns(keyHash) {
+		return
+	}
+	b.dropCorruptLocked(keyHash)
+}
+
+// dropCorruptLocked 删除keyHash指向的读不出来的entry, 返回删除的数量
+func (b *bucket) dropCorruptLocked(keyHash uint64) int {
+	var corrupt []uint64
+	for i := 0; ; i++ {
+		v, ok := b.index.get(keyHash, i)
+		if !ok {
+			break
+		}
+		if b.validLocked(v) {
+			if _, err := b.readEntryLocked(v & 0x000000ffffffffff); err != nil {
+				corrupt = append(corrupt, v)
+			}
+		}
+	}
+	for _, v := range corrupt {
+		b.index.remove(keyHash, v)
+		atomic.AddUint64(&b.statistics.Corruptions, 1)
+		// 损坏的entry读不出key
+		b.events.emit(EventEvicted, keyHash, nil)
+	}
+	return len(corrupt)
+}
+
+// verify 检查所有索引指向的entry, 删除损坏的, 返回删除的数量
+func (b *bucket) verify() int {
+	b.lock()
+	defer b.unlock()
+	hashes := make(map[uint64]struct{})
+	b.index.rangeAll(func(keyHash, v uint64) bool {
+		if b.validLocked(v) {
+			if _, err := b.readEntryLocked(v & 0x000000ffffffffff); err != nil {
+				hashes[keyHash] = struct{}{}
+			}
+		}
+		return true
+	})
+	count := 0
+	for keyHash := range hashes {
+		count += b.dropCorruptLocked(keyHash)
+	}
+	return count
+}
+
+func (b *bucket) clean() {
+	b.lock()
+	defer b.unlock()
+	type slot struct{ keyHash, v uint64 }
+	var stale []slot
+	b.index.rangeAll(func(keyHash, v uint64) bool {
+		if !b.validLocked(v) {
+			stale = append(stale, slot{keyHash, v})
+		}
+		return true
+	})
+	for _, s := range stale {
+		b.index.remove(s.keyHash, s.v)
+		atomic.AddUint64(&b.statistics.Evictions, 1)
+		b.events.emit(EventEvicted, s.keyHash, nil)
+	}
+	if b.logger.enabled(LevelDebug) {
+		b.logger.logLimited(LevelDebug, "bucket cleaned", F("bucket", b.id), F("stale", len(stale)), F("keys", b.index.len()))
 	}
-	b.mutex.Unlock()
 }
 
 func (b *bucket) size() int {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
-	return len(b.m)
+	return b.index.len()
 }
 
-func (b *bucket) del(keyHash uint64) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-	delete(b.m, keyHash)
+func (b *bucket) del(keyHash uint64, key []byte) error {
+	b.lock()
+	defer b.unlock()
+	if !b.owns(keyHash) {
+		return errBucketMoved
+	}
+	b.delLocked(keyHash, key)
+	return nil
 }
 
-func (b *bucket) reset() {
+func (b *bucket) delLocked(keyHash uint64, key []byte) {
+	v, _, err := b.lookupLocked(keyHash, key)
+	switch err {
+	case nil:
+		b.index.remove(keyHash, v)
+		b.events.emit(EventDel, keyHash, key)
+	case ErrorCorruptEntry:
+		b.dropCorruptLocked(keyHash)
+	}
+}
+
+// onGetError 删除get发现的过期或者损坏的entry
+func (b *bucket) onGetError(err error, keyHash uint64, key []byte) {
+	switch err {
+	case ErrorValueExpire:
+		b.delExpired(keyHash, key)
+	case ErrorCorruptEntry:
+		b.delCorrupt(keyHash)
+	}
+}
+
+// delExpired get发现key过期后调用, 再次确认后从索引中删除
+func (b *bucket) delExpired(keyHash uint64, key []byte) {
+	b.lock()
+	defer b.unlock()
+	if !b.owns(keyHash) {
+		return
+	}
+	v, entry, err := b.lookupLocked(keyHash, key)
+	if err != nil {
+		return
+	}
+	timestamp := readTimeStamp(entry)
+	if timestamp > 0 && timestamp < time.Now().Unix() {
+		b.index.remove(keyHash, v)
+		atomic.AddUint64(&b.statistics.Expirations, 1)
+		b.events.emit(EventExpired, keyHash, key)
+	}
+}
+
+// version 返回key当前的写入版本, 0表示不存在
+// 每次put都会写到ring里新的位置, 所以索引值本身就是一个单调变化的写序号
+func (b *bucket) version(keyHash uint64) (uint64, error) {
 	b.mutex.RLock()
 	defer b.mutex.RUnlock()
+	if !b.owns(keyHash) {
+		return 0, errBucketMoved
+	}
+	return b.versionLocked(keyHash), nil
+}
+
+// versionLocked keyHash没有冲突时就是索引值+1, 有冲突时合并所有有效的索引值
+// 任何一个key写入都会改变版本, 事务只会多冲突不会漏掉冲突
+func (b *bucket) versionLocked(keyHash uint64) uint64 {
+	version := uint64(0)
+	for i := 0; ; i++ {
+		v, ok := b.index.get(keyHash, i)
+		if !ok {
+			return version
+		}
+		if b.validLocked(v) {
+			version = version*31 + v + 1
+		}
+	}
+}
+
+func (b *bucket) reset() {
+	b.lock()
+	defer b.unlock()
 
 	chunks := b.chunks
 	for i := range chunks {
@@ -194,9 +678,7 @@ func (b *bucket) reset() {
 		chunks[i] = nil
 	}
 
-	for k := range b.m {
-		delete(b.m, k)
-	}
+	b.index.reset()
 	b.offset = 0
 	b.loop = 0
 }
@@ -215,7 +697,7 @@ func (b *bucket) stats() (uint64, uint64, uint64, uint64) {
 			size += uint64(len(b.chunks[i]))
 		}
 	}
-	return uint64(len(b.m)), uint64(len(b.m) * 16), size, uint64(len(b.chunks)) * chunkSize
+	return uint64(b.index.len()), b.index.bytes(), size, uint64(len(b.chunks)) * chunkSize
 }
 
 func (b *bucket) scan(count int) ([][]byte, error) {
@@ -223,21 +705,108 @@ func (b *bucket) scan(count int) ([][]byte, error) {
 	defer b.mutex.RUnlock()
 	ret := make([][]byte, 0, count)
 	i := 0
-	for _, v := range b.m {
+	b.index.rangeAll(func(keyHash, v uint64) bool {
 		i++
 		if i > count {
-			break
+			return false
 		}
-		loop := uint32(v >> OffsetSizeOf)
-		offset := v & 0x000000ffffffffff
-		if loop == b.loop && offset < b.offset || (loop+1 == b.loop && offset >= b.offset) {
-			chunkIndex := offset / chunkSize
-			if int(chunkIndex) < len(b.chunks) {
-				chunkOffset := offset & (chunkSize - 1)
-				readKey := readKey(b.chunks[chunkIndex][chunkOffset:])
-				ret = append(ret, readKey)
-			}
+		if entry, ok := b.entryLocked(v); ok {
+			ret = append(ret, readKey(entry))
 		}
-	}
+		return true
+	})
 	return ret, nil
 }
+
+// entryLocked 返回索引值指向的entry, 已经被覆盖或者损坏时返回false
+func (b *bucket) entryLocked(v uint64) ([]byte, bool) {
+	if !b.validLocked(v) {
+		return nil, false
+	}
+	entry, err := b.readEntryLocked(v & 0x000000ffffffffff)
+	return entry, err == nil
+}
+
+// scanFromLocked 按反转后的keyHash从小到大返回反转后 >= start的key, 最多count个, keyHash相同的key一起返回
+// 没有返回完时next是下一个反转后的keyHash, 否则more为false, 调用方需要持有读锁
+// bucket的key反转后是连续的一段, 顺序和bucket的数量无关, Rebucket前后的cursor可以接着用
+func (b *bucket) scanFromLocked(start uint64, count int, keys [][]byte) ([][]byte, uint64, bool) {
+	type slot struct {
+		reversed uint64
+		entry    []byte
+	}
+	now := time.Now().Unix()
+	slots := make([]slot, 0, b.index.len())
+	b.index.rangeAll(func(keyHash, v uint64) bool {
+		reversed := bits.Reverse64(keyHash)
+		if reversed < start {
+			return true
+		}
+		entry, ok := b.entryLocked(v)
+		if !ok {
+			return true
+		}
+		if ts := readTimeStamp(entry); ts > 0 && ts < now {
+			return true
+		}
+		slots = append(slots, slot{reversed, entry})
+		return true
+	})
+	sort.Slice(slots, func(i, j int) bool { return slots[i].reversed < slots[j].reversed })
+
+	added := 0
+	for i := range slots {
+		if added >= count && (i == 0 || slots[i].reversed != slots[i-1].reversed) {
+			return keys, slots[i].reversed, true
+		}
+		keys = append(keys, append([]byte(nil), readKey(slots[i].entry)...))
+		added++
+	}
+	return keys, 0, false
+}
+
+func (b *bucket) info() BucketStats {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	ret := BucketStats{
+		Keys:          uint64(b.index.len()),
+		MapBytes:      b.index.bytes(),
+		MaxChunkBytes: uint64(len(b.chunks)) * chunkSize,
+		Loop:          b.loop,
+		Offset:        b.offset,
+		Ops:           atomic.LoadUint64(&b.statistics.Gets) + atomic.LoadUint64(&b.statistics.Puts),
+	}
+	for i := range b.chunks {
+		if b.chunks[i] != nil {
+			ret.ChunkBytes += uint64(len(b.chunks[i]))
+		}
+	}
+	return ret
+}
+
+// entrySize 返回key的entry占用的字节数, 不计入统计
+func (b *bucket) entrySize(keyHash uint64, key []byte) (int, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if !b.owns(keyHash) {
+		return 0, errBucketMoved
+	}
+	_, entry, err := b.lookupLocked(keyHash, key)
+	if err != nil {
+		return 0, err
+	}
+	if timestamp := readTimeStamp(entry); timestamp > 0 && timestamp < time.Now().Unix() {
+		return 0, ErrorValueExpire
+	}
+	return len(entry), nil
+}
+
+func (b *bucket) getEntry(blob []byte, keyHash uint64, key []byte) ([]byte, int64, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if !b.owns(keyHash) {
+		return nil, 0, errBucketMoved
+	}
+	return b.getEntryLocked(blob, keyHash, key)
+}
@@ -0,0 +1,179 @@
+package lantern_cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+/*
+乐观读: 读不加锁, 读之前和读之后各读一次bucket的seq
+写锁内seq是奇数, 两次相同并且是偶数说明读的过程中没有写入, 读到的value是完整的, 否则重试, 几次都失败时加读锁
+读的过程中数据可能正在被改写, 所以:
+1. 索引只用flat, 它的表指针原子替换, 探测次数有上限
+2. chunk表是原子发布的, resize换表时读到的是完整的旧表或者新表
+   chunk只原子地读slice的数据指针, 长度总是chunkSize, chunk放回allocator后不会释放内存
+3. entry头只读一次, 所有的下标都检查边界, 读到乱的数据也不会越界
+4. value先拷贝出来, 校验seq之后才交给调用方或者解密
+*/
+
+// optimisticRetries 和写入重叠时重试的次数, 之后加读锁
+const optimisticRetries = 4
+
+// lock 加写锁, 开启乐观读时seq加一变成奇数, 开启延迟统计时采样等锁的时间
+func (b *bucket) lock() {
+	var start time.Time
+	if b.latency.enabled() {
+		start = b.latency.start(atomic.AddUint64(&b.locks, 1))
+	}
+	b.mutex.Lock()
+	b.latency.lockWait.since(start)
+	if b.optimistic {
+		atomic.AddUint64(&b.seq, 1)
+	}
+}
+
+func (b *bucket) unlock() {
+	if b.optimistic {
+		atomic.AddUint64(&b.seq, 1)
+	}
+	b.mutex.Unlock()
+}
+
+// setChunks 调用方需要持有写锁或者bucket还没有被使用, 同时原子地发布给乐观读
+func (b *bucket) setChunks(chunks [][]byte) {
+	b.chunks = chunks
+	atomic.StorePointer(&b.sharedChunks, unsafe.Pointer(&chunks))
+}
+
+// loadChunks 原子地读chunk表, 不会读到写了一半的slice头
+func (b *bucket) loadChunks() [][]byte {
+	return *(*[][]byte)(atomic.LoadPointer(&b.sharedChunks))
+}
+
+// loadChunk 原子地读chunk的数据指针, 不会读到写了一半的slice头
+func loadChunk(chunks [][]byte, chunkIndex uint64) *[chunkSize]byte {
+	return (*[chunkSize]byte)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&chunks[chunkIndex]))))
+}
+
+// getOptimistic ok为false表示没有读成功, 调用方需要加锁再读
+func (b *bucket) getOptimistic(blob []byte, keyHash uint64, key []byte) ([]byte, bool, error) {
+	if b.cipher == nil {
+		ret, ok, err := b.readOptimistic(blob, keyHash, key)
+		if ok && err == nil {
+			atomic.AddUint64(&b.statistics.Hits, 1)
+		}
+		return ret, ok, err
+	}
+	buf := viewBufferPool.Get().(*[]byte)
+	sealed, ok, err := b.readOptimistic((*buf)[:0], keyHash, key)
+	if ok && err == nil {
+		blob, err = b.openValue(blob, key, sealed)
+	}
+	if sealed != nil {
+		*buf = sealed[:0]
+	}
+	viewBufferPool.Put(buf)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	return blob, true, nil
+}
+
+// viewOptimistic value拷贝到pool里的缓冲区再调用fn
+func (b *bucket) viewOptimistic(keyHash uint64, key []byte, fn func(value []byte) error) (bool, error) {
+	buf := viewBufferPool.Get().(*[]byte)
+	value, ok, err := b.readOptimistic((*buf)[:0], keyHash, key)
+	if ok && err == nil {
+		err = b.viewValue(key, value, fn)
+	}
+	if value != nil {
+		*buf = value[:0]
+	}
+	viewBufferPool.Put(buf)
+	return ok, err
+}
+
+// readOptimistic 不加锁地把chunk里保存的value追加到blob, 统计和findLocked一样, 命中由调用方统计
+// 读到损坏的entry时也返回false, 由加锁的读删除它
+func (b *bucket) readOptimistic(blob []byte, keyHash uint64, key []byte) ([]byte, bool, error) {
+	x := b.index.(*flatIndex)
+	n := len(blob)
+	for i := 0; i < optimisticRetries; i++ {
+		seq := atomic.LoadUint64(&b.seq)
+		if seq&1 == 1 {
+			continue
+		}
+		// 迁移走的key由加锁的读返回errBucketMoved
+		if !b.owns(keyHash) {
+			break
+		}
+		ret, timestamp, collided, err := b.findShared(x, blob[:n], keyHash, key)
+		if atomic.LoadUint64(&b.seq) != seq {
+			continue
+		}
+		if err == ErrorCorruptEntry {
+			break
+		}
+		atomic.AddUint64(&b.statistics.Gets, 1)
+		switch {
+		case err == ErrorNotFound && collided:
+			atomic.AddUint64(&b.statistics.Collisions, 1)
+			return nil, true, err
+		case err == ErrorNotFound:
+			atomic.AddUint64(&b.statistics.Misses, 1)
+			return nil, true, err
+		case timestamp > 0 && timestamp < time.Now().Unix():
+			return nil, true, ErrorValueExpire
+		}
+		return ret, true, nil
+	}
+	return blob[:n], false, nil
+}
+
+// findShared 和lookupLocked一样查找key, 找到时把value追加到blob, collided表示只找到了keyHash相同的其它key
+// 结果只有在seq没有变化时才是对的
+func (b *bucket) findShared(x *flatIndex, blob []byte, keyHash uint64, key []byte) ([]byte, int64, bool, error) {
+	collided := false
+	chunks := b.loadChunks()
+	for i := 0; ; i++ {
+		v, ok := x.getShared(keyHash, i)
+		if !ok {
+			return blob, 0, collided, ErrorNotFound
+		}
+		if !b.validLocked(v) {
+			continue
+		}
+		offset := v & 0x000000ffffffffff
+		chunkIndex := offset / chunkSize
+		if chunkIndex >= uint64(len(chunks)) {
+			return blob, 0, false, ErrorCorruptEntry
+		}
+		chunk := loadChunk(chunks, chunkIndex)
+		if chunk == nil {
+			return blob, 0, false, ErrorCorruptEntry
+		}
+		head := chunk[offset&(chunkSize-1):]
+		if len(head) < EntryHeadFieldSizeOf {
+			return blob, 0, false, ErrorCorruptEntry
+		}
+		// 头只读一次, entry的下标都用这里的大小
+		keySize := int(binary.LittleEndian.Uint16(head[EntryTimeStampFieldSizeOf:]))
+		valSize := int(binary.LittleEndian.Uint16(head[EntryTimeStampFieldSizeOf+EntryKeyFieldSizeOf:]))
+		size := EntryHeadFieldSizeOf + keySize + valSize
+		if keySize == 0 || size > len(head) {
+			return blob, 0, false, ErrorCorruptEntry
+		}
+		entry := head[:size:size]
+		if b.checksum && !verifyEntry(entry, true) {
+			return blob, 0, false, ErrorCorruptEntry
+		}
+		if !bytes.Equal(entry[EntryHeadFieldSizeOf:EntryHeadFieldSizeOf+keySize], key) {
+			collided = true
+			continue
+		}
+		return append(blob, entry[EntryHeadFieldSizeOf+keySize:]...), readTimeStamp(entry), false, nil
+	}
+}
@@ -2,6 +2,7 @@ package lantern_cache
 
 import (
 	"bytes"
+	"math/rand"
 	"testing"
 	"time"
 )
@@ -10,12 +11,36 @@ func makeByte(size int) []byte {
 	return make([]byte, size)
 }
 
+func newTestBucket(t *testing.T, cfg *bucketConfig) *bucket {
+	b, err := newBucket(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// failingChunkFactory 总是分配失败
+type failingChunkFactory struct{}
+
+func (failingChunkFactory) getChunk(size uint32) ([]byte, error) {
+	return nil, ErrorChunkAlloc
+}
+
+func TestNewBucketChunkAllocFailure(t *testing.T) {
+	b, err := newBucket(&bucketConfig{
+		maxCapacity: 64 * 1024 * 2,
+		chunkAlloc:  &chunkAllocator{factory: failingChunkFactory{}, policy: "failing"},
+	})
+	if b != nil || err == nil {
+		t.Fatal(b, err)
+	}
+}
+
 func TestBucketPutGet(t *testing.T) {
-	b := newBucket(&bucketConfig{
-		64 * 1024 * 2,
-		0,
-		NewChunkAllocator("heap"),
-		&Stats{},
+	b := newTestBucket(t, &bucketConfig{
+		maxCapacity: 64 * 1024 * 2,
+		chunkAlloc:  NewChunkAllocator("heap"),
+		statistics:  &Stats{},
 	})
 	h := newFowlerNollVoHasher()
 	key1 := []byte("key1")
@@ -34,11 +59,10 @@ func TestBucketPutGet(t *testing.T) {
 }
 
 func TestBucketPutGetExpire(t *testing.T) {
-	b := newBucket(&bucketConfig{
-		64 * 1024 * 2,
-		0,
-		NewChunkAllocator("heap"),
-		&Stats{},
+	b := newTestBucket(t, &bucketConfig{
+		maxCapacity: 64 * 1024 * 2,
+		chunkAlloc:  NewChunkAllocator("heap"),
+		statistics:  &Stats{},
 	})
 	h := newFowlerNollVoHasher()
 	key1 := []byte("key1")
@@ -63,11 +87,10 @@ func TestBucketPutGetExpire(t *testing.T) {
 }
 
 func TestBucketPutGetSmall(t *testing.T) {
-	b := newBucket(&bucketConfig{
-		1,
-		0,
-		NewChunkAllocator("heap"),
-		&Stats{},
+	b := newTestBucket(t, &bucketConfig{
+		maxCapacity: 1,
+		chunkAlloc:  NewChunkAllocator("heap"),
+		statistics:  &Stats{},
 	})
 	h := newFowlerNollVoHasher()
 	key1 := []byte("key1")
@@ -86,11 +109,10 @@ func TestBucketPutGetSmall(t *testing.T) {
 }
 
 func TestCacheBigKeyValue(t *testing.T) {
-	b := newBucket(&bucketConfig{
-		64 * 1024 * 2,
-		0,
-		NewChunkAllocator("heap"),
-		&Stats{},
+	b := newTestBucket(t, &bucketConfig{
+		maxCapacity: 64 * 1024 * 2,
+		chunkAlloc:  NewChunkAllocator("heap"),
+		statistics:  &Stats{},
 	})
 	h := newFowlerNollVoHasher()
 	key1 := []byte("key1")
@@ -102,11 +124,10 @@ func TestCacheBigKeyValue(t *testing.T) {
 }
 
 func TestBucketDel(t *testing.T) {
-	b := newBucket(&bucketConfig{
-		64 * 1024 * 2,
-		0,
-		NewChunkAllocator("heap"),
-		&Stats{},
+	b := newTestBucket(t, &bucketConfig{
+		maxCapacity: 64 * 1024 * 2,
+		chunkAlloc:  NewChunkAllocator("heap"),
+		statistics:  &Stats{},
 	})
 	h := newFowlerNollVoHasher()
 	key1 := []byte("key1")
@@ -123,9 +144,121 @@ func TestBucketDel(t *testing.T) {
 		t.Fatal("not equal")
 	}
 
-	b.del(h.Hash(key1))
+	b.del(h.Hash(key1), key1)
 	_, err = b.get(nil, h.Hash(key1), key1)
 	if err != ErrorNotFound {
 		t.Fatal(err)
 	}
 }
+
+// constHasher 让所有key的hash相同
+type constHasher uint64
+
+func (h constHasher) Hash([]byte) uint64 {
+	return uint64(h)
+}
+
+func TestBucketCollision(t *testing.T) {
+	stats := &Stats{}
+	b := newTestBucket(t, &bucketConfig{
+		maxCapacity: 64 * 1024 * 2,
+		chunkAlloc:  NewChunkAllocator("heap"),
+		statistics:  stats,
+		hash:        constHasher(1),
+	})
+	keys := [][]byte{[]byte("key1"), []byte("key2"), []byte("key3")}
+	for i := range keys {
+		if err := b.put(1, keys[i], keys[i], 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.put(1, keys[1], []byte("new2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if b.size() != 3 || stats.Collisions != 2 {
+		t.Fatal(b.size(), stats.Collisions)
+	}
+	for i, expect := range []string{"key1", "new2", "key3"} {
+		actual, err := b.get(nil, 1, keys[i])
+		if err != nil || string(actual) != expect {
+			t.Fatal(err, string(actual))
+		}
+	}
+	if _, err := b.get(nil, 1, []byte("key4")); err != ErrorNotFound {
+		t.Fatal(err)
+	}
+
+	// 删除m里的key后overflow里的key补上来
+	b.del(1, keys[0])
+	if _, err := b.get(nil, 1, keys[0]); err != ErrorNotFound {
+		t.Fatal(err)
+	}
+	for _, key := range keys[1:] {
+		if _, err := b.get(nil, 1, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 覆盖整个ring后冲突的key都被淘汰
+	val := makeByte(1024)
+	for i := 0; i < 256; i++ {
+		if err := b.put(1, []byte("other"), val, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys {
+		if _, err := b.get(nil, 1, key); err != ErrorNotFound {
+			t.Fatal(err)
+		}
+	}
+	if b.size() != 1 || b.index.(*mapIndex).overflowLen != 0 {
+		t.Fatal(b.size(), b.index.(*mapIndex).overflowLen)
+	}
+}
+
+func TestBucketOptimisticRead(t *testing.T) {
+	if !optimisticSupported {
+		t.Skip("optimistic reads are not supported")
+	}
+	b := newTestBucket(t, &bucketConfig{
+		maxCapacity: 64 * 1024 * 2,
+		chunkAlloc:  NewChunkAllocator("heap"),
+		statistics:  &Stats{},
+		indexPolicy: "flat",
+		optimistic:  true,
+	})
+	h := newFowlerNollVoHasher()
+	key := []byte("key1")
+	if err := b.put(h.Hash(key), key, []byte("val1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	v, ok, err := b.readOptimistic(nil, h.Hash(key), key)
+	if !ok || err != nil || string(v) != "val1" {
+		t.Fatal(string(v), ok, err)
+	}
+	_, ok, err = b.readOptimistic(nil, h.Hash([]byte("none")), []byte("none"))
+	if !ok || err != ErrorNotFound {
+		t.Fatal(ok, err)
+	}
+
+	// 写锁内不能乐观读, 加读锁时等写入完成
+	b.lock()
+	if _, ok, _ := b.readOptimistic(nil, h.Hash(key), key); ok {
+		t.Fatal("read while writing")
+	}
+	b.unlock()
+
+	// 读到写了一半的数据时不能越界
+	r := rand.New(rand.NewSource(1))
+	for i := range b.chunks[0] {
+		b.chunks[0][i] = byte(r.Intn(256))
+	}
+	for i := 0; i < 1000; i++ {
+		b.index.add(uint64(i%10), uint64(r.Intn(2*chunkSize)))
+	}
+	// 上一轮写入的索引值都有效
+	b.loop, b.offset = 1, 0
+	for i := 0; i < 10; i++ {
+		_, _, _, _ = b.findShared(b.index.(*flatIndex), nil, uint64(i), key)
+	}
+}
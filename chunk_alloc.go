@@ -28,6 +28,8 @@ type chunkAllocator struct {
 	freeChunks     []*[chunkSize]byte
 	freeChunksLock sync.Mutex
 	factory        chunkFactory
+	policy         string
+	logger         *eventLogger
 }
 
 func NewChunkAllocator(policy string) *chunkAllocator {
@@ -44,6 +46,7 @@ func NewChunkAllocator(policy string) *chunkAllocator {
 	default:
 		panic(fmt.Errorf("can't support factory %s", policy))
 	}
+	ret.policy = policy
 	ret.freeChunks = make([]*[chunkSize]byte, 0)
 	return ret
 }
@@ -57,8 +60,11 @@ func (c *chunkAllocator) getChunk() ([]byte, error) {
 		data, err := c.factory.getChunk(uint32(allocSize))
 		cc++
 		if err != nil {
-			panic(fmt.Errorf("cannot allocate %d bytes via mmap: %s", chunkSize*chunksPerAlloc, err))
+			c.freeChunksLock.Unlock()
+			c.logger.logLimited(LevelError, "chunk allocation failed", F("allocator", c.policy), F("bytes", allocSize), F("err", err))
+			return nil, fmt.Errorf("cannot allocate %d bytes via %s: %s", allocSize, c.policy, err)
 		}
+		c.logger.logLimited(LevelDebug, "chunks allocated", F("allocator", c.policy), F("bytes", allocSize))
 		for len(data) > 0 {
 			p := (*[chunkSize]byte)(unsafe.Pointer(&data[0]))
 			c.freeChunks = append(c.freeChunks, p)
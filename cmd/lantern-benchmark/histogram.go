@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math/bits"
+	"time"
+)
+
+// histogram 按2的幂分段, 每段再线性分成histogramSubBuckets份, 误差不超过1/histogramSubBuckets
+// 每个worker一个, 结束后合并, 记录时不需要加锁
+const (
+	histogramSubBits    = 4
+	histogramSubBuckets = 1 << histogramSubBits
+)
+
+type histogram struct {
+	counts [64 * histogramSubBuckets]uint64
+	total  uint64
+	max    int64
+}
+
+func histogramIndex(v uint64) int {
+	if v < histogramSubBuckets {
+		return int(v)
+	}
+	// 最高位决定分段, 后面histogramSubBits位决定段内位置
+	shift := uint(bits.Len64(v)) - histogramSubBits - 1
+	return int((uint64(shift)+1)<<histogramSubBits | (v>>shift)&(histogramSubBuckets-1))
+}
+
+// histogramValue 返回index对应区间的上界
+func histogramValue(index int) uint64 {
+	if index < histogramSubBuckets {
+		return uint64(index)
+	}
+	shift := uint(index>>histogramSubBits) - 1
+	sub := uint64(index & (histogramSubBuckets - 1))
+	return (histogramSubBuckets|sub+1)<<shift - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.counts[histogramIndex(uint64(d))]++
+	h.total++
+	if int64(d) > h.max {
+		h.max = int64(d)
+	}
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i := range h.counts {
+		h.counts[i] += o.counts[i]
+	}
+	h.total += o.total
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// percentile p在0到100之间
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(p / 100 * float64(h.total))
+	if rank >= h.total {
+		rank = h.total - 1
+	}
+	seen := uint64(0)
+	for i, c := range h.counts {
+		seen += c
+		if seen > rank {
+			v := time.Duration(histogramValue(i))
+			if int64(v) > h.max {
+				return time.Duration(h.max)
+			}
+			return v
+		}
+	}
+	return time.Duration(h.max)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramIndex(t *testing.T) {
+	last := -1
+	for v := uint64(0); v < 1<<20; v++ {
+		i := histogramIndex(v)
+		assert.True(t, i == last || i == last+1)
+		assert.True(t, v <= histogramValue(i))
+		// 误差不超过1/histogramSubBuckets
+		assert.True(t, histogramValue(i)-v <= v/histogramSubBuckets)
+		last = i
+	}
+	assert.True(t, histogramIndex(1<<63) < len(histogram{}.counts))
+}
+
+func TestHistogramPercentile(t *testing.T) {
+	var h, o histogram
+	assert.Equal(t, time.Duration(0), h.percentile(99))
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Microsecond)
+	}
+	o.record(time.Second)
+	h.merge(&o)
+
+	p50 := h.percentile(50)
+	assert.True(t, p50 >= 500*time.Microsecond && p50 <= 532*time.Microsecond, p50)
+	p99 := h.percentile(99)
+	assert.True(t, p99 >= 990*time.Microsecond && p99 <= 1024*time.Microsecond, p99)
+	assert.Equal(t, time.Second, h.percentile(100))
+	assert.Equal(t, uint64(1001), h.total)
+}
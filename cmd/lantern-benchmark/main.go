@@ -0,0 +1,337 @@
+// lantern-benchmark drives an in-process LanternCache or a server speaking RESP, like redis-benchmark.
+//
+// Keys and value sizes follow a uniform or zipfian distribution, every worker sends batches of
+// -pipeline requests mixing reads and writes, and the report contains the throughput, latency
+// percentiles and the hit ratio of reads, as text or as JSON for regression tracking.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lantern_cache "github.com/linger1216/lantern-cache"
+)
+
+type options struct {
+	target      string
+	addr        string
+	password    string
+	bucketCount uint
+	maxCapacity uint64
+	allocator   string
+	index       string
+	optimistic  bool
+
+	keyCount    int
+	keyDist     string
+	keySize     sizeRange
+	valueDist   string
+	valueSize   sizeRange
+	zipfS       float64
+	reads       float64
+	pipeline    int
+	connections int
+	ttlMix      float64
+	ttl         time.Duration
+	duration    time.Duration
+	prefill     bool
+	seed        int64
+	json        bool
+}
+
+// report 的json字段名不要修改, 回归对比依赖它们
+type report struct {
+	Target      string  `json:"target"`
+	Connections int     `json:"connections"`
+	Pipeline    int     `json:"pipeline"`
+	KeyDist     string  `json:"key_dist"`
+	ValueDist   string  `json:"value_dist"`
+	Reads       float64 `json:"read_ratio"`
+	Seconds     float64 `json:"seconds"`
+	Requests    uint64  `json:"requests"`
+	Gets        uint64  `json:"gets"`
+	Sets        uint64  `json:"sets"`
+	Errors      uint64  `json:"errors"`
+	OpsPerSec   float64 `json:"ops_per_sec"`
+	HitRatio    float64 `json:"hit_ratio"`
+	P50         float64 `json:"p50_us"`
+	P99         float64 `json:"p99_us"`
+	P999        float64 `json:"p999_us"`
+	Max         float64 `json:"max_us"`
+	FirstError  string  `json:"first_error,omitempty"`
+}
+
+func parseOptions(args []string) (*options, error) {
+	o := &options{
+		keySize:   sizeRange{min: 16, max: 16},
+		valueSize: sizeRange{min: 256, max: 256},
+	}
+	fs := flag.NewFlagSet("lantern-benchmark", flag.ContinueOnError)
+	fs.StringVar(&o.target, "target", "inproc", "inproc or redis")
+	fs.StringVar(&o.addr, "addr", "127.0.0.1:6379", "server address of the redis target")
+	fs.StringVar(&o.password, "password", "", "password of the redis target")
+	fs.UintVar(&o.bucketCount, "bucket-count", 1024, "bucket count of the inproc target")
+	fs.Uint64Var(&o.maxCapacity, "max-capacity", 1<<30, "max capacity of the inproc target in bytes")
+	fs.StringVar(&o.allocator, "chunk-allocator", "heap", "chunk allocator of the inproc target")
+	fs.StringVar(&o.index, "index", "map", "bucket index of the inproc target, map or flat")
+	fs.BoolVar(&o.optimistic, "optimistic-reads", false, "read the inproc target without locking buckets, needs -index flat")
+
+	fs.IntVar(&o.keyCount, "keys", 100000, "size of the keyspace")
+	fs.StringVar(&o.keyDist, "key-dist", "uniform", "key distribution, uniform or zipf")
+	fs.Var(&o.keySize, "key-size", "key size in bytes, a number or a min-max range")
+	fs.StringVar(&o.valueDist, "value-dist", "uniform", "value size distribution, uniform or zipf (skewed to small values)")
+	fs.Var(&o.valueSize, "value-size", "value size in bytes, a number or a min-max range")
+	fs.Float64Var(&o.zipfS, "zipf-s", 1.1, "exponent of the zipf distributions, > 1")
+	fs.Float64Var(&o.reads, "reads", 0.9, "ratio of reads, the rest are writes")
+	fs.IntVar(&o.pipeline, "pipeline", 1, "requests per batch")
+	fs.IntVar(&o.connections, "connections", 50, "concurrent workers, one connection each for the redis target")
+	fs.Float64Var(&o.ttlMix, "ttl-ratio", 0, "ratio of writes with a ttl")
+	fs.DurationVar(&o.ttl, "ttl", time.Minute, "ttl of writes selected by -ttl-ratio")
+	fs.DurationVar(&o.duration, "duration", 10*time.Second, "duration of the benchmark")
+	fs.BoolVar(&o.prefill, "prefill", true, "write every key once before the benchmark")
+	fs.Int64Var(&o.seed, "seed", 1, "random seed")
+	fs.BoolVar(&o.json, "json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case o.target != "inproc" && o.target != "redis":
+		return nil, fmt.Errorf("unknown target %s", o.target)
+	case o.keyCount <= 0:
+		return nil, fmt.Errorf("keys must be > 0")
+	case o.valueSize.max > lantern_cache.MaxValueSize:
+		return nil, fmt.Errorf("value size must be <= %d", lantern_cache.MaxValueSize)
+	case o.reads < 0 || o.reads > 1 || o.ttlMix < 0 || o.ttlMix > 1:
+		return nil, fmt.Errorf("ratios must be between 0 and 1")
+	case o.pipeline <= 0 || o.connections <= 0:
+		return nil, fmt.Errorf("pipeline and connections must be > 0")
+	case o.ttlMix > 0 && o.ttl < time.Second:
+		return nil, fmt.Errorf("ttl must be at least 1s")
+	}
+	return o, nil
+}
+
+func main() {
+	o, err := parseOptions(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lantern-benchmark: %v\n", err)
+		os.Exit(2)
+	}
+	r, err := run(o)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lantern-benchmark: %v\n", err)
+		os.Exit(1)
+	}
+	if o.json {
+		_ = json.NewEncoder(os.Stdout).Encode(r)
+	} else {
+		printReport(r)
+	}
+	if r.Errors > 0 {
+		os.Exit(1)
+	}
+}
+
+func newTarget(o *options) (target, error) {
+	if o.target == "redis" {
+		client, err := newRedisClient(o.addr, o.password, o.connections)
+		if err != nil {
+			return nil, err
+		}
+		return &redisTarget{client: client}, nil
+	}
+	cache, err := lantern_cache.New(&lantern_cache.Config{
+		BucketCount:          uint32(o.bucketCount),
+		MaxCapacity:          o.maxCapacity,
+		InitCapacity:         o.maxCapacity,
+		ChunkAllocatorPolicy: o.allocator,
+		IndexPolicy:          o.index,
+		OptimisticReads:      o.optimistic,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &inprocTarget{cache: cache}, nil
+}
+
+// worker 的统计只在自己的goroutine里修改
+type worker struct {
+	workload *workload
+	latency  histogram
+	gets     uint64
+	sets     uint64
+	hits     uint64
+	errors   uint64
+	firstErr error
+}
+
+func newWorker(o *options, keys [][]byte, values []byte, seed int64) (*worker, error) {
+	r := rand.New(rand.NewSource(seed))
+	key, err := newDistribution(o.keyDist, r, uint64(len(keys)), o.zipfS)
+	if err != nil {
+		return nil, err
+	}
+	size, err := newDistribution(o.valueDist, r, uint64(o.valueSize.max-o.valueSize.min+1), o.zipfS)
+	if err != nil {
+		return nil, err
+	}
+	return &worker{workload: &workload{
+		r:      r,
+		keys:   keys,
+		values: values,
+		key:    key,
+		size:   size,
+		sizes:  o.valueSize,
+		reads:  o.reads,
+		ttlMix: o.ttlMix,
+		ttl:    o.ttl,
+	}}, nil
+}
+
+// run 每个batch的耗时记到batch里的每个请求上, 和redis-benchmark的算法一致
+func (w *worker) run(t target, pipeline int, stop *int32) {
+	ops := make([]op, pipeline)
+	for atomic.LoadInt32(stop) == 0 {
+		reads := 0
+		for i := range ops {
+			w.workload.next(&ops[i])
+			if !ops[i].write {
+				reads++
+			}
+		}
+		start := time.Now()
+		hits, err := t.do(ops)
+		elapsed := time.Since(start)
+		if err != nil {
+			w.errors++
+			if w.firstErr == nil {
+				w.firstErr = err
+			}
+			continue
+		}
+		for range ops {
+			w.latency.record(elapsed)
+		}
+		w.gets += uint64(reads)
+		w.sets += uint64(pipeline - reads)
+		w.hits += uint64(hits)
+	}
+}
+
+// prefill 写入所有key, 读命中率从一开始就是稳定的
+func prefill(t target, o *options, keys [][]byte, values []byte) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, o.connections)
+	for c := 0; c < o.connections; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			ops := make([]op, 0, o.pipeline)
+			for i := c; i < len(keys); i += o.connections {
+				ops = append(ops, op{write: true, key: keys[i], value: values[:o.valueSize.min]})
+				if len(ops) == o.pipeline || i+o.connections >= len(keys) {
+					if _, err := t.do(ops); err != nil {
+						errs <- err
+						return
+					}
+					ops = ops[:0]
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func run(o *options) (*report, error) {
+	t, err := newTarget(o)
+	if err != nil {
+		return nil, err
+	}
+	defer t.close()
+
+	keys := makeKeys(o.keyCount, o.keySize, o.seed)
+	values := makeValues(o.valueSize.max, o.seed)
+	if o.prefill {
+		if err := prefill(t, o, keys, values); err != nil {
+			return nil, fmt.Errorf("prefill: %v", err)
+		}
+	}
+
+	workers := make([]*worker, o.connections)
+	for i := range workers {
+		if workers[i], err = newWorker(o, keys, values, o.seed+int64(i)+1); err != nil {
+			return nil, err
+		}
+	}
+
+	var stop int32
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.run(t, o.pipeline, &stop)
+		}(w)
+	}
+	time.Sleep(o.duration)
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	r := &report{
+		Target:      o.target,
+		Connections: o.connections,
+		Pipeline:    o.pipeline,
+		KeyDist:     o.keyDist,
+		ValueDist:   o.valueDist,
+		Reads:       o.reads,
+		Seconds:     elapsed.Seconds(),
+	}
+	var latency histogram
+	hits := uint64(0)
+	for _, w := range workers {
+		latency.merge(&w.latency)
+		r.Gets += w.gets
+		r.Sets += w.sets
+		r.Errors += w.errors
+		hits += w.hits
+		if w.firstErr != nil && r.FirstError == "" {
+			r.FirstError = w.firstErr.Error()
+		}
+	}
+	r.Requests = r.Gets + r.Sets
+	r.OpsPerSec = float64(r.Requests) / elapsed.Seconds()
+	if r.Gets > 0 {
+		r.HitRatio = float64(hits) / float64(r.Gets)
+	}
+	micros := func(d time.Duration) float64 { return float64(d) / float64(time.Microsecond) }
+	r.P50 = micros(latency.percentile(50))
+	r.P99 = micros(latency.percentile(99))
+	r.P999 = micros(latency.percentile(99.9))
+	r.Max = micros(time.Duration(latency.max))
+	return r, nil
+}
+
+func printReport(r *report) {
+	fmt.Printf("target: %s  connections: %d  pipeline: %d  keys: %s  values: %s  reads: %.0f%%\n",
+		r.Target, r.Connections, r.Pipeline, r.KeyDist, r.ValueDist, r.Reads*100)
+	fmt.Printf("%d requests in %.2fs, %.0f requests per second\n", r.Requests, r.Seconds, r.OpsPerSec)
+	fmt.Printf("gets: %d  sets: %d  errors: %d  hit ratio: %.4f\n", r.Gets, r.Sets, r.Errors, r.HitRatio)
+	fmt.Printf("latency p50: %.1fus  p99: %.1fus  p99.9: %.1fus  max: %.1fus\n", r.P50, r.P99, r.P999, r.Max)
+	if r.FirstError != "" {
+		fmt.Printf("first error: %s\n", r.FirstError)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	lantern_cache "github.com/linger1216/lantern-cache"
+)
+
+// target 执行一批op, 返回读命中的数量
+type target interface {
+	do(ops []op) (hits int, err error)
+	close() error
+}
+
+// inprocTarget 直接调用LanternCache, pipeline没有意义, 按顺序执行
+type inprocTarget struct {
+	cache *lantern_cache.LanternCache
+	buf   []byte
+}
+
+func (t *inprocTarget) do(ops []op) (int, error) {
+	hits := 0
+	for i := range ops {
+		o := &ops[i]
+		if o.write {
+			var err error
+			if o.ttl > 0 {
+				err = t.cache.PutWithExpire(o.key, o.value, int64(o.ttl/time.Second))
+			} else {
+				err = t.cache.Put(o.key, o.value)
+			}
+			if err != nil {
+				return hits, err
+			}
+			continue
+		}
+		v, err := t.cache.GetWithBuffer(t.buf[:0], o.key)
+		switch err {
+		case nil:
+			t.buf = v
+			hits++
+		case lantern_cache.ErrorNotFound, lantern_cache.ErrorValueExpire, lantern_cache.ErrorCorruptEntry:
+		default:
+			return hits, err
+		}
+	}
+	return hits, nil
+}
+
+func (t *inprocTarget) close() error {
+	return nil
+}
+
+// redisTarget 所有worker共享一个连接池
+type redisTarget struct {
+	client *redis.Client
+}
+
+func newRedisClient(addr, password string, connections int) (*redis.Client, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:         addr,
+		Password:     password,
+		PoolSize:     connections,
+		MinIdleConns: connections,
+	})
+	if err := client.Ping().Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("connect %s: %v", addr, err)
+	}
+	return client, nil
+}
+
+func (t *redisTarget) do(ops []op) (int, error) {
+	if len(ops) == 1 {
+		return t.one(&ops[0])
+	}
+	pipe := t.client.Pipeline()
+	for i := range ops {
+		o := &ops[i]
+		if o.write {
+			pipe.Set(string(o.key), o.value, o.ttl)
+		} else {
+			pipe.Get(string(o.key))
+		}
+	}
+	cmds, err := pipe.Exec()
+	// 有key不存在时Exec返回redis.Nil, 逐个检查
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	hits := 0
+	for i, cmd := range cmds {
+		err := cmd.Err()
+		switch {
+		case err == redis.Nil:
+		case err != nil:
+			return hits, err
+		case !ops[i].write:
+			hits++
+		}
+	}
+	return hits, nil
+}
+
+func (t *redisTarget) one(o *op) (int, error) {
+	if o.write {
+		return 0, t.client.Set(string(o.key), o.value, o.ttl).Err()
+	}
+	err := t.client.Get(string(o.key)).Err()
+	switch err {
+	case nil:
+		return 1, nil
+	case redis.Nil:
+		return 0, nil
+	default:
+		return 0, err
+	}
+}
+
+func (t *redisTarget) close() error {
+	return t.client.Close()
+}
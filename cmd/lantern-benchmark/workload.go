@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sizeRange 是"256"或者"64-1024"这样的长度区间
+type sizeRange struct {
+	min, max int
+}
+
+func (s *sizeRange) String() string {
+	if s.min == s.max {
+		return strconv.Itoa(s.min)
+	}
+	return strconv.Itoa(s.min) + "-" + strconv.Itoa(s.max)
+}
+
+func (s *sizeRange) Set(v string) error {
+	parts := strings.SplitN(v, "-", 2)
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return err
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(parts[1]); err != nil {
+			return err
+		}
+	}
+	if min <= 0 || max < min {
+		return fmt.Errorf("invalid size range %s", v)
+	}
+	s.min, s.max = min, max
+	return nil
+}
+
+// distribution 在[0, n)之间取值
+type distribution interface {
+	next() uint64
+}
+
+type uniform struct {
+	r *rand.Rand
+	n uint64
+}
+
+func (u *uniform) next() uint64 {
+	return uint64(u.r.Int63n(int64(u.n)))
+}
+
+type zipf struct {
+	z *rand.Zipf
+}
+
+func (z *zipf) next() uint64 {
+	return z.z.Uint64()
+}
+
+func newDistribution(name string, r *rand.Rand, n uint64, s float64) (distribution, error) {
+	switch name {
+	case "uniform":
+		return &uniform{r: r, n: n}, nil
+	case "zipf", "zipfian":
+		if s <= 1 {
+			return nil, fmt.Errorf("zipf exponent %v must be > 1", s)
+		}
+		return &zipf{z: rand.NewZipf(r, s, 1, n-1)}, nil
+	default:
+		return nil, fmt.Errorf("unknown distribution %s", name)
+	}
+}
+
+type op struct {
+	write bool
+	key   []byte
+	value []byte
+	ttl   time.Duration
+}
+
+// workload 每个worker一个, 生成的op引用共享的keys和values, 不分配内存
+type workload struct {
+	r      *rand.Rand
+	keys   [][]byte
+	values []byte
+	key    distribution
+	size   distribution
+	sizes  sizeRange
+	reads  float64
+	ttlMix float64
+	ttl    time.Duration
+}
+
+// makeKeys 生成keyspace, 每个key的长度在范围内随机但固定
+func makeKeys(n int, sizes sizeRange, seed int64) [][]byte {
+	r := rand.New(rand.NewSource(seed))
+	keys := make([][]byte, n)
+	for i := range keys {
+		size := sizes.min + r.Intn(sizes.max-sizes.min+1)
+		key := []byte("key:" + strconv.Itoa(i) + ":")
+		for len(key) < size {
+			key = append(key, 'x')
+		}
+		keys[i] = key
+	}
+	return keys
+}
+
+func makeValues(size int, seed int64) []byte {
+	r := rand.New(rand.NewSource(seed))
+	ret := make([]byte, size)
+	for i := range ret {
+		ret[i] = 'a' + byte(r.Intn(26))
+	}
+	return ret
+}
+
+func (w *workload) next(o *op) {
+	o.key = w.keys[w.key.next()]
+	o.write = w.r.Float64() >= w.reads
+	if !o.write {
+		return
+	}
+	o.value = w.values[:w.sizes.min+int(w.size.next())]
+	o.ttl = 0
+	if w.ttlMix > 0 && w.r.Float64() < w.ttlMix {
+		o.ttl = w.ttl
+	}
+}
@@ -0,0 +1,239 @@
+// lantern-inspect reads a snapshot written by LanternCache.SaveSnapshot offline.
+//
+// By default it reports entry counts, ring positions, fragmentation, TTL and size histograms
+// and the top key prefixes. -dump prints the entries as JSON lines and -verify checks the entry
+// headers and the index of every bucket. Chunks only live in memory (heap or anonymous mmap),
+// so snapshots are the only on-disk format to inspect.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	lantern_cache "github.com/linger1216/lantern-cache"
+)
+
+type options struct {
+	path      string
+	dump      bool
+	dumpDead  bool
+	verify    bool
+	buckets   bool
+	json      bool
+	top       int
+	separator string
+	prefixLen int
+}
+
+func parseOptions(args []string) (*options, error) {
+	o := &options{}
+	fs := flag.NewFlagSet("lantern-inspect", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: lantern-inspect [flags] <snapshot>\n")
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&o.dump, "dump", false, "print live entries as JSON lines")
+	fs.BoolVar(&o.dumpDead, "dump-dead", false, "with -dump, also print overwritten and deleted entries")
+	fs.BoolVar(&o.verify, "verify", false, "verify entry headers and the index, exit 1 on corruption")
+	fs.BoolVar(&o.buckets, "buckets", false, "include per bucket statistics in the report")
+	fs.BoolVar(&o.json, "json", false, "print the report as JSON")
+	fs.IntVar(&o.top, "top", 10, "number of key prefixes to report")
+	fs.StringVar(&o.separator, "separator", ":", "key prefixes end at the first separator")
+	fs.IntVar(&o.prefixLen, "prefix-len", 16, "max prefix length when a key has no separator")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return nil, fmt.Errorf("need exactly one snapshot file")
+	}
+	o.path = fs.Arg(0)
+	return o, nil
+}
+
+func main() {
+	o, err := parseOptions(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lantern-inspect: %v\n", err)
+		os.Exit(2)
+	}
+	ok, err := run(o, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lantern-inspect: %v\n", err)
+		os.Exit(1)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// run 返回false表示verify发现了错误
+func run(o *options, out io.Writer) (bool, error) {
+	f, err := os.Open(o.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	sr, err := lantern_cache.NewSnapshotReader(f)
+	if err != nil {
+		return false, err
+	}
+
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	hasher := lantern_cache.NewHasher("fnv")
+	now := time.Now().Unix()
+	r := newReport(sr.Header())
+	prefix := func(key []byte) string { return keyPrefix(key, o.separator, o.prefixLen) }
+	ok := true
+
+	for {
+		b, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// 后面的bucket没法定位, 只能停下
+			return false, fmt.Errorf("bucket %d: %v", len(r.Buckets), err)
+		}
+		switch {
+		case o.dump:
+			if err := dumpBucket(enc, b, o.dumpDead); err != nil {
+				return false, err
+			}
+		case o.verify:
+			for _, err := range b.Verify(hasher) {
+				ok = false
+				fmt.Fprintln(w, err)
+			}
+		default:
+			if err := r.addBucket(b, now, prefix); err != nil {
+				r.Errors = append(r.Errors, err.Error())
+			}
+		}
+	}
+
+	switch {
+	case o.dump:
+	case o.verify:
+		if ok {
+			fmt.Fprintf(w, "%d buckets ok\n", r.BucketCount)
+		}
+	case o.json:
+		if !o.buckets {
+			r.Buckets = nil
+		}
+		r.finish(o.top)
+		return true, enc.Encode(r)
+	default:
+		r.finish(o.top)
+		printReport(w, r, o.buckets)
+	}
+	return ok, nil
+}
+
+func keyPrefix(key []byte, separator string, max int) string {
+	if separator != "" {
+		if i := bytes.Index(key, []byte(separator)); i >= 0 {
+			return string(key[:i+len(separator)])
+		}
+	}
+	if len(key) > max {
+		key = key[:max]
+	}
+	return string(key)
+}
+
+// dumpEntry 是-dump输出的一行, 不是合法UTF-8的key和value用base64, 由encoding字段说明
+type dumpEntry struct {
+	Bucket   int    `json:"bucket"`
+	Loop     uint32 `json:"loop"`
+	Offset   uint64 `json:"offset"`
+	Live     bool   `json:"live"`
+	Expire   int64  `json:"expire,omitempty"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func dumpBucket(enc *json.Encoder, b *lantern_cache.SnapshotBucket, dead bool) error {
+	var err error
+	write := func(e *lantern_cache.SnapshotEntry) bool {
+		d := dumpEntry{
+			Bucket: b.Index,
+			Loop:   e.Loop,
+			Offset: e.Offset,
+			Live:   e.Live,
+			Expire: e.Expire,
+		}
+		if utf8.Valid(e.Key) && utf8.Valid(e.Value) {
+			d.Key, d.Value = string(e.Key), string(e.Value)
+		} else {
+			d.Key, d.Value, d.Encoding = base64.StdEncoding.EncodeToString(e.Key), base64.StdEncoding.EncodeToString(e.Value), "base64"
+		}
+		err = enc.Encode(&d)
+		return err == nil
+	}
+	if !dead {
+		b.Live(write)
+		return err
+	}
+	if walkErr := b.Walk(write); err == nil {
+		err = walkErr
+	}
+	return err
+}
+
+func printReport(w io.Writer, r *report, buckets bool) {
+	fmt.Fprintf(w, "snapshot version %d created %s, %d buckets\n", r.Version, r.Created.Format(time.RFC3339), r.BucketCount)
+	if r.Encrypted {
+		fmt.Fprintln(w, "values are encrypted")
+	}
+	fmt.Fprintf(w, "live: %d  expired: %d  dead: %d\n", r.Live, r.Expired, r.Dead)
+	fmt.Fprintf(w, "live bytes: %d  used bytes: %d  allocated bytes: %d  fragmentation: %.2f%%\n",
+		r.LiveBytes, r.UsedBytes, r.AllocatedBytes, r.Fragmentation*100)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	printHistogram := func(name string, h []histogramBucket) {
+		fmt.Fprintf(tw, "\n%s\n", name)
+		for _, b := range h {
+			if b.Count > 0 {
+				fmt.Fprintf(tw, "  %s\t%d\n", b.Label, b.Count)
+			}
+		}
+	}
+	printHistogram("ttl", r.TTL)
+	printHistogram("key size", r.KeySizes)
+	printHistogram("value size", r.ValueSizes)
+
+	fmt.Fprintf(tw, "\ntop prefixes\n")
+	for _, p := range r.TopPrefixes {
+		fmt.Fprintf(tw, "  %q\t%d keys\t%d bytes\n", p.Prefix, p.Keys, p.Bytes)
+	}
+
+	if buckets {
+		fmt.Fprintf(tw, "\nbucket\tloop\toffset\tchunks\tlive\texpired\tdead\tfragmentation\n")
+		for _, b := range r.Buckets {
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d/%d\t%d\t%d\t%d\t%.2f%%\n", b.Index, b.Loop, b.Offset,
+				b.AllocatedChunks, b.Chunks, b.Live, b.Expired, b.Dead, b.Fragmentation*100)
+		}
+	}
+	_ = tw.Flush()
+	for _, e := range r.Errors {
+		fmt.Fprintf(w, "error: %s\n", e)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lantern_cache "github.com/linger1216/lantern-cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lantern")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump")
+
+	cache := lantern_cache.NewLanternCache(&lantern_cache.Config{
+		BucketCount: 4,
+		MaxCapacity: 1024 * 1024,
+	})
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, cache.Put([]byte(fmt.Sprintf("user:%d", i)), []byte("value")))
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, cache.PutWithExpire([]byte(fmt.Sprintf("session:%d", i)), []byte("value"), 600))
+	}
+	// 覆盖写留下dead entry
+	assert.Nil(t, cache.Put([]byte("user:0"), []byte("value2")))
+	assert.Nil(t, cache.PutWithExpire([]byte("\xff"), []byte{0}, -10))
+	assert.Nil(t, cache.SaveSnapshotFile(path))
+
+	out := &bytes.Buffer{}
+	ok, err := run(&options{path: path, json: true, top: 1, separator: ":"}, out)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	var r report
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &r))
+	assert.Equal(t, uint32(4), r.BucketCount)
+	assert.Equal(t, uint64(110), r.Live)
+	assert.Equal(t, uint64(1), r.Expired)
+	assert.Equal(t, uint64(1), r.Dead)
+	assert.Equal(t, []prefixReport{{Prefix: "user:", Keys: 100, Bytes: r.TopPrefixes[0].Bytes}}, r.TopPrefixes)
+	assert.Equal(t, uint64(10), r.TTL[4].Count)
+
+	out.Reset()
+	ok, err = run(&options{path: path, dump: true, dumpDead: true}, out)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 112, len(lines))
+	assert.Contains(t, out.String(), `"encoding":"base64"`)
+
+	out.Reset()
+	ok, err = run(&options{path: path, verify: true}, out)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "4 buckets ok\n", out.String())
+
+	_, err = run(&options{path: filepath.Join(dir, "missing")}, out)
+	assert.NotNil(t, err)
+}
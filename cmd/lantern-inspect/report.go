@@ -0,0 +1,223 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	lantern_cache "github.com/linger1216/lantern-cache"
+)
+
+const chunkSize = 64 * 1024
+
+// histogramBucket 是一个区间和落在里面的entry数
+type histogramBucket struct {
+	Label string `json:"label"`
+	Count uint64 `json:"count"`
+}
+
+// sizeHistogram 按2的幂分段, 从<=16开始, entry最大64KB
+type sizeHistogram [13]uint64
+
+func (h *sizeHistogram) add(size int) {
+	i, limit := 0, 16
+	for size > limit && i < len(h)-1 {
+		i++
+		limit <<= 1
+	}
+	h[i]++
+}
+
+func (h *sizeHistogram) buckets() []histogramBucket {
+	ret := make([]histogramBucket, len(h))
+	limit := 16
+	for i := range h {
+		ret[i] = histogramBucket{Label: "<=" + strconv.Itoa(limit), Count: h[i]}
+		limit <<= 1
+	}
+	return ret
+}
+
+var ttlLimits = [...]struct {
+	label string
+	limit time.Duration
+}{
+	{"<1m", time.Minute},
+	{"<10m", 10 * time.Minute},
+	{"<1h", time.Hour},
+	{"<1d", 24 * time.Hour},
+	{"<7d", 7 * 24 * time.Hour},
+}
+
+// ttlHistogram 0: 不过期, 1: 已经过期, 后面是ttlLimits, 最后是更长的ttl
+type ttlHistogram [len(ttlLimits) + 3]uint64
+
+func (h *ttlHistogram) add(expire, now int64) {
+	switch {
+	case expire == 0:
+		h[0]++
+		return
+	case expire < now:
+		h[1]++
+		return
+	}
+	ttl := time.Duration(expire-now) * time.Second
+	for i, l := range ttlLimits {
+		if ttl < l.limit {
+			h[i+2]++
+			return
+		}
+	}
+	h[len(h)-1]++
+}
+
+func (h *ttlHistogram) buckets() []histogramBucket {
+	ret := []histogramBucket{{"none", h[0]}, {"expired", h[1]}}
+	for i, l := range ttlLimits {
+		ret = append(ret, histogramBucket{l.label, h[i+2]})
+	}
+	return append(ret, histogramBucket{">=7d", h[len(h)-1]})
+}
+
+// bucketReport 是一个bucket的统计
+type bucketReport struct {
+	Index           int     `json:"index"`
+	Loop            uint32  `json:"loop"`
+	Offset          uint64  `json:"offset"`
+	Chunks          int     `json:"chunks"`
+	AllocatedChunks int     `json:"allocated_chunks"`
+	IndexKeys       int     `json:"index_keys"`
+	Live            uint64  `json:"live"`
+	Expired         uint64  `json:"expired"`
+	Dead            uint64  `json:"dead"`
+	LiveBytes       uint64  `json:"live_bytes"`
+	UsedBytes       uint64  `json:"used_bytes"`
+	Fragmentation   float64 `json:"fragmentation"`
+}
+
+type prefixReport struct {
+	Prefix string `json:"prefix"`
+	Keys   uint64 `json:"keys"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+// report 是整个snapshot的统计, live不包含已经过期的entry
+type report struct {
+	Version        uint32            `json:"version"`
+	Created        time.Time         `json:"created"`
+	BucketCount    uint32            `json:"bucket_count"`
+	Encrypted      bool              `json:"encrypted"`
+	Live           uint64            `json:"live"`
+	Expired        uint64            `json:"expired"`
+	Dead           uint64            `json:"dead"`
+	LiveBytes      uint64            `json:"live_bytes"`
+	UsedBytes      uint64            `json:"used_bytes"`
+	AllocatedBytes uint64            `json:"allocated_bytes"`
+	Fragmentation  float64           `json:"fragmentation"`
+	TTL            []histogramBucket `json:"ttl"`
+	KeySizes       []histogramBucket `json:"key_sizes"`
+	ValueSizes     []histogramBucket `json:"value_sizes"`
+	TopPrefixes    []prefixReport    `json:"top_prefixes"`
+	Buckets        []bucketReport    `json:"buckets,omitempty"`
+	Errors         []string          `json:"errors,omitempty"`
+
+	ttl        ttlHistogram
+	keySizes   sizeHistogram
+	valueSizes sizeHistogram
+	prefixes   map[string]*prefixReport
+}
+
+func newReport(header lantern_cache.SnapshotHeader) *report {
+	return &report{
+		Version:     header.Version,
+		Created:     header.Created,
+		BucketCount: header.BucketCount,
+		Encrypted:   header.Encrypted,
+		prefixes:    make(map[string]*prefixReport),
+	}
+}
+
+// usedBytes 是ring里已经写过的部分, 第一轮没写完时只到offset
+func usedBytes(b *lantern_cache.SnapshotBucket) uint64 {
+	if b.Loop == 0 {
+		return b.Offset
+	}
+	return uint64(b.ChunkCount) * chunkSize
+}
+
+func fragmentation(live, used uint64) float64 {
+	if used == 0 {
+		return 0
+	}
+	return 1 - float64(live)/float64(used)
+}
+
+// addBucket 统计一个bucket, 返回Walk发现的错误
+func (r *report) addBucket(b *lantern_cache.SnapshotBucket, now int64, prefix func([]byte) string) error {
+	br := bucketReport{
+		Index:           b.Index,
+		Loop:            b.Loop,
+		Offset:          b.Offset,
+		Chunks:          b.ChunkCount,
+		AllocatedChunks: b.AllocatedChunks,
+		IndexKeys:       b.Keys,
+		UsedBytes:       usedBytes(b),
+	}
+	b.Live(func(e *lantern_cache.SnapshotEntry) bool {
+		r.ttl.add(e.Expire, now)
+		if e.Expire > 0 && e.Expire < now {
+			br.Expired++
+			return true
+		}
+		br.Live++
+		br.LiveBytes += uint64(e.Size)
+		r.keySizes.add(len(e.Key))
+		r.valueSizes.add(len(e.Value))
+		p := prefix(e.Key)
+		pr := r.prefixes[p]
+		if pr == nil {
+			pr = &prefixReport{Prefix: p}
+			r.prefixes[p] = pr
+		}
+		pr.Keys++
+		pr.Bytes += uint64(e.Size)
+		return true
+	})
+	err := b.Walk(func(e *lantern_cache.SnapshotEntry) bool {
+		if !e.Live {
+			br.Dead++
+		}
+		return true
+	})
+	br.Fragmentation = fragmentation(br.LiveBytes, br.UsedBytes)
+
+	r.Live += br.Live
+	r.Expired += br.Expired
+	r.Dead += br.Dead
+	r.LiveBytes += br.LiveBytes
+	r.UsedBytes += br.UsedBytes
+	r.AllocatedBytes += uint64(b.AllocatedChunks) * chunkSize
+	r.Buckets = append(r.Buckets, br)
+	return err
+}
+
+func (r *report) finish(top int) {
+	r.Fragmentation = fragmentation(r.LiveBytes, r.UsedBytes)
+	r.TTL = r.ttl.buckets()
+	r.KeySizes = r.keySizes.buckets()
+	r.ValueSizes = r.valueSizes.buckets()
+	r.TopPrefixes = make([]prefixReport, 0, len(r.prefixes))
+	for _, p := range r.prefixes {
+		r.TopPrefixes = append(r.TopPrefixes, *p)
+	}
+	sort.Slice(r.TopPrefixes, func(i, j int) bool {
+		a, b := r.TopPrefixes[i], r.TopPrefixes[j]
+		if a.Keys != b.Keys {
+			return a.Keys > b.Keys
+		}
+		return a.Prefix < b.Prefix
+	})
+	if len(r.TopPrefixes) > top {
+		r.TopPrefixes = r.TopPrefixes[:top]
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	lantern_cache "github.com/linger1216/lantern-cache"
+)
+
+const envPrefix = "LANTERN_"
+
+// duration 在配置文件里可以写成"30s"或者秒数
+type duration time.Duration
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(s string) error {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*d = duration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	return d.Set(s)
+}
+
+// config 的来源按优先级从低到高: 默认值, 配置文件, LANTERN_前缀的环境变量, 命令行
+// 环境变量的名字是flag名字转成大写, '-'换成'_', 比如LANTERN_MAX_CAPACITY
+type config struct {
+	ConfigFile string `json:"-"`
+
+	BucketCount          uint32 `json:"bucket_count"`
+	MaxCapacity          uint64 `json:"max_capacity"`
+	InitCapacity         uint64 `json:"init_capacity"`
+	ChunkAllocatorPolicy string `json:"chunk_allocator"`
+	HashPolicy           string `json:"hash"`
+	IndexPolicy          string `json:"index"`
+	OptimisticReads      bool   `json:"optimistic_reads"`
+	Checksum             bool   `json:"checksum"`
+	LatencySampleRate    uint32 `json:"latency_sample_rate"`
+	HotKeySampleRate     uint32 `json:"hot_key_sample_rate"`
+	TrackBigKeys         bool   `json:"track_big_keys"`
+
+	RedisAddr     string   `json:"redis_addr"`
+	RequirePass   string   `json:"requirepass"`
+	MemcachedAddr string   `json:"memcached_addr"`
+	HTTPAddr      string   `json:"http_addr"`
+	MaxClients    int      `json:"max_clients"`
+	IdleTimeout   duration `json:"idle_timeout"`
+
+	PidFile         string   `json:"pidfile"`
+	LogFile         string   `json:"logfile"`
+	Verbose         bool     `json:"verbose"`
+	Snapshot        string   `json:"snapshot"`
+	SnapshotOnExit  bool     `json:"snapshot_on_exit"`
+	ShutdownTimeout duration `json:"shutdown_timeout"`
+}
+
+func defaultConfig() *config {
+	c := lantern_cache.DefaultConfig()
+	return &config{
+		BucketCount:          c.BucketCount,
+		MaxCapacity:          c.MaxCapacity,
+		ChunkAllocatorPolicy: c.ChunkAllocatorPolicy,
+		HashPolicy:           c.HashPolicy,
+		IndexPolicy:          c.IndexPolicy,
+		RedisAddr:            ":6379",
+		ShutdownTimeout:      duration(10 * time.Second),
+	}
+}
+
+// flagSet 把flag绑定到c的字段上, 默认值是c当前的值
+func (c *config) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("lantern-server", flag.ContinueOnError)
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "JSON config file")
+
+	fs.Var(uint32Value{&c.BucketCount}, "bucket-count", "number of buckets, must be a power of two")
+	fs.Uint64Var(&c.MaxCapacity, "max-capacity", c.MaxCapacity, "max capacity of the cache in bytes")
+	fs.Uint64Var(&c.InitCapacity, "init-capacity", c.InitCapacity, "capacity allocated at startup in bytes, 0 means a quarter of max capacity")
+	fs.StringVar(&c.ChunkAllocatorPolicy, "chunk-allocator", c.ChunkAllocatorPolicy, "chunk allocator, heap or mmap")
+	fs.StringVar(&c.HashPolicy, "hash", c.HashPolicy, "hash policy, fnv")
+	fs.StringVar(&c.IndexPolicy, "index", c.IndexPolicy, "bucket index, map or flat")
+	fs.BoolVar(&c.OptimisticReads, "optimistic-reads", c.OptimisticReads, "read without locking the bucket, needs the flat index")
+	fs.BoolVar(&c.Checksum, "checksum", c.Checksum, "verify a CRC32C of every entry on reads")
+	fs.Var(uint32Value{&c.LatencySampleRate}, "latency-sample-rate", "time one in n cache operations for the latency histograms, 0 disables them")
+	fs.Var(uint32Value{&c.HotKeySampleRate}, "hot-key-sample-rate", "count one in n gets and puts for LANTERN HOTKEYS, 0 disables it")
+	fs.BoolVar(&c.TrackBigKeys, "track-big-keys", c.TrackBigKeys, "track the largest entries for LANTERN BIGKEYS")
+
+	fs.StringVar(&c.RedisAddr, "redis-addr", c.RedisAddr, "redis listen address, empty disables it")
+	fs.StringVar(&c.RequirePass, "requirepass", c.RequirePass, "redis password")
+	fs.StringVar(&c.MemcachedAddr, "memcached-addr", c.MemcachedAddr, "memcached listen address, empty disables it")
+	fs.StringVar(&c.HTTPAddr, "http-addr", c.HTTPAddr, "http listen address, empty disables it")
+	fs.IntVar(&c.MaxClients, "max-clients", c.MaxClients, "max clients of every protocol server, 0 means no limit")
+	fs.Var(&c.IdleTimeout, "idle-timeout", "close idle clients after the duration, 0 means never")
+
+	fs.StringVar(&c.PidFile, "pidfile", c.PidFile, "write the process id to the file")
+	fs.StringVar(&c.LogFile, "logfile", c.LogFile, "log file, reopened on SIGHUP, stderr when empty")
+	fs.BoolVar(&c.Verbose, "verbose", c.Verbose, "also log debug events like ring wraps and client connects")
+	fs.StringVar(&c.Snapshot, "snapshot", c.Snapshot, "snapshot file loaded at startup")
+	fs.BoolVar(&c.SnapshotOnExit, "snapshot-on-exit", c.SnapshotOnExit, "save the snapshot file on exit")
+	fs.Var(&c.ShutdownTimeout, "shutdown-timeout", "time to wait for clients on exit")
+	return fs
+}
+
+type uint32Value struct {
+	p *uint32
+}
+
+func (v uint32Value) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(*v.p), 10)
+}
+
+func (v uint32Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return err
+	}
+	*v.p = uint32(n)
+	return nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// applyEnv 用环境变量覆盖fs绑定的字段
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("invalid %s: %v", envName(f.Name), e)
+		}
+	})
+	return err
+}
+
+// loadConfig 每次SIGHUP都会重新调用, 命令行参数始终优先
+func loadConfig(args []string) (*config, error) {
+	// 第一遍只为了找到配置文件
+	c := defaultConfig()
+	fs := c.flagSet()
+	fs.SetOutput(ioutil.Discard)
+	if err := applyEnv(fs); err != nil {
+		return nil, err
+	}
+	// 参数错误和-h留给第二遍报告
+	_ = fs.Parse(args)
+	path := c.ConfigFile
+
+	c = defaultConfig()
+	fs = c.flagSet()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := applyEnv(fs); err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	c.ConfigFile = path
+	return c, c.validate()
+}
+
+// validate 提前检查lantern_cache.New会返回错误的参数
+func (c *config) validate() error {
+	if err := c.cacheConfig().Validate(); err != nil {
+		return err
+	}
+	if c.RedisAddr == "" && c.MemcachedAddr == "" && c.HTTPAddr == "" {
+		return fmt.Errorf("no server address")
+	}
+	if c.SnapshotOnExit && c.Snapshot == "" {
+		return fmt.Errorf("snapshot-on-exit needs a snapshot file")
+	}
+	return nil
+}
+
+func (c *config) cacheConfig() *lantern_cache.Config {
+	return &lantern_cache.Config{
+		BucketCount:          c.BucketCount,
+		MaxCapacity:          c.MaxCapacity,
+		InitCapacity:         c.InitCapacity,
+		ChunkAllocatorPolicy: c.ChunkAllocatorPolicy,
+		HashPolicy:           c.HashPolicy,
+		IndexPolicy:          c.IndexPolicy,
+		OptimisticReads:      c.OptimisticReads,
+		Checksum:             c.Checksum,
+		LatencySampleRate:    c.LatencySampleRate,
+		HotKeySampleRate:     c.HotKeySampleRate,
+		TrackBigKeys:         c.TrackBigKeys,
+		Verbose:              c.Verbose,
+	}
+}
+
+// sameCache 缓存的参数只能重启生效
+func (c *config) sameCache(o *config) bool {
+	return *c.cacheConfig() == *o.cacheConfig()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lantern")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lantern.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{
+		"bucket_count": 16,
+		"max_capacity": 1048576,
+		"redis_addr": ":7000",
+		"http_addr": ":8000",
+		"idle_timeout": "1m",
+		"shutdown_timeout": 3
+	}`), 0644))
+
+	cfg, err := loadConfig([]string{"-config", path})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(16), cfg.BucketCount)
+	assert.Equal(t, ":7000", cfg.RedisAddr)
+	assert.Equal(t, duration(time.Minute), cfg.IdleTimeout)
+	assert.Equal(t, duration(3*time.Second), cfg.ShutdownTimeout)
+
+	// 环境变量覆盖配置文件, 命令行覆盖环境变量
+	os.Setenv("LANTERN_CONFIG", path)
+	os.Setenv("LANTERN_REDIS_ADDR", ":7001")
+	os.Setenv("LANTERN_HTTP_ADDR", ":8001")
+	defer os.Unsetenv("LANTERN_CONFIG")
+	defer os.Unsetenv("LANTERN_REDIS_ADDR")
+	defer os.Unsetenv("LANTERN_HTTP_ADDR")
+	cfg, err = loadConfig([]string{"-http-addr", ":8002"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(16), cfg.BucketCount)
+	assert.Equal(t, ":7001", cfg.RedisAddr)
+	assert.Equal(t, ":8002", cfg.HTTPAddr)
+
+	_, err = loadConfig([]string{"-bucket-count", "3"})
+	assert.NotNil(t, err)
+	_, err = loadConfig([]string{"-snapshot-on-exit"})
+	assert.NotNil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"unknown": 1}`), 0644))
+	_, err = loadConfig(nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// logOutput 是可以重新打开的日志文件, logrotate移走文件后发SIGHUP即可
+type logOutput struct {
+	mutex sync.Mutex
+	path  string
+	w     io.Writer
+	file  *os.File
+}
+
+// open 打开path, path为空时写到stderr, 成功后才关闭旧的文件
+func (o *logOutput) open(path string) error {
+	var file *os.File
+	var w io.Writer = os.Stderr
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		file, w = f, f
+	}
+
+	o.mutex.Lock()
+	old := o.file
+	o.path, o.w, o.file = path, w, file
+	o.mutex.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+func (o *logOutput) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.w.Write(p)
+}
+
+func (o *logOutput) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.w = os.Stderr
+	if o.file == nil {
+		return nil
+	}
+	err := o.file.Close()
+	o.file = nil
+	return err
+}
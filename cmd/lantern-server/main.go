@@ -0,0 +1,152 @@
+// lantern-server serves a LanternCache over the redis, memcached and http protocols.
+//
+// Configuration comes from a JSON file (-config), LANTERN_* environment variables and flags,
+// see lantern-server -h. SIGINT and SIGTERM shut down gracefully and save the snapshot when
+// snapshot-on-exit is set, SIGHUP reloads the configuration and reopens the log file.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	lantern_cache "github.com/linger1216/lantern-cache"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	cfg, err := loadConfig(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lantern-server: %v\n", err)
+		return 2
+	}
+
+	out := &logOutput{}
+	if err := out.open(cfg.LogFile); err != nil {
+		fmt.Fprintf(os.Stderr, "lantern-server: %v\n", err)
+		return 1
+	}
+	defer out.Close()
+	logger := log.New(out, "", log.LstdFlags)
+
+	if cfg.PidFile != "" {
+		if err := writePidFile(cfg.PidFile); err != nil {
+			logger.Printf("write pidfile: %v", err)
+			return 1
+		}
+		defer os.Remove(cfg.PidFile)
+	}
+
+	cacheConfig := cfg.cacheConfig()
+	cacheConfig.Logger = logger
+	cache, err := lantern_cache.New(cacheConfig)
+	if err != nil {
+		logger.Printf("%v", err)
+		return 1
+	}
+	cache.PublishExpvar("lantern")
+	if cfg.Snapshot != "" {
+		start := time.Now()
+		err := cache.LoadSnapshotFile(cfg.Snapshot)
+		switch {
+		case err == nil:
+			logger.Printf("loaded %d keys from %s in %v", cache.Size(), cfg.Snapshot, time.Since(start))
+		case os.IsNotExist(err):
+			logger.Printf("snapshot %s does not exist, starting empty", cfg.Snapshot)
+		default:
+			logger.Printf("load snapshot %s: %v", cfg.Snapshot, err)
+			return 1
+		}
+	}
+
+	servers := newServers(cache, logger)
+	if err := servers.apply(cfg); err != nil {
+		logger.Printf("%v", err)
+		servers.shutdown(context.Background())
+		return 1
+	}
+	logger.Printf("lantern-server started, pid %d", os.Getpid())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	code := 0
+loop:
+	for {
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				logger.Printf("received %v, shutting down", sig)
+				break loop
+			}
+			cfg = reload(cfg, args, out, servers, logger)
+		case err := <-servers.errors:
+			logger.Printf("%v, shutting down", err)
+			code = 1
+			break loop
+		}
+	}
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	servers.shutdown(ctx)
+	cancel()
+
+	if cfg.SnapshotOnExit {
+		start := time.Now()
+		if err := cache.SaveSnapshotFile(cfg.Snapshot); err != nil {
+			logger.Printf("save snapshot %s: %v", cfg.Snapshot, err)
+			code = 1
+		} else {
+			logger.Printf("saved %d keys to %s in %v", cache.Size(), cfg.Snapshot, time.Since(start))
+		}
+	}
+	logger.Printf("lantern-server stopped")
+	return code
+}
+
+// reload 重新读取配置, 出错时继续使用旧的配置
+func reload(old *config, args []string, out *logOutput, servers *servers, logger *log.Logger) *config {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		logger.Printf("reload config: %v", err)
+		return old
+	}
+	if err := out.open(cfg.LogFile); err != nil {
+		logger.Printf("reopen log file: %v", err)
+		cfg.LogFile = old.LogFile
+	}
+	if !cfg.sameCache(old) {
+		logger.Printf("cache settings changed, restart to apply them")
+	}
+	if cfg.PidFile != old.PidFile {
+		logger.Printf("pidfile changed, restart to apply it")
+		cfg.PidFile = old.PidFile
+	}
+	if err := servers.apply(cfg); err != nil {
+		logger.Printf("reload servers: %v", err)
+	}
+	logger.Printf("config reloaded")
+	return cfg
+}
+
+// writePidFile 先写临时文件再rename, 其他进程不会读到一半的pid
+func writePidFile(path string) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	lantern_cache "github.com/linger1216/lantern-cache"
+)
+
+// protocolServer 是RedisServer, MemcachedServer和HTTPServer共同的方法
+type protocolServer interface {
+	Serve(ln net.Listener) error
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// running 是一个正在运行的协议服务器, settings不同时需要重启
+type running struct {
+	server   protocolServer
+	settings string
+}
+
+// servers 管理所有协议服务器, 只在main goroutine里调用
+type servers struct {
+	cache   *lantern_cache.LanternCache
+	logger  lantern_cache.Logger
+	running map[string]*running
+	// errors 收到服务器意外退出的错误
+	errors chan error
+	wg     sync.WaitGroup
+}
+
+func newServers(cache *lantern_cache.LanternCache, logger lantern_cache.Logger) *servers {
+	return &servers{
+		cache:   cache,
+		logger:  logger,
+		running: make(map[string]*running),
+		errors:  make(chan error, 3),
+	}
+}
+
+// apply 启动新增的服务器, 关闭去掉的服务器, 重启配置变化的服务器
+func (s *servers) apply(cfg *config) error {
+	protocols := []struct {
+		name string
+		addr string
+		// settings 包含影响这个服务器的所有配置
+		settings string
+		create   func() (protocolServer, error)
+	}{
+		{"redis", cfg.RedisAddr, fmt.Sprint(cfg.RedisAddr, cfg.RequirePass, cfg.MaxClients, cfg.IdleTimeout, cfg.Verbose), func() (protocolServer, error) {
+			return lantern_cache.NewRedisServerWithOptions(cfg.RedisAddr, s.cache, &lantern_cache.RedisServerOptions{
+				RequirePass: cfg.RequirePass,
+				MaxClients:  cfg.MaxClients,
+				IdleTimeout: time.Duration(cfg.IdleTimeout),
+				Logger:      s.logger,
+				Verbose:     cfg.Verbose,
+			})
+		}},
+		{"memcached", cfg.MemcachedAddr, fmt.Sprint(cfg.MemcachedAddr, cfg.MaxClients, cfg.IdleTimeout), func() (protocolServer, error) {
+			return lantern_cache.NewMemcachedServer(cfg.MemcachedAddr, s.cache, &lantern_cache.MemcachedServerOptions{
+				MaxClients:  cfg.MaxClients,
+				IdleTimeout: time.Duration(cfg.IdleTimeout),
+				Logger:      s.logger,
+			}), nil
+		}},
+		{"http", cfg.HTTPAddr, fmt.Sprint(cfg.HTTPAddr, cfg.IdleTimeout), func() (protocolServer, error) {
+			return lantern_cache.NewHTTPServer(cfg.HTTPAddr, s.cache, &lantern_cache.HTTPServerOptions{
+				IdleTimeout: time.Duration(cfg.IdleTimeout),
+				Logger:      s.logger,
+			}), nil
+		}},
+	}
+
+	for _, p := range protocols {
+		old := s.running[p.name]
+		if old != nil && old.settings == p.settings {
+			continue
+		}
+		// 先关闭旧的服务器, 它在cache上注册的listener随之删除, 不会和新的服务器一起收到事件
+		if old != nil {
+			s.stop(p.name, old)
+		}
+		if p.addr == "" {
+			continue
+		}
+		server, err := p.create()
+		if err != nil {
+			return fmt.Errorf("%s server: %v", p.name, err)
+		}
+		// 地址被旧的服务器占用时, stop已经等它关闭了监听
+		ln, err := net.Listen("tcp", p.addr)
+		if err != nil {
+			_ = server.Close()
+			return fmt.Errorf("%s server: %v", p.name, err)
+		}
+		s.running[p.name] = &running{server: server, settings: p.settings}
+		s.logger.Printf("%s server listening on %s", p.name, ln.Addr())
+
+		name := p.name
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := server.Serve(ln); err != nil {
+				select {
+				case s.errors <- fmt.Errorf("%s server: %v", name, err):
+				default:
+					s.logger.Printf("%s server: %v", name, err)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+func (s *servers) stop(name string, r *running) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := r.server.Shutdown(ctx); err != nil {
+		s.logger.Printf("%s server shutdown: %v", name, err)
+	}
+	delete(s.running, name)
+	s.logger.Printf("%s server stopped", name)
+}
+
+// shutdown 同时关闭所有服务器, ctx结束时强制断开剩下的客户端
+func (s *servers) shutdown(ctx context.Context) {
+	var wg sync.WaitGroup
+	for name, r := range s.running {
+		wg.Add(1)
+		go func(name string, r *running) {
+			defer wg.Done()
+			if err := r.server.Shutdown(ctx); err != nil {
+				s.logger.Printf("%s server shutdown: %v", name, err)
+			}
+		}(name, r)
+	}
+	wg.Wait()
+	s.running = make(map[string]*running)
+	s.wg.Wait()
+}
@@ -0,0 +1,188 @@
+package lantern_cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// KeyProvider supplies the AES keys used to encrypt values when set in Config.
+// Rotate keys by adding a new key and switching CurrentKeyID to it, values written with
+// older keys stay readable as long as Key still returns them.
+type KeyProvider interface {
+	// CurrentKeyID returns the id of the key new values are encrypted with.
+	CurrentKeyID() uint32
+	// Key returns the AES key with the id, 16, 24 or 32 bytes long.
+	// The key of an id must never change.
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider holding its keys in memory, it is safe for concurrent use.
+type KeyRing struct {
+	mutex   sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewKeyRing returns a KeyRing encrypting with key, which has the given id.
+func NewKeyRing(id uint32, key []byte) (*KeyRing, error) {
+	ret := &KeyRing{keys: make(map[uint32][]byte)}
+	if err := ret.Add(id, key); err != nil {
+		return nil, err
+	}
+	ret.current = id
+	return ret, nil
+}
+
+// Add adds a key, it fails with ErrorInvalidKey when the key is not a valid AES key
+// or the id is already used by another key.
+func (r *KeyRing) Add(id uint32, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return ErrorInvalidKey
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if old, ok := r.keys[id]; ok && string(old) != string(key) {
+		return ErrorInvalidKey
+	}
+	r.keys[id] = append([]byte(nil), key...)
+	return nil
+}
+
+// SetCurrent makes the key with the id encrypt new values.
+func (r *KeyRing) SetCurrent(id uint32) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.keys[id]; !ok {
+		return ErrorUnknownKey
+	}
+	r.current = id
+	return nil
+}
+
+func (r *KeyRing) CurrentKeyID() uint32 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.current
+}
+
+func (r *KeyRing) Key(id uint32) ([]byte, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, ErrorUnknownKey
+	}
+	return key, nil
+}
+
+/*
+加密后entry里保存的value
+┌──────────────────────────────┐
+│        sealed value          │
+├─────┬───────┬────────┬───────┤
+│  4  │  12   │   m    │  16   │
+├─────┼───────┼────────┼───────┤
+│ key │ nonce │ cipher │  tag  │
+│ id  │       │ text   │       │
+└─────┴───────┴────────┴───────┘
+key作为additional data, entry的value被换到别的key下面时解密失败
+*/
+const (
+	sealKeyIDSizeOf = 4
+	sealNonceSizeOf = 12
+	sealTagSizeOf   = 16
+	sealOverhead    = sealKeyIDSizeOf + sealNonceSizeOf + sealTagSizeOf
+)
+
+// valueCipher 缓存每个key id的AEAD, 所有bucket共享
+type valueCipher struct {
+	provider KeyProvider
+	mutex    sync.RWMutex
+	aeads    map[uint32]cipher.AEAD
+	// nonce 是随机的起点加上计数器, 同一个进程里不会重复, 不需要每次put都读随机数
+	nonceBase [sealNonceSizeOf]byte
+	counter   uint64
+}
+
+func newValueCipher(provider KeyProvider) *valueCipher {
+	ret := &valueCipher{
+		provider: provider,
+		aeads:    make(map[uint32]cipher.AEAD),
+	}
+	if _, err := rand.Read(ret.nonceBase[:]); err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// overhead c为nil表示不加密
+func (c *valueCipher) overhead() int {
+	if c == nil {
+		return 0
+	}
+	return sealOverhead
+}
+
+func (c *valueCipher) aead(id uint32) (cipher.AEAD, error) {
+	c.mutex.RLock()
+	aead, ok := c.aeads[id]
+	c.mutex.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	key, err := c.provider.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrorInvalidKey
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.aeads[id] = aead
+	c.mutex.Unlock()
+	return aead, nil
+}
+
+// current 返回加密新value使用的key
+func (c *valueCipher) current() (uint32, cipher.AEAD, error) {
+	id := c.provider.CurrentKeyID()
+	aead, err := c.aead(id)
+	return id, aead, err
+}
+
+// seal 把加密后的val写到dst的末尾, dst容量足够时不分配内存
+func (c *valueCipher) seal(dst []byte, id uint32, aead cipher.AEAD, key, val []byte) []byte {
+	var head [sealKeyIDSizeOf + sealNonceSizeOf]byte
+	binary.LittleEndian.PutUint32(head[:], id)
+	nonce := head[sealKeyIDSizeOf:]
+	copy(nonce, c.nonceBase[:])
+	n := binary.LittleEndian.Uint64(nonce) + atomic.AddUint64(&c.counter, 1)
+	binary.LittleEndian.PutUint64(nonce, n)
+	dst = append(dst, head[:]...)
+	return aead.Seal(dst, nonce, val, key)
+}
+
+// open 把解密后的value追加到dst, sealed不能和dst重叠
+func (c *valueCipher) open(dst, key, sealed []byte) ([]byte, error) {
+	if len(sealed) < sealOverhead {
+		return nil, ErrorDecrypt
+	}
+	aead, err := c.aead(binary.LittleEndian.Uint32(sealed))
+	if err != nil {
+		return nil, err
+	}
+	ret, err := aead.Open(dst, sealed[sealKeyIDSizeOf:sealKeyIDSizeOf+sealNonceSizeOf], sealed[sealKeyIDSizeOf+sealNonceSizeOf:], key)
+	if err != nil {
+		return nil, ErrorDecrypt
+	}
+	return ret, nil
+}
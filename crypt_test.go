@@ -0,0 +1,161 @@
+package lantern_cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEncryptedCache(provider KeyProvider) *LanternCache {
+	return NewLanternCache(&Config{
+		BucketCount: 4,
+		MaxCapacity: 1024 * 1024,
+		KeyProvider: provider,
+	})
+}
+
+func TestKeyRing(t *testing.T) {
+	_, err := NewKeyRing(1, []byte("short"))
+	assert.Equal(t, ErrorInvalidKey, err)
+
+	ring, err := NewKeyRing(1, bytes.Repeat([]byte{1}, 16))
+	assert.Nil(t, err)
+	assert.Equal(t, ErrorInvalidKey, ring.Add(1, bytes.Repeat([]byte{2}, 16)))
+	assert.Equal(t, ErrorUnknownKey, ring.SetCurrent(2))
+	assert.Nil(t, ring.Add(2, bytes.Repeat([]byte{2}, 32)))
+	assert.Nil(t, ring.SetCurrent(2))
+	assert.Equal(t, uint32(2), ring.CurrentKeyID())
+	_, err = ring.Key(3)
+	assert.Equal(t, ErrorUnknownKey, err)
+}
+
+func TestLanternCacheEncryption(t *testing.T) {
+	ring, err := NewKeyRing(1, bytes.Repeat([]byte{1}, 16))
+	assert.Nil(t, err)
+	cache := newEncryptedCache(ring)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, cache.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("secret%d", i))))
+	}
+	// 轮换key后旧的value仍然可以读
+	assert.Nil(t, ring.Add(2, bytes.Repeat([]byte{2}, 32)))
+	assert.Nil(t, ring.SetCurrent(2))
+	assert.Nil(t, cache.Put([]byte("key0"), []byte("rotated")))
+
+	v, err := cache.Get([]byte("key0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "rotated", string(v))
+	v, err = cache.GetWithBuffer([]byte("prefix:"), []byte("key99"))
+	assert.Nil(t, err)
+	assert.Equal(t, "prefix:secret99", string(v))
+	assert.Nil(t, cache.View([]byte("key98"), func(value []byte) error {
+		assert.Equal(t, "secret98", string(value))
+		return nil
+	}))
+	assert.Nil(t, cache.Update(func(tx *Txn) error {
+		v, err := tx.Get([]byte("key1"))
+		assert.Nil(t, err)
+		assert.Equal(t, "secret1", string(v))
+		return tx.Put([]byte("key1"), []byte("txn"))
+	}))
+	v, err = cache.Get([]byte("key1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "txn", string(v))
+
+	for _, b := range cache.loadLayout().buckets {
+		for _, chunk := range b.chunks {
+			assert.False(t, bytes.Contains(chunk, []byte("secret")))
+		}
+	}
+
+	// 加密后超过entry大小限制
+	assert.Equal(t, ErrorInvalidEntry, cache.Put([]byte("big"), make([]byte, MaxValueSize-sealOverhead+1)))
+	assert.Nil(t, cache.Put([]byte("big"), make([]byte, chunkSize-EntryHeadFieldSizeOf-len("big")-sealOverhead)))
+}
+
+func TestLanternCacheEncryptionTamper(t *testing.T) {
+	ring, err := NewKeyRing(1, bytes.Repeat([]byte{1}, 16))
+	assert.Nil(t, err)
+	cache := NewLanternCache(&Config{
+		BucketCount: 1,
+		MaxCapacity: 1024 * 1024,
+		KeyProvider: ring,
+	})
+	assert.Nil(t, cache.Put([]byte("key"), []byte("value")))
+	entry, ok := entryAt(cache.loadLayout().buckets[0].chunks[0])
+	assert.True(t, ok)
+	entry[len(entry)-1] ^= 1
+	_, err = cache.Get([]byte("key"))
+	assert.Equal(t, ErrorDecrypt, err)
+
+	// 不认识的key id
+	assert.Nil(t, cache.Put([]byte("key"), []byte("value")))
+	other, err := NewKeyRing(7, bytes.Repeat([]byte{1}, 16))
+	assert.Nil(t, err)
+	buf := &bytes.Buffer{}
+	assert.Nil(t, cache.SaveSnapshot(buf))
+	dst := newEncryptedCache(other)
+	assert.Nil(t, dst.LoadSnapshot(bytes.NewReader(buf.Bytes())))
+	_, err = dst.Get([]byte("key"))
+	assert.Equal(t, ErrorUnknownKey, err)
+}
+
+func TestSnapshotEncrypted(t *testing.T) {
+	ring, err := NewKeyRing(1, bytes.Repeat([]byte{1}, 16))
+	assert.Nil(t, err)
+	src := newEncryptedCache(ring)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, src.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("secret%d", i))))
+	}
+	buf := &bytes.Buffer{}
+	assert.Nil(t, src.SaveSnapshot(buf))
+	assert.False(t, bytes.Contains(buf.Bytes(), []byte("secret")))
+
+	dst := newEncryptedCache(ring)
+	assert.Nil(t, dst.LoadSnapshot(bytes.NewReader(buf.Bytes())))
+	for i := 0; i < 100; i++ {
+		v, err := dst.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("secret%d", i), string(v))
+	}
+}
+
+func TestSnapshotEncryptionMismatch(t *testing.T) {
+	ring, err := NewKeyRing(1, bytes.Repeat([]byte{1}, 16))
+	assert.Nil(t, err)
+	newPlainCache := func() *LanternCache {
+		return NewLanternCache(&Config{BucketCount: 4, MaxCapacity: 1024 * 1024})
+	}
+
+	encrypted := newEncryptedCache(ring)
+	assert.Nil(t, encrypted.Put([]byte("key"), []byte("secret")))
+	buf := &bytes.Buffer{}
+	assert.Nil(t, encrypted.SaveSnapshot(buf))
+	sr, err := NewSnapshotReader(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.True(t, sr.Header().Encrypted)
+
+	plain := newPlainCache()
+	err = plain.LoadSnapshot(bytes.NewReader(buf.Bytes()))
+	assert.True(t, errors.Is(err, ErrorSnapshotEncryption))
+	assert.Equal(t, &SnapshotEncryptionError{Snapshot: true, Cache: false}, err)
+	_, err = plain.Get([]byte("key"))
+	assert.Equal(t, ErrorNotFound, err)
+
+	assert.Nil(t, plain.Put([]byte("key"), []byte("plain")))
+	buf.Reset()
+	assert.Nil(t, plain.SaveSnapshot(buf))
+	sr, err = NewSnapshotReader(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.False(t, sr.Header().Encrypted)
+
+	dst := newEncryptedCache(ring)
+	err = dst.LoadSnapshot(bytes.NewReader(buf.Bytes()))
+	assert.True(t, errors.Is(err, ErrorSnapshotEncryption))
+	assert.Equal(t, &SnapshotEncryptionError{Snapshot: false, Cache: true}, err)
+	_, err = dst.Get([]byte("key"))
+	assert.Equal(t, ErrorNotFound, err)
+}
@@ -9,7 +9,10 @@ const (
 	EntryTimeStampFieldSizeOf = 8
 	EntryKeyFieldSizeOf       = 2
 	EntryValueFieldSizeOf     = 2
-	EntryHeadFieldSizeOf      = EntryTimeStampFieldSizeOf + EntryKeyFieldSizeOf + EntryValueFieldSizeOf
+	EntryChecksumFieldSizeOf  = 4
+	EntryHeadFieldSizeOf      = EntryTimeStampFieldSizeOf + EntryKeyFieldSizeOf + EntryValueFieldSizeOf + EntryChecksumFieldSizeOf
 	OffsetSizeOf              = 40
 	LoopSizeOf                = 64 - OffsetSizeOf
+
+	lanternVersion = "1.0.0"
 )
@@ -2,24 +2,36 @@ package lantern_cache
 
 import (
 	"encoding/binary"
+	"hash/crc32"
 )
 
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
 /*
 ┌───────────────────┐
 │   entry marshal   │
-├─────┬─────┬─────┬─┴───┬─────┐
-│  8  │  2  │  2  │  n  │  m  │
-│     │     │     │     │     │
-├─────┼─────┼─────┼─────┼─────┤
-│ ts  │ key │ val │ key │ val │
-│     │size │size │     │     │
-└─────┴─────┴─────┴─────┴─────┘
+├─────┬─────┬─────┬─┴───┬─────┬─────┐
+│  8  │  2  │  2  │  4  │  n  │  m  │
+│     │     │     │     │     │     │
+├─────┼─────┼─────┼─────┼─────┼─────┤
+│ ts  │ key │ val │ crc │ key │ val │
+│     │size │size │     │     │     │
+└─────┴─────┴─────┴─────┴─────┴─────┘
+crc是除crc字段外整个entry的CRC32C, 0表示没有计算
 */
 func wrapEntry(blob []byte, timestamp int64, key, val []byte) []byte {
 	size := EntryHeadFieldSizeOf + len(key) + len(val)
 	if blob == nil {
 		blob = make([]byte, size)
 	}
+	pos := wrapEntryHead(blob, timestamp, key, len(val))
+	copy(blob[pos:], val)
+	return blob
+}
+
+// wrapEntryHead 写入entry头和key, 返回val的起始位置, 调用方负责写入valSize字节的val
+func wrapEntryHead(blob []byte, timestamp int64, key []byte, valSize int) int {
+	size := EntryHeadFieldSizeOf + len(key) + valSize
 	ensure(cap(blob) >= size, "wrapEntry blob size need bigger than entry marshal")
 	pos := 0
 
@@ -29,29 +41,99 @@ func wrapEntry(blob []byte, timestamp int64, key, val []byte) []byte {
 	binary.LittleEndian.PutUint16(blob[pos:pos+EntryKeyFieldSizeOf], uint16(len(key)))
 	pos += EntryKeyFieldSizeOf
 
-	binary.LittleEndian.PutUint16(blob[pos:pos+EntryValueFieldSizeOf], uint16(len(val)))
+	binary.LittleEndian.PutUint16(blob[pos:pos+EntryValueFieldSizeOf], uint16(valSize))
 	pos += EntryValueFieldSizeOf
 
+	binary.LittleEndian.PutUint32(blob[pos:pos+EntryChecksumFieldSizeOf], 0)
+	pos += EntryChecksumFieldSizeOf
+
 	copy(blob[pos:], key)
 	pos += len(key)
+	return pos
+}
 
-	copy(blob[pos:], val)
-	pos += len(val)
-	return blob
+const entryChecksumPos = EntryTimeStampFieldSizeOf + EntryKeyFieldSizeOf + EntryValueFieldSizeOf
+
+func entryChecksum(entry []byte) uint32 {
+	sum := crc32.Update(0, castagnoliTable, entry[:entryChecksumPos])
+	sum = crc32.Update(sum, castagnoliTable, entry[EntryHeadFieldSizeOf:])
+	// 0表示没有计算, 算出来是0的时候换一个值
+	if sum == 0 {
+		sum = 0xffffffff
+	}
+	return sum
+}
+
+// wrapChecksum 在wrapEntry之后调用, entry是完整的entry
+func wrapChecksum(entry []byte) {
+	binary.LittleEndian.PutUint32(entry[entryChecksumPos:], entryChecksum(entry))
+}
+
+// verifyEntry checksum是写入时是否计算了checksum
+// entryChecksum不会返回0, 所以开启checksum时0说明checksum被改坏了, 只有没开启的时候0表示没有计算
+func verifyEntry(entry []byte, checksum bool) bool {
+	stored := binary.LittleEndian.Uint32(entry[entryChecksumPos:])
+	if stored == 0 {
+		return !checksum
+	}
+	return stored == entryChecksum(entry)
+}
+
+// entryAt 检查blob开头是不是一个完整的entry, 返回entry, 越界时返回false
+func entryAt(blob []byte) ([]byte, bool) {
+	if len(blob) < EntryHeadFieldSizeOf {
+		return nil, false
+	}
+	keySize := int(binary.LittleEndian.Uint16(blob[EntryTimeStampFieldSizeOf:]))
+	valueSize := int(binary.LittleEndian.Uint16(blob[EntryTimeStampFieldSizeOf+EntryKeyFieldSizeOf:]))
+	size := EntryHeadFieldSizeOf + keySize + valueSize
+	if keySize == 0 || size > len(blob) {
+		return nil, false
+	}
+	return blob[:size], true
+}
+
+// validEntry overhead是加密增加的value大小
+func validEntry(key, val []byte, overhead int) bool {
+	valSize := len(val) + overhead
+	entrySize := EntryHeadFieldSizeOf + len(key) + valSize
+	return len(key) > 0 && len(val) > 0 && len(key) <= MaxKeySize && valSize <= MaxValueSize && entrySize <= chunkSize
+}
+
+// wrapEndMark 在chunk剩余空间写入key size为0的头, 表示chunk中的entry到此结束
+func wrapEndMark(blob []byte) {
+	if len(blob) < EntryHeadFieldSizeOf {
+		return
+	}
+	for i := 0; i < EntryHeadFieldSizeOf; i++ {
+		blob[i] = 0
+	}
+}
+
+// walkEntries 从头遍历chunk中的entry, 遇到结束标记或者不完整的entry时停止
+func walkEntries(chunk []byte, fn func(pos int, entry []byte) bool) {
+	pos := 0
+	for {
+		entry, ok := entryAt(chunk[pos:])
+		if !ok || !fn(pos, entry) {
+			return
+		}
+		pos += len(entry)
+	}
 }
 
 // 返回位置正好是val部分的起始位置
 func readKey(blob []byte) []byte {
 	pos := EntryTimeStampFieldSizeOf
 	keySize := binary.LittleEndian.Uint16(blob[pos : pos+EntryKeyFieldSizeOf])
-	pos += EntryKeyFieldSizeOf + EntryValueFieldSizeOf
+	pos += EntryKeyFieldSizeOf + EntryValueFieldSizeOf + EntryChecksumFieldSizeOf
 	return blob[pos : pos+int(keySize)]
 }
 
 func readValue(blob []byte, keySize uint16) []byte {
 	pos := EntryTimeStampFieldSizeOf + EntryKeyFieldSizeOf
 	valueSize := binary.LittleEndian.Uint16(blob[pos : pos+EntryValueFieldSizeOf])
-	pos += EntryValueFieldSizeOf + int(keySize)
+	pos += EntryValueFieldSizeOf + EntryChecksumFieldSizeOf + int(keySize)
 	return blob[pos : pos+int(valueSize)]
 }
 
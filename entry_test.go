@@ -27,3 +27,31 @@ func TestWrap(t *testing.T) {
 		t.Fatalf("except:%s actual:%s", bytes2str(value1), bytes2str(val))
 	}
 }
+
+func TestWrapChecksum(t *testing.T) {
+	blob := wrapEntry(nil, 0, []byte("key1"), []byte("value1"))
+	// 没有开启checksum时0表示没有计算
+	if !verifyEntry(blob, false) {
+		t.Fatal("verify entry without checksum")
+	}
+	// 开启checksum时0说明checksum被改坏了
+	if verifyEntry(blob, true) {
+		t.Fatal("zero checksum accepted")
+	}
+	wrapChecksum(blob)
+	if !verifyEntry(blob, true) || !verifyEntry(blob, false) {
+		t.Fatal("verify entry with checksum")
+	}
+	blob[len(blob)-1] ^= 1
+	if verifyEntry(blob, true) {
+		t.Fatal("corrupt value not found")
+	}
+
+	entry, ok := entryAt(blob)
+	if !ok || len(entry) != len(blob) {
+		t.Fatal("entryAt")
+	}
+	if _, ok := entryAt(blob[:len(blob)-1]); ok {
+		t.Fatal("entryAt out of range")
+	}
+}
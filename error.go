@@ -2,13 +2,46 @@ package lantern_cache
 
 import "fmt"
 
+// ConfigError is returned by New, Resize and Rebucket when a field of Config is invalid, it wraps ErrorInvalidConfig.
+type ConfigError struct {
+	// Field is the name of the Config field.
+	Field  string
+	Value  interface{}
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config %s %v: %s", e.Field, e.Value, e.Reason)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return ErrorInvalidConfig
+}
+
+// SnapshotEncryptionError is returned by LoadSnapshot when only one of the snapshot and the cache
+// is encrypted, it wraps ErrorSnapshotEncryption.
+type SnapshotEncryptionError struct {
+	// Snapshot and Cache tell whether the snapshot and the cache are encrypted.
+	Snapshot bool
+	Cache    bool
+}
+
+func (e *SnapshotEncryptionError) Error() string {
+	return fmt.Sprintf("snapshot encrypted %v but cache encrypted %v", e.Snapshot, e.Cache)
+}
+
+func (e *SnapshotEncryptionError) Unwrap() error {
+	return ErrorSnapshotEncryption
+}
+
 var (
 	ErrorInValidStackType = fmt.Errorf("invalid slot stack type should be uint32")
 
 	ErrorInvalidEntry = fmt.Errorf("invalid entry")
 
 	// common
-	ErrorCopy = fmt.Errorf("invalid copy")
+	ErrorCopy          = fmt.Errorf("invalid copy")
+	ErrorInvalidConfig = fmt.Errorf("invalid config")
 
 	// chunk
 	ErrorChunkAlloc = fmt.Errorf("alloc chunk error")
@@ -16,10 +49,29 @@ var (
 	// bucket
 	ErrorEntryTooBig          = fmt.Errorf("value too big")
 	ErrorChunkIndexOutOfRange = fmt.Errorf("chunk index out of range")
+	// errBucketMoved key已经被Rebucket迁移到其它bucket, 不会返回给调用方, 重新找bucket后重试
+	errBucketMoved = fmt.Errorf("bucket moved")
 
 	// cache
-	ErrorNotFound    = fmt.Errorf("not found")
-	ErrorValueExpire = fmt.Errorf("value expire")
+	ErrorNotFound     = fmt.Errorf("not found")
+	ErrorValueExpire  = fmt.Errorf("value expire")
+	ErrorCorruptEntry = fmt.Errorf("corrupt entry")
+
+	// encryption
+	ErrorInvalidKey = fmt.Errorf("invalid encryption key")
+	ErrorUnknownKey = fmt.Errorf("unknown encryption key")
+	ErrorDecrypt    = fmt.Errorf("decrypt value failed")
+
+	// redis server
+	ErrorServerClosed = fmt.Errorf("server closed")
+
+	// snapshot
+	ErrorSnapshotFormat     = fmt.Errorf("invalid snapshot format")
+	ErrorSnapshotChecksum   = fmt.Errorf("snapshot checksum mismatch")
+	ErrorSnapshotEncryption = fmt.Errorf("snapshot encryption mismatch")
+
+	// txn
+	ErrorTxnConflict = fmt.Errorf("transaction conflict")
 
 	// slot
 	ErrorSlotDelete         = fmt.Errorf("")
@@ -0,0 +1,85 @@
+package lantern_cache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type EventType uint8
+
+const (
+	EventSet EventType = iota + 1
+	EventDel
+	EventExpired
+	EventEvicted
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventSet:
+		return "set"
+	case EventDel:
+		return "del"
+	case EventExpired:
+		return "expired"
+	case EventEvicted:
+		return "evicted"
+	}
+	return "unknown"
+}
+
+// Listener is invoked synchronously on every mutation of the cache while the bucket lock is held,
+// so it must be fast and must not call back into the cache.
+// key points into cache memory and is only valid during the call, it is nil when only the hash is known.
+type Listener func(event EventType, keyHash uint64, key []byte)
+
+// notifier 被所有bucket共享, 没有listener时emit只有一次原子读
+type notifier struct {
+	mutex     sync.Mutex
+	listeners atomic.Value // []*registeredListener
+}
+
+// registeredListener 用指针区分同一个函数的多次注册, 函数不能比较
+type registeredListener struct {
+	fn Listener
+}
+
+func newNotifier() *notifier {
+	ret := &notifier{}
+	ret.listeners.Store([]*registeredListener(nil))
+	return ret
+}
+
+// add 返回的函数删除这次注册的listener, 可以调用多次
+func (n *notifier) add(l Listener) func() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	r := &registeredListener{fn: l}
+	old := n.listeners.Load().([]*registeredListener)
+	listeners := make([]*registeredListener, len(old), len(old)+1)
+	copy(listeners, old)
+	n.listeners.Store(append(listeners, r))
+	return func() {
+		n.remove(r)
+	}
+}
+
+func (n *notifier) remove(r *registeredListener) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	old := n.listeners.Load().([]*registeredListener)
+	listeners := make([]*registeredListener, 0, len(old))
+	for _, l := range old {
+		if l != r {
+			listeners = append(listeners, l)
+		}
+	}
+	n.listeners.Store(listeners)
+}
+
+func (n *notifier) emit(event EventType, keyHash uint64, key []byte) {
+	listeners := n.listeners.Load().([]*registeredListener)
+	for i := range listeners {
+		listeners[i].fn(event, keyHash, key)
+	}
+}
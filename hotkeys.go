@@ -0,0 +1,249 @@
+package lantern_cache
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+热点key: 用Space-Saving算法统计采样到的访问, 只保存capacity个计数
+新key在计数满了时替换计数最小的key, 继承它的计数并记为误差, 真实的访问次数在count-err和count之间
+大key: 保存写入过的capacity个最大的entry, 满了以后小于最小值的写入只读一次原子变量就返回
+两个tracker都是整个cache共享一把锁, 热点key靠采样, 大key靠阈值减少加锁
+*/
+
+const defaultTrackedKeys = 128
+
+// HotKey is a frequently accessed key found by HotKeys.
+type HotKey struct {
+	Key []byte `json:"key"`
+	// Count estimates the gets and puts of the key, the sampled accesses multiplied by the sample rate.
+	// It overestimates by at most Error.
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// BigKey is a key with a large entry found by BigKeys.
+type BigKey struct {
+	Key []byte `json:"key"`
+	// Size is the bytes of the entry in the ring, header and key included.
+	Size int `json:"size"`
+}
+
+// countedKey 是heap的元素, heap按value排成小顶堆
+type countedKey struct {
+	key   string
+	value uint64
+	err   uint64
+	index int
+}
+
+type countedKeyHeap []*countedKey
+
+func (h countedKeyHeap) Len() int           { return len(h) }
+func (h countedKeyHeap) Less(i, j int) bool { return h[i].value < h[j].value }
+func (h countedKeyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *countedKeyHeap) Push(x interface{}) {
+	k := x.(*countedKey)
+	k.index = len(*h)
+	*h = append(*h, k)
+}
+
+func (h *countedKeyHeap) Pop() interface{} {
+	old := *h
+	k := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return k
+}
+
+// keyTracker 保存value最大的capacity个key
+type keyTracker struct {
+	capacity int
+	mutex    sync.Mutex
+	keys     map[string]*countedKey
+	heap     countedKeyHeap
+}
+
+func newKeyTracker(capacity int) *keyTracker {
+	return &keyTracker{capacity: capacity, keys: make(map[string]*countedKey, capacity)}
+}
+
+// incrLocked Space-Saving计数加一
+func (t *keyTracker) incrLocked(key []byte) {
+	if k, ok := t.keys[string(key)]; ok {
+		k.value++
+		heap.Fix(&t.heap, k.index)
+		return
+	}
+	if len(t.heap) < t.capacity {
+		t.addLocked(key, 1, 0)
+		return
+	}
+	min := t.heap[0]
+	delete(t.keys, min.key)
+	min.key = string(key)
+	min.err = min.value
+	min.value++
+	t.keys[min.key] = min
+	heap.Fix(&t.heap, 0)
+}
+
+// setLocked 记录key的value, 满了时替换value最小的key, 返回满了以后的最小value
+func (t *keyTracker) setLocked(key []byte, value uint64) uint64 {
+	if k, ok := t.keys[string(key)]; ok {
+		k.value = value
+		heap.Fix(&t.heap, k.index)
+	} else if len(t.heap) < t.capacity {
+		t.addLocked(key, value, 0)
+	} else if value > t.heap[0].value {
+		min := t.heap[0]
+		delete(t.keys, min.key)
+		min.key = string(key)
+		min.value = value
+		t.keys[min.key] = min
+		heap.Fix(&t.heap, 0)
+	}
+	if len(t.heap) < t.capacity {
+		return 0
+	}
+	return t.heap[0].value
+}
+
+func (t *keyTracker) addLocked(key []byte, value, err uint64) {
+	k := &countedKey{key: string(key), value: value, err: err}
+	t.keys[k.key] = k
+	heap.Push(&t.heap, k)
+}
+
+// top 按value从大到小返回所有key的拷贝
+func (t *keyTracker) top() []countedKey {
+	t.mutex.Lock()
+	ret := make([]countedKey, len(t.heap))
+	for i, k := range t.heap {
+		ret[i] = *k
+	}
+	t.mutex.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].value > ret[j].value
+	})
+	return ret
+}
+
+func (t *keyTracker) get(key []byte) (uint64, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if k, ok := t.keys[string(key)]; ok {
+		return k.value, true
+	}
+	return 0, false
+}
+
+func (t *keyTracker) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.keys = make(map[string]*countedKey, t.capacity)
+	t.heap = nil
+}
+
+// hotKeyTracker rate是0时不统计
+type hotKeyTracker struct {
+	rate uint64
+	*keyTracker
+}
+
+func newHotKeyTracker(rate uint32, capacity int) *hotKeyTracker {
+	return &hotKeyTracker{rate: uint64(rate), keyTracker: newKeyTracker(capacity)}
+}
+
+// sample n是bucket里这类操作的计数, 每rate次统计一次
+func (t *hotKeyTracker) sample(n uint64, key []byte) {
+	if t.rate == 0 || n%t.rate != 0 {
+		return
+	}
+	t.mutex.Lock()
+	t.incrLocked(key)
+	t.mutex.Unlock()
+}
+
+// freq 返回key估计的访问次数, 没有统计到时返回false
+func (t *hotKeyTracker) freq(key []byte) (uint64, bool) {
+	n, ok := t.get(key)
+	return n * t.rate, ok
+}
+
+// bigKeyTracker capacity是0时不统计
+type bigKeyTracker struct {
+	// min 满了以后最小的entry大小, 更小的entry不加锁
+	min uint64
+	*keyTracker
+}
+
+func newBigKeyTracker(capacity int) *bigKeyTracker {
+	return &bigKeyTracker{keyTracker: newKeyTracker(capacity)}
+}
+
+// observe 已经记录的key变小以后可能不会更新, BigKeys返回前会重新读entry的大小
+func (t *bigKeyTracker) observe(key []byte, size int) {
+	if t.capacity == 0 || uint64(size) < atomic.LoadUint64(&t.min) {
+		return
+	}
+	t.mutex.Lock()
+	atomic.StoreUint64(&t.min, t.setLocked(key, uint64(size)))
+	t.mutex.Unlock()
+}
+
+func (t *bigKeyTracker) reset() {
+	t.keyTracker.reset()
+	atomic.StoreUint64(&t.min, 0)
+}
+
+// HotKeys returns up to n of the most frequently accessed keys, most frequent first. It needs
+// Config.HotKeySampleRate, counts start at the creation of the cache or the last ResetStats.
+func (lc *LanternCache) HotKeys(n int) []HotKey {
+	top := lc.hotKeys.top()
+	if n >= 0 && n < len(top) {
+		top = top[:n]
+	}
+	ret := make([]HotKey, len(top))
+	for i := range top {
+		ret[i] = HotKey{Key: []byte(top[i].key), Count: top[i].value * lc.hotKeys.rate, Error: top[i].err * lc.hotKeys.rate}
+	}
+	return ret
+}
+
+// BigKeys returns up to n of the keys with the largest entries written, largest first. It needs
+// Config.TrackBigKeys. Keys deleted, expired or evicted since are left out.
+func (lc *LanternCache) BigKeys(n int) []BigKey {
+	top := lc.bigKeys.top()
+	ret := make([]BigKey, 0, len(top))
+	for i := range top {
+		key := []byte(top[i].key)
+		if size, err := lc.entrySize(key); err == nil {
+			ret = append(ret, BigKey{Key: key, Size: size})
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Size > ret[j].Size
+	})
+	if n >= 0 && n < len(ret) {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+// entrySize 返回key的entry在ring里占用的字节数, 不计入统计
+func (lc *LanternCache) entrySize(key []byte) (int, error) {
+	keyHash := lc.hash.Hash(key)
+	size, err := lc.bucketFor(keyHash).entrySize(keyHash, key)
+	for err == errBucketMoved {
+		size, err = lc.bucketFor(keyHash).entrySize(keyHash, key)
+	}
+	return size, err
+}
@@ -0,0 +1,78 @@
+package lantern_cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyTracker(t *testing.T) {
+	// 频繁的key不会被偶尔出现的key挤掉
+	tr := newHotKeyTracker(1, 8)
+	for i := 0; i < 1000; i++ {
+		tr.sample(1, []byte("hot"))
+		if i%2 == 0 {
+			tr.sample(1, []byte("warm"))
+		}
+		tr.sample(1, []byte(fmt.Sprintf("cold%d", i)))
+	}
+	top := tr.top()
+	assert.Equal(t, 8, len(top))
+	assert.Equal(t, "hot", top[0].key)
+	assert.Equal(t, "warm", top[1].key)
+	assert.True(t, top[0].value >= 1000 && top[0].value-top[0].err <= 1000, top[0])
+	n, ok := tr.freq([]byte("warm"))
+	assert.True(t, ok && n >= 500, n)
+
+	// 满了以后只保留最大的
+	big := newBigKeyTracker(2)
+	for i := 1; i <= 10; i++ {
+		big.observe([]byte(fmt.Sprintf("key%d", i)), i)
+	}
+	assert.Equal(t, uint64(9), big.min)
+	top = big.top()
+	assert.Equal(t, []string{"key10", "key9"}, []string{top[0].key, top[1].key})
+	big.reset()
+	assert.Equal(t, 0, len(big.top()))
+	assert.Equal(t, uint64(0), big.min)
+}
+
+func TestLanternCacheHotKeys(t *testing.T) {
+	ca := NewLanternCache(&Config{BucketCount: 4, MaxCapacity: 16 * chunkSize, HotKeySampleRate: 2, TrackBigKeys: true, TrackedKeys: 8})
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, ca.Put([]byte(fmt.Sprintf("key%d", i)), make([]byte, i+1)))
+	}
+	for i := 0; i < 1000; i++ {
+		_, _ = ca.Get([]byte("key7"))
+	}
+	hot := ca.HotKeys(1)
+	assert.Equal(t, 1, len(hot))
+	assert.Equal(t, "key7", string(hot[0].Key))
+	assert.True(t, hot[0].Count >= 1000, hot[0])
+
+	big := ca.BigKeys(3)
+	assert.Equal(t, []BigKey{
+		{Key: []byte("key99"), Size: EntryHeadFieldSizeOf + 5 + 100},
+		{Key: []byte("key98"), Size: EntryHeadFieldSizeOf + 5 + 99},
+		{Key: []byte("key97"), Size: EntryHeadFieldSizeOf + 5 + 98},
+	}, big)
+	// 删除的key不再返回
+	ca.Del([]byte("key99"))
+	assert.Equal(t, "key98", string(ca.BigKeys(1)[0].Key))
+
+	// key7所在的bucket的ops明显多于其它bucket
+	m := ca.Metrics()
+	assert.True(t, m.BucketOpsSkew > 2, m.BucketOpsSkew)
+	rec := httptest.NewRecorder()
+	ca.MetricsHandler(&MetricsOptions{PerBucket: true}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.True(t, strings.Contains(rec.Body.String(), fmt.Sprintf("lantern_bucket_ops_skew %g\n", m.BucketOpsSkew)))
+	assert.True(t, strings.Contains(rec.Body.String(), `lantern_bucket_ops_total{bucket="3"}`))
+
+	ca.ResetStats()
+	assert.Equal(t, 0, len(ca.HotKeys(10)))
+	assert.Equal(t, 0, len(ca.BigKeys(10)))
+}
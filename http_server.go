@@ -0,0 +1,464 @@
+package lantern_cache
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHTTPMaxBodySize = 32 * 1024 * 1024
+	defaultHTTPScanCount   = 100
+
+	httpTTLHeader  = "X-TTL"
+	httpBinaryType = "application/octet-stream"
+	httpJSONType   = "application/json"
+)
+
+// HTTPServerOptions configures a HTTPServer, the zero value serves plain HTTP without timeouts.
+type HTTPServerOptions struct {
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// MaxBodySize limits the request body of /mget and /mset, 32MB by default.
+	MaxBodySize int64
+	// Metrics configures /metrics.
+	Metrics *MetricsOptions
+
+	// Logger logs the errors of http.Server, such as a panicking handler or a failed accept,
+	// DefaultLogger() when nil.
+	Logger Logger
+}
+
+func (o *HTTPServerOptions) init() {
+	if o.MaxBodySize <= 0 {
+		o.MaxBodySize = defaultHTTPMaxBodySize
+	}
+	if o.Logger == nil {
+		o.Logger = DefaultLogger()
+	}
+}
+
+// HTTPServer serves LanternCache over HTTP:
+//
+//	GET/HEAD/PUT/DELETE /keys/{key}   ttl in seconds via the X-TTL header or the ttl query
+//	POST /mget, POST /mset            JSON or application/octet-stream bodies
+//	GET /scan?cursor=0&count=100      cursor based scan
+//	GET /stats, GET /healthz
+//	GET /metrics                      Prometheus text format
+//	GET /debug/vars                   expvar, see LanternCache.PublishExpvar
+//
+// GET and HEAD return an ETag derived from the value hash and honor If-None-Match.
+// /mset stores all entries or none of them, like LanternCache.MultiPut.
+type HTTPServer struct {
+	addr   string
+	cache  *LanternCache
+	opts   HTTPServerOptions
+	mux    *http.ServeMux
+	server *http.Server
+
+	requests uint64
+}
+
+func NewHTTPServer(addr string, cache *LanternCache, opts *HTTPServerOptions) *HTTPServer {
+	if opts == nil {
+		opts = &HTTPServerOptions{}
+	}
+	ret := &HTTPServer{
+		addr:  addr,
+		cache: cache,
+		opts:  *opts,
+		mux:   http.NewServeMux(),
+	}
+	ret.opts.init()
+	ret.mux.HandleFunc("/keys/", ret.handleKey)
+	ret.mux.HandleFunc("/mget", ret.handleMGet)
+	ret.mux.HandleFunc("/mset", ret.handleMSet)
+	ret.mux.HandleFunc("/scan", ret.handleScan)
+	ret.mux.HandleFunc("/stats", ret.handleStats)
+	ret.mux.HandleFunc("/healthz", ret.handleHealthz)
+	ret.mux.Handle("/metrics", cache.MetricsHandler(opts.Metrics))
+	ret.mux.Handle("/debug/vars", expvar.Handler())
+	ret.server = &http.Server{
+		Addr:         addr,
+		Handler:      ret,
+		ReadTimeout:  ret.opts.ReadTimeout,
+		WriteTimeout: ret.opts.WriteTimeout,
+		IdleTimeout:  ret.opts.IdleTimeout,
+		ErrorLog:     stdLogger(ret.opts.Logger),
+	}
+	return ret
+}
+
+func (h *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&h.requests, 1)
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *HTTPServer) ListenAndServe() error {
+	return h.ignoreClosed(h.server.ListenAndServe())
+}
+
+// Serve serves clients on ln until Shutdown or Close
+func (h *HTTPServer) Serve(ln net.Listener) error {
+	return h.ignoreClosed(h.server.Serve(ln))
+}
+
+// Shutdown stops accepting clients and waits for requests in progress to finish
+func (h *HTTPServer) Shutdown(ctx context.Context) error {
+	return h.server.Shutdown(ctx)
+}
+
+// Close stops the server and closes all clients immediately
+func (h *HTTPServer) Close() error {
+	return h.server.Close()
+}
+
+// ignoreClosed 和RedisServer保持一致, 被Shutdown或Close停止时返回nil
+func (h *HTTPServer) ignoreClosed(err error) error {
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func httpError(w http.ResponseWriter, code int, msg string) {
+	http.Error(w, msg, code)
+}
+
+func httpJSON(w http.ResponseWriter, v interface{}) {
+	httpJSONStatus(w, http.StatusOK, v)
+}
+
+// httpJSONStatus header要在WriteHeader之前设置
+func httpJSONStatus(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", httpJSONType)
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// httpPutStatus 是写入失败的状态码, 只有entry太大或者key/value为空是客户端的问题
+func httpPutStatus(err error) int {
+	switch err {
+	case ErrorInvalidEntry, ErrorEntryTooBig:
+		return http.StatusRequestEntityTooLarge
+	case ErrorChunkAlloc:
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// etag 用value的hash生成
+func (h *HTTPServer) etag(value []byte) string {
+	return `"` + strconv.FormatUint(h.cache.hash.Hash(value), 16) + `"`
+}
+
+// ttl 从X-TTL header或者ttl参数读取过期秒数, 0表示不过期
+func httpTTL(r *http.Request) (int64, error) {
+	s := r.Header.Get(httpTTLHeader)
+	if q := r.URL.Query().Get("ttl"); q != "" {
+		s = q
+	}
+	if s == "" {
+		return 0, nil
+	}
+	ttl, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("invalid ttl %s", s)
+	}
+	return ttl, nil
+}
+
+func (h *HTTPServer) put(key, value []byte, ttl int64) error {
+	if ttl > 0 {
+		return h.cache.PutWithExpire(key, value, ttl)
+	}
+	return h.cache.Put(key, value)
+}
+
+func (h *HTTPServer) handleKey(w http.ResponseWriter, r *http.Request) {
+	// key里可能有转义的'/', 从EscapedPath中取
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/keys/"))
+	if err != nil || key == "" {
+		httpError(w, http.StatusBadRequest, "invalid key")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		value, expire, err := h.cache.getWithExpire([]byte(key))
+		if err != nil {
+			httpError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		etag := h.etag(value)
+		w.Header().Set("ETag", etag)
+		if expire > 0 {
+			w.Header().Set(httpTTLHeader, strconv.FormatInt(expire-time.Now().Unix(), 10))
+		}
+		if match := r.Header.Get("If-None-Match"); match != "" && (match == etag || match == "*") {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", httpBinaryType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(value)
+		}
+	case http.MethodPut:
+		ttl, err := httpTTL(r)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxValueSize))
+		if err != nil {
+			httpError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		if err := h.put([]byte(key), value, ttl); err != nil {
+			httpError(w, httpPutStatus(err), err.Error())
+			return
+		}
+		w.Header().Set("ETag", h.etag(value))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		h.cache.Del([]byte(key))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+type httpMGetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// httpMGetResponse 不存在的key对应null
+type httpMGetResponse struct {
+	Values []*string `json:"values"`
+}
+
+type httpMSetEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl,omitempty"`
+}
+
+type httpMSetRequest struct {
+	Entries []httpMSetEntry `json:"entries"`
+}
+
+type httpMSetResponse struct {
+	Stored int    `json:"stored"`
+	Error  string `json:"error,omitempty"`
+}
+
+func httpBinary(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), httpBinaryType)
+}
+
+/*
+binary bodies, every length is a big endian uint32
+┌───────────────────────────────────────────────────────────┐
+│ mget request:  (key len, key)*                            │
+│ mget response: (value len, value)*  0xffffffff: missing   │
+│ mset request:  (key len, key, value len, value)*          │
+└───────────────────────────────────────────────────────────┘
+*/
+func readBinaryField(rd io.Reader) ([]byte, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(rd, n[:]); err != nil {
+		return nil, err
+	}
+	// 长度来自请求, 先检查再分配, 超过一个entry能放下的大小的字段不会被接受
+	size := binary.BigEndian.Uint32(n[:])
+	if size > MaxValueSize {
+		return nil, ErrorEntryTooBig
+	}
+	ret := make([]byte, size)
+	if _, err := io.ReadFull(rd, ret); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return ret, nil
+}
+
+func (h *HTTPServer) handleMGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, h.opts.MaxBodySize)
+
+	if httpBinary(r) {
+		w.Header().Set("Content-Type", httpBinaryType)
+		var n [4]byte
+		for {
+			key, err := readBinaryField(body)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				httpError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			value, err := h.cache.Get(key)
+			if err != nil {
+				binary.BigEndian.PutUint32(n[:], 0xffffffff)
+				_, _ = w.Write(n[:])
+				continue
+			}
+			binary.BigEndian.PutUint32(n[:], uint32(len(value)))
+			_, _ = w.Write(n[:])
+			_, _ = w.Write(value)
+		}
+	}
+
+	var req httpMGetRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp := httpMGetResponse{Values: make([]*string, len(req.Keys))}
+	for i := range req.Keys {
+		if value, err := h.cache.Get([]byte(req.Keys[i])); err == nil {
+			s := string(value)
+			resp.Values[i] = &s
+		}
+	}
+	httpJSON(w, &resp)
+}
+
+func (h *HTTPServer) handleMSet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	// 二进制格式的ttl对所有key生效, JSON可以单独指定
+	ttl, err := httpTTL(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, h.opts.MaxBodySize)
+
+	var entries []httpMSetEntry
+	if httpBinary(r) {
+		for {
+			key, err := readBinaryField(body)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				httpError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			value, err := readBinaryField(body)
+			if err != nil {
+				httpError(w, http.StatusBadRequest, "missing value")
+				return
+			}
+			entries = append(entries, httpMSetEntry{Key: string(key), Value: string(value), TTL: ttl})
+		}
+	} else {
+		var req httpMSetRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		entries = req.Entries
+		for i := range entries {
+			if entries[i].TTL == 0 {
+				entries[i].TTL = ttl
+			}
+		}
+	}
+
+	// MultiPut要么全部写入要么什么都不写
+	batch := make([]Entry, len(entries))
+	for i := range entries {
+		batch[i] = Entry{Key: []byte(entries[i].Key), Value: []byte(entries[i].Value)}
+		// 和put一样, ttl不是正数时不过期
+		if entries[i].TTL > 0 {
+			batch[i].Expire = entries[i].TTL
+		}
+	}
+	if err := h.cache.MultiPut(batch); err != nil {
+		httpJSONStatus(w, httpPutStatus(err), &httpMSetResponse{Error: err.Error()})
+		return
+	}
+	httpJSON(w, &httpMSetResponse{Stored: len(batch)})
+}
+
+type httpScanResponse struct {
+	// Cursor 是字符串, uint64在JavaScript里会丢精度
+	Cursor string   `json:"cursor"`
+	Keys   []string `json:"keys"`
+}
+
+func (h *HTTPServer) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	cursor := uint64(0)
+	if s := query.Get("cursor"); s != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(s, 10, 64); err != nil {
+			httpError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+	count := defaultHTTPScanCount
+	if s := query.Get("count"); s != "" {
+		var err error
+		if count, err = strconv.Atoi(s); err != nil || count <= 0 {
+			httpError(w, http.StatusBadRequest, "invalid count")
+			return
+		}
+	}
+	keys, next := h.cache.ScanCursor(cursor, count)
+	resp := httpScanResponse{Cursor: strconv.FormatUint(next, 10), Keys: make([]string, len(keys))}
+	for i := range keys {
+		resp.Keys[i] = string(keys[i])
+	}
+	httpJSON(w, &resp)
+}
+
+type httpStatsResponse struct {
+	Stats    StatsSnapshot `json:"stats"`
+	Size     uint64        `json:"size"`
+	Requests uint64        `json:"requests"`
+	Buckets  []BucketStats `json:"buckets"`
+}
+
+func (h *HTTPServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	httpJSON(w, &httpStatsResponse{
+		Stats:    *h.cache.StatsSnapshot(),
+		Size:     h.cache.Size(),
+		Requests: atomic.LoadUint64(&h.requests),
+		Buckets:  h.cache.BucketStats(),
+	})
+}
+
+func (h *HTTPServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = io.WriteString(w, "ok\n")
+}
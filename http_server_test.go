@@ -0,0 +1,250 @@
+package lantern_cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHTTPServer(t *testing.T) (*LanternCache, *httptest.Server) {
+	ca := NewLanternCache(&Config{
+		BucketCount: 16,
+		MaxCapacity: 1024 * 1024 * 10,
+	})
+	server := NewHTTPServer("", ca, &HTTPServerOptions{Logger: NoneLogger()})
+	return ca, httptest.NewServer(server)
+}
+
+func httpDo(t *testing.T, method, url string, header map[string]string, body []byte) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	assert.Nil(t, err)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return resp, data
+}
+
+func TestHTTPServerKeys(t *testing.T) {
+	ca, ts := newTestHTTPServer(t)
+	defer ts.Close()
+
+	resp, _ := httpDo(t, http.MethodGet, ts.URL+"/keys/foo", nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = httpDo(t, http.MethodHead, ts.URL+"/keys/foo", nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = httpDo(t, http.MethodPut, ts.URL+"/keys/foo", nil, []byte("bar"))
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, data := httpDo(t, http.MethodGet, ts.URL+"/keys/foo", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "bar", string(data))
+	assert.Equal(t, "", resp.Header.Get(httpTTLHeader))
+	etag := resp.Header.Get("ETag")
+	assert.NotEqual(t, "", etag)
+
+	resp, data = httpDo(t, http.MethodGet, ts.URL+"/keys/foo", map[string]string{"If-None-Match": etag}, nil)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Equal(t, 0, len(data))
+	resp, _ = httpDo(t, http.MethodHead, ts.URL+"/keys/foo", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	// 修改后etag变化
+	resp, _ = httpDo(t, http.MethodPut, ts.URL+"/keys/foo?ttl=100", nil, []byte("baz"))
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, data = httpDo(t, http.MethodGet, ts.URL+"/keys/foo", map[string]string{"If-None-Match": etag}, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "baz", string(data))
+	ttl, err := strconv.Atoi(resp.Header.Get(httpTTLHeader))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 90 && ttl <= 100)
+
+	resp, _ = httpDo(t, http.MethodPut, ts.URL+"/keys/a%2Fb", map[string]string{httpTTLHeader: "50"}, []byte("slash"))
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	v, err := ca.Get([]byte("a/b"))
+	assert.Nil(t, err)
+	assert.Equal(t, "slash", string(v))
+
+	resp, _ = httpDo(t, http.MethodPut, ts.URL+"/keys/foo?ttl=abc", nil, []byte("bar"))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = httpDo(t, http.MethodPut, ts.URL+"/keys/big", nil, make([]byte, MaxValueSize+1))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	resp, _ = httpDo(t, http.MethodPost, ts.URL+"/keys/foo", nil, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, _ = httpDo(t, http.MethodDelete, ts.URL+"/keys/foo", nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	_, err = ca.Get([]byte("foo"))
+	assert.Equal(t, ErrorNotFound, err)
+}
+
+func TestHTTPServerBatch(t *testing.T) {
+	_, ts := newTestHTTPServer(t)
+	defer ts.Close()
+
+	resp, data := httpDo(t, http.MethodPost, ts.URL+"/mset", nil,
+		[]byte(`{"entries":[{"key":"a","value":"1"},{"key":"b","value":"2","ttl":100}]}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"stored":2}`, strings.TrimSpace(string(data)))
+
+	resp, data = httpDo(t, http.MethodPost, ts.URL+"/mget", nil, []byte(`{"keys":["a","b","c"]}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"values":["1","2",null]}`, strings.TrimSpace(string(data)))
+
+	field := func(buf *bytes.Buffer, s string) {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(s)))
+		buf.Write(n[:])
+		buf.WriteString(s)
+	}
+	binaryType := map[string]string{"Content-Type": httpBinaryType}
+
+	body := &bytes.Buffer{}
+	field(body, "c")
+	field(body, "3")
+	field(body, "d")
+	field(body, "")
+	resp, data = httpDo(t, http.MethodPost, ts.URL+"/mset", binaryType, body.Bytes())
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal(t, httpJSONType, resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"stored":0,"error":"invalid entry"}`, strings.TrimSpace(string(data)))
+
+	// 一个entry失败时前面的也不写入
+	body.Reset()
+	field(body, "a")
+	field(body, "c")
+	field(body, "x")
+	resp, data = httpDo(t, http.MethodPost, ts.URL+"/mget", binaryType, body.Bytes())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []byte{0, 0, 0, 1, '1', 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, data)
+
+	body.Reset()
+	field(body, "c")
+	field(body, "3")
+	resp, data = httpDo(t, http.MethodPost, ts.URL+"/mset", binaryType, body.Bytes())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"stored":1}`, strings.TrimSpace(string(data)))
+
+	resp, _ = httpDo(t, http.MethodPost, ts.URL+"/mget", binaryType, []byte{0, 0, 0, 5, 'a'})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	// 长度超过MaxValueSize时不分配内存
+	resp, data = httpDo(t, http.MethodPost, ts.URL+"/mset", binaryType, []byte{0xff, 0xff, 0xff, 0xfe, 'a'})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(data), ErrorEntryTooBig.Error())
+	resp, _ = httpDo(t, http.MethodGet, ts.URL+"/mget", nil, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	{
+		// 分配不到chunk不是请求太大
+		ca, err := New(&Config{}, WithBuckets(1), WithMaxCapacity(4*chunkSize), WithInitCapacity(chunkSize))
+		assert.Nil(t, err)
+		ts := httptest.NewServer(NewHTTPServer("", ca, &HTTPServerOptions{Logger: NoneLogger()}))
+		defer ts.Close()
+		assert.Nil(t, ca.Put([]byte("a"), []byte("1")))
+		restore := failChunkAlloc(ca)
+		defer restore()
+		value := strings.Repeat("v", chunkSize/2)
+		resp, data := httpDo(t, http.MethodPost, ts.URL+"/mset", nil,
+			[]byte(`{"entries":[{"key":"a","value":"`+value+`"},{"key":"b","value":"`+value+`"}]}`))
+		assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+		assert.Equal(t, `{"stored":0,"error":"alloc chunk error"}`, strings.TrimSpace(string(data)))
+		actual, err := ca.Get([]byte("a"))
+		assert.Nil(t, err)
+		assert.Equal(t, "1", string(actual))
+	}
+}
+
+func TestHTTPServerScanStats(t *testing.T) {
+	ca, ts := newTestHTTPServer(t)
+	defer ts.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, ca.Put([]byte("key"+strconv.Itoa(i)), []byte("value")))
+	}
+
+	keys := map[string]bool{}
+	cursor := "0"
+	for {
+		resp, data := httpDo(t, http.MethodGet, ts.URL+"/scan?count=7&cursor="+cursor, nil, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var ret httpScanResponse
+		assert.Nil(t, json.Unmarshal(data, &ret))
+		assert.True(t, len(ret.Keys) <= 7)
+		for _, k := range ret.Keys {
+			assert.False(t, keys[k])
+			keys[k] = true
+		}
+		cursor = ret.Cursor
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Equal(t, 100, len(keys))
+
+	resp, _ := httpDo(t, http.MethodGet, ts.URL+"/scan?cursor=-1", nil, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	_, _ = ca.Get([]byte("key1"))
+	resp, data := httpDo(t, http.MethodGet, ts.URL+"/stats", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var stats httpStatsResponse
+	assert.Nil(t, json.Unmarshal(data, &stats))
+	assert.Equal(t, uint64(100), stats.Stats.Puts)
+	assert.Equal(t, uint64(1), stats.Stats.Hits)
+	assert.Equal(t, uint64(100), stats.Size)
+	assert.Equal(t, 16, len(stats.Buckets))
+	total := uint64(0)
+	for _, b := range stats.Buckets {
+		total += b.Keys
+	}
+	assert.Equal(t, uint64(100), total)
+
+	resp, data = httpDo(t, http.MethodGet, ts.URL+"/metrics", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.Contains(string(data), "lantern_puts_total 100\n"))
+
+	resp, data = httpDo(t, http.MethodGet, ts.URL+"/healthz", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok\n", string(data))
+}
+
+func TestHTTPServerErrorLog(t *testing.T) {
+	ca := NewLanternCache(&Config{
+		BucketCount: 16,
+		MaxCapacity: 1024 * 1024 * 10,
+	})
+	out := &recordLogger{}
+	server := NewHTTPServer("", ca, &HTTPServerOptions{Logger: out})
+	server.mux.HandleFunc("/panic", func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	defer server.Close()
+
+	// panic记录日志之后才关闭连接
+	_, err = http.Get("http://" + ln.Addr().String() + "/panic")
+	assert.NotNil(t, err)
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	assert.Equal(t, 1, len(out.lines))
+	assert.True(t, strings.HasPrefix(out.lines[0], "http: panic serving"), out.lines)
+	assert.Contains(t, out.lines[0], "boom")
+}
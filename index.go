@@ -0,0 +1,180 @@
+package lantern_cache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// bucketIndex 是bucket的索引, keyHash -> 索引值(loop<<40|offset), 一个keyHash可以有多个索引值
+// 一个keyHash对应哪个key要读出entry里的key比较, 这由bucket负责, 调用方需要持有bucket的锁
+type bucketIndex interface {
+	// get 返回keyHash的第i个索引值, 没有时返回false, 从0开始依次调用可以遍历keyHash的所有索引值
+	// 这里不用回调, 调用接口方法时闭包会逃逸到堆上, 读路径上不能有内存分配
+	get(keyHash uint64, i int) (uint64, bool)
+	add(keyHash, v uint64)
+	// replace 把keyHash的索引值old换成v, old不存在时返回false
+	replace(keyHash, old, v uint64) bool
+	// remove 删除keyHash的索引值v, v不存在时返回false
+	remove(keyHash, v uint64) bool
+	// rangeAll 对所有索引值调用fn, fn返回false时停止, fn里不能修改索引
+	rangeAll(fn func(keyHash, v uint64) bool)
+	len() int
+	// bytes 估算索引占用的内存
+	bytes() uint64
+	clone() bucketIndex
+	reset()
+}
+
+func newBucketIndex(policy string) bucketIndex {
+	switch strings.ToLower(policy) {
+	case "", "map":
+		return newMapIndex()
+	case "flat":
+		return newFlatIndex()
+	default:
+		panic(fmt.Errorf("index can't support policy %s", policy))
+	}
+}
+
+/*
+mapIndex 用map实现bucketIndex
+不同的key算出相同的keyHash时, 第一个key放在m里, 后面的key放到overflow里
+m里没有指针, GC不需要扫描它, overflow只保存冲突的key, 通常是空的
+*/
+type mapIndex struct {
+	m        map[uint64]uint64
+	overflow map[uint64][]uint64
+	// overflowLen 是overflow里索引值的总数
+	overflowLen int
+}
+
+func newMapIndex() *mapIndex {
+	return &mapIndex{
+		m:        make(map[uint64]uint64),
+		overflow: make(map[uint64][]uint64),
+	}
+}
+
+// get 第0个在m里, 后面的在overflow里
+func (x *mapIndex) get(keyHash uint64, i int) (uint64, bool) {
+	if i == 0 {
+		v, ok := x.m[keyHash]
+		return v, ok
+	}
+	list := x.overflow[keyHash]
+	if i > len(list) {
+		return 0, false
+	}
+	return list[i-1], true
+}
+
+func (x *mapIndex) add(keyHash, v uint64) {
+	if _, ok := x.m[keyHash]; !ok {
+		x.m[keyHash] = v
+		return
+	}
+	x.overflow[keyHash] = append(x.overflow[keyHash], v)
+	x.overflowLen++
+}
+
+func (x *mapIndex) replace(keyHash, old, v uint64) bool {
+	if cur, ok := x.m[keyHash]; !ok {
+		return false
+	} else if cur == old {
+		x.m[keyHash] = v
+		return true
+	}
+	list := x.overflow[keyHash]
+	for i := range list {
+		if list[i] == old {
+			list[i] = v
+			return true
+		}
+	}
+	return false
+}
+
+// remove m里的被删除时从overflow里补一个上来
+func (x *mapIndex) remove(keyHash, v uint64) bool {
+	cur, ok := x.m[keyHash]
+	if !ok {
+		return false
+	}
+	list := x.overflow[keyHash]
+	i := -1
+	if cur != v {
+		for j := range list {
+			if list[j] == v {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return false
+		}
+	}
+	if len(list) == 0 {
+		delete(x.m, keyHash)
+		return true
+	}
+	last := list[len(list)-1]
+	if i < 0 {
+		x.m[keyHash] = last
+	} else {
+		list[i] = last
+	}
+	if len(list) == 1 {
+		delete(x.overflow, keyHash)
+	} else {
+		x.overflow[keyHash] = list[:len(list)-1]
+	}
+	x.overflowLen--
+	return true
+}
+
+func (x *mapIndex) rangeAll(fn func(keyHash, v uint64) bool) {
+	for k, v := range x.m {
+		if !fn(k, v) {
+			return
+		}
+	}
+	for k, list := range x.overflow {
+		for _, v := range list {
+			if !fn(k, v) {
+				return
+			}
+		}
+	}
+}
+
+func (x *mapIndex) len() int {
+	return len(x.m) + x.overflowLen
+}
+
+// bytes map的每一项按16字节算
+func (x *mapIndex) bytes() uint64 {
+	return uint64(len(x.m)*16 + len(x.overflow)*32 + x.overflowLen*8)
+}
+
+func (x *mapIndex) clone() bucketIndex {
+	ret := &mapIndex{
+		m:           make(map[uint64]uint64, len(x.m)),
+		overflow:    make(map[uint64][]uint64, len(x.overflow)),
+		overflowLen: x.overflowLen,
+	}
+	for k, v := range x.m {
+		ret.m[k] = v
+	}
+	for k, list := range x.overflow {
+		ret.overflow[k] = append([]uint64(nil), list...)
+	}
+	return ret
+}
+
+func (x *mapIndex) reset() {
+	for k := range x.m {
+		delete(x.m, k)
+	}
+	x.overflow = make(map[uint64][]uint64)
+	x.overflowLen = 0
+}
@@ -0,0 +1,292 @@
+package lantern_cache
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+/*
+flatIndex 是开放寻址(Robin Hood)的bucket索引, 所有数据在一个[]uint64里, 没有指针, GC不需要扫描
+┌────────────────────────────────────────────┐
+│                  slots                     │
+├──────────┬──────────┬──────────┬──────────┬┘
+│ keyHash  │ value+1  │ keyHash  │ value+1  │ ...
+└──────────┴──────────┴──────────┴──────────┘
+value+1为0表示空slot, 索引值本身可以是0
+同一个bucket里keyHash的低位都相同, 所以用keyHash乘一个奇数后的高位决定起始位置
+keyHash相同的key在同一段连续的slot里, 不需要额外的冲突链
+
+负载超过7/8时扩容为2倍, 低于1/8时缩小一半, 新表建好后每次写操作迁移一部分旧表的slot,
+迁移完成之前查找要看两张表, 不会在一次写入里rehash整个表
+
+表的slots创建后不再替换, 换表时原子地替换表指针, 乐观读不加锁也不会读到一半的slice头,
+探测次数不超过表的容量, 和写入同时进行时读到的结果可能是错的, 但不会越界也不会死循环
+*/
+const (
+	flatMinCapacity  = 64
+	flatMigrateStep  = 64
+	flatFibonacciMul = 0x9E3779B97F4A7C15
+)
+
+type flatTable struct {
+	slots []uint64
+	mask  uint64
+	shift uint
+	count int
+}
+
+func newFlatTable(capacity int) *flatTable {
+	shift := uint(64)
+	for c := capacity; c > 1; c >>= 1 {
+		shift--
+	}
+	return &flatTable{
+		slots: make([]uint64, 2*capacity),
+		mask:  uint64(capacity) - 1,
+		shift: shift,
+	}
+}
+
+func (t *flatTable) capacity() int {
+	return int(t.mask) + 1
+}
+
+func (t *flatTable) home(keyHash uint64) uint64 {
+	return (keyHash * flatFibonacciMul) >> t.shift
+}
+
+func (t *flatTable) empty(pos uint64) bool {
+	return t.slots[2*pos+1] == 0
+}
+
+// distance slot里的元素离它起始位置的距离
+func (t *flatTable) distance(pos uint64) uint64 {
+	return (pos - t.home(t.slots[2*pos])) & t.mask
+}
+
+func (t *flatTable) insert(keyHash, v uint64) {
+	stored := v + 1
+	pos, dist := t.home(keyHash), uint64(0)
+	for {
+		if t.empty(pos) {
+			t.slots[2*pos], t.slots[2*pos+1] = keyHash, stored
+			t.count++
+			return
+		}
+		// 比当前元素离起始位置更近的让位置, 继续给被换出来的元素找位置
+		if d := t.distance(pos); d < dist {
+			t.slots[2*pos], keyHash = keyHash, t.slots[2*pos]
+			t.slots[2*pos+1], stored = stored, t.slots[2*pos+1]
+			dist = d
+		}
+		pos = (pos + 1) & t.mask
+		dist++
+	}
+}
+
+// get 返回keyHash的第i个索引值, 没有时返回keyHash在表里的索引值个数
+func (t *flatTable) get(keyHash uint64, i int) (uint64, int, bool) {
+	pos, dist, n := t.home(keyHash), uint64(0), 0
+	for dist <= t.mask && !t.empty(pos) && t.distance(pos) >= dist {
+		if t.slots[2*pos] == keyHash {
+			if n == i {
+				return t.slots[2*pos+1] - 1, n, true
+			}
+			n++
+		}
+		pos = (pos + 1) & t.mask
+		dist++
+	}
+	return 0, n, false
+}
+
+// find 返回索引值v所在的slot
+func (t *flatTable) find(keyHash, v uint64) (uint64, bool) {
+	pos, dist := t.home(keyHash), uint64(0)
+	for !t.empty(pos) && t.distance(pos) >= dist {
+		if t.slots[2*pos] == keyHash && t.slots[2*pos+1] == v+1 {
+			return pos, true
+		}
+		pos = (pos + 1) & t.mask
+		dist++
+	}
+	return 0, false
+}
+
+// deleteAt 删除slot后把后面的元素往前移, 不需要墓碑
+func (t *flatTable) deleteAt(pos uint64) {
+	for {
+		next := (pos + 1) & t.mask
+		if t.empty(next) || t.distance(next) == 0 {
+			t.slots[2*pos], t.slots[2*pos+1] = 0, 0
+			break
+		}
+		t.slots[2*pos], t.slots[2*pos+1] = t.slots[2*next], t.slots[2*next+1]
+		pos = next
+	}
+	t.count--
+}
+
+func (t *flatTable) rangeAll(fn func(keyHash, v uint64) bool) bool {
+	for pos := uint64(0); pos <= t.mask; pos++ {
+		if !t.empty(pos) && !fn(t.slots[2*pos], t.slots[2*pos+1]-1) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *flatTable) clone() *flatTable {
+	ret := *t
+	ret.slots = append([]uint64(nil), t.slots...)
+	return &ret
+}
+
+type flatIndex struct {
+	cur *flatTable
+	// old 是迁移中的旧表, nil表示没有在调整大小
+	old *flatTable
+	// migrated 是old里下一个要迁移的slot, 它前面的slot都已经是空的
+	migrated uint64
+}
+
+func newFlatIndex() *flatIndex {
+	return &flatIndex{cur: newFlatTable(flatMinCapacity)}
+}
+
+// get 先old后cur, 迁移中keyHash的索引值可能分在两张表里
+func (x *flatIndex) get(keyHash uint64, i int) (uint64, bool) {
+	return getFromTables(x.old, x.cur, keyHash, i)
+}
+
+// getShared 和get一样, 不持有bucket的锁时调用, 结果需要调用方校验
+func (x *flatIndex) getShared(keyHash uint64, i int) (uint64, bool) {
+	return getFromTables(loadFlatTable(&x.old), loadFlatTable(&x.cur), keyHash, i)
+}
+
+func getFromTables(old, cur *flatTable, keyHash uint64, i int) (uint64, bool) {
+	if old != nil {
+		v, n, ok := old.get(keyHash, i)
+		if ok {
+			return v, true
+		}
+		i -= n
+	}
+	v, _, ok := cur.get(keyHash, i)
+	return v, ok
+}
+
+func loadFlatTable(p **flatTable) *flatTable {
+	return (*flatTable)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(p))))
+}
+
+func storeFlatTable(p **flatTable, t *flatTable) {
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(p)), unsafe.Pointer(t))
+}
+
+func (x *flatIndex) add(keyHash, v uint64) {
+	x.migrate(flatMigrateStep)
+	if x.cur.count+1 > x.cur.capacity()/8*7 {
+		// 迁移还没完成新表就满了, 先一次迁移完
+		if x.old != nil {
+			x.migrate(x.old.capacity() + x.old.count)
+		}
+		x.resize(x.cur.capacity() * 2)
+	}
+	x.cur.insert(keyHash, v)
+}
+
+func (x *flatIndex) replace(keyHash, old, v uint64) bool {
+	t, pos, ok := x.find(keyHash, old)
+	if ok {
+		t.slots[2*pos+1] = v + 1
+	}
+	return ok
+}
+
+func (x *flatIndex) remove(keyHash, v uint64) bool {
+	t, pos, ok := x.find(keyHash, v)
+	if !ok {
+		return false
+	}
+	t.deleteAt(pos)
+	x.migrate(flatMigrateStep)
+	if x.old == nil && x.cur.capacity() > flatMinCapacity && x.cur.count < x.cur.capacity()/8 {
+		x.resize(x.cur.capacity() / 2)
+	}
+	return true
+}
+
+// find 返回索引值v所在的表和slot
+func (x *flatIndex) find(keyHash, v uint64) (*flatTable, uint64, bool) {
+	if x.old != nil {
+		if pos, ok := x.old.find(keyHash, v); ok {
+			return x.old, pos, true
+		}
+	}
+	pos, ok := x.cur.find(keyHash, v)
+	return x.cur, pos, ok
+}
+
+func (x *flatIndex) rangeAll(fn func(keyHash, v uint64) bool) {
+	if x.old != nil && !x.old.rangeAll(fn) {
+		return
+	}
+	x.cur.rangeAll(fn)
+}
+
+func (x *flatIndex) len() int {
+	if x.old != nil {
+		return x.cur.count + x.old.count
+	}
+	return x.cur.count
+}
+
+func (x *flatIndex) bytes() uint64 {
+	ret := uint64(len(x.cur.slots) * 8)
+	if x.old != nil {
+		ret += uint64(len(x.old.slots) * 8)
+	}
+	return ret
+}
+
+func (x *flatIndex) clone() bucketIndex {
+	ret := &flatIndex{cur: x.cur.clone(), migrated: x.migrated}
+	if x.old != nil {
+		ret.old = x.old.clone()
+	}
+	return ret
+}
+
+func (x *flatIndex) reset() {
+	storeFlatTable(&x.old, nil)
+	storeFlatTable(&x.cur, newFlatTable(flatMinCapacity))
+	x.migrated = 0
+}
+
+// resize 先发布old再发布cur, 乐观读任何时候都能在两张表里找到已有的索引值
+func (x *flatIndex) resize(capacity int) {
+	storeFlatTable(&x.old, x.cur)
+	storeFlatTable(&x.cur, newFlatTable(capacity))
+	x.migrated = 0
+}
+
+// migrate 处理old里最多n个slot, 搬一个元素或者跳过一个空slot都算一个, old搬空后丢掉
+func (x *flatIndex) migrate(n int) {
+	if x.old == nil {
+		return
+	}
+	for ; n > 0 && x.migrated <= x.old.mask; n-- {
+		pos := x.migrated
+		if x.old.empty(pos) {
+			x.migrated++
+			continue
+		}
+		x.cur.insert(x.old.slots[2*pos], x.old.slots[2*pos+1]-1)
+		// deleteAt可能把后面的元素移到pos, 所以pos不前进
+		x.old.deleteAt(pos)
+	}
+	if x.migrated > x.old.mask || x.old.count == 0 {
+		storeFlatTable(&x.old, nil)
+	}
+}
@@ -0,0 +1,137 @@
+package lantern_cache
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func sortedValues(x bucketIndex, keyHash uint64) []uint64 {
+	var ret []uint64
+	for i := 0; ; i++ {
+		v, ok := x.get(keyHash, i)
+		if !ok {
+			break
+		}
+		ret = append(ret, v)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// 随机操作后和一个简单的实现对比
+func testBucketIndex(t *testing.T, policy string) {
+	x := newBucketIndex(policy)
+	expect := make(map[uint64]map[uint64]bool)
+	r := rand.New(rand.NewSource(1))
+	// keyHash的低位相同, 和bucket里一样, 少量的keyHash保证有冲突
+	keyHash := func() uint64 { return uint64(r.Intn(5000))<<10 | 7 }
+	next := uint64(0)
+	check := func() {
+		n := 0
+		for k, vs := range expect {
+			got := sortedValues(x, k)
+			if len(got) != len(vs) {
+				t.Fatal(policy, k, got, vs)
+			}
+			for _, v := range got {
+				if !vs[v] {
+					t.Fatal(policy, k, v)
+				}
+			}
+			n += len(vs)
+		}
+		if x.len() != n {
+			t.Fatal(policy, x.len(), n)
+		}
+		ranged := 0
+		x.rangeAll(func(k, v uint64) bool {
+			if !expect[k][v] {
+				t.Fatal(policy, k, v)
+			}
+			ranged++
+			return true
+		})
+		if ranged != n {
+			t.Fatal(policy, ranged, n)
+		}
+	}
+
+	for round := 0; round < 3; round++ {
+		// 先涨到很大再删到很小, 覆盖扩容和缩小
+		for i := 0; i < 20000; i++ {
+			k := keyHash()
+			switch op := r.Intn(10); {
+			case op < 6:
+				x.add(k, next)
+				if expect[k] == nil {
+					expect[k] = make(map[uint64]bool)
+				}
+				expect[k][next] = true
+				next++
+			case op < 8:
+				for v := range expect[k] {
+					if !x.replace(k, v, next) {
+						t.Fatal(policy, "replace", k, v)
+					}
+					delete(expect[k], v)
+					expect[k][next] = true
+					next++
+					break
+				}
+			default:
+				for v := range expect[k] {
+					if !x.remove(k, v) {
+						t.Fatal(policy, "remove", k, v)
+					}
+					delete(expect[k], v)
+					break
+				}
+			}
+			if i%5000 == 0 {
+				check()
+			}
+		}
+		check()
+		if x.remove(1, next) || x.replace(1, next, next) {
+			t.Fatal(policy, "missing value")
+		}
+		clone := x.clone()
+		for k, vs := range expect {
+			for v := range vs {
+				if !x.remove(k, v) {
+					t.Fatal(policy, "remove all", k, v)
+				}
+			}
+			delete(expect, k)
+		}
+		check()
+		if clone.len() == 0 {
+			t.Fatal(policy, "clone")
+		}
+	}
+	x.add(1, 1)
+	x.reset()
+	if x.len() != 0 {
+		t.Fatal(policy, "reset")
+	}
+}
+
+func TestBucketIndex(t *testing.T) {
+	testBucketIndex(t, "map")
+	testBucketIndex(t, "flat")
+}
+
+func TestFlatIndexShrink(t *testing.T) {
+	x := newFlatIndex()
+	for i := uint64(0); i < 100000; i++ {
+		x.add(i*1024, i)
+	}
+	grown := x.bytes()
+	for i := uint64(0); i < 100000; i++ {
+		x.remove(i*1024, i)
+	}
+	if x.len() != 0 || x.bytes() >= grown/64 {
+		t.Fatal(x.len(), x.bytes(), grown)
+	}
+}
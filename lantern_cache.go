@@ -2,55 +2,104 @@ package lantern_cache
 
 import (
 	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 type LanternCache struct {
-	buckets    []*bucket
-	hash       Hasher
-	bucketMask uint64
-	stats      *Stats
+	// 原子操作的64位字段放在最前面, 保证在32位平台上对齐
+	// ops 统计不属于某个bucket的调用, 其它调用统计在bucket里
+	ops OpStats
+	// since 开始统计的时间, UnixNano
+	since int64
+	// maxCapacity Resize后是新的容量
+	maxCapacity uint64
+
+	// layout 指向当前的*bucketLayout, Rebucket时原子地替换
+	layout  unsafe.Pointer
+	hash    Hasher
+	events  *notifier
+	cipher  *valueCipher
+	latency *cacheLatency
+	hotKeys *hotKeyTracker
+	bigKeys *bigKeyTracker
+	logger  *eventLogger
+	// bucketConfig Rebucket创建新bucket时使用
+	bucketConfig bucketConfig
+	// resizeMutex 同一时间只有一个Resize或者Rebucket
+	resizeMutex sync.Mutex
+
+	rates *rateMeter
 }
 
+// NewLanternCache creates a cache, it panics when cfg is invalid. New returns the error instead
+// and checks cfg more strictly.
 func NewLanternCache(cfg *Config) *LanternCache {
 	if cfg == nil {
 		cfg = DefaultConfig()
 	}
-
-	if cfg.BucketCount == 0 {
-		cfg.BucketCount = 1024
-	}
-
-	if len(cfg.ChunkAllocatorPolicy) == 0 {
-		cfg.ChunkAllocatorPolicy = "heap"
+	cfg.setDefaults()
+	if err := cfg.validate(false); err != nil {
+		panic(err)
 	}
-
-	if len(cfg.HashPolicy) == 0 {
-		cfg.HashPolicy = "fnv"
+	ret, err := newLanternCache(cfg)
+	if err != nil {
+		panic(err)
 	}
+	return ret
+}
 
-	if !isPowerOfTwo(cfg.BucketCount) {
-		panic(fmt.Errorf("%d must be power of two", cfg.BucketCount))
+// New creates a cache from cfg, DefaultConfig() when nil, with opts applied to a copy of it.
+// An invalid config returns a *ConfigError, for example when a bucket gets less than one chunk
+// or InitCapacity exceeds MaxCapacity.
+func New(cfg *Config, opts ...Option) (*LanternCache, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
 	}
-
-	if cfg.MaxCapacity == 0 {
-		panic(fmt.Errorf("max capacity has to set"))
+	c := *cfg
+	for _, opt := range opts {
+		opt(&c)
 	}
-
-	if cfg.InitCapacity == 0 {
-		cfg.InitCapacity = cfg.MaxCapacity / 4
+	c.setDefaults()
+	if err := c.validate(true); err != nil {
+		return nil, err
 	}
-	return newLanternCache(cfg)
+	return newLanternCache(&c)
 }
 
-func newLanternCache(cfg *Config) *LanternCache {
+func newLanternCache(cfg *Config) (*LanternCache, error) {
 	ret := &LanternCache{}
-	ret.buckets = make([]*bucket, cfg.BucketCount)
-	ret.bucketMask = uint64(cfg.BucketCount) - 1
-	ret.hash = NewHasher(cfg.HashPolicy)
-	ret.stats = &Stats{}
+	layout := &bucketLayout{buckets: make([]*bucket, cfg.BucketCount), mask: uint64(cfg.BucketCount) - 1}
+	ret.hash = cfg.Hasher
+	if ret.hash == nil {
+		ret.hash = NewHasher(cfg.HashPolicy)
+	}
+	ret.since = time.Now().UnixNano()
+	ret.maxCapacity = cfg.MaxCapacity
+	ret.rates = newRateMeter(time.Now())
+	ret.events = newNotifier()
+	ret.latency = newCacheLatency(cfg.LatencySampleRate)
+	ret.logger = newEventLogger(cfg.Logger, cfg.Verbose)
+	trackedKeys := cfg.TrackedKeys
+	if trackedKeys <= 0 {
+		trackedKeys = defaultTrackedKeys
+	}
+	ret.hotKeys = newHotKeyTracker(cfg.HotKeySampleRate, trackedKeys)
+	ret.bigKeys = newBigKeyTracker(0)
+	if cfg.TrackBigKeys {
+		ret.bigKeys = newBigKeyTracker(trackedKeys)
+	}
+	if cfg.KeyProvider != nil {
+		ret.cipher = newValueCipher(cfg.KeyProvider)
+	}
 
 	chunkAlloc := NewChunkAllocator(cfg.ChunkAllocatorPolicy)
+	chunkAlloc.logger = ret.logger
 	bucketMaxCapacity := (cfg.MaxCapacity + uint64(cfg.BucketCount) - 1) / uint64(cfg.BucketCount)
 	bucketInitCapacity := (cfg.InitCapacity + uint64(cfg.BucketCount) - 1) / uint64(cfg.BucketCount)
 	if bucketInitCapacity == 0 {
@@ -61,82 +110,330 @@ func newLanternCache(cfg *Config) *LanternCache {
 		maxCapacity:  bucketMaxCapacity,
 		initCapacity: bucketInitCapacity,
 		chunkAlloc:   chunkAlloc,
-		statistics:   ret.stats,
+		hash:         ret.hash,
+		events:       ret.events,
+		checksum:     cfg.Checksum,
+		cipher:       ret.cipher,
+		indexPolicy:  cfg.IndexPolicy,
+		optimistic:   cfg.OptimisticReads,
+		latency:      ret.latency,
+		bigKeys:      ret.bigKeys,
+		logger:       ret.logger,
 	}
-	for i := range ret.buckets {
-		ret.buckets[i] = newBucket(bc)
+	ret.bucketConfig = *bc
+	for i := range layout.buckets {
+		b, err := newBucket(bc)
+		if err != nil {
+			for _, b := range layout.buckets[:i] {
+				b.reset()
+			}
+			ret.logger.log(LevelError, "cache initialization failed", F("err", err))
+			return nil, err
+		}
+		b.id = i
+		b.mask = layout.mask
+		layout.buckets[i] = b
+	}
+	ret.storeLayout(layout)
+	if capacity := cfg.capacity(); capacity > cfg.MaxCapacity {
+		ret.logger.log(LevelWarn, "max capacity rounded up to whole chunks per bucket", F("max_capacity", humanSize(int64(cfg.MaxCapacity))),
+			F("capacity", humanSize(int64(capacity))), F("waste", humanSize(int64(capacity-cfg.MaxCapacity))))
 	}
 
-	//ret.logger.Printf("LanternCache init success max capacity:%s bucket count:%d bucket capacity:%s hash:%s alloc:%s verbose:%v",
-	//	humanSize(int64(cfg.MaxCapacity)), len(ret.buckets), humanSize(int64(bucketMaxCapacity)), cfg.HashPolicy, cfg.ChunkAllocatorPolicy, ret.verbose)
-	return ret
+	ret.logger.log(LevelInfo, "cache initialized", F("max_capacity", humanSize(int64(cfg.MaxCapacity))), F("buckets", len(layout.buckets)),
+		F("bucket_capacity", humanSize(int64(bucketMaxCapacity))), F("hash", cfg.HashPolicy), F("allocator", cfg.ChunkAllocatorPolicy),
+		F("index", cfg.IndexPolicy), F("verbose", cfg.Verbose))
+	return ret, nil
 }
 
 func (lc *LanternCache) Put(key, value []byte) error {
 	keyHash := lc.hash.Hash(key)
-	bucketIndex := keyHash & lc.bucketMask
-	bucket := lc.buckets[bucketIndex]
-	return bucket.put(keyHash, key, value, 0)
+	bucket := lc.bucketFor(keyHash)
+	n := atomic.AddUint64(&bucket.ops.Put, 1)
+	lc.hotKeys.sample(n, key)
+	start := lc.latency.start(n)
+	err := bucket.put(keyHash, key, value, 0)
+	for err == errBucketMoved {
+		err = lc.bucketFor(keyHash).put(keyHash, key, value, 0)
+	}
+	lc.latency.put.since(start)
+	return err
 }
 
 func (lc *LanternCache) PutWithExpire(key, value []byte, expire int64) error {
 	keyHash := lc.hash.Hash(key)
-	bucketIndex := keyHash & lc.bucketMask
-	bucket := lc.buckets[bucketIndex]
-	return bucket.put(keyHash, key, value, time.Now().Unix()+expire)
+	bucket := lc.bucketFor(keyHash)
+	n := atomic.AddUint64(&bucket.ops.PutWithExpire, 1)
+	lc.hotKeys.sample(n, key)
+	start := lc.latency.start(n)
+	expire = time.Now().Unix() + expire
+	err := bucket.put(keyHash, key, value, expire)
+	for err == errBucketMoved {
+		err = lc.bucketFor(keyHash).put(keyHash, key, value, expire)
+	}
+	lc.latency.put.since(start)
+	return err
 }
 
 func (lc *LanternCache) Get(key []byte) ([]byte, error) {
 	keyHash := lc.hash.Hash(key)
-	bucketIndex := keyHash & lc.bucketMask
-	bucket := lc.buckets[bucketIndex]
+	bucket := lc.bucketFor(keyHash)
+	n := atomic.AddUint64(&bucket.ops.Get, 1)
+	lc.hotKeys.sample(n, key)
+	start := lc.latency.start(n)
 	v, err := bucket.get(nil, keyHash, key)
+	for err == errBucketMoved {
+		bucket = lc.bucketFor(keyHash)
+		v, err = bucket.get(nil, keyHash, key)
+	}
 	if err != nil {
-		return nil, err
+		bucket.onGetError(err, keyHash, key)
+		v = nil
 	}
-	return v, nil
+	lc.latency.get.since(start)
+	return v, err
 }
 
 func (lc *LanternCache) GetWithBuffer(dst []byte, key []byte) ([]byte, error) {
 	keyHash := lc.hash.Hash(key)
-	bucketIndex := keyHash & lc.bucketMask
-	bucket := lc.buckets[bucketIndex]
+	bucket := lc.bucketFor(keyHash)
+	n := atomic.AddUint64(&bucket.ops.GetWithBuffer, 1)
+	lc.hotKeys.sample(n, key)
+	start := lc.latency.start(n)
 	v, err := bucket.get(dst, keyHash, key)
+	for err == errBucketMoved {
+		bucket = lc.bucketFor(keyHash)
+		v, err = bucket.get(dst, keyHash, key)
+	}
 	if err != nil {
-		return nil, err
+		bucket.onGetError(err, keyHash, key)
+		v = nil
+	}
+	lc.latency.get.since(start)
+	return v, err
+}
+
+// View calls fn with the value of key while holding the read lock of its bucket, without copying it.
+// The value is only valid inside fn and must not be modified, fn must not write to the cache.
+// View returns the error of the lookup, like Get, or the error returned by fn.
+func (lc *LanternCache) View(key []byte, fn func(value []byte) error) error {
+	keyHash := lc.hash.Hash(key)
+	bucket := lc.bucketFor(keyHash)
+	lc.hotKeys.sample(atomic.AddUint64(&bucket.ops.View, 1), key)
+	err := bucket.view(keyHash, key, fn)
+	for err == errBucketMoved {
+		bucket = lc.bucketFor(keyHash)
+		err = bucket.view(keyHash, key, fn)
+	}
+	bucket.onGetError(err, keyHash, key)
+	return err
+}
+
+// WriteTo writes the value of key to w with View, writes to w block the writers of the bucket.
+func (lc *LanternCache) WriteTo(key []byte, w io.Writer) (int64, error) {
+	var n int
+	err := lc.View(key, func(value []byte) error {
+		var err error
+		n, err = w.Write(value)
+		return err
+	})
+	return int64(n), err
+}
+
+// Entry is a key value pair written by MultiPut, Expire is the ttl in seconds like the expire
+// of PutWithExpire, 0 means the entry never expires.
+type Entry struct {
+	Key    []byte
+	Value  []byte
+	Expire int64
+}
+
+// MultiGet gets the values of keys locking every bucket once. The value of keys[i] is appended to
+// dst[i] like GetWithBuffer, dst may be nil or shorter than keys. errs[i] is the error Get would
+// return for keys[i], values[i] is nil when it is not nil.
+func (lc *LanternCache) MultiGet(keys [][]byte, dst [][]byte) ([][]byte, []error) {
+	atomic.AddUint64(&lc.ops.MultiGet, 1)
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	hashes := make([]uint64, len(keys))
+	for i := range keys {
+		hashes[i] = lc.hash.Hash(keys[i])
+	}
+	buf := func(i int) []byte {
+		if i < len(dst) {
+			return dst[i]
+		}
+		return nil
+	}
+	lc.groupByBucket(hashes, func(bucket *bucket, group []int) {
+		bucket.mutex.RLock()
+		for _, i := range group {
+			if !bucket.owns(hashes[i]) {
+				errs[i] = errBucketMoved
+				continue
+			}
+			values[i], _, errs[i] = bucket.getEntryLocked(buf(i), hashes[i], keys[i])
+		}
+		bucket.mutex.RUnlock()
+		for _, i := range group {
+			bucket.onGetError(errs[i], hashes[i], keys[i])
+		}
+	})
+	// 分组以后被Rebucket迁移走的key逐个重新读
+	for i := range keys {
+		for errs[i] == errBucketMoved {
+			bucket := lc.bucketFor(hashes[i])
+			values[i], _, errs[i] = bucket.getEntry(buf(i), hashes[i], keys[i])
+			bucket.onGetError(errs[i], hashes[i], keys[i])
+		}
+	}
+	return values, errs
+}
+
+// MultiPut writes entries atomically, the buckets of all entries are locked at once so readers
+// see either none or all of them. Nothing is written when an entry is invalid or a chunk can't be
+// allocated, a repeated key keeps the value of its last entry.
+func (lc *LanternCache) MultiPut(entries []Entry) error {
+	atomic.AddUint64(&lc.ops.MultiPut, 1)
+	overhead := lc.cipher.overhead()
+	hashes := make([]uint64, len(entries))
+	for i := range entries {
+		if !validEntry(entries[i].Key, entries[i].Value, overhead) {
+			return ErrorInvalidEntry
+		}
+		hashes[i] = lc.hash.Hash(entries[i].Key)
+	}
+	now := time.Now().Unix()
+	writes := make([]txnWrite, len(entries))
+	for i := range entries {
+		e := &entries[i]
+		writes[i] = txnWrite{keyHash: hashes[i], key: e.Key, value: e.Value}
+		if e.Expire != 0 {
+			writes[i].expire = now + e.Expire
+		}
+	}
+	buckets := lc.lockKeys(hashes)
+	defer lc.unlockBuckets(buckets)
+	// 和事务提交一样先预留所有chunk, 分配失败时什么都不写
+	return lc.applyLocked(writes)
+}
+
+// groupByBucket 把hashes的下标按bucket分组, 每个bucket调用一次fn
+// 调用fn之前key可能被Rebucket迁移走, fn需要在锁内用owns确认
+func (lc *LanternCache) groupByBucket(hashes []uint64, fn func(bucket *bucket, group []int)) {
+	l := lc.loadLayout()
+	buckets := make([]*bucket, len(hashes))
+	order := make([]int, len(hashes))
+	for i := range order {
+		buckets[i] = l.bucket(hashes[i])
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return buckets[order[i]].id < buckets[order[j]].id
+	})
+	for start := 0; start < len(order); {
+		bucket := buckets[order[start]]
+		end := start + 1
+		for end < len(order) && buckets[order[end]] == bucket {
+			end++
+		}
+		fn(bucket, order[start:end])
+		start = end
 	}
-	return v, nil
 }
 
 func (lc *LanternCache) Del(key []byte) {
 	keyHash := lc.hash.Hash(key)
-	bucketIndex := keyHash & lc.bucketMask
-	bucket := lc.buckets[bucketIndex]
-	bucket.del(keyHash)
+	bucket := lc.bucketFor(keyHash)
+	start := lc.latency.start(atomic.AddUint64(&bucket.ops.Del, 1))
+	for bucket.del(keyHash, key) == errBucketMoved {
+		bucket = lc.bucketFor(keyHash)
+	}
+	lc.latency.del.since(start)
+}
+
+// AddListener registers l to be notified of every set, del, expired and evicted key.
+// Calling the returned function removes l again, calls in progress may still finish after it returns.
+func (lc *LanternCache) AddListener(l Listener) (remove func()) {
+	return lc.events.add(l)
 }
 
 func (lc *LanternCache) Reset() {
-	for i := range lc.buckets {
-		lc.buckets[i].reset()
+	for _, b := range lc.loadLayout().buckets {
+		b.reset()
 	}
 }
 
+// Stats returns the counters summed over all buckets, every counter is read atomically.
 func (lc *LanternCache) Stats() *Stats {
-	return lc.stats
+	l := lc.loadLayout()
+	ret := &Stats{}
+	ret.add(&l.retired)
+	for _, b := range l.buckets {
+		ret.add(b.statistics)
+	}
+	return ret
+}
+
+// StatsSnapshot returns the counters with the calls of every method, the hit ratio and the rates.
+func (lc *LanternCache) StatsSnapshot() *StatsSnapshot {
+	ret := &StatsSnapshot{Since: time.Unix(0, atomic.LoadInt64(&lc.since))}
+	l := lc.loadLayout()
+	ret.Ops.add(&lc.ops)
+	ret.Stats.add(&l.retired)
+	ret.Ops.add(&l.retiredOps)
+	for _, b := range l.buckets {
+		ret.Stats.add(b.statistics)
+		ret.Ops.add(&b.ops)
+	}
+	if ret.Gets > 0 {
+		ret.HitRatio = float64(ret.Hits) / float64(ret.Gets)
+	}
+	rates := lc.rates.get(lc.rateTotal, time.Now())
+	ret.Rate1, ret.Rate5, ret.Rate15 = rates[0], rates[1], rates[2]
+	ret.Latency = lc.latency.snapshot()
+	return ret
+}
+
+// ResetStats sets all counters and latency histograms to 0 and forgets hot keys and big keys. The rates are kept and decay as usual.
+func (lc *LanternCache) ResetStats() {
+	l := lc.loadLayout()
+	lc.ops.reset()
+	l.retired.reset()
+	l.retiredOps.reset()
+	for _, b := range l.buckets {
+		b.statistics.reset()
+		b.ops.reset()
+	}
+	lc.latency.reset()
+	lc.hotKeys.reset()
+	lc.bigKeys.reset()
+	atomic.StoreInt64(&lc.since, time.Now().UnixNano())
+}
+
+// rateTotal 是计算速率用的gets和puts的总数
+func (lc *LanternCache) rateTotal() uint64 {
+	l := lc.loadLayout()
+	total := atomic.LoadUint64(&l.retired.Gets) + atomic.LoadUint64(&l.retired.Puts)
+	for _, b := range l.buckets {
+		total += atomic.LoadUint64(&b.statistics.Gets) + atomic.LoadUint64(&b.statistics.Puts)
+	}
+	return total
 }
 
 func (lc *LanternCache) Size() uint64 {
 	ret := uint64(0)
-	for i := range lc.buckets {
-		ret += uint64(lc.buckets[i].size())
+	for _, b := range lc.loadLayout().buckets {
+		ret += uint64(b.size())
 	}
 	return ret
 }
 
 func (lc *LanternCache) Scan(count int) ([][]byte, error) {
+	atomic.AddUint64(&lc.ops.Scan, 1)
 	ret := make([][]byte, 0, count)
-	for i := range lc.buckets {
-		if data, err := lc.buckets[i].scan(count); err == nil && len(data) > 0 {
+	for _, b := range lc.loadLayout().buckets {
+		if data, err := b.scan(count); err == nil && len(data) > 0 {
 			ret = append(ret, data...)
 		}
 		if len(ret) >= count {
@@ -146,12 +443,85 @@ func (lc *LanternCache) Scan(count int) ([][]byte, error) {
 	return ret, nil
 }
 
+// ScanCursor returns up to count keys starting from cursor and the cursor to continue with.
+// Start with cursor 0, the scan is complete when the returned cursor is 0.
+// Keys existing during the whole scan are returned exactly once, also when Rebucket runs meanwhile.
+func (lc *LanternCache) ScanCursor(cursor uint64, count int) ([][]byte, uint64) {
+	atomic.AddUint64(&lc.ops.Scan, 1)
+	if count <= 0 {
+		count = 10
+	}
+	ret := make([][]byte, 0, count)
+	// cursor是下一个要返回的key反转后的keyHash, keyHash的低位是bucket的下标, 反转后是高位
+	// 所以每个bucket的key是cursor上连续的一段, 长度由bucket的mask决定
+	for {
+		bucket := lc.rlockKey(bits.Reverse64(cursor))
+		next, more := uint64(0), false
+		ret, next, more = bucket.scanFromLocked(cursor, count-len(ret), ret)
+		shift := uint(64 - bits.OnesCount64(atomic.LoadUint64(&bucket.mask)))
+		bucket.mutex.RUnlock()
+		if more {
+			return ret, next
+		}
+		// 下一个bucket的第一个位置, 越过最后一个bucket时是0
+		if cursor = (cursor>>shift + 1) << shift; cursor == 0 {
+			return ret, 0
+		}
+	}
+}
+
+// rlockKey 给keyHash所在的bucket加读锁, 返回时keyHash属于这个bucket
+func (lc *LanternCache) rlockKey(keyHash uint64) *bucket {
+	for {
+		bucket := lc.bucketFor(keyHash)
+		bucket.mutex.RLock()
+		if bucket.owns(keyHash) {
+			return bucket
+		}
+		bucket.mutex.RUnlock()
+	}
+}
+
+// BucketStats returns the stats of every bucket
+func (lc *LanternCache) BucketStats() []BucketStats {
+	buckets := lc.loadLayout().buckets
+	ret := make([]BucketStats, len(buckets))
+	for i := range buckets {
+		ret[i] = buckets[i].info()
+	}
+	return ret
+}
+
+// getWithExpire 和Get一样, 另外返回过期时间, 0表示不过期
+func (lc *LanternCache) getWithExpire(key []byte) ([]byte, int64, error) {
+	keyHash := lc.hash.Hash(key)
+	bucket := lc.bucketFor(keyHash)
+	v, expire, err := bucket.getEntry(nil, keyHash, key)
+	for err == errBucketMoved {
+		bucket = lc.bucketFor(keyHash)
+		v, expire, err = bucket.getEntry(nil, keyHash, key)
+	}
+	bucket.onGetError(err, keyHash, key)
+	return v, expire, err
+}
+
+// Verify checks the entries of all buckets and drops corrupt ones, it returns the number of dropped
+// entries. Without Config.Checksum only entries with broken headers are found.
+func (lc *LanternCache) Verify() int {
+	count := 0
+	for _, b := range lc.loadLayout().buckets {
+		count += b.verify()
+	}
+	return count
+}
+
 func (lc *LanternCache) String() string {
 	var mapLen, mapSize, chunkSize, maxChunkSize uint64
 	var bucketMinMapLen, bucketMaxMapLen uint64
 
-	for i := range lc.buckets {
-		ml, ms, cs, mcs := lc.buckets[i].stats()
+	buckets := lc.loadLayout().buckets
+	for i := range buckets {
+		ml, ms, cs, mcs := buckets[i].stats()
 		if i == 0 {
 			bucketMinMapLen = ml
 			bucketMaxMapLen = ml
@@ -171,5 +541,5 @@ func (lc *LanternCache) String() string {
 		maxChunkSize += mcs
 	}
 	return fmt.Sprintf("%s mapLen:%d mapCap:%s bucketMinMapLen:%d bucketMaxMapLen:%d bucketAvgMapLen:%d chunkCap:%s maxChunkCap:%s",
-		lc.stats.Raw(), mapLen, humanSize(int64(mapSize)), bucketMinMapLen, bucketMaxMapLen, mapLen/uint64(len(lc.buckets)), humanSize(int64(chunkSize)), humanSize(int64(maxChunkSize)))
+		lc.Stats().Raw(), mapLen, humanSize(int64(mapSize)), bucketMinMapLen, bucketMaxMapLen, mapLen/uint64(len(buckets)), humanSize(int64(chunkSize)), humanSize(int64(maxChunkSize)))
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -234,3 +235,32 @@ func BenchmarkCaches(b *testing.B) {
 		})
 	}
 }
+
+// BenchmarkIndexGrowth 一直写入新key, 索引不断扩容, 报告每次put的p99延迟
+func BenchmarkIndexGrowth(b *testing.B) {
+	for _, policy := range []string{"map", "flat"} {
+		b.Run(policy, func(b *testing.B) {
+			cache := NewLanternCache(&Config{
+				BucketCount:          1,
+				MaxCapacity:          1024 * 1024 * 1024,
+				ChunkAllocatorPolicy: "heap",
+				IndexPolicy:          policy,
+			})
+			keys := keysList(b.N, 16)
+			val := blob('a', 32)
+			latency := make([]int64, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if err := cache.Put(keys[i], val); err != nil {
+					b.Fatal(err)
+				}
+				latency[i] = int64(time.Since(start))
+			}
+			b.StopTimer()
+			sort.Slice(latency, func(i, j int) bool { return latency[i] < latency[j] })
+			b.ReportMetric(float64(latency[len(latency)*99/100]), "p99-put-ns")
+			b.ReportMetric(float64(latency[len(latency)-1]), "max-put-ns")
+		})
+	}
+}
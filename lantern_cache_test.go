@@ -2,7 +2,10 @@ package lantern_cache
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 )
@@ -23,11 +26,54 @@ func TestNewLanternCacheBucketCount(t *testing.T) {
 		ChunkAllocatorPolicy: "",
 		HashPolicy:           "",
 	})
-	if len(cache.buckets) != 1024 {
+	if len(cache.loadLayout().buckets) != 1024 {
 		t.Fatal("not equal")
 	}
 }
 
+func TestNew(t *testing.T) {
+	for _, c := range []struct {
+		cfg   *Config
+		field string
+	}{
+		{&Config{BucketCount: 3, MaxCapacity: 1 << 30}, "BucketCount"},
+		{&Config{BucketCount: 4}, "MaxCapacity"},
+		{&Config{BucketCount: 1024, MaxCapacity: 1024 * 1024}, "MaxCapacity"},
+		{&Config{BucketCount: 4, MaxCapacity: 1 << 20, InitCapacity: 1 << 21}, "InitCapacity"},
+		{&Config{BucketCount: 4, MaxCapacity: 1 << 20, ChunkAllocatorPolicy: "none"}, "ChunkAllocatorPolicy"},
+		{&Config{BucketCount: 4, MaxCapacity: 1 << 20, HashPolicy: "none"}, "HashPolicy"},
+		{&Config{BucketCount: 4, MaxCapacity: 1 << 20, IndexPolicy: "none"}, "IndexPolicy"},
+		{&Config{BucketCount: 4, MaxCapacity: 1 << 20, IndexPolicy: "map", OptimisticReads: true}, "OptimisticReads"},
+	} {
+		_, err := New(c.cfg)
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) || configErr.Field != c.field || !errors.Is(err, ErrorInvalidConfig) {
+			t.Fatal(c.field, err)
+		}
+		if c.cfg.Validate() == nil {
+			t.Fatal(c.field)
+		}
+	}
+
+	// 选项覆盖cfg, cfg本身不变
+	cfg := &Config{BucketCount: 4, MaxCapacity: 1 << 20}
+	out := &recordLogger{}
+	cache, err := New(cfg, WithBuckets(8), WithMaxCapacity(8*chunkSize+1), WithHasher(constHasher(1)), WithIndex("flat"), WithLogger(out, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.loadLayout().buckets) != 8 || cfg.BucketCount != 4 || cfg.InitCapacity != 0 || cache.hash.Hash([]byte("key")) != 1 {
+		t.Fatal(len(cache.loadLayout().buckets), cfg)
+	}
+	if _, ok := cache.loadLayout().buckets[0].index.(*flatIndex); !ok {
+		t.Fatal("not flat")
+	}
+	// 每个bucket多出1字节, 向上取整到chunk浪费了内存
+	if !out.has("warn max capacity rounded up to whole chunks per bucket") {
+		t.Fatal(out.events)
+	}
+}
+
 func TestLanternCachePutGet(t *testing.T) {
 	b := NewLanternCache(nil)
 	for i := 0; i < 10000; i++ {
@@ -167,11 +213,444 @@ func TestLanternCacheJumpChunk(t *testing.T) {
 			t.Fatal(err)
 		}
 	}
-	if b.buckets[0].chunks[1] == nil {
+	if b.loadLayout().buckets[0].chunks[1] == nil {
 		t.Fatal("no chunk")
 	}
 
-	if b.buckets[0].loop == 0 {
+	if b.loadLayout().buckets[0].loop == 0 {
 		t.Fatal("loop need > 0")
 	}
 }
+
+func TestLanternCacheListener(t *testing.T) {
+	b := NewLanternCache(&Config{
+		BucketCount: 1,
+		MaxCapacity: 2 * chunkSize,
+	})
+	events := make(map[EventType]int)
+	evicted := make([][]byte, 0)
+	remove := b.AddListener(func(event EventType, keyHash uint64, key []byte) {
+		events[event]++
+		if event == EventEvicted {
+			evicted = append(evicted, append([]byte(nil), key...))
+		}
+	})
+
+	key1 := []byte("key1")
+	if err := b.PutWithExpire(key1, []byte("val1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	b.Del(key1)
+	// 已经删除的key不再通知
+	b.Del(key1)
+	if events[EventSet] != 1 || events[EventDel] != 1 {
+		t.Fatal(events)
+	}
+
+	if err := b.PutWithExpire(key1, []byte("val1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second * 2)
+	if _, err := b.Get(key1); err != ErrorValueExpire {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(key1); err != ErrorNotFound {
+		t.Fatal(err)
+	}
+	if events[EventExpired] != 1 {
+		t.Fatal(events)
+	}
+
+	val := makeByte(1024)
+	for i := 0; i < 1024; i++ {
+		if err := b.Put([]byte(fmt.Sprintf("key%d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(evicted) == 0 {
+		t.Fatal("no evicted event")
+	}
+	for i := range evicted {
+		if _, err := b.Get(evicted[i]); err != ErrorNotFound {
+			t.Fatal(err)
+		}
+	}
+
+	// 删除后不再通知, 再次删除没有影响
+	remove()
+	remove()
+	sets := events[EventSet]
+	if err := b.Put(key1, []byte("val1")); err != nil {
+		t.Fatal(err)
+	}
+	if events[EventSet] != sets {
+		t.Fatal(events)
+	}
+}
+
+func TestLanternCacheChecksum(t *testing.T) {
+	b := NewLanternCache(&Config{
+		BucketCount: 1,
+		MaxCapacity: 2 * chunkSize,
+		Checksum:    true,
+	})
+	for i := 0; i < 10; i++ {
+		if err := b.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 修改第一个entry的value
+	entry, _ := entryAt(b.loadLayout().buckets[0].chunks[0])
+	entry[len(entry)-1] ^= 1
+	if _, err := b.Get([]byte("key0")); err != ErrorCorruptEntry {
+		t.Fatal(err)
+	}
+	if _, err := b.Get([]byte("key0")); err != ErrorNotFound {
+		t.Fatal(err)
+	}
+	if b.Stats().Corruptions != 1 {
+		t.Fatal(b.Stats())
+	}
+
+	entry, _ = entryAt(b.loadLayout().buckets[0].chunks[0][len(entry):])
+	entry[len(entry)-1] ^= 1
+	if n := b.Verify(); n != 1 {
+		t.Fatal(n)
+	}
+	if _, err := b.Get([]byte("key1")); err != ErrorNotFound {
+		t.Fatal(err)
+	}
+	for i := 2; i < 10; i++ {
+		if _, err := b.Get([]byte(fmt.Sprintf("key%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.Stats().Corruptions != 2 {
+		t.Fatal(b.Stats())
+	}
+
+	// 开启checksum时被清零的checksum也是损坏, 保存的snapshot里也一样
+	entry, _ = entryAt(b.loadLayout().buckets[0].chunks[0][2*len(entry):])
+	binary.LittleEndian.PutUint32(entry[entryChecksumPos:], 0)
+	buf := &bytes.Buffer{}
+	if err := b.SaveSnapshot(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get([]byte("key2")); err != ErrorCorruptEntry {
+		t.Fatal(err)
+	}
+	sr, err := NewSnapshotReader(bytes.NewReader(buf.Bytes()))
+	if err != nil || !sr.Header().Checksum {
+		t.Fatal(err, sr.Header())
+	}
+	sb, err := sr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 前两个entry已经被改坏了, 还留在chunk里
+	if errs := sb.Verify(b.hash); len(errs) != 3 {
+		t.Fatal(errs)
+	}
+}
+
+func TestLanternCacheView(t *testing.T) {
+	b := NewLanternCache(&Config{BucketCount: 4, MaxCapacity: 1024 * 1024})
+	key, val := []byte("key1"), []byte("val1")
+	if err := b.Put(key, val); err != nil {
+		t.Fatal(err)
+	}
+	var actual []byte
+	if err := b.View(key, func(value []byte) error {
+		actual = append(actual, value...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, val) {
+		t.Fatal("not equal")
+	}
+	if err := b.View([]byte("none"), func(value []byte) error { return nil }); err != ErrorNotFound {
+		t.Fatal(err)
+	}
+	if err := b.View(key, func(value []byte) error { return ErrorCopy }); err != ErrorCopy {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := b.WriteTo(key, buf)
+	if err != nil || n != int64(len(val)) || !bytes.Equal(buf.Bytes(), val) {
+		t.Fatal(n, err, buf.String())
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = b.View(key, func(value []byte) error { return nil })
+	})
+	if allocs != 0 {
+		t.Fatal(allocs)
+	}
+}
+
+func TestLanternCacheMultiGetPut(t *testing.T) {
+	b := NewLanternCache(&Config{BucketCount: 4, MaxCapacity: 1024 * 1024})
+	entries := make([]Entry, 0, 100)
+	keys := make([][]byte, 0, 101)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		entries = append(entries, Entry{Key: key, Value: []byte(fmt.Sprintf("val%d", i))})
+		keys = append(keys, key)
+	}
+	entries = append(entries, Entry{Key: []byte("ttl"), Value: []byte("ttl"), Expire: -10})
+	if err := b.MultiPut(entries); err != nil {
+		t.Fatal(err)
+	}
+	// 有一个entry不合法时什么都不写
+	if err := b.MultiPut([]Entry{{Key: []byte("new"), Value: []byte("new")}, {Key: []byte("empty")}}); err != ErrorInvalidEntry {
+		t.Fatal(err)
+	}
+	if _, err := b.Get([]byte("new")); err != ErrorNotFound {
+		t.Fatal(err)
+	}
+
+	keys = append(keys, []byte("none"), []byte("ttl"))
+	dst := [][]byte{[]byte("prefix:")}
+	values, errs := b.MultiGet(keys, dst)
+	if len(values) != len(keys) || len(errs) != len(keys) {
+		t.Fatal(len(values), len(errs))
+	}
+	if string(values[0]) != "prefix:val0" {
+		t.Fatal(string(values[0]))
+	}
+	for i := 1; i < 100; i++ {
+		if errs[i] != nil || string(values[i]) != fmt.Sprintf("val%d", i) {
+			t.Fatal(i, errs[i], string(values[i]))
+		}
+	}
+	if errs[100] != ErrorNotFound || errs[101] != ErrorValueExpire || values[100] != nil {
+		t.Fatal(errs[100], errs[101])
+	}
+	// 过期的key已经被删除
+	if _, err := b.Get([]byte("ttl")); err != ErrorNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestLanternCacheMultiPutChunkAllocFailure(t *testing.T) {
+	cache, err := New(&Config{}, WithBuckets(1), WithMaxCapacity(4*chunkSize), WithInitCapacity(chunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put([]byte("key1"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	restore := failChunkAlloc(cache)
+	defer restore()
+	// 第二个value需要新的chunk, 分配失败时第一个也不写
+	value := bytes.Repeat([]byte("v"), chunkSize/2)
+	err = cache.MultiPut([]Entry{{Key: []byte("key1"), Value: value}, {Key: []byte("key2"), Value: value}})
+	if err != ErrorChunkAlloc {
+		t.Fatal(err)
+	}
+	if actual, err := cache.Get([]byte("key1")); err != nil || string(actual) != "old" {
+		t.Fatal(string(actual), err)
+	}
+	if _, err := cache.Get([]byte("key2")); err != ErrorNotFound {
+		t.Fatal(err)
+	}
+}
+
+func TestLanternCacheFlatIndex(t *testing.T) {
+	b := NewLanternCache(&Config{
+		BucketCount: 2,
+		MaxCapacity: 4 * chunkSize,
+		IndexPolicy: "flat",
+	})
+	val := blob('a', 100)
+	// 写满好几圈, 旧的key被覆盖
+	n := 10000
+	for i := 0; i < n; i++ {
+		if err := b.Put([]byte(fmt.Sprintf("key%d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := n - 100; i < n; i++ {
+		v, err := b.Get([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil || !bytes.Equal(v, val) {
+			t.Fatal(i, err)
+		}
+	}
+	if _, err := b.Get([]byte("key0")); err != ErrorNotFound {
+		t.Fatal(err)
+	}
+	b.Del([]byte(fmt.Sprintf("key%d", n-1)))
+	if _, err := b.Get([]byte(fmt.Sprintf("key%d", n-1))); err != ErrorNotFound {
+		t.Fatal(err)
+	}
+	key := []byte(fmt.Sprintf("key%d", n-2))
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = b.View(key, func(value []byte) error { return nil })
+	})
+	if allocs != 0 {
+		t.Fatal(allocs)
+	}
+}
+
+func TestLanternCacheOptimisticReads(t *testing.T) {
+	b := NewLanternCache(&Config{
+		BucketCount:     2,
+		MaxCapacity:     4 * chunkSize,
+		OptimisticReads: true,
+	})
+	if b.loadLayout().buckets[0].optimistic != optimisticSupported {
+		t.Fatal(b.loadLayout().buckets[0].optimistic)
+	}
+	// value的每个字节都相同, 长度由这个字节决定, 读到被写了一半的value时能发现
+	value := func(c byte) []byte {
+		return blob(c, 100+int(c))
+	}
+	check := func(v []byte) error {
+		if len(v) != 100+int(v[0]) || !bytes.Equal(v, value(v[0])) {
+			return fmt.Errorf("torn value %d %d", len(v), v[0])
+		}
+		return nil
+	}
+	keys := keysList(1000, 16)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := b.Put(keys[(i*7+w)%len(keys)], value(byte(i))); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%100 == 0 {
+					b.Del(keys[i%len(keys)])
+				}
+			}
+		}(w)
+	}
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			buf := make([]byte, 0, 1024)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := keys[(i+r)%len(keys)]
+				var err error
+				if i%2 == 0 {
+					var v []byte
+					if v, err = b.GetWithBuffer(buf[:0], key); err == nil {
+						err = check(v)
+					}
+				} else {
+					err = b.View(key, check)
+				}
+				if err != nil && err != ErrorNotFound {
+					errs <- err
+					return
+				}
+			}
+		}(r)
+	}
+	time.Sleep(300 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if b.loadLayout().buckets[0].seq&1 != 0 {
+		t.Fatal(b.loadLayout().buckets[0].seq)
+	}
+}
+
+func TestLanternCacheStatsSnapshot(t *testing.T) {
+	b := NewLanternCache(&Config{BucketCount: 4, MaxCapacity: 1024 * 1024})
+	start := b.StatsSnapshot().Since
+	for i := 0; i < 10; i++ {
+		if err := b.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.PutWithExpire([]byte("ttl"), []byte("value"), 10); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		_, _ = b.Get([]byte(fmt.Sprintf("key%d", i)))
+	}
+	_, _ = b.GetWithBuffer(nil, []byte("key1"))
+	_ = b.View([]byte("key2"), func(value []byte) error { return nil })
+	_, _ = b.MultiGet([][]byte{[]byte("key3"), []byte("key4")}, nil)
+	b.Del([]byte("key5"))
+	_, _ = b.Scan(10)
+	_, _ = b.ScanCursor(0, 10)
+
+	s := b.StatsSnapshot()
+	if s.Puts != 11 || s.Gets != 24 || s.Hits != 14 || s.Misses != 10 {
+		t.Fatal(s.Raw())
+	}
+	if s.HitRatio != float64(14)/24 {
+		t.Fatal(s.HitRatio)
+	}
+	expect := OpStats{Get: 20, GetWithBuffer: 1, View: 1, MultiGet: 1, Put: 10, PutWithExpire: 1, Del: 1, Scan: 2}
+	if s.Ops != expect {
+		t.Fatal(s.Ops)
+	}
+	if *b.Stats() != s.Stats {
+		t.Fatal(b.Stats().Raw())
+	}
+
+	// 第一次tick直接用当前速率, 之后按窗口衰减
+	b.rates.tick(b.rateTotal(), b.rates.lastAt.Add(time.Second))
+	s = b.StatsSnapshot()
+	if s.Rate1 != 35 || s.Rate5 != 35 || s.Rate15 != 35 {
+		t.Fatal(s.Rate1, s.Rate5, s.Rate15)
+	}
+	b.rates.tick(b.rateTotal(), b.rates.lastAt.Add(time.Second))
+	s = b.StatsSnapshot()
+	if !(s.Rate1 < s.Rate5 && s.Rate5 < s.Rate15 && s.Rate15 < 35) {
+		t.Fatal(s.Rate1, s.Rate5, s.Rate15)
+	}
+	// 没有后台goroutine, 读取时超过rateTickInterval才更新
+	calls := 0
+	total := func() uint64 {
+		calls++
+		return b.rateTotal()
+	}
+	last := b.rates.lastAt
+	b.rates.get(total, last.Add(rateTickInterval-time.Millisecond))
+	if calls != 0 {
+		t.Fatal(calls)
+	}
+	if rates := b.rates.get(total, last.Add(rateTickInterval)); calls != 1 || rates[0] >= s.Rate1 {
+		t.Fatal(calls, rates)
+	}
+
+	b.ResetStats()
+	s = b.StatsSnapshot()
+	if s.Stats != (Stats{}) || s.Ops != (OpStats{}) || s.HitRatio != 0 || !s.Since.After(start) {
+		t.Fatal(s.Raw(), s.Ops, s.Since)
+	}
+	_, _ = b.Get([]byte("key1"))
+	if s = b.StatsSnapshot(); s.Gets != 1 || s.Ops.Get != 1 {
+		t.Fatal(s.Raw())
+	}
+	// 重置后的增量不会变成负数
+	b.rates.tick(b.rateTotal(), b.rates.lastAt.Add(time.Second))
+	if s = b.StatsSnapshot(); s.Rate1 < 0 {
+		t.Fatal(s.Rate1)
+	}
+}
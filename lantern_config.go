@@ -1,11 +1,49 @@
 package lantern_cache
 
+import (
+	"strings"
+)
+
 type Config struct {
 	BucketCount          uint32
 	MaxCapacity          uint64
 	InitCapacity         uint64
 	ChunkAllocatorPolicy string
 	HashPolicy           string
+	// Hasher hashes the keys instead of the hasher of HashPolicy.
+	Hasher Hasher
+	// IndexPolicy selects the bucket index, "map" (default) uses a Go map, "flat" an open addressing
+	// table in a flat []uint64 that the GC doesn't scan, resized incrementally and shrunk when it empties.
+	IndexPolicy string
+	// OptimisticReads lets Get and View read without the bucket lock and retry when a write
+	// overlapped them, readers no longer contend on the lock. It needs the flat index, which is
+	// used when IndexPolicy is empty. On architectures other than amd64 and 386, or with the
+	// race detector, reads always lock.
+	OptimisticReads bool
+	// Checksum stores a CRC32C of every entry on put and verifies it on get,
+	// corrupt entries are dropped and counted in Stats.Corruptions.
+	Checksum bool
+	// KeyProvider enables AES-GCM encryption of values, keys stay in plain text.
+	// Values take 32 more bytes, snapshots keep them encrypted and can only be
+	// loaded into a cache with the same keys.
+	KeyProvider KeyProvider
+	// LatencySampleRate enables the latency histograms of StatsSnapshot.Latency, one in
+	// LatencySampleRate calls of Get, Put and Del and write locks of a bucket is timed.
+	// 0 disables them, 100 keeps the overhead low.
+	LatencySampleRate uint32
+	// HotKeySampleRate enables HotKeys, one in HotKeySampleRate gets and puts of a bucket is
+	// counted by a Space-Saving tracker of TrackedKeys keys. 0 disables it.
+	HotKeySampleRate uint32
+	// TrackBigKeys enables BigKeys, the TrackedKeys largest entries written are tracked.
+	TrackBigKeys bool
+	// TrackedKeys is the number of keys tracked by HotKeys and BigKeys, 128 when 0.
+	TrackedKeys int
+	// Logger receives the events of the cache: initialization, chunk allocation failures and with
+	// Verbose ring wraps and cleaning passes. A LeveledLogger gets levels and fields, noisy events
+	// are logged at most once a second. Nothing is logged when nil.
+	Logger Logger
+	// Verbose also logs debug events.
+	Verbose bool
 }
 
 func DefaultConfig() *Config {
@@ -15,5 +53,77 @@ func DefaultConfig() *Config {
 		InitCapacity:         1024 * 1024 * 100,
 		ChunkAllocatorPolicy: "heap",
 		HashPolicy:           "fnv",
+		IndexPolicy:          "map",
+	}
+}
+
+// Validate returns the error New would return for the config, a *ConfigError, without creating a cache.
+func (c *Config) Validate() error {
+	cfg := *c
+	cfg.setDefaults()
+	return cfg.validate(true)
+}
+
+// setDefaults 填上没有设置的字段
+func (c *Config) setDefaults() {
+	if c.BucketCount == 0 {
+		c.BucketCount = 1024
+	}
+	if len(c.ChunkAllocatorPolicy) == 0 {
+		c.ChunkAllocatorPolicy = "heap"
+	}
+	if len(c.HashPolicy) == 0 {
+		c.HashPolicy = "fnv"
+	}
+	if c.OptimisticReads && len(c.IndexPolicy) == 0 {
+		c.IndexPolicy = "flat"
+	}
+	if c.InitCapacity == 0 {
+		c.InitCapacity = c.MaxCapacity / 4
+	}
+}
+
+// validate strict为false时只检查NewLanternCache一直以来会panic的错误, New还检查容量是否合理
+func (c *Config) validate(strict bool) error {
+	if !isPowerOfTwo(c.BucketCount) {
+		return &ConfigError{Field: "BucketCount", Value: c.BucketCount, Reason: "must be a power of two"}
+	}
+	if c.MaxCapacity == 0 {
+		return &ConfigError{Field: "MaxCapacity", Value: c.MaxCapacity, Reason: "has to be set"}
+	}
+	switch strings.ToLower(c.ChunkAllocatorPolicy) {
+	case "heap", "mmap":
+	default:
+		return &ConfigError{Field: "ChunkAllocatorPolicy", Value: c.ChunkAllocatorPolicy, Reason: "must be heap or mmap"}
+	}
+	if c.Hasher == nil && strings.ToLower(c.HashPolicy) != "fnv" {
+		return &ConfigError{Field: "HashPolicy", Value: c.HashPolicy, Reason: "must be fnv"}
+	}
+	switch strings.ToLower(c.IndexPolicy) {
+	case "", "map", "flat":
+	default:
+		return &ConfigError{Field: "IndexPolicy", Value: c.IndexPolicy, Reason: "must be map or flat"}
+	}
+	if c.OptimisticReads && strings.ToLower(c.IndexPolicy) != "flat" {
+		return &ConfigError{Field: "OptimisticReads", Value: c.OptimisticReads, Reason: "needs the flat index, not " + c.IndexPolicy}
 	}
+	if !strict {
+		return nil
+	}
+	if c.MaxCapacity/uint64(c.BucketCount) < chunkSize {
+		return &ConfigError{Field: "MaxCapacity", Value: c.MaxCapacity, Reason: "every bucket needs at least one chunk of 64KB"}
+	}
+	if c.InitCapacity > c.MaxCapacity {
+		return &ConfigError{Field: "InitCapacity", Value: c.InitCapacity, Reason: "is greater than MaxCapacity"}
+	}
+	if c.TrackedKeys < 0 {
+		return &ConfigError{Field: "TrackedKeys", Value: c.TrackedKeys, Reason: "must not be negative"}
+	}
+	return nil
+}
+
+// capacity 返回分配所有chunk时实际占用的内存, 每个bucket的容量向上取整到chunk
+func (c *Config) capacity() uint64 {
+	bucketMaxCapacity := (c.MaxCapacity + uint64(c.BucketCount) - 1) / uint64(c.BucketCount)
+	return (bucketMaxCapacity + chunkSize - 1) / chunkSize * chunkSize * uint64(c.BucketCount)
 }
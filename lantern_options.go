@@ -0,0 +1,97 @@
+package lantern_cache
+
+// Option changes a Config, options passed to New are applied in order after the Config.
+type Option func(cfg *Config)
+
+// WithBuckets sets Config.BucketCount, it must be a power of two.
+func WithBuckets(n uint32) Option {
+	return func(cfg *Config) {
+		cfg.BucketCount = n
+	}
+}
+
+// WithMaxCapacity sets Config.MaxCapacity in bytes.
+func WithMaxCapacity(n uint64) Option {
+	return func(cfg *Config) {
+		cfg.MaxCapacity = n
+	}
+}
+
+// WithInitCapacity sets Config.InitCapacity in bytes.
+func WithInitCapacity(n uint64) Option {
+	return func(cfg *Config) {
+		cfg.InitCapacity = n
+	}
+}
+
+// WithAllocator sets Config.ChunkAllocatorPolicy, heap or mmap.
+func WithAllocator(policy string) Option {
+	return func(cfg *Config) {
+		cfg.ChunkAllocatorPolicy = policy
+	}
+}
+
+// WithHasher sets Config.Hasher.
+func WithHasher(h Hasher) Option {
+	return func(cfg *Config) {
+		cfg.Hasher = h
+	}
+}
+
+// WithIndex sets Config.IndexPolicy, map or flat.
+func WithIndex(policy string) Option {
+	return func(cfg *Config) {
+		cfg.IndexPolicy = policy
+	}
+}
+
+// WithOptimisticReads sets Config.OptimisticReads with the flat index it needs.
+func WithOptimisticReads() Option {
+	return func(cfg *Config) {
+		cfg.OptimisticReads = true
+		cfg.IndexPolicy = "flat"
+	}
+}
+
+// WithChecksum sets Config.Checksum.
+func WithChecksum() Option {
+	return func(cfg *Config) {
+		cfg.Checksum = true
+	}
+}
+
+// WithEncryption sets Config.KeyProvider.
+func WithEncryption(kp KeyProvider) Option {
+	return func(cfg *Config) {
+		cfg.KeyProvider = kp
+	}
+}
+
+// WithLatencySampleRate sets Config.LatencySampleRate.
+func WithLatencySampleRate(n uint32) Option {
+	return func(cfg *Config) {
+		cfg.LatencySampleRate = n
+	}
+}
+
+// WithHotKeys sets Config.HotKeySampleRate.
+func WithHotKeys(sampleRate uint32) Option {
+	return func(cfg *Config) {
+		cfg.HotKeySampleRate = sampleRate
+	}
+}
+
+// WithBigKeys sets Config.TrackBigKeys.
+func WithBigKeys() Option {
+	return func(cfg *Config) {
+		cfg.TrackBigKeys = true
+	}
+}
+
+// WithLogger sets Config.Logger and Config.Verbose.
+func WithLogger(l Logger, verbose bool) Option {
+	return func(cfg *Config) {
+		cfg.Logger = l
+		cfg.Verbose = verbose
+	}
+}
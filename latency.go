@@ -0,0 +1,220 @@
+package lantern_cache
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+/*
+延迟直方图: 延迟换算成1/1024微秒的单位后按2的幂分组, 每组再等分成4个子区间, 相对误差不超过25%
+单位选1/1024微秒是为了让1, 2, 4, 8...微秒正好是区间的边界, prometheus和LATENCY HISTOGRAM按微秒的2的幂输出时没有误差
+计数都是原子操作, 一个直方图被所有goroutine共享, 靠采样减少对同一个计数的竞争
+*/
+
+const (
+	latencySubBits    = 2
+	latencySubBuckets = 1 << latencySubBits
+	// latencyMaxExp 超过2^40个单位(约18分钟)的延迟都计入最后一个区间
+	latencyMaxExp  = 40
+	latencyBuckets = (latencyMaxExp - latencySubBits + 2) * latencySubBuckets
+)
+
+// latencyUnits 把延迟换算成1/1024微秒
+func latencyUnits(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	if d >= 1<<latencyMaxExp {
+		return 1<<(latencyMaxExp+1) - 1
+	}
+	return uint64(d) * 128 / 125
+}
+
+// latencyDuration 把1/1024微秒的单位换算回延迟, 向上取整
+func latencyDuration(units uint64) time.Duration {
+	return time.Duration((units*125 + 127) / 128)
+}
+
+func latencyBucket(units uint64) int {
+	if units < latencySubBuckets {
+		return int(units)
+	}
+	exp := bits.Len64(units) - 1
+	if exp > latencyMaxExp {
+		return latencyBuckets - 1
+	}
+	sub := (units >> uint(exp-latencySubBits)) & (latencySubBuckets - 1)
+	return (exp-latencySubBits+1)*latencySubBuckets + int(sub)
+}
+
+// latencyUpperBound 返回区间的上界(不包含), 单位是1/1024微秒
+func latencyUpperBound(i int) uint64 {
+	if i < latencySubBuckets {
+		return uint64(i) + 1
+	}
+	exp := i/latencySubBuckets + latencySubBits - 1
+	sub := uint64(i % latencySubBuckets)
+	return (latencySubBuckets + sub + 1) << uint(exp-latencySubBits)
+}
+
+// latencyHistogram 快照的Count是各区间的和, 和区间的计数总是一致的
+type latencyHistogram struct {
+	sum     uint64
+	buckets [latencyBuckets]uint64
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	atomic.AddUint64(&h.buckets[latencyBucket(latencyUnits(d))], 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// since 记录从start开始的延迟, start是零值表示没有采样
+func (h *latencyHistogram) since(start time.Time) {
+	if !start.IsZero() {
+		h.record(time.Since(start))
+	}
+}
+
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	ret := LatencyHistogram{Sum: time.Duration(atomic.LoadUint64(&h.sum))}
+	for i := range h.buckets {
+		if n := atomic.LoadUint64(&h.buckets[i]); n > 0 {
+			ret.Count += n
+			ret.Buckets = append(ret.Buckets, LatencyBucket{UpperBound: latencyDuration(latencyUpperBound(i)), Count: n})
+		}
+	}
+	return ret
+}
+
+func (h *latencyHistogram) reset() {
+	atomic.StoreUint64(&h.sum, 0)
+	for i := range h.buckets {
+		atomic.StoreUint64(&h.buckets[i], 0)
+	}
+}
+
+// LatencyHistogram is a log bucketed latency histogram, the bucket of a latency is at most 25% wider
+// than the latency. Bucket bounds include every power of two microseconds.
+type LatencyHistogram struct {
+	Count uint64        `json:"count"`
+	Sum   time.Duration `json:"sum"`
+	// Buckets are the non empty buckets in ascending order, the counts are not cumulative.
+	Buckets []LatencyBucket `json:"buckets,omitempty"`
+}
+
+// LatencyBucket counts the latencies below UpperBound and at least the UpperBound of the previous bucket.
+type LatencyBucket struct {
+	UpperBound time.Duration `json:"le"`
+	Count      uint64        `json:"count"`
+}
+
+// Mean returns the average latency, 0 without latencies.
+func (h *LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Percentile returns the upper bound of the bucket holding the p-th percentile, p is in [0, 100].
+func (h *LatencyHistogram) Percentile(p float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(p / 100 * float64(h.Count))
+	if rank == 0 {
+		rank = 1
+	}
+	n := uint64(0)
+	for i := range h.Buckets {
+		n += h.Buckets[i].Count
+		if n >= rank {
+			return h.Buckets[i].UpperBound
+		}
+	}
+	return h.Buckets[len(h.Buckets)-1].UpperBound
+}
+
+// CountBelow returns the number of latencies in buckets whose upper bound is at most d, it is
+// exact when d is a power of two microseconds.
+func (h *LatencyHistogram) CountBelow(d time.Duration) uint64 {
+	n := uint64(0)
+	for i := range h.Buckets {
+		if h.Buckets[i].UpperBound > d {
+			break
+		}
+		n += h.Buckets[i].Count
+	}
+	return n
+}
+
+// LatencyStats are the latency histograms of a cache, enabled by Config.LatencySampleRate.
+type LatencyStats struct {
+	// SampleRate is Config.LatencySampleRate, Get, Put, Del and LockWait count one in SampleRate calls.
+	SampleRate uint32 `json:"sample_rate"`
+	// Get includes GetWithBuffer, Put includes PutWithExpire.
+	Get LatencyHistogram `json:"get"`
+	Put LatencyHistogram `json:"put"`
+	Del LatencyHistogram `json:"del"`
+	// LockWait is the time waiting for the write lock of a bucket.
+	LockWait LatencyHistogram `json:"lock_wait"`
+	// ChunkAlloc is the time allocating chunks while writing, every allocation is counted.
+	ChunkAlloc LatencyHistogram `json:"chunk_alloc"`
+}
+
+// cacheLatency 所有bucket共享, rate是0时不统计
+type cacheLatency struct {
+	rate       uint64
+	get        latencyHistogram
+	put        latencyHistogram
+	del        latencyHistogram
+	lockWait   latencyHistogram
+	chunkAlloc latencyHistogram
+}
+
+func newCacheLatency(rate uint32) *cacheLatency {
+	return &cacheLatency{rate: uint64(rate)}
+}
+
+func (l *cacheLatency) enabled() bool {
+	return l.rate != 0
+}
+
+// start n是调用的计数, 每rate次采样一次, 采样时返回当前时间, 否则返回零值
+func (l *cacheLatency) start(n uint64) time.Time {
+	if l.rate == 0 || n%l.rate != 0 {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// now 不采样, 开启统计时总是返回当前时间
+func (l *cacheLatency) now() time.Time {
+	if l.rate == 0 {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (l *cacheLatency) snapshot() *LatencyStats {
+	if l.rate == 0 {
+		return nil
+	}
+	return &LatencyStats{
+		SampleRate: uint32(l.rate),
+		Get:        l.get.snapshot(),
+		Put:        l.put.snapshot(),
+		Del:        l.del.snapshot(),
+		LockWait:   l.lockWait.snapshot(),
+		ChunkAlloc: l.chunkAlloc.snapshot(),
+	}
+}
+
+func (l *cacheLatency) reset() {
+	l.get.reset()
+	l.put.reset()
+	l.del.reset()
+	l.lockWait.reset()
+	l.chunkAlloc.reset()
+}
@@ -0,0 +1,92 @@
+package lantern_cache
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	// 区间的上界大于延迟, 宽度不超过延迟的25%
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		d := time.Duration(r.Int63n(int64(time.Second) >> uint(r.Intn(30))))
+		upper := latencyDuration(latencyUpperBound(latencyBucket(latencyUnits(d))))
+		if upper <= d || (d > 100 && float64(upper) > 1.25*float64(d)+2) {
+			t.Fatal(d, upper)
+		}
+	}
+	// 2的幂微秒是区间的边界
+	for usec := time.Duration(1); usec <= 1<<30; usec <<= 1 {
+		d := usec * time.Microsecond
+		assert.Equal(t, latencyBucket(latencyUnits(d-1))+1, latencyBucket(latencyUnits(d)), d)
+	}
+	assert.Equal(t, latencyBuckets-1, latencyBucket(latencyUnits(time.Duration(1<<62))))
+
+	h := &latencyHistogram{}
+	for i := 1; i <= 100; i++ {
+		h.record(time.Duration(i) * time.Microsecond)
+	}
+	s := h.snapshot()
+	assert.Equal(t, uint64(100), s.Count)
+	assert.Equal(t, 5050*time.Microsecond, s.Sum)
+	assert.Equal(t, 50500*time.Nanosecond, s.Mean())
+	assert.Equal(t, uint64(1), s.CountBelow(2*time.Microsecond))
+	assert.Equal(t, uint64(63), s.CountBelow(64*time.Microsecond))
+	assert.Equal(t, uint64(100), s.CountBelow(128*time.Microsecond))
+	p50 := s.Percentile(50)
+	assert.True(t, p50 > 50*time.Microsecond && p50 <= 64*time.Microsecond, p50)
+	p99 := s.Percentile(99)
+	assert.True(t, p99 > 99*time.Microsecond && p99 <= 112*time.Microsecond, p99)
+
+	h.reset()
+	assert.Equal(t, LatencyHistogram{}, h.snapshot())
+}
+
+func TestLanternCacheLatency(t *testing.T) {
+	ca := NewLanternCache(&Config{BucketCount: 2, MaxCapacity: 4 * chunkSize, InitCapacity: chunkSize})
+	assert.Nil(t, ca.StatsSnapshot().Latency)
+
+	ca = NewLanternCache(&Config{BucketCount: 2, MaxCapacity: 4 * chunkSize, InitCapacity: chunkSize, LatencySampleRate: 2})
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		assert.Nil(t, ca.Put(key, make([]byte, 200)))
+		_, _ = ca.Get(key)
+		ca.Del(key)
+	}
+	l := ca.StatsSnapshot().Latency
+	assert.Equal(t, uint32(2), l.SampleRate)
+	// 每个bucket采样一半
+	assert.Equal(t, uint64(500), l.Get.Count)
+	assert.Equal(t, uint64(500), l.Put.Count)
+	assert.Equal(t, uint64(500), l.Del.Count)
+	assert.Equal(t, uint64(1000), l.LockWait.Count)
+	// 初始每个bucket只有一个chunk, 写满时分配其余的chunk
+	assert.Equal(t, uint64(2), l.ChunkAlloc.Count)
+
+	rec := httptest.NewRecorder()
+	ca.MetricsHandler(&MetricsOptions{Commands: func() map[string]LatencyHistogram {
+		return map[string]LatencyHistogram{"get": l.Get}
+	}}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE lantern_latency_seconds histogram",
+		`lantern_latency_seconds_bucket{op="get",le="+Inf"} 500`,
+		`lantern_latency_seconds_count{op="put"} 500`,
+		fmt.Sprintf(`lantern_latency_seconds_bucket{op="del",le="1e-06"} %d`, l.Del.CountBelow(time.Microsecond)),
+		`lantern_lock_wait_seconds_bucket{le="+Inf"} 1000`,
+		"lantern_chunk_alloc_seconds_count 2",
+		`lantern_command_latency_seconds_count{command="get"} 500`,
+	} {
+		assert.True(t, strings.Contains(body, line+"\n"), line)
+	}
+
+	ca.ResetStats()
+	assert.Equal(t, uint64(0), ca.StatsSnapshot().Latency.Get.Count)
+}
@@ -1,11 +1,17 @@
 package lantern_cache
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Logger is invoked when `Config.Verbose=true`
+// Logger receives the events of the cache and the servers, see Config.Logger
 type Logger interface {
 	Printf(format string, v ...interface{})
 }
@@ -21,6 +27,24 @@ func DefaultLogger() Logger {
 	return log.New(os.Stdout, "", log.LstdFlags)
 }
 
+// stdLogger 把Logger转成*log.Logger, 给http.Server.ErrorLog这种只接受*log.Logger的地方用
+func stdLogger(l Logger) *log.Logger {
+	if ret, ok := l.(*log.Logger); ok {
+		return ret
+	}
+	return log.New(loggerWriter{l}, "", 0)
+}
+
+// loggerWriter log.Logger每次Output调用一次Write, 一次Write就是一行
+type loggerWriter struct {
+	l Logger
+}
+
+func (w loggerWriter) Write(p []byte) (int, error) {
+	w.l.Printf("%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
 type noneLogger struct {
 }
 
@@ -30,3 +54,157 @@ func (n *noneLogger) Printf(format string, v ...interface{}) {
 func NoneLogger() Logger {
 	return &noneLogger{}
 }
+
+// Level is the severity of a logged event.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Field is a key value pair attached to a logged event.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a Field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// LeveledLogger is a Logger receiving events with a level and fields. A Logger passed in the
+// options of the cache or a server that also implements LeveledLogger gets events through Log,
+// other Loggers get them formatted by NewLeveledLogger.
+type LeveledLogger interface {
+	Logger
+	Log(level Level, msg string, fields ...Field)
+}
+
+// NewLeveledLogger returns a LeveledLogger writing events of at least level to out, formatted as
+// logfmt like `level=info msg="cache initialized" buckets=1024`.
+func NewLeveledLogger(out Logger, level Level) LeveledLogger {
+	return &printfLogger{out: out, level: level}
+}
+
+type printfLogger struct {
+	out   Logger
+	level Level
+}
+
+func (p *printfLogger) Printf(format string, v ...interface{}) {
+	p.out.Printf(format, v...)
+}
+
+func (p *printfLogger) Log(level Level, msg string, fields ...Field) {
+	if level < p.level {
+		return
+	}
+	buf := make([]byte, 0, 128)
+	buf = append(buf, "level="...)
+	buf = append(buf, level.String()...)
+	buf = append(buf, " msg="...)
+	buf = appendLogValue(buf, msg)
+	for _, f := range fields {
+		buf = append(buf, ' ')
+		buf = append(buf, f.Key...)
+		buf = append(buf, '=')
+		buf = appendLogValue(buf, fmt.Sprint(f.Value))
+	}
+	p.out.Printf("%s", buf)
+}
+
+// appendLogValue 有空格, 引号或者等号时加引号
+func appendLogValue(buf []byte, s string) []byte {
+	if s == "" || strings.ContainsAny(s, " \"=\t\r\n") {
+		return strconv.AppendQuote(buf, s)
+	}
+	return append(buf, s...)
+}
+
+// logRateInterval 限流的事件每个间隔最多写一次, 其余的计数后在下一次一起报告
+const logRateInterval = time.Second
+
+// eventLogger 是cache, bucket, allocator和RedisServer写事件的入口, nil时什么都不写
+type eventLogger struct {
+	out   LeveledLogger
+	level Level
+	// limiters msg -> *logLimiter
+	limiters sync.Map
+}
+
+type logLimiter struct {
+	last       int64
+	suppressed uint64
+}
+
+// newEventLogger l是nil时返回nil, verbose时写debug事件
+func newEventLogger(l Logger, verbose bool) *eventLogger {
+	if l == nil {
+		return nil
+	}
+	if _, ok := l.(*noneLogger); ok {
+		return nil
+	}
+	ret := &eventLogger{level: LevelInfo}
+	if verbose {
+		ret.level = LevelDebug
+	}
+	if leveled, ok := l.(LeveledLogger); ok {
+		ret.out = leveled
+	} else {
+		ret.out = NewLeveledLogger(l, LevelDebug)
+	}
+	return ret
+}
+
+// enabled 调用方在准备fields之前检查, 避免在热路径上分配
+func (l *eventLogger) enabled(level Level) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *eventLogger) log(level Level, msg string, fields ...Field) {
+	if !l.enabled(level) {
+		return
+	}
+	l.out.Log(level, msg, fields...)
+}
+
+// logLimited 同一个msg每logRateInterval最多写一次, 被丢弃的次数写在下一次的suppressed里
+func (l *eventLogger) logLimited(level Level, msg string, fields ...Field) {
+	if !l.enabled(level) {
+		return
+	}
+	v, ok := l.limiters.Load(msg)
+	if !ok {
+		v, _ = l.limiters.LoadOrStore(msg, &logLimiter{})
+	}
+	limiter := v.(*logLimiter)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&limiter.last)
+	if now-last < int64(logRateInterval) || !atomic.CompareAndSwapInt64(&limiter.last, last, now) {
+		atomic.AddUint64(&limiter.suppressed, 1)
+		return
+	}
+	if n := atomic.SwapUint64(&limiter.suppressed, 0); n > 0 {
+		fields = append(fields, F("suppressed", n))
+	}
+	l.out.Log(level, msg, fields...)
+}
@@ -0,0 +1,98 @@
+package lantern_cache
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordLogger 记录收到的事件
+type recordLogger struct {
+	mutex  sync.Mutex
+	lines  []string
+	events []string
+}
+
+func (r *recordLogger) Printf(format string, v ...interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lines = append(r.lines, fmt.Sprintf(format, v...))
+}
+
+func (r *recordLogger) Log(level Level, msg string, fields ...Field) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, level.String()+" "+msg)
+}
+
+func (r *recordLogger) has(event string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, e := range r.events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLeveledLogger(t *testing.T) {
+	out := &recordLogger{}
+	l := NewLeveledLogger(out, LevelInfo)
+	l.Log(LevelDebug, "hidden")
+	l.Log(LevelWarn, "client rejected", F("addr", "127.0.0.1:1"), F("reason", "max clients"), F("n", 3))
+	assert.Equal(t, []string{`level=warn msg="client rejected" addr=127.0.0.1:1 reason="max clients" n=3`}, out.lines)
+}
+
+func TestEventLogger(t *testing.T) {
+	assert.Nil(t, newEventLogger(nil, true))
+	assert.Nil(t, newEventLogger(NoneLogger(), true))
+	// nil不写任何事件
+	var none *eventLogger
+	none.log(LevelError, "ignored")
+	none.logLimited(LevelError, "ignored")
+
+	out := &recordLogger{}
+	l := newEventLogger(out, false)
+	l.log(LevelDebug, "debug")
+	for i := 0; i < 10; i++ {
+		l.logLimited(LevelInfo, "noisy")
+	}
+	assert.Equal(t, []string{"info noisy"}, out.events)
+
+	// 被限流丢掉的次数在下一次写出
+	lines := &recordLogger{}
+	l = newEventLogger(NewLeveledLogger(lines, LevelDebug), true)
+	l.logLimited(LevelDebug, "noisy")
+	l.logLimited(LevelDebug, "noisy")
+	l.limiters.Range(func(key, value interface{}) bool {
+		value.(*logLimiter).last = 0
+		return true
+	})
+	l.logLimited(LevelDebug, "noisy")
+	assert.Equal(t, []string{"level=debug msg=noisy", "level=debug msg=noisy suppressed=1"}, lines.lines)
+}
+
+func TestLanternCacheLogger(t *testing.T) {
+	out := &recordLogger{}
+	ca := NewLanternCache(&Config{BucketCount: 1, MaxCapacity: 2 * chunkSize, Logger: out, Verbose: true})
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, ca.Put([]byte(fmt.Sprintf("key%d", i)), make([]byte, 200)))
+	}
+	// 每CleanCount次写入清理一次
+	ca.loadLayout().buckets[0].clean()
+	assert.True(t, out.has("info cache initialized"))
+	assert.True(t, out.has("debug ring wrapped"))
+	assert.True(t, out.has("debug bucket cleaned"))
+
+	// 不开启Verbose时只有初始化
+	out = &recordLogger{}
+	ca = NewLanternCache(&Config{BucketCount: 1, MaxCapacity: 2 * chunkSize, Logger: out})
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, ca.Put([]byte(fmt.Sprintf("key%d", i)), make([]byte, 200)))
+	}
+	assert.Equal(t, "info cache initialized", strings.Join(out.events, ","))
+}
@@ -0,0 +1,317 @@
+package lantern_cache
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	memcachedMagicRequest  = 0x80
+	memcachedMagicResponse = 0x81
+	memcachedHeaderSize    = 24
+)
+
+// 二进制协议的opcode, 带Q的是quiet版本, 成功时不回复(get类命令是miss时不回复)
+const (
+	memcachedOpGet        = 0x00
+	memcachedOpSet        = 0x01
+	memcachedOpAdd        = 0x02
+	memcachedOpReplace    = 0x03
+	memcachedOpDelete     = 0x04
+	memcachedOpIncrement  = 0x05
+	memcachedOpDecrement  = 0x06
+	memcachedOpQuit       = 0x07
+	memcachedOpFlush      = 0x08
+	memcachedOpGetQ       = 0x09
+	memcachedOpNoop       = 0x0a
+	memcachedOpVersion    = 0x0b
+	memcachedOpGetK       = 0x0c
+	memcachedOpGetKQ      = 0x0d
+	memcachedOpAppend     = 0x0e
+	memcachedOpPrepend    = 0x0f
+	memcachedOpStat       = 0x10
+	memcachedOpSetQ       = 0x11
+	memcachedOpAddQ       = 0x12
+	memcachedOpReplaceQ   = 0x13
+	memcachedOpDeleteQ    = 0x14
+	memcachedOpIncrementQ = 0x15
+	memcachedOpDecrementQ = 0x16
+	memcachedOpQuitQ      = 0x17
+	memcachedOpFlushQ     = 0x18
+	memcachedOpAppendQ    = 0x19
+	memcachedOpPrependQ   = 0x1a
+	memcachedOpTouch      = 0x1c
+	memcachedOpGAT        = 0x1d
+	memcachedOpGATQ       = 0x1e
+	memcachedOpGATK       = 0x23
+	memcachedOpGATKQ      = 0x24
+)
+
+const (
+	memcachedStatusOK             = 0x0000
+	memcachedStatusKeyNotFound    = 0x0001
+	memcachedStatusKeyExists      = 0x0002
+	memcachedStatusValueTooLarge  = 0x0003
+	memcachedStatusInvalidArgs    = 0x0004
+	memcachedStatusNotStored      = 0x0005
+	memcachedStatusNonNumeric     = 0x0006
+	memcachedStatusUnknownCommand = 0x0081
+	memcachedStatusOutOfMemory    = 0x0082
+)
+
+var memcachedStatusCodes = map[memcachedStatus]uint16{
+	memcachedOK:          memcachedStatusOK,
+	memcachedNotStored:   memcachedStatusNotStored,
+	memcachedExists:      memcachedStatusKeyExists,
+	memcachedNotFound:    memcachedStatusKeyNotFound,
+	memcachedNonNumeric:  memcachedStatusNonNumeric,
+	memcachedTooLarge:    memcachedStatusValueTooLarge,
+	memcachedServerError: memcachedStatusOutOfMemory,
+}
+
+var memcachedStatusMessages = map[uint16]string{
+	memcachedStatusKeyNotFound:    "Not found",
+	memcachedStatusKeyExists:      "Data exists for key.",
+	memcachedStatusValueTooLarge:  "Too large.",
+	memcachedStatusInvalidArgs:    "Invalid arguments",
+	memcachedStatusNotStored:      "Not stored.",
+	memcachedStatusNonNumeric:     "Non-numeric server-side value for incr or decr",
+	memcachedStatusUnknownCommand: "Unknown command",
+	memcachedStatusOutOfMemory:    "Out of memory",
+}
+
+/*
+┌─────────────────────────────────────────────────────────┐
+│                 binary request header                   │
+├───────┬────────┬─────────┬────────┬──────────┬──────────┤
+│   1   │   1    │    2    │   1    │    1     │    2     │
+├───────┼────────┼─────────┼────────┼──────────┼──────────┤
+│ magic │ opcode │ key len │ extras │ datatype │ vbucket  │
+├───────┴────────┴─────────┼────────┴──────────┴──────────┤
+│  total body len (4)      │          opaque (4)          │
+├──────────────────────────┴──────────────────────────────┤
+│                         cas (8)                         │
+└─────────────────────────────────────────────────────────┘
+*/
+type memcachedBinaryRequest struct {
+	opcode byte
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+func (m *MemcachedServer) writeBinary(c *memcachedConn, req *memcachedBinaryRequest, status uint16, cas uint64, extras, key, value []byte) {
+	if status != memcachedStatusOK && value == nil {
+		value = []byte(memcachedStatusMessages[status])
+	}
+	var hdr [memcachedHeaderSize]byte
+	hdr[0] = memcachedMagicResponse
+	hdr[1] = req.opcode
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(key)))
+	hdr[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(hdr[6:], status)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(hdr[12:], req.opaque)
+	binary.BigEndian.PutUint64(hdr[16:], cas)
+	c.wr.Write(hdr[:])
+	c.wr.Write(extras)
+	c.wr.Write(key)
+	c.wr.Write(value)
+}
+
+// handleBinary 处理一条二进制协议的命令, 返回错误时关闭连接
+func (m *MemcachedServer) handleBinary(c *memcachedConn) error {
+	var hdr [memcachedHeaderSize]byte
+	if _, err := io.ReadFull(c.rd, hdr[:]); err != nil {
+		return err
+	}
+	req := &memcachedBinaryRequest{
+		opcode: hdr[1],
+		opaque: binary.BigEndian.Uint32(hdr[12:]),
+		cas:    binary.BigEndian.Uint64(hdr[16:]),
+	}
+	keyLen := int(binary.BigEndian.Uint16(hdr[2:]))
+	extrasLen := int(hdr[4])
+	bodyLen := int64(binary.BigEndian.Uint32(hdr[8:]))
+	if int64(keyLen+extrasLen) > bodyLen {
+		m.writeBinary(c, req, memcachedStatusInvalidArgs, 0, nil, nil, nil)
+		return io.ErrUnexpectedEOF
+	}
+	if bodyLen-int64(keyLen+extrasLen) > int64(m.opts.MaxItemSize) {
+		if _, err := io.CopyN(ioutil.Discard, c.rd, bodyLen); err != nil {
+			return err
+		}
+		m.writeBinary(c, req, memcachedStatusValueTooLarge, 0, nil, nil, nil)
+		return nil
+	}
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(c.rd, body); err != nil {
+		return err
+	}
+	req.extras = body[:extrasLen]
+	req.key = body[extrasLen : extrasLen+keyLen]
+	req.value = body[extrasLen+keyLen:]
+
+	switch req.opcode {
+	case memcachedOpGet, memcachedOpGetQ, memcachedOpGetK, memcachedOpGetKQ,
+		memcachedOpGAT, memcachedOpGATQ, memcachedOpGATK, memcachedOpGATKQ:
+		m.binaryGet(c, req)
+	case memcachedOpSet, memcachedOpSetQ, memcachedOpAdd, memcachedOpAddQ, memcachedOpReplace, memcachedOpReplaceQ:
+		// extras: flags(4) exptime(4)
+		if len(req.extras) != 8 || len(req.key) == 0 {
+			m.writeBinary(c, req, memcachedStatusInvalidArgs, 0, nil, nil, nil)
+			return nil
+		}
+		mode := memcachedSet
+		switch req.opcode {
+		case memcachedOpAdd, memcachedOpAddQ:
+			mode = memcachedAdd
+		case memcachedOpReplace, memcachedOpReplaceQ:
+			mode = memcachedReplace
+		}
+		if req.cas != 0 {
+			mode = memcachedCas
+		}
+		flags := binary.BigEndian.Uint32(req.extras)
+		exptime := int64(binary.BigEndian.Uint32(req.extras[4:]))
+		status, cas := m.store(mode, req.key, flags, exptime, req.value, req.cas)
+		// 二进制协议里add遇到已存在的key返回KeyExists, replace遇到不存在的key返回KeyNotFound
+		if status == memcachedNotStored && mode == memcachedAdd {
+			status = memcachedExists
+		} else if status == memcachedNotStored && mode == memcachedReplace {
+			status = memcachedNotFound
+		}
+		m.binaryReply(c, req, status, cas, nil)
+	case memcachedOpAppend, memcachedOpAppendQ, memcachedOpPrepend, memcachedOpPrependQ:
+		if len(req.extras) != 0 || len(req.key) == 0 {
+			m.writeBinary(c, req, memcachedStatusInvalidArgs, 0, nil, nil, nil)
+			return nil
+		}
+		mode := memcachedAppend
+		if req.opcode == memcachedOpPrepend || req.opcode == memcachedOpPrependQ {
+			mode = memcachedPrepend
+		}
+		status, cas := m.store(mode, req.key, 0, 0, req.value, 0)
+		m.binaryReply(c, req, status, cas, nil)
+	case memcachedOpDelete, memcachedOpDeleteQ:
+		if len(req.key) == 0 {
+			m.writeBinary(c, req, memcachedStatusInvalidArgs, 0, nil, nil, nil)
+			return nil
+		}
+		m.binaryReply(c, req, m.delete(req.key, req.cas), 0, nil)
+	case memcachedOpIncrement, memcachedOpIncrementQ, memcachedOpDecrement, memcachedOpDecrementQ:
+		// extras: delta(8) initial(8) exptime(4), exptime为0xffffffff时key不存在不创建
+		if len(req.extras) != 20 || len(req.key) == 0 {
+			m.writeBinary(c, req, memcachedStatusInvalidArgs, 0, nil, nil, nil)
+			return nil
+		}
+		delta := binary.BigEndian.Uint64(req.extras)
+		initial := binary.BigEndian.Uint64(req.extras[8:])
+		exptime := binary.BigEndian.Uint32(req.extras[16:])
+		var init *uint64
+		if exptime != 0xffffffff {
+			init = &initial
+		}
+		decr := req.opcode == memcachedOpDecrement || req.opcode == memcachedOpDecrementQ
+		n, cas, status := m.incr(req.key, delta, decr, init, int64(exptime))
+		var value []byte
+		if status == memcachedOK {
+			value = make([]byte, 8)
+			binary.BigEndian.PutUint64(value, n)
+		}
+		m.binaryReply(c, req, status, cas, value)
+	case memcachedOpTouch:
+		if len(req.extras) != 4 || len(req.key) == 0 {
+			m.writeBinary(c, req, memcachedStatusInvalidArgs, 0, nil, nil, nil)
+			return nil
+		}
+		exptime := int64(binary.BigEndian.Uint32(req.extras))
+		m.binaryReply(c, req, m.touch(req.key, exptime), 0, nil)
+	case memcachedOpFlush, memcachedOpFlushQ:
+		delay := int64(0)
+		if len(req.extras) == 4 {
+			delay = int64(binary.BigEndian.Uint32(req.extras))
+		}
+		m.flushAll(delay)
+		m.binaryReply(c, req, memcachedOK, 0, nil)
+	case memcachedOpNoop:
+		m.writeBinary(c, req, memcachedStatusOK, 0, nil, nil, nil)
+	case memcachedOpVersion:
+		m.writeBinary(c, req, memcachedStatusOK, 0, nil, nil, []byte(lanternVersion))
+	case memcachedOpStat:
+		if len(req.key) == 0 {
+			for _, kv := range m.statsList() {
+				m.writeBinary(c, req, memcachedStatusOK, 0, nil, []byte(kv[0]), []byte(kv[1]))
+			}
+		}
+		m.writeBinary(c, req, memcachedStatusOK, 0, nil, nil, nil)
+	case memcachedOpQuit:
+		m.writeBinary(c, req, memcachedStatusOK, 0, nil, nil, nil)
+		return errMemcachedQuit
+	case memcachedOpQuitQ:
+		return errMemcachedQuit
+	default:
+		m.writeBinary(c, req, memcachedStatusUnknownCommand, 0, nil, nil, nil)
+	}
+	return nil
+}
+
+func memcachedQuiet(opcode byte) bool {
+	switch opcode {
+	case memcachedOpGetQ, memcachedOpGetKQ, memcachedOpGATQ, memcachedOpGATKQ,
+		memcachedOpSetQ, memcachedOpAddQ, memcachedOpReplaceQ, memcachedOpDeleteQ,
+		memcachedOpIncrementQ, memcachedOpDecrementQ, memcachedOpFlushQ,
+		memcachedOpAppendQ, memcachedOpPrependQ:
+		return true
+	}
+	return false
+}
+
+// binaryReply quiet命令成功时不回复
+func (m *MemcachedServer) binaryReply(c *memcachedConn, req *memcachedBinaryRequest, status memcachedStatus, cas uint64, value []byte) {
+	if status == memcachedOK && memcachedQuiet(req.opcode) {
+		return
+	}
+	m.writeBinary(c, req, memcachedStatusCodes[status], cas, nil, nil, value)
+}
+
+func (m *MemcachedServer) binaryGet(c *memcachedConn, req *memcachedBinaryRequest) {
+	withKey := false
+	touch := false
+	switch req.opcode {
+	case memcachedOpGetK, memcachedOpGetKQ:
+		withKey = true
+	case memcachedOpGAT, memcachedOpGATQ:
+		touch = true
+	case memcachedOpGATK, memcachedOpGATKQ:
+		withKey, touch = true, true
+	}
+	if len(req.key) == 0 || (touch && len(req.extras) != 4) || (!touch && len(req.extras) != 0) {
+		m.writeBinary(c, req, memcachedStatusInvalidArgs, 0, nil, nil, nil)
+		return
+	}
+
+	var item memcachedItem
+	var ok bool
+	if touch {
+		item, ok = m.getAndTouch(req.key, int64(binary.BigEndian.Uint32(req.extras)))
+	} else {
+		item, ok = m.get(req.key)
+	}
+	var key []byte
+	if withKey {
+		key = req.key
+	}
+	if !ok {
+		if !memcachedQuiet(req.opcode) {
+			m.writeBinary(c, req, memcachedStatusKeyNotFound, 0, nil, key, nil)
+		}
+		return
+	}
+	extras := make([]byte, 4)
+	binary.BigEndian.PutUint32(extras, item.flags)
+	m.writeBinary(c, req, memcachedStatusOK, item.cas, extras, key, item.data)
+}
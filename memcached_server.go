@@ -0,0 +1,342 @@
+package lantern_cache
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxMemcachedItemSize cache的value最大MaxValueSize, 还要放下flags和写入时间
+	maxMemcachedItemSize = MaxValueSize - memcachedValueHeaderSize
+	// memcached的命令行最长2048字节左右, multi get可能很长, 这里放宽到64KB
+	memcachedMaxLineLen = 64 * 1024
+)
+
+// MemcachedServerOptions configures a MemcachedServer, the zero value serves plain TCP without limits.
+type MemcachedServerOptions struct {
+	// Network is "tcp" (the default) or "unix", for "unix" addr is the socket path.
+	Network string
+	// MaxClients limits the number of connected clients, 0 means no limit.
+	MaxClients int
+	// IdleTimeout closes clients which send nothing for the duration.
+	IdleTimeout time.Duration
+	// ReadTimeout limits the time to read the rest of a request once it started.
+	ReadTimeout time.Duration
+	// WriteTimeout limits the time of every write to a client.
+	WriteTimeout time.Duration
+	// MaxItemSize limits the size of a value. It can't exceed the largest value the entry format of
+	// LanternCache can hold, MaxValueSize minus 12 bytes, which is also the default.
+	MaxItemSize int
+
+	// Logger logs connection errors, DefaultLogger() when nil.
+	Logger Logger
+}
+
+func (o *MemcachedServerOptions) init() {
+	if o.Network == "" {
+		o.Network = "tcp"
+	}
+	// 更大的value读完以后也存不进cache, 读取请求时就拒绝
+	if o.MaxItemSize <= 0 || o.MaxItemSize > maxMemcachedItemSize {
+		o.MaxItemSize = maxMemcachedItemSize
+	}
+	if o.Logger == nil {
+		o.Logger = DefaultLogger()
+	}
+}
+
+type MemcachedServerStats struct {
+	TotalConnections    uint64
+	RejectedConnections uint64
+	CmdGet              uint64
+	CmdSet              uint64
+	CmdTouch            uint64
+	CmdFlush            uint64
+	GetHits             uint64
+	GetMisses           uint64
+	DeleteHits          uint64
+	DeleteMisses        uint64
+	IncrHits            uint64
+	IncrMisses          uint64
+	DecrHits            uint64
+	DecrMisses          uint64
+	CasHits             uint64
+	CasMisses           uint64
+	CasBadval           uint64
+	TouchHits           uint64
+	TouchMisses         uint64
+	CurrConnections     int
+}
+
+// MemcachedServer serves LanternCache over the memcached text and binary protocols.
+// Flags are stored as a 4 bytes prefix of the value and the cas unique is the version of the entry,
+// so values written by the memcached server can't be shared with RedisServer.
+type MemcachedServer struct {
+	stats MemcachedServerStats
+	// flushAt 是延迟的flush_all生效的unix时间, 0表示没有
+	flushAt int64
+	addr    string
+	cache   *LanternCache
+	opts    MemcachedServerOptions
+	started time.Time
+
+	mutex          sync.Mutex
+	listener       net.Listener
+	listenerClosed bool
+	conns          map[*memcachedConn]struct{}
+	done           bool
+	inShutdown     int32
+}
+
+func NewMemcachedServer(addr string, cache *LanternCache, opts *MemcachedServerOptions) *MemcachedServer {
+	if opts == nil {
+		opts = &MemcachedServerOptions{}
+	}
+	ret := &MemcachedServer{
+		addr:    addr,
+		cache:   cache,
+		opts:    *opts,
+		started: time.Now(),
+		conns:   make(map[*memcachedConn]struct{}),
+	}
+	ret.opts.init()
+	return ret
+}
+
+type memcachedConn struct {
+	net.Conn
+	srv *MemcachedServer
+	rd  *bufio.Reader
+	wr  *bufio.Writer
+	// mutex 保证Shutdown只唤醒等待新命令的连接
+	mutex sync.Mutex
+	idle  bool
+}
+
+func (c *memcachedConn) Write(p []byte) (int, error) {
+	if timeout := c.srv.opts.WriteTimeout; timeout > 0 {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	return c.Conn.Write(p)
+}
+
+// waitCommand 等待下一个命令的第一个字节, 返回false表示连接需要关闭
+func (c *memcachedConn) waitCommand() bool {
+	c.mutex.Lock()
+	if c.rd.Buffered() == 0 {
+		if c.srv.shuttingDown() {
+			c.mutex.Unlock()
+			return false
+		}
+		c.idle = true
+		_ = c.Conn.SetReadDeadline(deadline(c.srv.opts.IdleTimeout))
+	}
+	c.mutex.Unlock()
+
+	_, err := c.rd.Peek(1)
+
+	c.mutex.Lock()
+	c.idle = false
+	_ = c.Conn.SetReadDeadline(deadline(c.srv.opts.ReadTimeout))
+	c.mutex.Unlock()
+	return err == nil
+}
+
+func (c *memcachedConn) wake() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.idle {
+		_ = c.Conn.SetReadDeadline(time.Now())
+	}
+}
+
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func (m *MemcachedServer) ListenAndServe() error {
+	ln, err := net.Listen(m.opts.Network, m.addr)
+	if err != nil {
+		return err
+	}
+	return m.Serve(ln)
+}
+
+// Serve serves clients on ln until Shutdown or Close
+func (m *MemcachedServer) Serve(ln net.Listener) error {
+	m.mutex.Lock()
+	if m.done {
+		m.mutex.Unlock()
+		_ = ln.Close()
+		return ErrorServerClosed
+	}
+	m.listener = ln
+	m.mutex.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if m.shuttingDown() {
+				return nil
+			}
+			return err
+		}
+		c := m.addConn(conn)
+		if c == nil {
+			continue
+		}
+		go m.serveConn(c)
+	}
+}
+
+// Addr returns the listening address, nil before serving
+func (m *MemcachedServer) Addr() net.Addr {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.listener == nil {
+		return nil
+	}
+	return m.listener.Addr()
+}
+
+// Shutdown stops accepting clients, then waits for connected clients to finish the request in progress
+// and disconnect. Clients still connected when ctx is done are closed.
+func (m *MemcachedServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&m.inShutdown, 1)
+	m.mutex.Lock()
+	err := m.closeListenerLocked()
+	for c := range m.conns {
+		c.wake()
+	}
+	m.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if m.Stats().CurrConnections == 0 {
+			return m.Close()
+		}
+		select {
+		case <-ctx.Done():
+			_ = m.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the server and closes all clients immediately
+func (m *MemcachedServer) Close() error {
+	atomic.StoreInt32(&m.inShutdown, 1)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.done = true
+	err := m.closeListenerLocked()
+	for c := range m.conns {
+		_ = c.Conn.Close()
+	}
+	return err
+}
+
+func (m *MemcachedServer) closeListenerLocked() error {
+	if m.listener == nil || m.listenerClosed {
+		return nil
+	}
+	m.listenerClosed = true
+	return m.listener.Close()
+}
+
+func (m *MemcachedServer) shuttingDown() bool {
+	return atomic.LoadInt32(&m.inShutdown) == 1
+}
+
+func (m *MemcachedServer) Stats() MemcachedServerStats {
+	m.mutex.Lock()
+	connected := len(m.conns)
+	m.mutex.Unlock()
+	s := &m.stats
+	return MemcachedServerStats{
+		TotalConnections:    atomic.LoadUint64(&s.TotalConnections),
+		RejectedConnections: atomic.LoadUint64(&s.RejectedConnections),
+		CmdGet:              atomic.LoadUint64(&s.CmdGet),
+		CmdSet:              atomic.LoadUint64(&s.CmdSet),
+		CmdTouch:            atomic.LoadUint64(&s.CmdTouch),
+		CmdFlush:            atomic.LoadUint64(&s.CmdFlush),
+		GetHits:             atomic.LoadUint64(&s.GetHits),
+		GetMisses:           atomic.LoadUint64(&s.GetMisses),
+		DeleteHits:          atomic.LoadUint64(&s.DeleteHits),
+		DeleteMisses:        atomic.LoadUint64(&s.DeleteMisses),
+		IncrHits:            atomic.LoadUint64(&s.IncrHits),
+		IncrMisses:          atomic.LoadUint64(&s.IncrMisses),
+		DecrHits:            atomic.LoadUint64(&s.DecrHits),
+		DecrMisses:          atomic.LoadUint64(&s.DecrMisses),
+		CasHits:             atomic.LoadUint64(&s.CasHits),
+		CasMisses:           atomic.LoadUint64(&s.CasMisses),
+		CasBadval:           atomic.LoadUint64(&s.CasBadval),
+		TouchHits:           atomic.LoadUint64(&s.TouchHits),
+		TouchMisses:         atomic.LoadUint64(&s.TouchMisses),
+		CurrConnections:     connected,
+	}
+}
+
+// addConn 返回nil表示连接被拒绝
+func (m *MemcachedServer) addConn(conn net.Conn) *memcachedConn {
+	atomic.AddUint64(&m.stats.TotalConnections, 1)
+	c := &memcachedConn{Conn: conn, srv: m}
+	c.rd = bufio.NewReaderSize(conn, memcachedMaxLineLen)
+	c.wr = bufio.NewWriter(c)
+
+	m.mutex.Lock()
+	if m.done || (m.opts.MaxClients > 0 && len(m.conns) >= m.opts.MaxClients) {
+		m.mutex.Unlock()
+		atomic.AddUint64(&m.stats.RejectedConnections, 1)
+		_, _ = c.Write([]byte("SERVER_ERROR too many open connections\r\n"))
+		_ = conn.Close()
+		return nil
+	}
+	m.conns[c] = struct{}{}
+	m.mutex.Unlock()
+	return c
+}
+
+func (m *MemcachedServer) removeConn(c *memcachedConn) {
+	m.mutex.Lock()
+	delete(m.conns, c)
+	m.mutex.Unlock()
+	_ = c.Conn.Close()
+}
+
+func (m *MemcachedServer) serveConn(c *memcachedConn) {
+	defer m.removeConn(c)
+	for c.waitCommand() {
+		first, _ := c.rd.Peek(1)
+		var err error
+		if first[0] == memcachedMagicRequest {
+			err = m.handleBinary(c)
+		} else {
+			err = m.handleText(c)
+		}
+		if err == nil && c.rd.Buffered() == 0 {
+			// pipeline里的命令都处理完了再发送回复
+			err = c.wr.Flush()
+		}
+		if err != nil {
+			if err != errMemcachedQuit && !m.shuttingDown() {
+				m.opts.Logger.Printf("memcached: client %s closed: %v", c.RemoteAddr(), err)
+			}
+			_ = c.wr.Flush()
+			return
+		}
+	}
+	_ = c.wr.Flush()
+}
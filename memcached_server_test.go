@@ -0,0 +1,339 @@
+package lantern_cache
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMemcachedServer(t *testing.T) (*MemcachedServer, string) {
+	ca := NewLanternCache(&Config{
+		BucketCount: 256,
+		MaxCapacity: 1024 * 1024 * 100,
+	})
+	server := NewMemcachedServer("", ca, &MemcachedServerOptions{Logger: NoneLogger()})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		err := server.Serve(ln)
+		if err != nil {
+			panic(err)
+		}
+	}()
+	return server, ln.Addr().String()
+}
+
+func TestMemcachedExpireAt(t *testing.T) {
+	now := time.Now().Unix()
+	assert.Equal(t, int64(0), memcachedExpireAt(0, now))
+	assert.Equal(t, int64(-1), memcachedExpireAt(-1, now))
+	assert.Equal(t, now+10, memcachedExpireAt(10, now))
+	assert.Equal(t, now+memcachedRelativeExpireMax, memcachedExpireAt(memcachedRelativeExpireMax, now))
+	assert.Equal(t, now+100, memcachedExpireAt(now+100, now))
+	assert.Equal(t, int64(-1), memcachedExpireAt(now-100, now))
+}
+
+func TestMemcachedFlushAllDelay(t *testing.T) {
+	ca := NewLanternCache(&Config{BucketCount: 4, MaxCapacity: 1024 * 1024})
+	m := NewMemcachedServer("", ca, &MemcachedServerOptions{MaxItemSize: 1024 * 1024, Logger: NoneLogger()})
+	assert.Equal(t, maxMemcachedItemSize, m.opts.MaxItemSize)
+	status, cas := m.store(memcachedSet, []byte("new"), 0, 0, []byte("v"), 0)
+	assert.Equal(t, memcachedOK, status)
+	// 返回的cas是写入时的版本
+	item, found := m.get([]byte("new"))
+	assert.True(t, found)
+	assert.Equal(t, cas, item.cas)
+
+	now := time.Now().Unix()
+	assert.Nil(t, ca.Put([]byte("old"), memcachedEncode(1, now-10, []byte("v"))))
+	m.flushAll(100)
+	_, found = m.get([]byte("old"))
+	assert.True(t, found)
+
+	// 生效以后之前写入的item都当作过期
+	atomic.StoreInt64(&m.flushAt, now-5)
+	_, found = m.get([]byte("old"))
+	assert.False(t, found)
+	assert.Equal(t, memcachedNotFound, m.touch([]byte("old"), 100))
+	status, _ = m.store(memcachedAdd, []byte("old"), 0, 0, []byte("v"), 0)
+	assert.Equal(t, memcachedOK, status)
+	_, found = m.get([]byte("new"))
+	assert.True(t, found)
+
+	m.flushAll(0)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&m.flushAt))
+	_, found = m.get([]byte("new"))
+	assert.False(t, found)
+}
+
+func TestMemcachedStoreErrors(t *testing.T) {
+	ca, err := New(&Config{}, WithBuckets(1), WithMaxCapacity(4*chunkSize), WithInitCapacity(chunkSize))
+	assert.Nil(t, err)
+	m := NewMemcachedServer("", ca, &MemcachedServerOptions{Logger: NoneLogger()})
+	value := make([]byte, chunkSize/2+1)
+	status, cas := m.store(memcachedSet, []byte("a"), 0, 0, value, 0)
+	assert.Equal(t, memcachedOK, status)
+
+	// 分配不到chunk不是value太大
+	restore := failChunkAlloc(ca)
+	defer restore()
+	status, _ = m.store(memcachedSet, []byte("b"), 0, 0, value, 0)
+	assert.Equal(t, memcachedServerError, status)
+	status, _ = m.store(memcachedCas, []byte("a"), 0, 0, value, cas)
+	assert.Equal(t, memcachedServerError, status)
+	assert.Equal(t, uint64(0), m.Stats().CasHits)
+	status, _ = m.store(memcachedSet, []byte("b"), 0, 0, make([]byte, maxMemcachedItemSize), 0)
+	assert.Equal(t, memcachedTooLarge, status)
+}
+
+func TestMemcachedServerText(t *testing.T) {
+	server, addr := newTestMemcachedServer(t)
+	defer server.Close()
+
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	do := func(req string, expected ...string) {
+		_, err := c.Write([]byte(req))
+		assert.Nil(t, err)
+		for i := range expected {
+			line, err := rd.ReadString('\n')
+			assert.Nil(t, err)
+			assert.Equal(t, expected[i], strings.TrimSuffix(line, "\r\n"), req)
+		}
+	}
+
+	do("set foo 5 0 3\r\nbar\r\n", "STORED")
+	do("get foo\r\n", "VALUE foo 5 3", "bar", "END")
+	do("add foo 0 0 1\r\nx\r\n", "NOT_STORED")
+	do("replace missing 0 0 1\r\nx\r\n", "NOT_STORED")
+	do("append foo 9 0 3\r\nbaz\r\n", "STORED")
+	do("prepend foo 9 0 3\r\nqux\r\n", "STORED")
+	do("get foo missing\r\n", "VALUE foo 5 9", "quxbarbaz", "END")
+
+	// cas
+	_, err = c.Write([]byte("gets foo\r\n"))
+	assert.Nil(t, err)
+	line, _ := rd.ReadString('\n')
+	fields := strings.Fields(line)
+	assert.Equal(t, 5, len(fields))
+	cas := fields[4]
+	do("", "quxbarbaz", "END")
+	do("cas foo 1 0 1 "+cas+"\r\nz\r\n", "STORED")
+	do("cas foo 1 0 1 "+cas+"\r\nz\r\n", "EXISTS")
+	do("cas missing 1 0 1 1\r\nz\r\n", "NOT_FOUND")
+
+	// incr/decr
+	do("set n 0 0 2\r\n10\r\n", "STORED")
+	do("incr n 5\r\n", "15")
+	do("decr n 20\r\n", "0")
+	do("incr foo 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	do("incr missing 1\r\n", "NOT_FOUND")
+
+	// delete/noreply
+	do("set quiet 0 0 1 noreply\r\nq\r\ndelete quiet noreply\r\ndelete quiet\r\n", "NOT_FOUND")
+	do("delete foo\r\n", "DELETED")
+	do("get foo\r\n", "END")
+
+	// exptime
+	do("set short 0 1 1\r\nx\r\n", "STORED")
+	do("set absolute 0 "+strconv.FormatInt(time.Now().Unix()+100, 10)+" 1\r\nx\r\n", "STORED")
+	do("set past 0 "+strconv.FormatInt(time.Now().Unix()-100, 10)+" 1\r\nx\r\n", "STORED")
+	do("get past\r\n", "END")
+	do("touch short 100\r\n", "TOUCHED")
+	do("touch missing 100\r\n", "NOT_FOUND")
+	do("gat 0 absolute\r\n", "VALUE absolute 0 1", "x", "END")
+	time.Sleep(2 * time.Second)
+	do("get short absolute\r\n", "VALUE short 0 1", "x", "VALUE absolute 0 1", "x", "END")
+
+	do("version\r\n", "VERSION "+lanternVersion)
+	do("bogus\r\n", "ERROR")
+	// cache存不下的value在读取时就拒绝
+	big := strconv.Itoa(maxMemcachedItemSize + 1)
+	do("set big 0 0 "+big+"\r\n"+strings.Repeat("x", maxMemcachedItemSize+1)+"\r\n", "SERVER_ERROR object too large for cache")
+	do("get big\r\n", "END")
+
+	do("flush_all\r\n", "OK")
+	do("get short n\r\n", "END")
+
+	_, err = c.Write([]byte("stats\r\n"))
+	assert.Nil(t, err)
+	stats := map[string]string{}
+	for {
+		line, err := rd.ReadString('\n')
+		assert.Nil(t, err)
+		if line == "END\r\n" {
+			break
+		}
+		fields := strings.Fields(line)
+		stats[fields[1]] = fields[2]
+	}
+	assert.Equal(t, "1", stats["curr_connections"])
+	assert.Equal(t, "1", stats["cas_hits"])
+	assert.Equal(t, "1", stats["cas_badval"])
+	assert.Equal(t, "1", stats["cas_misses"])
+	assert.Equal(t, "0", stats["curr_items"])
+
+	do("quit\r\n")
+	_, err = rd.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+}
+
+type memcachedBinaryResponse struct {
+	opcode byte
+	status uint16
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+func memcachedBinaryPacket(opcode byte, opaque uint32, cas uint64, extras, key, value []byte) []byte {
+	hdr := make([]byte, memcachedHeaderSize)
+	hdr[0] = memcachedMagicRequest
+	hdr[1] = opcode
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(key)))
+	hdr[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(hdr[12:], opaque)
+	binary.BigEndian.PutUint64(hdr[16:], cas)
+	hdr = append(hdr, extras...)
+	hdr = append(hdr, key...)
+	return append(hdr, value...)
+}
+
+func readMemcachedBinary(t *testing.T, rd io.Reader) memcachedBinaryResponse {
+	hdr := make([]byte, memcachedHeaderSize)
+	_, err := io.ReadFull(rd, hdr)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(memcachedMagicResponse), hdr[0])
+	body := make([]byte, binary.BigEndian.Uint32(hdr[8:]))
+	_, err = io.ReadFull(rd, body)
+	assert.Nil(t, err)
+	keyLen := int(binary.BigEndian.Uint16(hdr[2:]))
+	extrasLen := int(hdr[4])
+	return memcachedBinaryResponse{
+		opcode: hdr[1],
+		status: binary.BigEndian.Uint16(hdr[6:]),
+		opaque: binary.BigEndian.Uint32(hdr[12:]),
+		cas:    binary.BigEndian.Uint64(hdr[16:]),
+		extras: body[:extrasLen],
+		key:    body[extrasLen : extrasLen+keyLen],
+		value:  body[extrasLen+keyLen:],
+	}
+}
+
+func TestMemcachedServerBinary(t *testing.T) {
+	server, addr := newTestMemcachedServer(t)
+	defer server.Close()
+
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	do := func(opcode byte, cas uint64, extras, key, value []byte) memcachedBinaryResponse {
+		_, err := c.Write(memcachedBinaryPacket(opcode, 7, cas, extras, key, value))
+		assert.Nil(t, err)
+		resp := readMemcachedBinary(t, rd)
+		assert.Equal(t, opcode, resp.opcode)
+		assert.Equal(t, uint32(7), resp.opaque)
+		return resp
+	}
+	setExtras := func(flags, exptime uint32) []byte {
+		extras := make([]byte, 8)
+		binary.BigEndian.PutUint32(extras, flags)
+		binary.BigEndian.PutUint32(extras[4:], exptime)
+		return extras
+	}
+
+	resp := do(memcachedOpSet, 0, setExtras(3, 0), []byte("foo"), []byte("bar"))
+	assert.Equal(t, uint16(memcachedStatusOK), resp.status)
+	cas := resp.cas
+	assert.NotEqual(t, uint64(0), cas)
+
+	resp = do(memcachedOpGetK, 0, nil, []byte("foo"), nil)
+	assert.Equal(t, uint16(memcachedStatusOK), resp.status)
+	assert.Equal(t, uint32(3), binary.BigEndian.Uint32(resp.extras))
+	assert.Equal(t, "foo", string(resp.key))
+	assert.Equal(t, "bar", string(resp.value))
+	assert.Equal(t, cas, resp.cas)
+
+	resp = do(memcachedOpAdd, 0, setExtras(0, 0), []byte("foo"), []byte("x"))
+	assert.Equal(t, uint16(memcachedStatusKeyExists), resp.status)
+
+	resp = do(memcachedOpSet, cas+1, setExtras(0, 0), []byte("foo"), []byte("x"))
+	assert.Equal(t, uint16(memcachedStatusKeyExists), resp.status)
+	resp = do(memcachedOpSet, cas, setExtras(0, 0), []byte("foo"), []byte("x"))
+	assert.Equal(t, uint16(memcachedStatusOK), resp.status)
+
+	incrExtras := make([]byte, 20)
+	binary.BigEndian.PutUint64(incrExtras, 2)
+	binary.BigEndian.PutUint64(incrExtras[8:], 10)
+	resp = do(memcachedOpIncrement, 0, incrExtras, []byte("n"), nil)
+	assert.Equal(t, uint64(10), binary.BigEndian.Uint64(resp.value))
+	resp = do(memcachedOpIncrement, 0, incrExtras, []byte("n"), nil)
+	assert.Equal(t, uint64(12), binary.BigEndian.Uint64(resp.value))
+	binary.BigEndian.PutUint32(incrExtras[16:], 0xffffffff)
+	resp = do(memcachedOpDecrement, 0, incrExtras, []byte("missing"), nil)
+	assert.Equal(t, uint16(memcachedStatusKeyNotFound), resp.status)
+
+	// quiet commands only answer misses, noop flushes the pipeline
+	_, err = c.Write(append(append(append(
+		memcachedBinaryPacket(memcachedOpSetQ, 1, 0, setExtras(0, 0), []byte("q"), []byte("v")),
+		memcachedBinaryPacket(memcachedOpGetQ, 2, 0, nil, []byte("missing"), nil)...),
+		memcachedBinaryPacket(memcachedOpGetKQ, 3, 0, nil, []byte("q"), nil)...),
+		memcachedBinaryPacket(memcachedOpNoop, 4, 0, nil, nil, nil)...))
+	assert.Nil(t, err)
+	resp = readMemcachedBinary(t, rd)
+	assert.Equal(t, uint32(3), resp.opaque)
+	assert.Equal(t, "v", string(resp.value))
+	resp = readMemcachedBinary(t, rd)
+	assert.Equal(t, uint32(4), resp.opaque)
+
+	resp = do(memcachedOpDelete, 0, nil, []byte("foo"), nil)
+	assert.Equal(t, uint16(memcachedStatusOK), resp.status)
+	resp = do(memcachedOpGet, 0, nil, []byte("foo"), nil)
+	assert.Equal(t, uint16(memcachedStatusKeyNotFound), resp.status)
+
+	resp = do(memcachedOpVersion, 0, nil, nil, nil)
+	assert.Equal(t, lanternVersion, string(resp.value))
+	resp = do(0x7f, 0, nil, nil, nil)
+	assert.Equal(t, uint16(memcachedStatusUnknownCommand), resp.status)
+
+	// text and binary requests can be mixed on a connection
+	_, err = c.Write([]byte("get q\r\n"))
+	assert.Nil(t, err)
+	line, _ := rd.ReadString('\n')
+	assert.Equal(t, "VALUE q 0 1\r\n", line)
+}
+
+func TestMemcachedServerShutdown(t *testing.T) {
+	server, addr := newTestMemcachedServer(t)
+
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	_, err = c.Write([]byte("version\r\n"))
+	assert.Nil(t, err)
+	line, _ := rd.ReadString('\n')
+	assert.Equal(t, "VERSION "+lanternVersion+"\r\n", line)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, server.Shutdown(ctx))
+	_, err = rd.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, server.Stats().CurrConnections)
+}
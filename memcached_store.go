@@ -0,0 +1,386 @@
+package lantern_cache
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// memcached的exptime不超过30天时是相对时间, 否则是unix时间戳
+	memcachedRelativeExpireMax = 60 * 60 * 24 * 30
+	memcachedFlagsSize         = 4
+	// value的头是flags和写入的unix时间, flush_all按写入时间作废item
+	memcachedValueHeaderSize = memcachedFlagsSize + 8
+	// 事务冲突时重试的次数
+	memcachedUpdateRetry = 16
+)
+
+type memcachedStatus int
+
+const (
+	memcachedOK memcachedStatus = iota
+	memcachedNotStored
+	memcachedExists
+	memcachedNotFound
+	memcachedNonNumeric
+	memcachedTooLarge
+	// memcachedServerError 写入失败, 例如分配不到chunk或者事务一直冲突
+	memcachedServerError
+)
+
+type memcachedStoreMode int
+
+const (
+	memcachedSet memcachedStoreMode = iota
+	memcachedAdd
+	memcachedReplace
+	memcachedAppend
+	memcachedPrepend
+	memcachedCas
+)
+
+// memcachedExpireAt 把exptime转成entry的过期时间, 0表示不过期, -1表示已经过期
+func memcachedExpireAt(exptime int64, now int64) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return -1
+	case exptime <= memcachedRelativeExpireMax:
+		return now + exptime
+	case exptime <= now:
+		return -1
+	default:
+		return exptime
+	}
+}
+
+func memcachedEncode(flags uint32, storedAt int64, data []byte) []byte {
+	ret := make([]byte, memcachedValueHeaderSize+len(data))
+	binary.BigEndian.PutUint32(ret, flags)
+	binary.BigEndian.PutUint64(ret[memcachedFlagsSize:], uint64(storedAt))
+	copy(ret[memcachedValueHeaderSize:], data)
+	return ret
+}
+
+func memcachedDecode(value []byte) (uint32, int64, []byte, bool) {
+	if len(value) < memcachedValueHeaderSize {
+		return 0, 0, nil, false
+	}
+	return binary.BigEndian.Uint32(value), int64(binary.BigEndian.Uint64(value[memcachedFlagsSize:])), value[memcachedValueHeaderSize:], true
+}
+
+type memcachedItem struct {
+	flags uint32
+	data  []byte
+	cas   uint64
+}
+
+// update 在事务中执行fn, 冲突时重试, fn每次都会重新读取
+// 返回最后一次执行的事务, 提交成功后可以从它拿到写入的版本
+func (m *MemcachedServer) update(fn func(tx *Txn) error) (*Txn, error) {
+	var last *Txn
+	var err error
+	for i := 0; i < memcachedUpdateRetry; i++ {
+		if err = m.cache.Update(func(tx *Txn) error {
+			last = tx
+			return fn(tx)
+		}); err != ErrorTxnConflict {
+			return last, err
+		}
+	}
+	return last, err
+}
+
+// put 按过期时间写入或删除
+func (m *MemcachedServer) put(tx *Txn, key, value []byte, expireAt int64) memcachedStatus {
+	if expireAt < 0 {
+		tx.Del(key)
+		return memcachedOK
+	}
+	if len(value)-memcachedValueHeaderSize > m.opts.MaxItemSize || !validEntry(key, value, m.cache.cipher.overhead()) {
+		return memcachedTooLarge
+	}
+	if tx.put(key, value, expireAt) != nil {
+		return memcachedServerError
+	}
+	return memcachedOK
+}
+
+// getItem 在事务中读取item, 返回原始的value和过期时间, 被flush_all作废的item和不存在一样
+func (m *MemcachedServer) getItem(tx *Txn, key []byte) (memcachedItem, []byte, int64, bool) {
+	value, version, expire, err := tx.getEntry(nil, key)
+	if err != nil {
+		return memcachedItem{}, nil, 0, false
+	}
+	flags, storedAt, data, ok := memcachedDecode(value)
+	if !ok || m.flushed(storedAt, time.Now().Unix()) {
+		return memcachedItem{}, nil, 0, false
+	}
+	return memcachedItem{flags: flags, data: data, cas: version}, value, expire, true
+}
+
+// flushed 和memcached的oldest_live一样, 延迟的flush_all生效以后, 之前写入的item都当作过期
+func (m *MemcachedServer) flushed(storedAt int64, now int64) bool {
+	at := atomic.LoadInt64(&m.flushAt)
+	return at != 0 && at <= now && storedAt < at
+}
+
+func (m *MemcachedServer) get(key []byte) (memcachedItem, bool) {
+	atomic.AddUint64(&m.stats.CmdGet, 1)
+	var item memcachedItem
+	found := false
+	_, _ = m.update(func(tx *Txn) error {
+		item, _, _, found = m.getItem(tx, key)
+		return nil
+	})
+	if found {
+		atomic.AddUint64(&m.stats.GetHits, 1)
+	} else {
+		atomic.AddUint64(&m.stats.GetMisses, 1)
+	}
+	return item, found
+}
+
+// getAndTouch 读取的同时修改过期时间, 返回的cas是修改之后的版本
+func (m *MemcachedServer) getAndTouch(key []byte, exptime int64) (memcachedItem, bool) {
+	atomic.AddUint64(&m.stats.CmdGet, 1)
+	atomic.AddUint64(&m.stats.CmdTouch, 1)
+	var item memcachedItem
+	found := false
+	tx, err := m.update(func(tx *Txn) error {
+		var value []byte
+		if item, value, _, found = m.getItem(tx, key); found {
+			m.put(tx, key, value, memcachedExpireAt(exptime, time.Now().Unix()))
+		}
+		return nil
+	})
+	// 修改过期时间失败时和没有读到一样
+	found = found && err == nil
+	if found {
+		item.cas = tx.committedVersion(key)
+		atomic.AddUint64(&m.stats.GetHits, 1)
+		atomic.AddUint64(&m.stats.TouchHits, 1)
+	} else {
+		atomic.AddUint64(&m.stats.GetMisses, 1)
+		atomic.AddUint64(&m.stats.TouchMisses, 1)
+	}
+	return item, found
+}
+
+// store 实现set/add/replace/append/prepend/cas, 返回写入后的cas
+func (m *MemcachedServer) store(mode memcachedStoreMode, key []byte, flags uint32, exptime int64, data []byte, cas uint64) (memcachedStatus, uint64) {
+	atomic.AddUint64(&m.stats.CmdSet, 1)
+	if len(data) > m.opts.MaxItemSize {
+		return memcachedTooLarge, 0
+	}
+	status := memcachedOK
+	tx, err := m.update(func(tx *Txn) error {
+		old, _, expire, found := m.getItem(tx, key)
+
+		status = memcachedOK
+		switch mode {
+		case memcachedAdd:
+			if found {
+				status = memcachedNotStored
+			}
+		case memcachedReplace, memcachedAppend, memcachedPrepend:
+			if !found {
+				status = memcachedNotStored
+			}
+		case memcachedCas:
+			if !found {
+				status = memcachedNotFound
+			} else if old.cas != cas {
+				status = memcachedExists
+			}
+		}
+		if status != memcachedOK {
+			return nil
+		}
+
+		now := time.Now().Unix()
+		switch mode {
+		case memcachedAppend:
+			status = m.put(tx, key, memcachedEncode(old.flags, now, append(old.data, data...)), expire)
+		case memcachedPrepend:
+			status = m.put(tx, key, memcachedEncode(old.flags, now, append(append([]byte(nil), data...), old.data...)), expire)
+		default:
+			status = m.put(tx, key, memcachedEncode(flags, now, data), memcachedExpireAt(exptime, now))
+		}
+		return nil
+	})
+	if err != nil && status == memcachedOK {
+		status = memcachedServerError
+	}
+	if mode == memcachedCas {
+		switch status {
+		case memcachedOK:
+			atomic.AddUint64(&m.stats.CasHits, 1)
+		case memcachedNotFound:
+			atomic.AddUint64(&m.stats.CasMisses, 1)
+		case memcachedExists:
+			atomic.AddUint64(&m.stats.CasBadval, 1)
+		}
+	}
+	if status != memcachedOK {
+		return status, 0
+	}
+	return status, tx.committedVersion(key)
+}
+
+// delete cas不为0时只删除版本相同的key
+func (m *MemcachedServer) delete(key []byte, cas uint64) memcachedStatus {
+	status := memcachedOK
+	_, err := m.update(func(tx *Txn) error {
+		item, _, _, found := m.getItem(tx, key)
+		switch {
+		case !found:
+			status = memcachedNotFound
+		case cas != 0 && item.cas != cas:
+			status = memcachedExists
+		default:
+			status = memcachedOK
+			tx.Del(key)
+		}
+		return nil
+	})
+	if err != nil && status == memcachedOK {
+		return memcachedServerError
+	}
+	if status == memcachedOK {
+		atomic.AddUint64(&m.stats.DeleteHits, 1)
+	} else {
+		atomic.AddUint64(&m.stats.DeleteMisses, 1)
+	}
+	return status
+}
+
+// incr decr不会小于0, incr溢出后回绕, initial不为nil时key不存在则写入initial(二进制协议)
+func (m *MemcachedServer) incr(key []byte, delta uint64, decr bool, initial *uint64, exptime int64) (uint64, uint64, memcachedStatus) {
+	var result uint64
+	status := memcachedOK
+	tx, err := m.update(func(tx *Txn) error {
+		old, _, expire, found := m.getItem(tx, key)
+		now := time.Now().Unix()
+		if !found {
+			if initial == nil {
+				status = memcachedNotFound
+				return nil
+			}
+			result = *initial
+			status = m.put(tx, key, memcachedEncode(0, now, strconv.AppendUint(nil, result, 10)), memcachedExpireAt(exptime, now))
+			return nil
+		}
+		n, err := strconv.ParseUint(string(old.data), 10, 64)
+		if err != nil {
+			status = memcachedNonNumeric
+			return nil
+		}
+		if decr {
+			if delta > n {
+				n = 0
+			} else {
+				n -= delta
+			}
+		} else {
+			n += delta
+		}
+		result = n
+		status = m.put(tx, key, memcachedEncode(old.flags, now, strconv.AppendUint(nil, n, 10)), expire)
+		return nil
+	})
+	if err != nil && status == memcachedOK {
+		return 0, 0, memcachedServerError
+	}
+	hits, misses := &m.stats.IncrHits, &m.stats.IncrMisses
+	if decr {
+		hits, misses = &m.stats.DecrHits, &m.stats.DecrMisses
+	}
+	if status == memcachedNotFound {
+		atomic.AddUint64(misses, 1)
+		return 0, 0, status
+	}
+	atomic.AddUint64(hits, 1)
+	if status != memcachedOK {
+		return 0, 0, status
+	}
+	return result, tx.committedVersion(key), status
+}
+
+func (m *MemcachedServer) touch(key []byte, exptime int64) memcachedStatus {
+	atomic.AddUint64(&m.stats.CmdTouch, 1)
+	status := memcachedOK
+	_, err := m.update(func(tx *Txn) error {
+		_, value, _, found := m.getItem(tx, key)
+		if !found {
+			status = memcachedNotFound
+			return nil
+		}
+		status = m.put(tx, key, value, memcachedExpireAt(exptime, time.Now().Unix()))
+		return nil
+	})
+	if err != nil && status == memcachedOK {
+		return memcachedServerError
+	}
+	if status == memcachedNotFound {
+		atomic.AddUint64(&m.stats.TouchMisses, 1)
+	} else {
+		atomic.AddUint64(&m.stats.TouchHits, 1)
+	}
+	return status
+}
+
+// flushAll 清空缓存, delay和exptime的含义一样
+// 延迟的flush_all和memcached一样只记下生效的时间, 之后读取时把之前写入的item当作过期, 新的flush_all替换旧的
+func (m *MemcachedServer) flushAll(delay int64) {
+	atomic.AddUint64(&m.stats.CmdFlush, 1)
+	now := time.Now().Unix()
+	at := memcachedExpireAt(delay, now)
+	if at <= now {
+		atomic.StoreInt64(&m.flushAt, 0)
+		m.cache.Reset()
+		return
+	}
+	atomic.StoreInt64(&m.flushAt, at)
+}
+
+// statsList 是stats命令的输出, 名字和memcached一致
+func (m *MemcachedServer) statsList() [][2]string {
+	s := m.Stats()
+	cs := m.cache.Stats()
+	u := func(v uint64) string {
+		return strconv.FormatUint(v, 10)
+	}
+	now := time.Now()
+	return [][2]string{
+		{"uptime", strconv.FormatInt(int64(now.Sub(m.started)/time.Second), 10)},
+		{"time", strconv.FormatInt(now.Unix(), 10)},
+		{"version", lanternVersion},
+		{"curr_connections", strconv.Itoa(s.CurrConnections)},
+		{"total_connections", u(s.TotalConnections)},
+		{"rejected_connections", u(s.RejectedConnections)},
+		{"cmd_get", u(s.CmdGet)},
+		{"cmd_set", u(s.CmdSet)},
+		{"cmd_flush", u(s.CmdFlush)},
+		{"cmd_touch", u(s.CmdTouch)},
+		{"get_hits", u(s.GetHits)},
+		{"get_misses", u(s.GetMisses)},
+		{"delete_misses", u(s.DeleteMisses)},
+		{"delete_hits", u(s.DeleteHits)},
+		{"incr_misses", u(s.IncrMisses)},
+		{"incr_hits", u(s.IncrHits)},
+		{"decr_misses", u(s.DecrMisses)},
+		{"decr_hits", u(s.DecrHits)},
+		{"cas_misses", u(s.CasMisses)},
+		{"cas_hits", u(s.CasHits)},
+		{"cas_badval", u(s.CasBadval)},
+		{"touch_hits", u(s.TouchHits)},
+		{"touch_misses", u(s.TouchMisses)},
+		{"curr_items", u(m.cache.Size())},
+		{"evictions", u(cs.Evictions)},
+		{"expired_unfetched", u(cs.Expirations)},
+	}
+}
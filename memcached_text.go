@@ -0,0 +1,282 @@
+package lantern_cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var errMemcachedQuit = fmt.Errorf("quit")
+
+const memcachedMaxKeyLen = 250
+
+var memcachedStoreModes = map[string]memcachedStoreMode{
+	"set":     memcachedSet,
+	"add":     memcachedAdd,
+	"replace": memcachedReplace,
+	"append":  memcachedAppend,
+	"prepend": memcachedPrepend,
+	"cas":     memcachedCas,
+}
+
+func memcachedValidKey(key []byte) bool {
+	if len(key) == 0 || len(key) > memcachedMaxKeyLen {
+		return false
+	}
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// handleText 处理一条文本协议的命令, 返回错误时关闭连接
+func (m *MemcachedServer) handleText(c *memcachedConn) error {
+	line, err := c.rd.ReadSlice('\n')
+	if err != nil {
+		if err == io.EOF && len(line) == 0 {
+			return errMemcachedQuit
+		}
+		if len(line) == memcachedMaxLineLen {
+			c.wr.WriteString("CLIENT_ERROR line too long\r\n")
+		}
+		return err
+	}
+	args := bytes.Fields(line)
+	if len(args) == 0 {
+		c.wr.WriteString("ERROR\r\n")
+		return nil
+	}
+	// ReadSlice返回的是读缓冲区, 读取value之前拷贝key
+	for i := range args {
+		args[i] = append([]byte(nil), args[i]...)
+	}
+
+	switch name := strings.ToLower(string(args[0])); name {
+	case "get", "gets":
+		return m.textGet(c, args[1:], name == "gets", false, 0)
+	case "gat", "gats":
+		if len(args) < 3 {
+			c.wr.WriteString("ERROR\r\n")
+			return nil
+		}
+		exptime, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			c.wr.WriteString("CLIENT_ERROR invalid exptime argument\r\n")
+			return nil
+		}
+		return m.textGet(c, args[2:], name == "gats", true, exptime)
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return m.textStore(c, name, args)
+	case "delete":
+		// delete <key> [noreply]
+		if len(args) < 2 || len(args) > 3 {
+			c.wr.WriteString("ERROR\r\n")
+			return nil
+		}
+		noreply := len(args) == 3 && string(args[2]) == "noreply"
+		status := m.delete(args[1], 0)
+		if !noreply {
+			switch status {
+			case memcachedOK:
+				c.wr.WriteString("DELETED\r\n")
+			case memcachedServerError:
+				c.wr.WriteString("SERVER_ERROR out of memory\r\n")
+			default:
+				c.wr.WriteString("NOT_FOUND\r\n")
+			}
+		}
+	case "incr", "decr":
+		// incr <key> <value> [noreply]
+		if len(args) < 3 || len(args) > 4 {
+			c.wr.WriteString("ERROR\r\n")
+			return nil
+		}
+		noreply := len(args) == 4 && string(args[3]) == "noreply"
+		delta, err := strconv.ParseUint(string(args[2]), 10, 64)
+		if err != nil {
+			c.wr.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+			return nil
+		}
+		n, _, status := m.incr(args[1], delta, name == "decr", nil, 0)
+		if noreply {
+			return nil
+		}
+		switch status {
+		case memcachedOK:
+			c.wr.WriteString(strconv.FormatUint(n, 10) + "\r\n")
+		case memcachedNotFound:
+			c.wr.WriteString("NOT_FOUND\r\n")
+		case memcachedNonNumeric:
+			c.wr.WriteString("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+		default:
+			c.wr.WriteString("SERVER_ERROR out of memory\r\n")
+		}
+	case "touch":
+		// touch <key> <exptime> [noreply]
+		if len(args) < 3 || len(args) > 4 {
+			c.wr.WriteString("ERROR\r\n")
+			return nil
+		}
+		noreply := len(args) == 4 && string(args[3]) == "noreply"
+		exptime, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			c.wr.WriteString("CLIENT_ERROR invalid exptime argument\r\n")
+			return nil
+		}
+		status := m.touch(args[1], exptime)
+		if !noreply {
+			switch status {
+			case memcachedOK:
+				c.wr.WriteString("TOUCHED\r\n")
+			case memcachedNotFound:
+				c.wr.WriteString("NOT_FOUND\r\n")
+			default:
+				c.wr.WriteString("SERVER_ERROR out of memory\r\n")
+			}
+		}
+	case "flush_all":
+		// flush_all [delay] [noreply]
+		noreply := string(args[len(args)-1]) == "noreply"
+		if noreply {
+			args = args[:len(args)-1]
+		}
+		delay := int64(0)
+		if len(args) > 1 {
+			if delay, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+				c.wr.WriteString("CLIENT_ERROR bad command line format\r\n")
+				return nil
+			}
+		}
+		m.flushAll(delay)
+		if !noreply {
+			c.wr.WriteString("OK\r\n")
+		}
+	case "stats":
+		if len(args) > 1 {
+			// 只支持通用的统计
+			c.wr.WriteString("END\r\n")
+			return nil
+		}
+		for _, kv := range m.statsList() {
+			c.wr.WriteString("STAT " + kv[0] + " " + kv[1] + "\r\n")
+		}
+		c.wr.WriteString("END\r\n")
+	case "version":
+		c.wr.WriteString("VERSION " + lanternVersion + "\r\n")
+	case "verbosity":
+		if string(args[len(args)-1]) != "noreply" {
+			c.wr.WriteString("OK\r\n")
+		}
+	case "quit":
+		return errMemcachedQuit
+	default:
+		c.wr.WriteString("ERROR\r\n")
+	}
+	return nil
+}
+
+// textGet get/gets/gat/gats
+func (m *MemcachedServer) textGet(c *memcachedConn, keys [][]byte, withCas, touch bool, exptime int64) error {
+	if len(keys) == 0 {
+		c.wr.WriteString("ERROR\r\n")
+		return nil
+	}
+	for _, key := range keys {
+		if !memcachedValidKey(key) {
+			c.wr.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return nil
+		}
+	}
+	for _, key := range keys {
+		var item memcachedItem
+		var ok bool
+		if touch {
+			item, ok = m.getAndTouch(key, exptime)
+		} else {
+			item, ok = m.get(key)
+		}
+		if !ok {
+			continue
+		}
+		c.wr.WriteString("VALUE ")
+		c.wr.Write(key)
+		c.wr.WriteString(" " + strconv.FormatUint(uint64(item.flags), 10) + " " + strconv.Itoa(len(item.data)))
+		if withCas {
+			c.wr.WriteString(" " + strconv.FormatUint(item.cas, 10))
+		}
+		c.wr.WriteString("\r\n")
+		c.wr.Write(item.data)
+		c.wr.WriteString("\r\n")
+	}
+	c.wr.WriteString("END\r\n")
+	return nil
+}
+
+// textStore <command name> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]\r\n<data block>\r\n
+func (m *MemcachedServer) textStore(c *memcachedConn, name string, args [][]byte) error {
+	fields := 5
+	if name == "cas" {
+		fields = 6
+	}
+	if len(args) != fields && len(args) != fields+1 {
+		c.wr.WriteString("ERROR\r\n")
+		return nil
+	}
+	noreply := len(args) == fields+1 && string(args[fields]) == "noreply"
+	flags, err1 := strconv.ParseUint(string(args[2]), 10, 32)
+	exptime, err2 := strconv.ParseInt(string(args[3]), 10, 64)
+	size, err3 := strconv.ParseInt(string(args[4]), 10, 64)
+	var cas uint64
+	var err4 error
+	if name == "cas" {
+		cas, err4 = strconv.ParseUint(string(args[5]), 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 || !memcachedValidKey(args[1]) {
+		// 格式错误时不知道后面的数据有多长, 只能断开
+		c.wr.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return fmt.Errorf("bad command line format")
+	}
+	if size > int64(m.opts.MaxItemSize) {
+		// 和memcached一样丢弃数据块
+		if _, err := io.CopyN(ioutil.Discard, c.rd, size+2); err != nil {
+			return err
+		}
+		c.wr.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return nil
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.rd, data); err != nil {
+		return err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		c.wr.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return fmt.Errorf("bad data chunk")
+	}
+	data = data[:size]
+
+	status, _ := m.store(memcachedStoreModes[name], args[1], uint32(flags), exptime, data, cas)
+	if noreply {
+		return nil
+	}
+	switch status {
+	case memcachedOK:
+		c.wr.WriteString("STORED\r\n")
+	case memcachedNotStored:
+		c.wr.WriteString("NOT_STORED\r\n")
+	case memcachedExists:
+		c.wr.WriteString("EXISTS\r\n")
+	case memcachedNotFound:
+		c.wr.WriteString("NOT_FOUND\r\n")
+	case memcachedTooLarge:
+		c.wr.WriteString("SERVER_ERROR object too large for cache\r\n")
+	default:
+		c.wr.WriteString("SERVER_ERROR out of memory storing object\r\n")
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package lantern_cache
+
+import (
+	"bufio"
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMetricsNamespace = "lantern"
+	metricsContentType      = "text/plain; version=0.0.4; charset=utf-8"
+	// metricsLatencyBuckets 直方图输出1微秒到2^24微秒(约17秒)的2的幂作为le
+	metricsLatencyBuckets = 25
+)
+
+// MetricsOptions configures a metrics handler, the zero value exports aggregated metrics
+// named lantern_*.
+type MetricsOptions struct {
+	// Namespace prefixes every metric name, "lantern" by default.
+	Namespace string
+	// PerBucket also exports the keys, index bytes, ops and ring loops of every bucket labeled by
+	// bucket index, a series per bucket.
+	PerBucket bool
+	// Commands exports latency histograms per command labeled by command, e.g. RedisServer.CommandLatency.
+	Commands func() map[string]LatencyHistogram
+}
+
+func (o *MetricsOptions) init() {
+	if o.Namespace == "" {
+		o.Namespace = defaultMetricsNamespace
+	}
+}
+
+// Metrics is a point in time view of the cache, exported by the metrics handler and expvar.
+type Metrics struct {
+	Stats      StatsSnapshot `json:"stats"`
+	Keys       uint64        `json:"keys"`
+	IndexBytes uint64        `json:"index_bytes"`
+	// ChunkBytes is the memory of allocated chunks, MaxChunkBytes the memory when every chunk is allocated.
+	ChunkBytes    uint64 `json:"chunk_bytes"`
+	MaxChunkBytes uint64 `json:"max_chunk_bytes"`
+	Chunks        uint64 `json:"chunks"`
+	Buckets       int    `json:"buckets"`
+	// BucketMinKeys, BucketMaxKeys and BucketKeySkew describe how evenly keys spread over buckets,
+	// the skew is the max keys of a bucket divided by the average, 1 means perfectly even.
+	BucketMinKeys uint64  `json:"bucket_min_keys"`
+	BucketMaxKeys uint64  `json:"bucket_max_keys"`
+	BucketKeySkew float64 `json:"bucket_key_skew"`
+	// BucketMaxOps and BucketOpsSkew describe how evenly gets and puts spread over buckets, a high
+	// skew means a hot key serializes its callers on the lock of one bucket.
+	BucketMaxOps  uint64  `json:"bucket_max_ops"`
+	BucketOpsSkew float64 `json:"bucket_ops_skew"`
+	// Loops is the sum of the ring loops of all buckets, every loop overwrote the oldest entries.
+	Loops uint64 `json:"loops"`
+}
+
+// Metrics collects the metrics, it takes the read lock of every bucket in turn.
+func (lc *LanternCache) Metrics() *Metrics {
+	return lc.metrics(lc.BucketStats())
+}
+
+func (lc *LanternCache) metrics(buckets []BucketStats) *Metrics {
+	ret := &Metrics{Stats: *lc.StatsSnapshot(), Buckets: len(buckets)}
+	ops := uint64(0)
+	for i := range buckets {
+		b := &buckets[i]
+		if i == 0 || b.Keys < ret.BucketMinKeys {
+			ret.BucketMinKeys = b.Keys
+		}
+		if b.Keys > ret.BucketMaxKeys {
+			ret.BucketMaxKeys = b.Keys
+		}
+		if b.Ops > ret.BucketMaxOps {
+			ret.BucketMaxOps = b.Ops
+		}
+		ops += b.Ops
+		ret.Keys += b.Keys
+		ret.IndexBytes += b.MapBytes
+		ret.ChunkBytes += b.ChunkBytes
+		ret.MaxChunkBytes += b.MaxChunkBytes
+		ret.Loops += uint64(b.Loop)
+	}
+	ret.Chunks = ret.ChunkBytes / chunkSize
+	if ret.Keys > 0 {
+		ret.BucketKeySkew = float64(ret.BucketMaxKeys) * float64(len(buckets)) / float64(ret.Keys)
+	}
+	if ops > 0 {
+		ret.BucketOpsSkew = float64(ret.BucketMaxOps) * float64(len(buckets)) / float64(ops)
+	}
+	return ret
+}
+
+// MetricsHandler returns a http.Handler serving the metrics in the Prometheus text exposition format.
+func (lc *LanternCache) MetricsHandler(opts *MetricsOptions) http.Handler {
+	if opts == nil {
+		opts = &MetricsOptions{}
+	}
+	h := &metricsHandler{cache: lc, opts: *opts}
+	h.opts.init()
+	return h
+}
+
+// PublishExpvar publishes Metrics as the expvar variable name, served by expvar at /debug/vars.
+// Like expvar.Publish it panics when the name is already used.
+func (lc *LanternCache) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return lc.Metrics()
+	}))
+}
+
+type metricsHandler struct {
+	cache *LanternCache
+	opts  MetricsOptions
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buckets := h.cache.BucketStats()
+	m := h.cache.metrics(buckets)
+	w.Header().Set("Content-Type", metricsContentType)
+	mw := &metricsWriter{w: bufio.NewWriter(w), namespace: h.opts.Namespace}
+
+	mw.metric("gets_total", "counter", "Gets including misses.", float64(m.Stats.Gets))
+	mw.metric("puts_total", "counter", "Puts.", float64(m.Stats.Puts))
+	mw.metric("hits_total", "counter", "Gets that found the key.", float64(m.Stats.Hits))
+	mw.metric("misses_total", "counter", "Gets that didn't find the key.", float64(m.Stats.Misses))
+	mw.metric("collisions_total", "counter", "Puts and gets that met another key with the same hash.", float64(m.Stats.Collisions))
+	mw.metric("errors_total", "counter", "Failed operations.", float64(m.Stats.Errors))
+	mw.metric("corruptions_total", "counter", "Corrupt entries dropped.", float64(m.Stats.Corruptions))
+	mw.metric("evictions_total", "counter", "Entries overwritten by the ring.", float64(m.Stats.Evictions))
+	mw.metric("expirations_total", "counter", "Expired entries dropped.", float64(m.Stats.Expirations))
+	mw.metric("hit_ratio", "gauge", "Hits divided by gets.", m.Stats.HitRatio)
+	mw.header("ops_rate", "gauge", "Gets and puts per second, exponentially weighted over the window.")
+	mw.sample("ops_rate", `{window="1m"}`, m.Stats.Rate1)
+	mw.sample("ops_rate", `{window="5m"}`, m.Stats.Rate5)
+	mw.sample("ops_rate", `{window="15m"}`, m.Stats.Rate15)
+	mw.header("calls_total", "counter", "Calls of the cache methods.")
+	ops := &m.Stats.Ops
+	for _, op := range []struct {
+		name string
+		v    uint64
+	}{
+		{"get", ops.Get}, {"get_with_buffer", ops.GetWithBuffer}, {"view", ops.View}, {"multi_get", ops.MultiGet},
+		{"put", ops.Put}, {"put_with_expire", ops.PutWithExpire}, {"multi_put", ops.MultiPut},
+		{"del", ops.Del}, {"scan", ops.Scan},
+	} {
+		mw.sample("calls_total", `{op="`+op.name+`"}`, float64(op.v))
+	}
+	mw.metric("keys", "gauge", "Keys in the index, including not yet evicted stale ones.", float64(m.Keys))
+	mw.metric("index_bytes", "gauge", "Estimated memory of the bucket indexes.", float64(m.IndexBytes))
+	mw.metric("chunk_bytes", "gauge", "Memory of allocated chunks.", float64(m.ChunkBytes))
+	mw.metric("max_chunk_bytes", "gauge", "Memory of chunks when all are allocated.", float64(m.MaxChunkBytes))
+	mw.metric("chunks", "gauge", "Allocated chunks.", float64(m.Chunks))
+	mw.metric("buckets", "gauge", "Buckets.", float64(m.Buckets))
+	mw.metric("bucket_min_keys", "gauge", "Keys of the bucket with the fewest keys.", float64(m.BucketMinKeys))
+	mw.metric("bucket_max_keys", "gauge", "Keys of the bucket with the most keys.", float64(m.BucketMaxKeys))
+	mw.metric("bucket_key_skew", "gauge", "Max keys of a bucket divided by the average.", m.BucketKeySkew)
+	mw.metric("bucket_max_ops", "gauge", "Gets and puts of the bucket with the most.", float64(m.BucketMaxOps))
+	mw.metric("bucket_ops_skew", "gauge", "Max gets and puts of a bucket divided by the average.", m.BucketOpsSkew)
+	mw.metric("loops_total", "counter", "Ring loops of all buckets.", float64(m.Loops))
+
+	if l := m.Stats.Latency; l != nil {
+		mw.header("latency_seconds", "histogram", "Latency of sampled cache operations.")
+		mw.histogram("latency_seconds", `op="get"`, &l.Get)
+		mw.histogram("latency_seconds", `op="put"`, &l.Put)
+		mw.histogram("latency_seconds", `op="del"`, &l.Del)
+		mw.header("lock_wait_seconds", "histogram", "Sampled time waiting for the write lock of a bucket.")
+		mw.histogram("lock_wait_seconds", "", &l.LockWait)
+		mw.header("chunk_alloc_seconds", "histogram", "Time allocating chunks.")
+		mw.histogram("chunk_alloc_seconds", "", &l.ChunkAlloc)
+	}
+	if h.opts.Commands != nil {
+		commands := h.opts.Commands()
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		mw.header("command_latency_seconds", "histogram", "Latency of commands.")
+		for _, name := range names {
+			h := commands[name]
+			mw.histogram("command_latency_seconds", `command="`+name+`"`, &h)
+		}
+	}
+
+	if h.opts.PerBucket {
+		mw.header("bucket_keys", "gauge", "Keys of the bucket.")
+		for i := range buckets {
+			mw.bucketSample("bucket_keys", i, float64(buckets[i].Keys))
+		}
+		mw.header("bucket_index_bytes", "gauge", "Estimated memory of the bucket index.")
+		for i := range buckets {
+			mw.bucketSample("bucket_index_bytes", i, float64(buckets[i].MapBytes))
+		}
+		mw.header("bucket_ops_total", "counter", "Gets and puts of the bucket.")
+		for i := range buckets {
+			mw.bucketSample("bucket_ops_total", i, float64(buckets[i].Ops))
+		}
+		mw.header("bucket_loops_total", "counter", "Ring loops of the bucket.")
+		for i := range buckets {
+			mw.bucketSample("bucket_loops_total", i, float64(buckets[i].Loop))
+		}
+	}
+	_ = mw.w.Flush()
+}
+
+// metricsWriter 按Prometheus文本格式写指标, 写失败时由Flush返回错误, 客户端断开不需要处理
+type metricsWriter struct {
+	w         *bufio.Writer
+	namespace string
+	buf       []byte
+}
+
+func (mw *metricsWriter) header(name, typ, help string) {
+	_, _ = mw.w.WriteString("# HELP " + mw.namespace + "_" + name + " " + help + "\n")
+	_, _ = mw.w.WriteString("# TYPE " + mw.namespace + "_" + name + " " + typ + "\n")
+}
+
+func (mw *metricsWriter) metric(name, typ, help string, v float64) {
+	mw.header(name, typ, help)
+	mw.sample(name, "", v)
+}
+
+func (mw *metricsWriter) bucketSample(name string, bucket int, v float64) {
+	mw.sample(name, `{bucket="`+strconv.Itoa(bucket)+`"}`, v)
+}
+
+// histogram 输出累计的_bucket, _sum和_count, labels不带括号, 可以为空
+func (mw *metricsWriter) histogram(name, labels string, h *LatencyHistogram) {
+	prefix := "{"
+	if labels != "" {
+		prefix += labels + ","
+	}
+	for i := 0; i < metricsLatencyBuckets; i++ {
+		le := time.Microsecond << uint(i)
+		mw.sample(name+"_bucket", prefix+`le="`+strconv.FormatFloat(le.Seconds(), 'g', -1, 64)+`"}`, float64(h.CountBelow(le)))
+	}
+	mw.sample(name+"_bucket", prefix+`le="+Inf"}`, float64(h.Count))
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	mw.sample(name+"_sum", labels, h.Sum.Seconds())
+	mw.sample(name+"_count", labels, float64(h.Count))
+}
+
+func (mw *metricsWriter) sample(name, labels string, v float64) {
+	mw.buf = append(mw.buf[:0], mw.namespace...)
+	mw.buf = append(mw.buf, '_')
+	mw.buf = append(mw.buf, name...)
+	mw.buf = append(mw.buf, labels...)
+	mw.buf = append(mw.buf, ' ')
+	mw.buf = strconv.AppendFloat(mw.buf, v, 'g', -1, 64)
+	mw.buf = append(mw.buf, '\n')
+	_, _ = mw.w.Write(mw.buf)
+}
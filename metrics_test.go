@@ -0,0 +1,77 @@
+package lantern_cache
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	ca := NewLanternCache(&Config{
+		BucketCount: 2,
+		MaxCapacity: 4 * chunkSize,
+	})
+	// 写满几圈, 产生淘汰
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, ca.Put([]byte(fmt.Sprintf("key%d", i)), make([]byte, 200)))
+	}
+	assert.Nil(t, ca.PutWithExpire([]byte("ttl"), []byte("value"), -1))
+	_, err := ca.Get([]byte("ttl"))
+	assert.Equal(t, ErrorValueExpire, err)
+	_, _ = ca.Get([]byte("key1999"))
+	_, _ = ca.Get([]byte("none"))
+
+	m := ca.Metrics()
+	assert.Equal(t, uint64(1), m.Stats.Expirations)
+	assert.True(t, m.Stats.Evictions > 0)
+	assert.Equal(t, 2, m.Buckets)
+	assert.Equal(t, uint64(ca.Size()), m.Keys)
+	assert.Equal(t, m.Keys, m.BucketMinKeys+m.BucketMaxKeys)
+	assert.True(t, m.Loops >= 2)
+	assert.Equal(t, uint64(4), m.Chunks)
+
+	rec := httptest.NewRecorder()
+	ca.MetricsHandler(&MetricsOptions{PerBucket: true}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, metricsContentType, rec.Header().Get("Content-Type"))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE lantern_gets_total counter",
+		fmt.Sprintf("lantern_gets_total %d", m.Stats.Gets),
+		"lantern_hits_total 1",
+		"lantern_expirations_total 1",
+		fmt.Sprintf("lantern_evictions_total %d", m.Stats.Evictions),
+		fmt.Sprintf("lantern_keys %d", m.Keys),
+		"lantern_chunks 4",
+		fmt.Sprintf("lantern_hit_ratio %g", m.Stats.HitRatio),
+		`lantern_calls_total{op="put"} 2000`,
+		`lantern_ops_rate{window="1m"} 0`,
+		"# TYPE lantern_bucket_keys gauge",
+		fmt.Sprintf(`lantern_bucket_loops_total{bucket="1"} %d`, ca.BucketStats()[1].Loop),
+	} {
+		assert.True(t, strings.Contains(body, line+"\n"), line)
+	}
+
+	rec = httptest.NewRecorder()
+	ca.MetricsHandler(&MetricsOptions{Namespace: "cache"}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.True(t, strings.Contains(rec.Body.String(), "cache_puts_total 2001\n"))
+	assert.False(t, strings.Contains(rec.Body.String(), "bucket_keys"))
+}
+
+func TestPublishExpvar(t *testing.T) {
+	ca := NewLanternCache(&Config{BucketCount: 2, MaxCapacity: 1024 * 1024})
+	assert.Nil(t, ca.Put([]byte("key"), []byte("value")))
+	name := fmt.Sprintf("lantern-test-%d", time.Now().UnixNano())
+	ca.PublishExpvar(name)
+
+	var m Metrics
+	assert.Nil(t, json.Unmarshal([]byte(expvar.Get(name).String()), &m))
+	assert.Equal(t, uint64(1), m.Stats.Puts)
+	assert.Equal(t, uint64(1), m.Keys)
+}
@@ -0,0 +1,9 @@
+//go:build (amd64 || 386) && !race
+// +build amd64 386
+// +build !race
+
+package lantern_cache
+
+// optimisticSupported x86的load不会和其它load重排, 读完数据后再读seq就能发现重叠的写入
+// race检测会把乐观读报告为数据竞争, 开启race时不使用
+const optimisticSupported = true
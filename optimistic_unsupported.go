@@ -0,0 +1,7 @@
+//go:build (!amd64 && !386) || race
+// +build !amd64,!386 race
+
+package lantern_cache
+
+// optimisticSupported 其它架构需要读屏障才能保证seq的校验, Go没有提供, 总是加读锁
+const optimisticSupported = false
@@ -0,0 +1,300 @@
+package lantern_cache
+
+import (
+	"sync"
+
+	"github.com/tidwall/redcon"
+)
+
+const subscriberBufferSize = 1024
+
+// subscriber 是一个detach后进入订阅模式的连接
+// 消息先放进out, 由单独的goroutine写到网络, 这样publish不会被慢连接阻塞
+type subscriber struct {
+	id       uint64
+	conn     redcon.DetachedConn
+	out      chan []byte
+	done     chan struct{}
+	once     sync.Once
+	channels map[string]struct{}
+	patterns map[string]struct{}
+}
+
+func newSubscriber(conn redcon.DetachedConn) *subscriber {
+	ret := &subscriber{
+		conn:     conn,
+		out:      make(chan []byte, subscriberBufferSize),
+		done:     make(chan struct{}),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+	go ret.writeLoop()
+	return ret
+}
+
+// send 不会阻塞, 缓冲区满了说明客户端消费不过来, 直接断开
+func (s *subscriber) send(msg []byte) {
+	select {
+	case s.out <- msg:
+	case <-s.done:
+	default:
+		s.close()
+	}
+}
+
+func (s *subscriber) count() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+// close 可以在任何goroutine调用, 连接由writeLoop关闭
+func (s *subscriber) close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// writeLoop 是唯一写和关闭连接的goroutine, redcon的连接不能并发使用
+func (s *subscriber) writeLoop() {
+	defer func() {
+		_ = s.conn.Close()
+	}()
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.out:
+			// nil 表示写完之前的消息后关闭连接
+			if msg == nil {
+				_ = s.conn.Flush()
+				s.close()
+				return
+			}
+			s.conn.WriteRaw(msg)
+			for n := len(s.out); n > 0; n-- {
+				if msg = <-s.out; msg == nil {
+					_ = s.conn.Flush()
+					s.close()
+					return
+				}
+				s.conn.WriteRaw(msg)
+			}
+			if err := s.conn.Flush(); err != nil {
+				s.close()
+				return
+			}
+		}
+	}
+}
+
+type pubsub struct {
+	mutex    sync.RWMutex
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+	clients  map[uint64]*subscriber
+}
+
+func newPubSub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+		clients:  make(map[uint64]*subscriber),
+	}
+}
+
+func (ps *pubsub) addClient(s *subscriber) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.clients[s.id] = s
+}
+
+func (ps *pubsub) removeClient(s *subscriber) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	delete(ps.clients, s.id)
+}
+
+func (ps *pubsub) hasClient(id uint64) bool {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	_, ok := ps.clients[id]
+	return ok
+}
+
+// sendTo 把消息发给指定id的订阅连接, 用于CLIENT TRACKING的REDIRECT
+func (ps *pubsub) sendTo(id uint64, msg []byte) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	if s, ok := ps.clients[id]; ok {
+		s.send(msg)
+	}
+}
+
+func (ps *pubsub) subscribe(s *subscriber, channel string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	addSubscriber(ps.channels, channel, s)
+	s.channels[channel] = struct{}{}
+}
+
+func (ps *pubsub) psubscribe(s *subscriber, pattern string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	addSubscriber(ps.patterns, pattern, s)
+	s.patterns[pattern] = struct{}{}
+}
+
+func (ps *pubsub) unsubscribe(s *subscriber, channel string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	removeSubscriber(ps.channels, channel, s)
+	delete(s.channels, channel)
+}
+
+func (ps *pubsub) punsubscribe(s *subscriber, pattern string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	removeSubscriber(ps.patterns, pattern, s)
+	delete(s.patterns, pattern)
+}
+
+func (ps *pubsub) unsubscribeAll(s *subscriber) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	for channel := range s.channels {
+		removeSubscriber(ps.channels, channel, s)
+	}
+	for pattern := range s.patterns {
+		removeSubscriber(ps.patterns, pattern, s)
+	}
+	s.channels = make(map[string]struct{})
+	s.patterns = make(map[string]struct{})
+}
+
+// publish 返回收到消息的订阅数
+func (ps *pubsub) publish(channel string, message []byte) int {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	count := 0
+	if subs, ok := ps.channels[channel]; ok {
+		msg := redcon.AppendArray(nil, 3)
+		msg = redcon.AppendBulkString(msg, "message")
+		msg = redcon.AppendBulkString(msg, channel)
+		msg = redcon.AppendBulk(msg, message)
+		for s := range subs {
+			s.send(msg)
+			count++
+		}
+	}
+	for pattern, subs := range ps.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		msg := redcon.AppendArray(nil, 4)
+		msg = redcon.AppendBulkString(msg, "pmessage")
+		msg = redcon.AppendBulkString(msg, pattern)
+		msg = redcon.AppendBulkString(msg, channel)
+		msg = redcon.AppendBulk(msg, message)
+		for s := range subs {
+			s.send(msg)
+			count++
+		}
+	}
+	return count
+}
+
+func addSubscriber(m map[string]map[*subscriber]struct{}, name string, s *subscriber) {
+	subs, ok := m[name]
+	if !ok {
+		subs = make(map[*subscriber]struct{})
+		m[name] = subs
+	}
+	subs[s] = struct{}{}
+}
+
+func removeSubscriber(m map[string]map[*subscriber]struct{}, name string, s *subscriber) {
+	if subs, ok := m[name]; ok {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(m, name)
+		}
+	}
+}
+
+// globMatch 按redis的规则匹配, 支持 * ? [abc] [^a-z] 和 \ 转义
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				if pattern[0] == '\\' && len(pattern) > 1 {
+					pattern = pattern[1:]
+					if pattern[0] == s[0] {
+						match = true
+					}
+					pattern = pattern[1:]
+				} else if len(pattern) > 2 && pattern[1] == '-' {
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					if s[0] >= start && s[0] <= end {
+						match = true
+					}
+					pattern = pattern[3:]
+				} else {
+					if pattern[0] == s[0] {
+						match = true
+					}
+					pattern = pattern[1:]
+				}
+			}
+			if len(pattern) > 0 {
+				pattern = pattern[1:]
+			}
+			if match == not {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
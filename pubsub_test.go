@@ -0,0 +1,32 @@
+package lantern_cache
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"__keyspace@0__:*", "__keyspace@0__:key", true},
+		{"__keyspace@0__:*", "__keyevent@0__:set", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+	}
+	for _, c := range cases {
+		if globMatch(c.pattern, c.s) != c.match {
+			t.Fatalf("pattern:%s s:%s except:%v", c.pattern, c.s, c.match)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package lantern_cache
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+/*
+改变bucket数量: 每次翻倍或者减半, 直到变成目标数量
+翻倍: bucket i按keyHash多用的一位拆成i和i+n, 减半: bucket t+n合并到t
+迁移时同时有新旧两个布局, done标记每组key是否已经迁移, 没有迁移的key还在旧的bucket里读写
+一组一次只锁住相关的两个bucket, 把有效的entry重写到新的ring里, 其它bucket照常读写
+bucket的mask和id决定它拥有哪些key, 在写锁内和done一起修改
+拿到旧布局的调用在bucket的锁内发现key不属于它时返回errBucketMoved, 重新找bucket后重试
+重写后loop比原来的都大, 索引值都变了, 事务的WATCH只会多冲突
+*/
+
+// bucketLayout 发布以后只有done会被修改, 迁移结束后发布没有done的新布局
+type bucketLayout struct {
+	// retired 减半时合并掉的bucket的计数, Stats加上它们, 计数不会因为Rebucket变少
+	retired    Stats
+	retiredOps OpStats
+
+	buckets []*bucket
+	mask    uint64
+	// oldMask 和done 只在迁移时使用, done[keyHash&(len(done)-1)]是1表示这组key已经迁移到mask的位置
+	oldMask uint64
+	done    []uint32
+}
+
+// bucket 返回keyHash所在的bucket, 只有持有这个bucket的锁并且它owns(keyHash)时结果才不会变
+func (l *bucketLayout) bucket(keyHash uint64) *bucket {
+	if l.done != nil && atomic.LoadUint32(&l.done[keyHash&uint64(len(l.done)-1)]) == 0 {
+		return l.buckets[keyHash&l.oldMask]
+	}
+	return l.buckets[keyHash&l.mask]
+}
+
+func (lc *LanternCache) loadLayout() *bucketLayout {
+	return (*bucketLayout)(atomic.LoadPointer(&lc.layout))
+}
+
+func (lc *LanternCache) storeLayout(l *bucketLayout) {
+	atomic.StorePointer(&lc.layout, unsafe.Pointer(l))
+}
+
+// bucketFor 返回keyHash所在的bucket, 在bucket的锁内要用owns确认key没有被迁移走
+func (lc *LanternCache) bucketFor(keyHash uint64) *bucket {
+	return lc.loadLayout().bucket(keyHash)
+}
+
+// BucketCount returns the number of buckets, Config.BucketCount or the count of the last Rebucket.
+func (lc *LanternCache) BucketCount() uint32 {
+	return uint32(lc.loadLayout().mask + 1)
+}
+
+// Rebucket changes the number of buckets online, n must be a power of two and every bucket needs
+// at least one chunk of the max capacity. The count is doubled or halved until it reaches n, each
+// step moves the entries of one or two buckets at a time while readers and writers of the other
+// keys are not blocked, keys not moved yet are served from the old buckets. Entries are rewritten
+// oldest first, when a bucket gets more than fits the oldest are evicted. An invalid n returns a
+// *ConfigError. When a chunk can't be allocated Rebucket stops with the keys moved so far served
+// from their new buckets, calling Rebucket again finishes the move.
+func (lc *LanternCache) Rebucket(n uint32) error {
+	lc.resizeMutex.Lock()
+	defer lc.resizeMutex.Unlock()
+	if n == 0 || !isPowerOfTwo(n) {
+		return &ConfigError{Field: "BucketCount", Value: n, Reason: "must be a power of two"}
+	}
+	maxCapacity := lc.MaxCapacity()
+	if maxCapacity/uint64(n) < chunkSize {
+		return &ConfigError{Field: "BucketCount", Value: n, Reason: "every bucket needs at least one chunk of 64KB of max capacity " + humanSize(int64(maxCapacity))}
+	}
+
+	start := time.Now()
+	l := lc.loadLayout()
+	old := l.mask + 1
+	if l.done != nil {
+		old = l.oldMask + 1
+	}
+	evicted := 0
+	for {
+		// 上次迁移失败时先完成它
+		if l.done != nil {
+			count, err := lc.migrate(l)
+			evicted += count
+			if err != nil {
+				lc.logger.log(LevelError, "cache rebucket failed", F("buckets", old), F("target", n), F("err", err))
+				return err
+			}
+			l = lc.finishMigration(l)
+		}
+		count := uint32(l.mask + 1)
+		if count == n {
+			break
+		}
+		var err error
+		if count < n {
+			l, err = lc.splitLayout(l)
+		} else {
+			l = lc.mergeLayout(l)
+		}
+		if err != nil {
+			lc.logger.log(LevelError, "cache rebucket failed", F("buckets", count), F("target", n), F("err", err))
+			return err
+		}
+	}
+	lc.logger.log(LevelInfo, "cache rebucketed", F("old_buckets", old), F("buckets", n), F("evicted", evicted), F("elapsed", time.Since(start)))
+	return nil
+}
+
+// bucketChunks 返回cache有count个bucket时每个bucket的chunk数
+func (lc *LanternCache) bucketChunks(count int) int {
+	bucketMaxCapacity := (lc.MaxCapacity() + uint64(count) - 1) / uint64(count)
+	return int((bucketMaxCapacity + chunkSize - 1) / chunkSize)
+}
+
+// splitLayout 发布翻倍的迁移布局, 新的bucket i+n不拥有任何key, 迁移时才修改mask
+func (lc *LanternCache) splitLayout(l *bucketLayout) (*bucketLayout, error) {
+	count := len(l.buckets)
+	next := &bucketLayout{buckets: make([]*bucket, 2*count), mask: uint64(2*count - 1), oldMask: l.mask, done: make([]uint32, count)}
+	next.retired.add(&l.retired)
+	next.retiredOps.add(&l.retiredOps)
+	copy(next.buckets, l.buckets)
+	bc := lc.bucketConfig
+	bc.maxCapacity = uint64(lc.bucketChunks(2*count)) * chunkSize
+	bc.initCapacity = 1
+	for i := count; i < 2*count; i++ {
+		b, err := newBucket(&bc)
+		if err != nil {
+			for _, b := range next.buckets[count:i] {
+				b.reset()
+			}
+			return nil, err
+		}
+		b.id = i
+		b.mask = l.mask
+		next.buckets[i] = b
+	}
+	lc.storeLayout(next)
+	return next, nil
+}
+
+// mergeLayout 发布减半的迁移布局, bucket t+n合并到t
+func (lc *LanternCache) mergeLayout(l *bucketLayout) *bucketLayout {
+	half := len(l.buckets) / 2
+	next := &bucketLayout{buckets: l.buckets, mask: uint64(half - 1), oldMask: l.mask, done: make([]uint32, half)}
+	next.retired.add(&l.retired)
+	next.retiredOps.add(&l.retiredOps)
+	lc.storeLayout(next)
+	return next
+}
+
+// migrate 迁移l里还没有迁移的每组key, 返回淘汰的entry数
+func (lc *LanternCache) migrate(l *bucketLayout) (int, error) {
+	evicted := 0
+	chunkCount := lc.bucketChunks(int(l.mask + 1))
+	for i := range l.done {
+		if atomic.LoadUint32(&l.done[i]) == 1 {
+			continue
+		}
+		var n int
+		var err error
+		if l.mask > l.oldMask {
+			n, err = l.split(i, chunkCount)
+		} else {
+			n, err = l.merge(i, chunkCount)
+		}
+		evicted += n
+		if err != nil {
+			return evicted, err
+		}
+	}
+	return evicted, nil
+}
+
+// split 把bucket i里keyHash多用的一位是1的key搬到i+n, 两个bucket都重写成chunkCount个chunk
+func (l *bucketLayout) split(i, chunkCount int) (int, error) {
+	b, nb := l.buckets[i], l.buckets[i+len(l.done)]
+	b.lock()
+	defer b.unlock()
+	nb.lock()
+	defer nb.unlock()
+
+	live, expired, corrupt := b.liveEntriesLocked(time.Now().Unix())
+	var low, high []ringEntry
+	for _, e := range live {
+		if e.keyHash&uint64(len(l.done)) == 0 {
+			low = append(low, e)
+		} else {
+			high = append(high, e)
+		}
+	}
+	loop := b.loop + 1
+	lowRing, lowFirst, err := packRing(b.chunkAlloc, low, chunkCount, loop)
+	if err != nil {
+		return 0, err
+	}
+	highRing, highFirst, err := packRing(b.chunkAlloc, high, chunkCount, loop)
+	if err != nil {
+		for _, chunk := range lowRing.chunks {
+			b.chunkAlloc.putChunk(chunk)
+		}
+		return 0, err
+	}
+	b.droppedLocked(append(low[:lowFirst:lowFirst], high[:highFirst]...), expired, corrupt)
+	nb.installLocked(highRing, high[highFirst:])
+	b.installLocked(lowRing, low[lowFirst:])
+	atomic.StoreUint64(&b.mask, l.mask)
+	atomic.StoreUint64(&nb.mask, l.mask)
+	atomic.StoreUint32(&l.done[i], 1)
+	return lowFirst + highFirst, nil
+}
+
+// merge 把bucket t+n的key搬到t, t重写成chunkCount个chunk, t+n的chunk放回allocator
+func (l *bucketLayout) merge(t, chunkCount int) (int, error) {
+	b, rb := l.buckets[t], l.buckets[t+len(l.done)]
+	b.lock()
+	defer b.unlock()
+	rb.lock()
+	defer rb.unlock()
+
+	now := time.Now().Unix()
+	live, expired, corrupt := b.liveEntriesLocked(now)
+	rlive, rexpired, rcorrupt := rb.liveEntriesLocked(now)
+	// 两个bucket之间分不出先后, 容量是原来的两倍, 一般都放得下
+	live = append(live, rlive...)
+	loop := b.loop
+	if rb.loop > loop {
+		loop = rb.loop
+	}
+	r, first, err := packRing(b.chunkAlloc, live, chunkCount, loop+1)
+	if err != nil {
+		return 0, err
+	}
+	b.droppedLocked(live[:first], expired, corrupt)
+	rb.droppedLocked(nil, rexpired, rcorrupt)
+	b.installLocked(r, live[first:])
+	rb.installLocked(ring{loop: loop + 1}, nil)
+	atomic.StoreUint64(&b.mask, l.mask)
+	atomic.StoreUint64(&rb.mask, l.mask)
+	atomic.StoreUint32(&l.done[t], 1)
+	return first, nil
+}
+
+// finishMigration 所有key迁移完以后发布只有新bucket的布局, 合并掉的bucket的计数加到retired
+func (lc *LanternCache) finishMigration(l *bucketLayout) *bucketLayout {
+	count := int(l.mask + 1)
+	next := &bucketLayout{buckets: l.buckets[:count:count], mask: l.mask}
+	next.retired.add(&l.retired)
+	next.retiredOps.add(&l.retiredOps)
+	for _, b := range l.buckets[count:] {
+		next.retired.add(b.statistics)
+		next.retiredOps.add(&b.ops)
+	}
+	lc.storeLayout(next)
+	return next
+}
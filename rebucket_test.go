@@ -0,0 +1,191 @@
+package lantern_cache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebucketSplit(t *testing.T) {
+	cache, err := New(&Config{}, WithBuckets(4), WithMaxCapacity(64*chunkSize))
+	assert.Nil(t, err)
+	const n = 1000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, cache.Put([]byte(fmt.Sprintf("key%d", i)), resizeTestValue(i)))
+	}
+	assert.Nil(t, cache.PutWithExpire([]byte("expired"), []byte("value"), -10))
+
+	assert.Nil(t, cache.Rebucket(16))
+	assert.Equal(t, uint32(16), cache.BucketCount())
+	assert.Equal(t, 16, len(cache.BucketStats()))
+	assert.Equal(t, uint64(n), cache.Size())
+	for i := 0; i < n; i++ {
+		v, err := cache.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.Nil(t, err, i)
+		assert.Equal(t, resizeTestValue(i), v)
+	}
+	stats := cache.Stats()
+	assert.Equal(t, uint64(n+1), stats.Puts)
+	assert.Equal(t, uint64(0), stats.Evictions)
+	assert.Equal(t, uint64(1), stats.Expirations)
+	for _, bs := range cache.BucketStats() {
+		assert.Equal(t, uint64(4*chunkSize), bs.MaxChunkBytes)
+	}
+}
+
+func TestRebucketMerge(t *testing.T) {
+	cache, err := New(&Config{}, WithBuckets(16), WithMaxCapacity(64*chunkSize))
+	assert.Nil(t, err)
+	const n = 1000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, cache.Put([]byte(fmt.Sprintf("key%d", i)), resizeTestValue(i)))
+	}
+	for i := 0; i < n; i++ {
+		_, err := cache.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, cache.Rebucket(2))
+	assert.Equal(t, uint32(2), cache.BucketCount())
+	assert.Equal(t, uint64(n), cache.Size())
+	for i := 0; i < n; i++ {
+		v, err := cache.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.Nil(t, err, i)
+		assert.Equal(t, resizeTestValue(i), v)
+	}
+	// 合并掉的bucket的计数还在
+	stats := cache.Stats()
+	assert.Equal(t, uint64(n), stats.Puts)
+	assert.Equal(t, uint64(2*n), stats.Gets)
+	assert.Equal(t, uint64(2*n), stats.Hits)
+
+	// 再拆开也不丢key
+	assert.Nil(t, cache.Rebucket(8))
+	assert.Equal(t, uint64(n), cache.Size())
+	assert.Equal(t, uint64(n), cache.Stats().Puts)
+}
+
+func TestRebucketInvalid(t *testing.T) {
+	cache, err := New(&Config{}, WithBuckets(4), WithMaxCapacity(16*chunkSize))
+	assert.Nil(t, err)
+	for _, n := range []uint32{0, 3, 32} {
+		err = cache.Rebucket(n)
+		var configErr *ConfigError
+		assert.True(t, errors.As(err, &configErr), n)
+		assert.Equal(t, "BucketCount", configErr.Field)
+	}
+	assert.Equal(t, uint32(4), cache.BucketCount())
+	assert.Nil(t, cache.Rebucket(4))
+}
+
+func TestRebucketChunkAllocFailure(t *testing.T) {
+	cache, err := New(&Config{}, WithBuckets(2), WithMaxCapacity(8*chunkSize))
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, cache.Put([]byte(fmt.Sprintf("key%d", i)), resizeTestValue(i)))
+	}
+	alloc := cache.bucketConfig.chunkAlloc
+	alloc.freeChunksLock.Lock()
+	factory, free := alloc.factory, alloc.freeChunks
+	alloc.factory, alloc.freeChunks = failingChunkFactory{}, nil
+	alloc.freeChunksLock.Unlock()
+
+	assert.NotNil(t, cache.Rebucket(4))
+	assert.Equal(t, uint32(2), cache.BucketCount())
+	for i := 0; i < 100; i++ {
+		_, err := cache.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.Nil(t, err, i)
+	}
+
+	alloc.freeChunksLock.Lock()
+	alloc.factory, alloc.freeChunks = factory, free
+	alloc.freeChunksLock.Unlock()
+	assert.Nil(t, cache.Rebucket(4))
+	assert.Equal(t, uint64(100), cache.Size())
+}
+
+func TestRebucketScanCursor(t *testing.T) {
+	cache, err := New(&Config{}, WithBuckets(4), WithMaxCapacity(64*chunkSize))
+	assert.Nil(t, err)
+	const n = 500
+	for i := 0; i < n; i++ {
+		assert.Nil(t, cache.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+	// 每一步扫描之间改变bucket的数量, 每个key都只返回一次
+	seen := make(map[string]int)
+	counts := []uint32{16, 2, 8, 1, 32, 4}
+	cursor, steps := uint64(0), 0
+	for {
+		var keys [][]byte
+		keys, cursor = cache.ScanCursor(cursor, 30)
+		for _, key := range keys {
+			seen[string(key)]++
+		}
+		if cursor == 0 {
+			break
+		}
+		assert.Nil(t, cache.Rebucket(counts[steps%len(counts)]))
+		steps++
+	}
+	assert.True(t, steps > 5, steps)
+	assert.Equal(t, n, len(seen))
+	for key, count := range seen {
+		assert.Equal(t, 1, count, key)
+	}
+}
+
+func TestRebucketConcurrent(t *testing.T) {
+	cache, err := New(&Config{}, WithBuckets(4), WithMaxCapacity(64*chunkSize), WithOptimisticReads())
+	assert.Nil(t, err)
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := []byte(fmt.Sprintf("key%d-%d", g, i%500))
+				switch i % 4 {
+				case 0:
+					assert.Nil(t, cache.Put(key, key))
+				case 1:
+					if v, err := cache.Get(key); err == nil {
+						assert.Equal(t, key, v)
+					}
+				case 2:
+					// 只有这个goroutine写自己的key, 只有迁移会让事务冲突
+					err := cache.Update(func(tx *Txn) error {
+						if _, err := tx.Get(key); err != nil && err != ErrorNotFound {
+							return err
+						}
+						return tx.Put(key, key)
+					})
+					if err != ErrorTxnConflict {
+						assert.Nil(t, err)
+					}
+				default:
+					cache.Del(key)
+				}
+			}
+		}(g)
+	}
+	for i := 0; i < 20; i++ {
+		count := uint32(4)
+		if i%2 == 0 {
+			count = 16
+		}
+		assert.Nil(t, cache.Rebucket(count))
+	}
+	close(stop)
+	wg.Wait()
+	assert.Equal(t, uint32(4), cache.BucketCount())
+	assert.Equal(t, 0, cache.Verify())
+}
@@ -0,0 +1,484 @@
+package lantern_cache
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/redcon"
+)
+
+const defaultUser = "default"
+
+// commandCategories 是每个命令所属的ACL分类, 也是ACL能识别的全部命令
+var commandCategories = map[string][]string{
+	"get":          {"read", "string", "fast"},
+	"mget":         {"read", "string", "fast"},
+	"hget":         {"read", "hash", "fast"},
+	"hmget":        {"read", "hash", "fast"},
+	"set":          {"write", "string", "slow"},
+	"setex":        {"write", "string", "slow"},
+	"mset":         {"write", "string", "slow"},
+	"hset":         {"write", "hash", "fast"},
+	"hmset":        {"write", "hash", "fast"},
+	"del":          {"write", "keyspace", "slow"},
+	"scan":         {"read", "keyspace", "slow"},
+	"dbsize":       {"read", "keyspace", "fast"},
+	"info":         {"dangerous", "slow"},
+	"publish":      {"pubsub", "fast"},
+	"subscribe":    {"pubsub", "slow"},
+	"psubscribe":   {"pubsub", "slow"},
+	"unsubscribe":  {"pubsub", "slow"},
+	"punsubscribe": {"pubsub", "slow"},
+	"multi":        {"transaction", "fast"},
+	"exec":         {"transaction", "slow"},
+	"discard":      {"transaction", "fast"},
+	"watch":        {"transaction", "fast"},
+	"unwatch":      {"transaction", "fast"},
+	"ping":         {"connection", "fast"},
+	"select":       {"connection", "fast"},
+	"hello":        {"connection", "fast"},
+	"client":       {"connection", "slow"},
+	"config":       {"admin", "dangerous", "slow"},
+	"acl":          {"admin", "dangerous", "slow"},
+	"latency":      {"admin", "dangerous", "slow"},
+	"slowlog":      {"admin", "dangerous", "slow"},
+	"object":       {"read", "keyspace", "slow"},
+	"memory":       {"read", "slow"},
+	"lantern":      {"admin", "dangerous", "slow"},
+}
+
+// aclUser 创建后不再修改, ACL SETUSER会生成新的aclUser替换旧的
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords map[string]struct{} // sha256 hex
+	commands  map[string]struct{}
+	allKeys   bool
+	patterns  []string
+}
+
+func newACLUser(name string) *aclUser {
+	return &aclUser{
+		name:      name,
+		passwords: make(map[string]struct{}),
+		commands:  make(map[string]struct{}),
+	}
+}
+
+func (u *aclUser) clone() *aclUser {
+	ret := newACLUser(u.name)
+	ret.enabled = u.enabled
+	ret.nopass = u.nopass
+	ret.allKeys = u.allKeys
+	for k := range u.passwords {
+		ret.passwords[k] = struct{}{}
+	}
+	for k := range u.commands {
+		ret.commands[k] = struct{}{}
+	}
+	ret.patterns = append(ret.patterns, u.patterns...)
+	return ret
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// apply 按redis ACL SETUSER的语法修改用户, 支持
+// on off >pass <pass nopass resetpass ~pattern allkeys resetkeys +cmd -cmd +@category -@category allcommands nocommands reset
+func (u *aclUser) apply(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+	case "off":
+		u.enabled = false
+	case "nopass":
+		u.nopass = true
+		u.passwords = make(map[string]struct{})
+	case "resetpass":
+		u.nopass = false
+		u.passwords = make(map[string]struct{})
+	case "allkeys":
+		u.allKeys = true
+		u.patterns = nil
+	case "resetkeys":
+		u.allKeys = false
+		u.patterns = nil
+	case "allcommands":
+		for cmd := range commandCategories {
+			u.commands[cmd] = struct{}{}
+		}
+	case "nocommands":
+		u.commands = make(map[string]struct{})
+	case "reset":
+		*u = *newACLUser(u.name)
+		return nil
+	default:
+		if len(rule) < 2 {
+			return fmt.Errorf("Syntax error")
+		}
+		switch rule[0] {
+		case '>':
+			u.nopass = false
+			u.passwords[hashPassword(rule[1:])] = struct{}{}
+		case '<':
+			delete(u.passwords, hashPassword(rule[1:]))
+		case '~':
+			if rule == "~*" {
+				u.allKeys = true
+				u.patterns = nil
+			} else if !u.allKeys {
+				u.patterns = append(u.patterns, rule[1:])
+			}
+		case '+', '-':
+			names, err := ruleCommands(strings.ToLower(rule[1:]))
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				if rule[0] == '+' {
+					u.commands[name] = struct{}{}
+				} else {
+					delete(u.commands, name)
+				}
+			}
+		default:
+			return fmt.Errorf("Syntax error")
+		}
+	}
+	return nil
+}
+
+func ruleCommands(name string) ([]string, error) {
+	if strings.HasPrefix(name, "@") {
+		category := name[1:]
+		var ret []string
+		for cmd, categories := range commandCategories {
+			for _, c := range categories {
+				if c == category || category == "all" {
+					ret = append(ret, cmd)
+					break
+				}
+			}
+		}
+		if len(ret) == 0 {
+			return nil, fmt.Errorf("Unknown command category '%s'", category)
+		}
+		return ret, nil
+	}
+	if _, ok := commandCategories[name]; !ok {
+		return nil, fmt.Errorf("Unknown command '%s'", name)
+	}
+	return []string{name}, nil
+}
+
+func (u *aclUser) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	h := hashPassword(password)
+	for k := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(h)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) canRun(name string) bool {
+	_, ok := u.commands[name]
+	return ok
+}
+
+func (u *aclUser) allCommands() bool {
+	return len(u.commands) == len(commandCategories)
+}
+
+func (u *aclUser) canAccess(key []byte) bool {
+	if u.allKeys {
+		return true
+	}
+	for i := range u.patterns {
+		if globMatch(u.patterns[i], bytes2str(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) String() string {
+	var sb strings.Builder
+	sb.WriteString("user ")
+	sb.WriteString(u.name)
+	if u.enabled {
+		sb.WriteString(" on")
+	} else {
+		sb.WriteString(" off")
+	}
+	if u.nopass {
+		sb.WriteString(" nopass")
+	}
+	passwords := make([]string, 0, len(u.passwords))
+	for k := range u.passwords {
+		passwords = append(passwords, k)
+	}
+	sort.Strings(passwords)
+	for _, k := range passwords {
+		sb.WriteString(" #")
+		sb.WriteString(k)
+	}
+	if u.allKeys {
+		sb.WriteString(" ~*")
+	}
+	for _, p := range u.patterns {
+		sb.WriteString(" ~")
+		sb.WriteString(p)
+	}
+	if u.allCommands() {
+		sb.WriteString(" +@all")
+	} else {
+		sb.WriteString(" -@all")
+		commands := make([]string, 0, len(u.commands))
+		for k := range u.commands {
+			commands = append(commands, k)
+		}
+		sort.Strings(commands)
+		for _, k := range commands {
+			sb.WriteString(" +")
+			sb.WriteString(k)
+		}
+	}
+	return sb.String()
+}
+
+type acl struct {
+	mutex sync.RWMutex
+	users map[string]*aclUser
+}
+
+func newACL(requirePass string) *acl {
+	ret := &acl{users: make(map[string]*aclUser)}
+	u := newACLUser(defaultUser)
+	_ = u.apply("on")
+	_ = u.apply("allkeys")
+	_ = u.apply("allcommands")
+	if requirePass == "" {
+		_ = u.apply("nopass")
+	} else {
+		_ = u.apply(">" + requirePass)
+	}
+	ret.users[defaultUser] = u
+	return ret
+}
+
+func (a *acl) user(name string) *aclUser {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.users[name]
+}
+
+func (a *acl) setUser(name string, rules []string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	u, ok := a.users[name]
+	if ok {
+		u = u.clone()
+	} else {
+		u = newACLUser(name)
+	}
+	for _, rule := range rules {
+		if err := u.apply(rule); err != nil {
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': %s", rule, err)
+		}
+	}
+	a.users[name] = u
+	return nil
+}
+
+// accessible 返回name有权限访问的key, 不修改keys, 用户被删除或者禁用时返回nil
+// SCAN的结果和失效通知不经过authorize, 要在返回给客户端之前过滤
+func (a *acl) accessible(name string, keys [][]byte) [][]byte {
+	u := a.user(name)
+	if u == nil || !u.enabled {
+		return nil
+	}
+	if u.allKeys {
+		return keys
+	}
+	var ret [][]byte
+	for _, key := range keys {
+		if u.canAccess(key) {
+			ret = append(ret, key)
+		}
+	}
+	return ret
+}
+
+func (a *acl) delUser(names ...string) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	n := 0
+	for _, name := range names {
+		if name == defaultUser {
+			continue
+		}
+		if _, ok := a.users[name]; ok {
+			delete(a.users, name)
+			n++
+		}
+	}
+	return n
+}
+
+func (a *acl) list() []*aclUser {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	ret := make([]*aclUser, 0, len(a.users))
+	for _, u := range a.users {
+		ret = append(ret, u)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+// authenticate 返回认证成功的用户名
+func (a *acl) authenticate(name, password string) (string, bool) {
+	u := a.user(name)
+	if u == nil || !u.enabled || !u.checkPassword(password) {
+		return "", false
+	}
+	return u.name, true
+}
+
+// authorize 检查连接当前的用户能否执行cmd, 不能时返回错误信息
+func (r *RedisServer) authorize(ctx *redisConnContext, cmd redcon.Command) (string, bool) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	switch name {
+	case "auth", "quit", "exit":
+		return "", true
+	case "hello":
+		if len(cmd.Args) > 2 {
+			return "", true
+		}
+	}
+	u := r.acl.user(ctx.user)
+	if !ctx.authenticated || u == nil || !u.enabled {
+		ctx.authenticated = false
+		return "NOAUTH Authentication required.", false
+	}
+	if name == "acl" && len(cmd.Args) > 1 && strings.ToLower(string(cmd.Args[1])) == "whoami" {
+		return "", true
+	}
+	// 不认识的命令只有可以执行所有命令的用户才能执行
+	if _, ok := commandCategories[name]; ok && !u.canRun(name) || !ok && !u.allCommands() {
+		return "NOPERM this user has no permissions to run the '" + name + "' command", false
+	}
+	for _, key := range aclKeys(cmd) {
+		if !u.canAccess(key) {
+			return "NOPERM this user has no permissions to access one of the keys used as arguments", false
+		}
+	}
+	return "", true
+}
+
+// aclKeys 返回命令中客户端可见的key, hash命令是hash的名字而不是内部拼接的key
+func aclKeys(cmd redcon.Command) [][]byte {
+	switch strings.ToLower(string(cmd.Args[0])) {
+	case "hget", "hset", "hmget", "hmset":
+		if len(cmd.Args) < 2 {
+			return nil
+		}
+		return cmd.Args[1:2]
+	case "watch":
+		return cmd.Args[1:]
+	case "object", "memory":
+		if len(cmd.Args) < 3 {
+			return nil
+		}
+		return cmd.Args[2:3]
+	}
+	keys, _ := commandKeys(cmd)
+	return keys
+}
+
+func (r *RedisServer) auth(conn redcon.Conn, ctx *redisConnContext, cmd redcon.Command) {
+	// AUTH password
+	// AUTH username password
+	var user, password string
+	switch len(cmd.Args) {
+	case 2:
+		user, password = defaultUser, string(cmd.Args[1])
+	case 3:
+		user, password = string(cmd.Args[1]), string(cmd.Args[2])
+	default:
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	if !r.login(ctx, user, password) {
+		conn.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	conn.WriteString("OK")
+}
+
+func (r *RedisServer) login(ctx *redisConnContext, user, password string) bool {
+	name, ok := r.acl.authenticate(user, password)
+	if !ok {
+		return false
+	}
+	ctx.user = name
+	ctx.authenticated = true
+	return true
+}
+
+func (r *RedisServer) aclCommand(conn redcon.Conn, ctx *redisConnContext, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "whoami":
+		conn.WriteBulkString(ctx.user)
+	case "setuser":
+		if len(cmd.Args) < 3 {
+			conn.WriteError("ERR wrong number of arguments for 'acl setuser' command")
+			return
+		}
+		rules := make([]string, 0, len(cmd.Args)-3)
+		for i := 3; i < len(cmd.Args); i++ {
+			rules = append(rules, string(cmd.Args[i]))
+		}
+		if err := r.acl.setUser(string(cmd.Args[2]), rules); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	case "deluser":
+		names := make([]string, 0, len(cmd.Args)-2)
+		for i := 2; i < len(cmd.Args); i++ {
+			names = append(names, string(cmd.Args[i]))
+		}
+		conn.WriteInt(r.acl.delUser(names...))
+	case "users":
+		users := r.acl.list()
+		conn.WriteArray(len(users))
+		for _, u := range users {
+			conn.WriteBulkString(u.name)
+		}
+	case "list":
+		users := r.acl.list()
+		conn.WriteArray(len(users))
+		for _, u := range users {
+			conn.WriteBulkString(u.String())
+		}
+	default:
+		conn.WriteError("ERR Unknown subcommand or wrong number of arguments for '" + string(cmd.Args[1]) + "'")
+	}
+}
@@ -0,0 +1,108 @@
+package lantern_cache
+
+import (
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+func command(args ...string) redcon.Command {
+	cmd := redcon.Command{}
+	for i := range args {
+		cmd.Args = append(cmd.Args, []byte(args[i]))
+	}
+	return cmd
+}
+
+func TestACLUser(t *testing.T) {
+	a := newACL("")
+	if err := a.setUser("alice", []string{"on", ">secret", "~cache:*", "+@read", "-scan"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.authenticate("alice", "wrong"); ok {
+		t.Fatal("wrong password")
+	}
+	if _, ok := a.authenticate("alice", "secret"); !ok {
+		t.Fatal("right password")
+	}
+
+	u := a.user("alice")
+	if !u.canRun("get") || !u.canRun("hmget") || u.canRun("set") || u.canRun("scan") {
+		t.Fatal(u.String())
+	}
+	if !u.canAccess([]byte("cache:1")) || u.canAccess([]byte("session:1")) {
+		t.Fatal(u.String())
+	}
+
+	if err := a.setUser("alice", []string{"off"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.authenticate("alice", "secret"); ok {
+		t.Fatal("disabled user")
+	}
+	if err := a.setUser("bob", []string{"+nosuchcommand"}); err == nil {
+		t.Fatal("need error")
+	}
+	if a.delUser("alice", defaultUser) != 1 {
+		t.Fatal("deluser")
+	}
+}
+
+func TestRedisServerAuthorize(t *testing.T) {
+	r, err := NewRedisServerWithOptions(":0", NewLanternCache(&Config{BucketCount: 1, MaxCapacity: 1024 * 1024}), &RedisServerOptions{
+		RequirePass: "pass",
+		Users: map[string][]string{
+			"reader": {"on", ">reader", "~cache:*", "+@read"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &redisConnContext{user: defaultUser}
+	if _, ok := r.authorize(ctx, command("get", "cache:1")); ok {
+		t.Fatal("need auth")
+	}
+	if _, ok := r.authorize(ctx, command("auth", "pass")); !ok {
+		t.Fatal("auth always allowed")
+	}
+	if !r.login(ctx, "reader", "reader") {
+		t.Fatal("login")
+	}
+	if _, ok := r.authorize(ctx, command("get", "cache:1")); !ok {
+		t.Fatal("get allowed")
+	}
+	if _, ok := r.authorize(ctx, command("hget", "cache:h", "field")); !ok {
+		t.Fatal("hget allowed")
+	}
+	if _, ok := r.authorize(ctx, command("get", "session:1")); ok {
+		t.Fatal("key not allowed")
+	}
+	if _, ok := r.authorize(ctx, command("set", "cache:1", "v")); ok {
+		t.Fatal("set not allowed")
+	}
+	if _, ok := r.authorize(ctx, command("acl", "whoami")); !ok {
+		t.Fatal("whoami allowed")
+	}
+	if _, ok := r.authorize(ctx, command("flushall")); ok {
+		t.Fatal("unknown command not allowed")
+	}
+	if !r.login(ctx, defaultUser, "pass") {
+		t.Fatal("login")
+	}
+	if _, ok := r.authorize(ctx, command("flushall")); !ok {
+		t.Fatal("unknown command allowed for all commands")
+	}
+}
+
+func TestAllowIPs(t *testing.T) {
+	accept, err := AllowIPs("127.0.0.1", "10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !accept("127.0.0.1:1234") || !accept("10.1.2.3:80") || accept("192.168.1.1:80") {
+		t.Fatal("not equal")
+	}
+	if _, err := AllowIPs("not ip"); err == nil {
+		t.Fatal("need error")
+	}
+}
@@ -0,0 +1,245 @@
+package lantern_cache
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+const (
+	defaultMaxBulkLen      = 512 * 1024 * 1024
+	defaultMaxMultiBulkLen = 1024 * 1024
+	// inline命令没有长度前缀, 和redis一样限制一行最多64KB
+	maxInlineLen = 64 * 1024
+	// *和$开头的行只包含一个数字
+	maxHeaderLen = 32
+)
+
+type errRequestTooLarge struct {
+	msg string
+}
+
+func (e *errRequestTooLarge) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+// requestScanner 在redcon解析之前检查请求的大小, 超过限制的请求直接断开连接, 不会被读进内存
+// 格式错误的请求交给redcon处理, scanner不再检查
+type requestScanner struct {
+	maxBulkLen      int64
+	maxMultiBulkLen int64
+	invalid         bool
+	line            []byte
+	lineLen         int
+	args            int64 // 当前multibulk还剩多少个bulk
+	skip            int64 // 当前bulk还剩多少字节, 包括\r\n
+}
+
+// idle 表示已经读到的数据都是完整的命令
+func (s *requestScanner) idle() bool {
+	return s.invalid || (s.args == 0 && s.skip == 0 && s.lineLen == 0)
+}
+
+func (s *requestScanner) scan(p []byte) error {
+	for len(p) > 0 && !s.invalid {
+		if s.skip > 0 {
+			n := s.skip
+			if n > int64(len(p)) {
+				n = int64(len(p))
+			}
+			s.skip -= n
+			p = p[n:]
+			if s.skip == 0 {
+				s.args--
+			}
+			continue
+		}
+		c := p[0]
+		p = p[1:]
+		if c != '\n' {
+			s.lineLen++
+			if len(s.line) < maxHeaderLen {
+				s.line = append(s.line, c)
+			}
+			if s.lineLen > maxInlineLen {
+				return &errRequestTooLarge{"too big inline request"}
+			}
+			continue
+		}
+		if err := s.header(); err != nil {
+			return err
+		}
+		s.line = s.line[:0]
+		s.lineLen = 0
+	}
+	return nil
+}
+
+func (s *requestScanner) header() error {
+	line := s.line
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	if s.args == 0 {
+		if len(line) == 0 || line[0] != '*' {
+			// inline命令
+			return nil
+		}
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || s.lineLen > maxHeaderLen {
+			s.invalid = true
+			return nil
+		}
+		if n > s.maxMultiBulkLen {
+			return &errRequestTooLarge{"invalid multibulk length"}
+		}
+		if n > 0 {
+			s.args = n
+		}
+		return nil
+	}
+	if len(line) == 0 || line[0] != '$' || s.lineLen > maxHeaderLen {
+		s.invalid = true
+		return nil
+	}
+	n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || n < 0 {
+		s.invalid = true
+		return nil
+	}
+	if n > s.maxBulkLen {
+		return &errRequestTooLarge{"invalid bulk length"}
+	}
+	s.skip = n + 2
+	return nil
+}
+
+// serverListener 包装accept到的连接, 用来限制超时/请求大小和统计连接数
+type serverListener struct {
+	net.Listener
+	srv    *RedisServer
+	server *redcon.Server
+	once   sync.Once
+}
+
+func (l *serverListener) Accept() (net.Conn, error) {
+	l.once.Do(func() {
+		l.srv.serving(l.server)
+	})
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.srv.addConn(c), nil
+}
+
+type serverConn struct {
+	net.Conn
+	srv     *RedisServer
+	scanner requestScanner
+	// mutex 保证Shutdown唤醒连接和Close断开连接时设置的deadline不会被Read/Write重新设置的覆盖
+	mutex    sync.Mutex
+	woken    bool
+	killed   bool
+	detached int32
+	once     sync.Once
+}
+
+func (c *serverConn) Read(p []byte) (int, error) {
+	for {
+		c.mutex.Lock()
+		idle := c.scanner.idle()
+		if c.killed || c.srv.shuttingDown() && idle {
+			c.mutex.Unlock()
+			return 0, io.EOF
+		}
+		_ = c.Conn.SetReadDeadline(c.readDeadline(idle))
+		c.woken = false
+		c.mutex.Unlock()
+
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			if serr := c.scanner.scan(p[:n]); serr != nil {
+				c.writeError(serr)
+				return 0, serr
+			}
+			return n, err
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && c.takeWoken() {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *serverConn) readDeadline(idle bool) time.Time {
+	timeout := c.srv.opts.ReadTimeout
+	if idle {
+		timeout = c.srv.opts.IdleTimeout
+		if atomic.LoadInt32(&c.detached) == 1 {
+			// 和redis一样, 订阅模式的连接不受idle timeout限制
+			timeout = 0
+		}
+	}
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func (c *serverConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	if c.killed {
+		c.mutex.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if timeout := c.srv.opts.WriteTimeout; timeout > 0 {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	c.mutex.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *serverConn) writeError(err error) {
+	_, _ = c.Write([]byte("-ERR " + err.Error() + "\r\n"))
+}
+
+func (c *serverConn) Close() error {
+	c.once.Do(func() {
+		c.srv.removeConn(c)
+	})
+	return c.Conn.Close()
+}
+
+// wake 打断阻塞在Read上的连接, Read重新检查是否需要断开
+func (c *serverConn) wake() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.woken = true
+	_ = c.Conn.SetReadDeadline(time.Now())
+}
+
+// kill 让连接尽快断开, 之后Read返回EOF, Write返回错误, 正在阻塞的读写被deadline打断
+// 连接不在这里关闭, 读写连接的goroutine退出时自己关闭
+func (c *serverConn) kill() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.killed = true
+	now := time.Now()
+	_ = c.Conn.SetReadDeadline(now)
+	_ = c.Conn.SetWriteDeadline(now)
+}
+
+// takeWoken 区分超时是被wake打断还是真的超时
+func (c *serverConn) takeWoken() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	woken := c.woken
+	c.woken = false
+	return woken
+}
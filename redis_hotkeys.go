@@ -0,0 +1,105 @@
+package lantern_cache
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+const defaultHotKeysCount = 10
+
+// object OBJECT FREQ key, 频率是热点key统计估计的访问次数
+func (r *RedisServer) object(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "freq":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'object|freq' command")
+			return
+		}
+		if r.cache.hotKeys.rate == 0 {
+			conn.WriteError("ERR hot key tracking is disabled, access frequency not tracked")
+			return
+		}
+		if _, err := r.cache.entrySize(cmd.Args[2]); err != nil {
+			conn.WriteNull()
+			return
+		}
+		freq, _ := r.cache.hotKeys.freq(cmd.Args[2])
+		conn.WriteUint64(freq)
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'. Try OBJECT HELP.")
+	}
+}
+
+// memory MEMORY USAGE key [SAMPLES count], 返回entry在ring里占用的字节数
+func (r *RedisServer) memory(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "usage":
+		if len(cmd.Args) != 3 && (len(cmd.Args) != 5 || strings.ToLower(string(cmd.Args[3])) != "samples") {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		size, err := r.cache.entrySize(cmd.Args[2])
+		if err != nil {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteInt(size)
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'. Try MEMORY HELP.")
+	}
+}
+
+// lantern LANTERN HOTKEYS [count] | BIGKEYS [count], 返回[key, 次数或者字节数]的数组
+func (r *RedisServer) lantern(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 || len(cmd.Args) > 3 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	count := defaultHotKeysCount
+	if len(cmd.Args) == 3 {
+		n, err := strconv.Atoi(string(cmd.Args[2]))
+		if err != nil || n < 0 {
+			conn.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+		count = n
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "hotkeys":
+		if r.cache.hotKeys.rate == 0 {
+			conn.WriteError("ERR hot key tracking is disabled")
+			return
+		}
+		keys := r.cache.HotKeys(count)
+		conn.WriteArray(len(keys))
+		for i := range keys {
+			conn.WriteArray(2)
+			conn.WriteBulk(keys[i].Key)
+			conn.WriteUint64(keys[i].Count)
+		}
+	case "bigkeys":
+		if r.cache.bigKeys.capacity == 0 {
+			conn.WriteError("ERR big key tracking is disabled")
+			return
+		}
+		keys := r.cache.BigKeys(count)
+		conn.WriteArray(len(keys))
+		for i := range keys {
+			conn.WriteArray(2)
+			conn.WriteBulk(keys[i].Key)
+			conn.WriteInt(keys[i].Size)
+		}
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'. Try LANTERN HOTKEYS or LANTERN BIGKEYS.")
+	}
+}
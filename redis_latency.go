@@ -0,0 +1,313 @@
+package lantern_cache
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+const (
+	defaultSlowlogLogSlowerThan = 10 * time.Millisecond
+	defaultSlowlogMaxLen        = 128
+	// slowlogMaxArgs 和slowlogMaxArgLen 和redis一样, 慢日志只保存前32个参数, 每个参数最多128字节
+	slowlogMaxArgs   = 32
+	slowlogMaxArgLen = 128
+	// commandNameMaxLen 命令名不超过这个长度时在栈上转成小写
+	commandNameMaxLen = 16
+)
+
+/*
+每个命令都计时, 和网络读写相比两次time.Now的开销可以忽略, 慢日志也需要每个命令的耗时
+直方图只统计commandCategories里的命令, 在创建时分配好, 之后map只读, 未知的命令不会让map无限增长
+*/
+
+// commandLatency 命令名 -> 直方图
+type commandLatency map[string]*latencyHistogram
+
+func newCommandLatency() commandLatency {
+	ret := make(commandLatency, len(commandCategories))
+	for name := range commandCategories {
+		ret[name] = &latencyHistogram{}
+	}
+	return ret
+}
+
+// histogram 不认识的命令返回nil
+func (c commandLatency) histogram(name []byte) *latencyHistogram {
+	if len(name) > commandNameMaxLen {
+		return nil
+	}
+	var buf [commandNameMaxLen]byte
+	for i, ch := range name {
+		if 'A' <= ch && ch <= 'Z' {
+			ch += 'a' - 'A'
+		}
+		buf[i] = ch
+	}
+	return c[string(buf[:len(name)])]
+}
+
+type slowlogEntry struct {
+	id       uint64
+	time     int64
+	duration time.Duration
+	args     [][]byte
+	addr     string
+}
+
+// slowlog 最新的在最后, 超过maxLen时丢掉最旧的
+type slowlog struct {
+	// logSlowerThan 单位是微秒, 负数表示不记录, 0表示记录所有命令
+	logSlowerThan int64
+	maxLen        int64
+
+	mutex   sync.Mutex
+	nextID  uint64
+	entries []slowlogEntry
+}
+
+func newSlowlog(logSlowerThan time.Duration, maxLen int) *slowlog {
+	ret := &slowlog{logSlowerThan: -1, maxLen: int64(maxLen)}
+	if logSlowerThan >= 0 {
+		ret.logSlowerThan = int64(logSlowerThan / time.Microsecond)
+	}
+	return ret
+}
+
+func (s *slowlog) slow(d time.Duration) bool {
+	threshold := atomic.LoadInt64(&s.logSlowerThan)
+	return threshold >= 0 && int64(d/time.Microsecond) >= threshold
+}
+
+// add 参数的缓冲区会被redcon复用, 需要拷贝
+func (s *slowlog) add(cmd redcon.Command, d time.Duration, addr string) {
+	args := cmd.Args
+	if len(args) > slowlogMaxArgs {
+		args = args[:slowlogMaxArgs-1]
+	}
+	e := slowlogEntry{time: time.Now().Unix(), duration: d, addr: addr, args: make([][]byte, 0, len(args)+1)}
+	for i, arg := range args {
+		if slowlogRedacted(cmd.Args, i) {
+			arg = []byte("(redacted)")
+		} else if len(arg) > slowlogMaxArgLen {
+			arg = append(append([]byte(nil), arg[:slowlogMaxArgLen]...), "... ("+strconv.Itoa(len(arg)-slowlogMaxArgLen)+" more bytes)"...)
+		} else {
+			arg = append([]byte(nil), arg...)
+		}
+		e.args = append(e.args, arg)
+	}
+	if len(args) < len(cmd.Args) {
+		e.args = append(e.args, []byte("... ("+strconv.Itoa(len(cmd.Args)-len(args))+" more arguments)"))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e.id = s.nextID
+	s.nextID++
+	s.entries = append(s.entries, e)
+	s.trimLocked()
+}
+
+// slowlogRedacted 和redis一样, 慢日志不保存AUTH, HELLO ... AUTH和ACL SETUSER中的密码
+func slowlogRedacted(args [][]byte, i int) bool {
+	switch {
+	case strings.EqualFold(string(args[0]), "auth"):
+		return i > 0
+	case strings.EqualFold(string(args[0]), "hello"):
+		// HELLO protover AUTH username password
+		for j := 2; j < i && j < len(args); j++ {
+			if strings.EqualFold(string(args[j]), "auth") {
+				return i <= j+2
+			}
+		}
+	case strings.EqualFold(string(args[0]), "acl"):
+		// ACL SETUSER username rules...
+		return i > 2 && strings.EqualFold(string(args[1]), "setuser")
+	}
+	return false
+}
+
+func (s *slowlog) trimLocked() {
+	maxLen := int(atomic.LoadInt64(&s.maxLen))
+	if maxLen < 0 {
+		maxLen = 0
+	}
+	if n := len(s.entries) - maxLen; n > 0 {
+		s.entries = append(s.entries[:0], s.entries[n:]...)
+	}
+}
+
+// get 返回最新的count条, 最新的在前
+func (s *slowlog) get(count int) []slowlogEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if count < 0 || count > len(s.entries) {
+		count = len(s.entries)
+	}
+	ret := make([]slowlogEntry, count)
+	for i := range ret {
+		ret[i] = s.entries[len(s.entries)-1-i]
+	}
+	return ret
+}
+
+func (s *slowlog) len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.entries)
+}
+
+func (s *slowlog) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries = nil
+}
+
+func (s *slowlog) setMaxLen(n int64) {
+	atomic.StoreInt64(&s.maxLen, n)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.trimLocked()
+}
+
+// observe 记录命令的耗时, 慢命令写入慢日志
+func (r *RedisServer) observe(conn redcon.Conn, cmd redcon.Command, d time.Duration) {
+	if h := r.latency.histogram(cmd.Args[0]); h != nil {
+		h.record(d)
+	}
+	if r.slowlog.slow(d) {
+		r.slowlog.add(cmd, d, conn.RemoteAddr())
+	}
+}
+
+// CommandLatency returns the latency histograms of the commands called at least once, by lower
+// case command name. Every command is timed from parsing to writing the reply to the output buffer.
+func (r *RedisServer) CommandLatency() map[string]LatencyHistogram {
+	ret := make(map[string]LatencyHistogram)
+	for name, h := range r.latency {
+		if s := h.snapshot(); s.Count > 0 {
+			ret[name] = s
+		}
+	}
+	return ret
+}
+
+// latencyCommand LATENCY HISTOGRAM [command ...]
+func (r *RedisServer) latencyCommand(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "histogram":
+		histograms := r.CommandLatency()
+		names := make([]string, 0, len(histograms))
+		if len(cmd.Args) == 2 {
+			for name := range histograms {
+				names = append(names, name)
+			}
+		} else {
+			for _, arg := range cmd.Args[2:] {
+				name := strings.ToLower(string(arg))
+				if _, ok := histograms[name]; ok {
+					names = append(names, name)
+				}
+			}
+		}
+		resp3 := false
+		if ctx, ok := conn.Context().(*redisConnContext); ok {
+			resp3 = ctx.resp == 3
+		}
+		buf := appendMapHeader(nil, len(names), resp3)
+		for _, name := range names {
+			h := histograms[name]
+			buf = redcon.AppendBulkString(buf, name)
+			buf = appendMapHeader(buf, 2, resp3)
+			buf = redcon.AppendBulkString(buf, "calls")
+			buf = redcon.AppendUint(buf, h.Count)
+			buf = redcon.AppendBulkString(buf, "histogram_usec")
+			buf = appendLatencyUsec(buf, &h, resp3)
+		}
+		conn.WriteRaw(buf)
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'. Try LATENCY HELP.")
+	}
+}
+
+// appendLatencyUsec 和redis一样输出2的幂微秒 -> 累计次数, 从第一个有计数的区间到所有计数都包含在内为止
+func appendLatencyUsec(buf []byte, h *LatencyHistogram, resp3 bool) []byte {
+	var bounds []int64
+	var counts []uint64
+	for usec := time.Duration(1); ; usec <<= 1 {
+		n := h.CountBelow(usec * time.Microsecond)
+		if n > 0 {
+			bounds = append(bounds, int64(usec))
+			counts = append(counts, n)
+		}
+		if n == h.Count {
+			break
+		}
+	}
+	buf = appendMapHeader(buf, len(bounds), resp3)
+	for i := range bounds {
+		buf = redcon.AppendInt(buf, bounds[i])
+		buf = redcon.AppendUint(buf, counts[i])
+	}
+	return buf
+}
+
+// appendMapHeader RESP3用map, RESP2用键值交替的数组
+func appendMapHeader(buf []byte, n int, resp3 bool) []byte {
+	if !resp3 {
+		return redcon.AppendArray(buf, 2*n)
+	}
+	buf = append(buf, '%')
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	return append(buf, '\r', '\n')
+}
+
+// slowlogCommand SLOWLOG GET [count] | LEN | RESET
+func (r *RedisServer) slowlogCommand(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "get":
+		count := 10
+		if len(cmd.Args) > 2 {
+			n, err := strconv.Atoi(string(cmd.Args[2]))
+			if err != nil || n < -1 {
+				conn.WriteError("ERR count should be greater than or equal to -1")
+				return
+			}
+			count = n
+		}
+		entries := r.slowlog.get(count)
+		conn.WriteArray(len(entries))
+		for i := range entries {
+			e := &entries[i]
+			conn.WriteArray(6)
+			conn.WriteUint64(e.id)
+			conn.WriteInt64(e.time)
+			conn.WriteInt64(int64(e.duration / time.Microsecond))
+			conn.WriteArray(len(e.args))
+			for _, arg := range e.args {
+				conn.WriteBulk(arg)
+			}
+			conn.WriteBulkString(e.addr)
+			conn.WriteBulkString("")
+		}
+	case "len":
+		conn.WriteInt(r.slowlog.len())
+	case "reset":
+		r.slowlog.reset()
+		conn.WriteString("OK")
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'. Try SLOWLOG HELP.")
+	}
+}
@@ -0,0 +1,125 @@
+package lantern_cache
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// RedisServerOptions configures a RedisServer, the zero value serves plain TCP without authentication.
+type RedisServerOptions struct {
+	// RequirePass is the password of the default user, empty means no password.
+	RequirePass string
+	// Users are ACL rules applied at startup, user name -> rules in ACL SETUSER syntax,
+	// e.g. "alice": {"on", ">secret", "~cache:*", "+@read"}.
+	Users map[string][]string
+
+	// TLSConfig enables TLS, CertFile/KeyFile are loaded into it when set.
+	TLSConfig *tls.Config
+	CertFile  string
+	KeyFile   string
+
+	// Accept is called with the remote address of every new connection, returning false rejects it.
+	Accept func(remoteAddr string) bool
+
+	// Network is "tcp" (the default) or "unix", for "unix" addr is the socket path.
+	Network string
+	// MaxClients limits the number of connected clients, 0 means no limit.
+	MaxClients int
+	// IdleTimeout closes clients which send nothing for the duration, subscribers are not affected.
+	IdleTimeout time.Duration
+	// ReadTimeout limits the time to read the rest of a request once it started.
+	ReadTimeout time.Duration
+	// WriteTimeout limits the time of every write to a client.
+	WriteTimeout time.Duration
+	// MaxBulkLen and MaxMultiBulkLen limit the size of a single argument and the number of
+	// arguments of a request, clients exceeding them are disconnected. 0 means redis defaults, 512MB and 1M.
+	MaxBulkLen      int64
+	MaxMultiBulkLen int64
+
+	// SlowlogLogSlowerThan logs commands taking at least the duration to SLOWLOG, 10ms when 0.
+	// A negative value disables the slow log. CONFIG SET slowlog-log-slower-than changes it at runtime.
+	SlowlogLogSlowerThan time.Duration
+	// SlowlogMaxLen is the number of commands kept in SLOWLOG, 128 when 0.
+	SlowlogMaxLen int
+
+	// Logger logs connection errors, DefaultLogger() when nil. A LeveledLogger gets levels and
+	// fields, noisy events are logged at most once a second.
+	Logger Logger
+	// Verbose also logs connects and clean disconnects of clients.
+	Verbose bool
+}
+
+func (o *RedisServerOptions) init() {
+	if o.Network == "" {
+		o.Network = "tcp"
+	}
+	if o.MaxBulkLen <= 0 {
+		o.MaxBulkLen = defaultMaxBulkLen
+	}
+	if o.MaxMultiBulkLen <= 0 {
+		o.MaxMultiBulkLen = defaultMaxMultiBulkLen
+	}
+	if o.SlowlogLogSlowerThan == 0 {
+		o.SlowlogLogSlowerThan = defaultSlowlogLogSlowerThan
+	}
+	if o.SlowlogMaxLen <= 0 {
+		o.SlowlogMaxLen = defaultSlowlogMaxLen
+	}
+	if o.Logger == nil {
+		o.Logger = DefaultLogger()
+	}
+}
+
+func (o *RedisServerOptions) tlsConfig() (*tls.Config, error) {
+	if o.CertFile == "" && o.KeyFile == "" {
+		return o.TLSConfig, nil
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if o.TLSConfig != nil {
+		cfg = o.TLSConfig.Clone()
+	}
+	cfg.Certificates = append(cfg.Certificates, cert)
+	return cfg, nil
+}
+
+// AllowIPs returns an Accept hook which only accepts connections from the given IPs or CIDRs.
+func AllowIPs(allowed ...string) (func(remoteAddr string) bool, error) {
+	nets := make([]*net.IPNet, 0, len(allowed))
+	for _, s := range allowed {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip or cidr %s", s)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		nets = append(nets, n)
+	}
+	return func(remoteAddr string) bool {
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			host = remoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
@@ -0,0 +1,202 @@
+package lantern_cache
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/tidwall/redcon"
+)
+
+// notify-keyspace-events 的各个开关, 和redis的含义一致
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyAll      = notifyGeneric | notifyString | notifyExpired | notifyEvicted
+)
+
+func parseNotifyFlags(s string) (uint32, bool) {
+	flags := uint32(0)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case 'K':
+			flags |= notifyKeyspace
+		case 'E':
+			flags |= notifyKeyevent
+		case 'g':
+			flags |= notifyGeneric
+		case '$':
+			flags |= notifyString
+		case 'x':
+			flags |= notifyExpired
+		case 'e':
+			flags |= notifyEvicted
+		case 'A':
+			flags |= notifyAll
+		default:
+			return 0, false
+		}
+	}
+	return flags, true
+}
+
+func notifyFlagsString(flags uint32) string {
+	var sb strings.Builder
+	if flags&notifyAll == notifyAll {
+		sb.WriteByte('A')
+	} else {
+		if flags&notifyGeneric != 0 {
+			sb.WriteByte('g')
+		}
+		if flags&notifyString != 0 {
+			sb.WriteByte('$')
+		}
+		if flags&notifyExpired != 0 {
+			sb.WriteByte('x')
+		}
+		if flags&notifyEvicted != 0 {
+			sb.WriteByte('e')
+		}
+	}
+	if flags&notifyKeyspace != 0 {
+		sb.WriteByte('K')
+	}
+	if flags&notifyKeyevent != 0 {
+		sb.WriteByte('E')
+	}
+	return sb.String()
+}
+
+// notifyKeyspaceEvent 注册为cache的Listener, 在bucket锁内被调用, publish不会阻塞
+func (r *RedisServer) notifyKeyspaceEvent(event EventType, keyHash uint64, key []byte) {
+	flags := atomic.LoadUint32(&r.notifyFlags)
+	if flags&(notifyKeyspace|notifyKeyevent) == 0 || key == nil {
+		return
+	}
+	var class uint32
+	switch event {
+	case EventSet:
+		class = notifyString
+	case EventDel:
+		class = notifyGeneric
+	case EventExpired:
+		class = notifyExpired
+	case EventEvicted:
+		class = notifyEvicted
+	}
+	if flags&class == 0 {
+		return
+	}
+	if flags&notifyKeyspace != 0 {
+		r.pubsub.publish("__keyspace@0__:"+string(key), []byte(event.String()))
+	}
+	if flags&notifyKeyevent != 0 {
+		r.pubsub.publish("__keyevent@0__:"+event.String(), key)
+	}
+}
+
+// subscribe 把连接detach出来进入订阅模式, 之后这个连接只能执行订阅相关的命令
+func (r *RedisServer) subscribe(conn redcon.Conn, cmd redcon.Command) {
+	ctx := conn.Context().(*redisConnContext)
+	ctx.detached = true
+	if c, ok := conn.NetConn().(*serverConn); ok {
+		atomic.StoreInt32(&c.detached, 1)
+	}
+	s := newSubscriber(conn.Detach())
+	s.id = ctx.id
+	r.pubsub.addClient(s)
+	go func() {
+		defer func() {
+			r.pubsub.unsubscribeAll(s)
+			r.pubsub.removeClient(s)
+			r.tracking.disable(ctx.id)
+			s.close()
+		}()
+		for {
+			if !r.handleSubscriber(s, ctx, cmd) {
+				return
+			}
+			var err error
+			if cmd, err = s.conn.ReadCommand(); err != nil {
+				return
+			}
+			atomic.AddUint64(&r.totalCommands, 1)
+		}
+	}()
+}
+
+func (r *RedisServer) handleSubscriber(s *subscriber, ctx *redisConnContext, cmd redcon.Command) bool {
+	// 订阅模式下的命令和普通命令一样检查权限, 用户可能在订阅以后被ACL修改
+	if msg, ok := r.authorize(ctx, cmd); !ok {
+		s.send(redcon.AppendError(nil, msg))
+		return true
+	}
+	name := strings.ToLower(string(cmd.Args[0]))
+	switch name {
+	case "subscribe", "psubscribe":
+		if len(cmd.Args) < 2 {
+			s.send(redcon.AppendError(nil, "ERR wrong number of arguments for '"+name+"' command"))
+			return true
+		}
+		for i := 1; i < len(cmd.Args); i++ {
+			if name == "subscribe" {
+				r.pubsub.subscribe(s, string(cmd.Args[i]))
+			} else {
+				r.pubsub.psubscribe(s, string(cmd.Args[i]))
+			}
+			s.send(subscribeReply(name, cmd.Args[i], s.count()))
+		}
+	case "unsubscribe", "punsubscribe":
+		names := cmd.Args[1:]
+		if len(names) == 0 {
+			subscribed := s.channels
+			if name == "punsubscribe" {
+				subscribed = s.patterns
+			}
+			for k := range subscribed {
+				names = append(names, []byte(k))
+			}
+		}
+		if len(names) == 0 {
+			s.send(subscribeReply(name, nil, s.count()))
+		}
+		for i := range names {
+			if name == "unsubscribe" {
+				r.pubsub.unsubscribe(s, string(names[i]))
+			} else {
+				r.pubsub.punsubscribe(s, string(names[i]))
+			}
+			s.send(subscribeReply(name, names[i], s.count()))
+		}
+	case "ping":
+		msg := redcon.AppendArray(nil, 2)
+		msg = redcon.AppendBulkString(msg, "pong")
+		if len(cmd.Args) > 1 {
+			msg = redcon.AppendBulk(msg, cmd.Args[1])
+		} else {
+			msg = redcon.AppendBulkString(msg, "")
+		}
+		s.send(msg)
+	case "quit":
+		s.send(redcon.AppendOK(nil))
+		s.send(nil)
+		return false
+	default:
+		s.send(redcon.AppendError(nil, "ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context"))
+	}
+	return true
+}
+
+func subscribeReply(kind string, name []byte, count int) []byte {
+	msg := redcon.AppendArray(nil, 3)
+	msg = redcon.AppendBulkString(msg, kind)
+	if name == nil {
+		msg = redcon.AppendNull(msg)
+	} else {
+		msg = redcon.AppendBulk(msg, name)
+	}
+	return redcon.AppendInt(msg, int64(count))
+}
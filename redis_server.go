@@ -2,237 +2,861 @@ package lantern_cache
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tidwall/redcon"
 )
 
 const (
 	Delimiter = '^'
+
+	shutdownPollInterval = 50 * time.Millisecond
+	// redisReusedValues MGET的key不超过这个数量时连接保留value缓冲区
+	redisReusedValues = 64
 )
 
 type RedisServer struct {
-	addr  string
-	cache *LanternCache
+	addr         string
+	cache        *LanternCache
+	opts         RedisServerOptions
+	acl          *acl
+	pubsub       *pubsub
+	tracking     *trackingTable
+	notifyFlags  uint32
+	nextClientID uint64
+	latency      commandLatency
+	slowlog      *slowlog
+	logger       *eventLogger
+	// removeListeners Close时从cache删除注册的listener
+	removeListeners []func()
+
+	mutex      sync.Mutex
+	server     *redcon.Server
+	listener   net.Listener
+	conns      map[*serverConn]struct{}
+	done       bool
+	inShutdown int32
+	// handling 是redcon还持有的连接数, redcon.Server.Close会关闭它们, 和处理连接的goroutine并发
+	// Close要等它们都退出以后才能关闭redcon
+	handling int
+	handled  *sync.Cond
+
+	totalConnections    uint64
+	rejectedConnections uint64
+	totalCommands       uint64
+}
+
+type RedisServerStats struct {
+	ConnectedClients    int
+	TotalConnections    uint64
+	RejectedConnections uint64
+	TotalCommands       uint64
 }
 
 func NewRedisServer(addr string, cache *LanternCache) *RedisServer {
-	return &RedisServer{addr: addr, cache: cache}
+	ret, err := NewRedisServerWithOptions(addr, cache, nil)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+func NewRedisServerWithOptions(addr string, cache *LanternCache, opts *RedisServerOptions) (*RedisServer, error) {
+	if opts == nil {
+		opts = &RedisServerOptions{}
+	}
+	ret := &RedisServer{
+		addr:     addr,
+		cache:    cache,
+		opts:     *opts,
+		acl:      newACL(opts.RequirePass),
+		pubsub:   newPubSub(),
+		tracking: newTrackingTable(),
+		conns:    make(map[*serverConn]struct{}),
+		latency:  newCommandLatency(),
+	}
+	ret.handled = sync.NewCond(&ret.mutex)
+	ret.opts.init()
+	ret.slowlog = newSlowlog(ret.opts.SlowlogLogSlowerThan, ret.opts.SlowlogMaxLen)
+	ret.logger = newEventLogger(ret.opts.Logger, ret.opts.Verbose)
+	for name, rules := range opts.Users {
+		if err := ret.acl.setUser(name, rules); err != nil {
+			return nil, err
+		}
+	}
+	ret.removeListeners = []func(){
+		cache.AddListener(ret.notifyKeyspaceEvent),
+		cache.AddListener(ret.tracking.invalidate),
+	}
+	return ret, nil
+}
+
+// redisStore 是命令读写数据的入口, 事务(EXEC)中是*Txn, 否则是*LanternCache
+type redisStore interface {
+	Put(key, value []byte) error
+	PutWithExpire(key, value []byte, expire int64) error
+	Get(key []byte) ([]byte, error)
+	View(key []byte, fn func(value []byte) error) error
+	MultiGet(keys [][]byte, dst [][]byte) ([][]byte, []error)
+	MultiPut(entries []Entry) error
+	Del(key []byte)
+}
+
+// redisConnContext 保存每个连接的状态
+type redisConnContext struct {
+	id      uint64
+	resp    int
+	multi   bool
+	aborted bool
+	queue   []redcon.Command
+	watched []txnRead
+	// values 是MGET/HMGET复用的value缓冲区
+	values [][]byte
+	// detached 表示连接已经从redcon中detach, 由push负责写回复和推送消息
+	detached bool
+	push     *subscriber
+	// user 是当前登录的ACL用户
+	user          string
+	authenticated bool
+}
+
+func (c *redisConnContext) reset() {
+	c.multi = false
+	c.aborted = false
+	c.queue = nil
+	c.watched = nil
 }
 
 func (r *RedisServer) ListenAndServe() error {
-	err := redcon.ListenAndServe(r.addr,
-		func(conn redcon.Conn, cmd redcon.Command) {
-			switch strings.ToLower(string(cmd.Args[0])) {
-			default:
-				conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
-			case "select":
-				conn.WriteString("OK")
-			case "ping":
-				conn.WriteString("pong")
-			case "quit", "exit":
-				conn.WriteString("OK")
-				_ = conn.Close()
-			case "set":
-				// set key value
-				// SET key value EX seconds
-				size := len(cmd.Args)
-				if size != 3 && size != 5 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-
-				var err error
-				if size == 3 {
-					err = r.cache.Put(cmd.Args[1], cmd.Args[2])
-				} else if size == 5 {
-					if seconds, err := strconv.ParseInt(string(cmd.Args[4]), 10, 64); err == nil {
-						err = r.cache.PutWithExpire(cmd.Args[1], cmd.Args[2], seconds)
-					}
-				}
-				if err != nil {
-					conn.WriteError(err.Error())
-				} else {
-					conn.WriteInt(1)
-				}
-			case "setex":
-				// SETEX key seconds value
-				if len(cmd.Args) != 4 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-
-				seconds, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
-				if err != nil {
-					conn.WriteError("ERR wrong ttl of argument for" + string(cmd.Args[0]) + "' command")
-				}
-
-				err = r.cache.PutWithExpire(cmd.Args[1], cmd.Args[2], seconds)
-				if err != nil {
-					conn.WriteError(err.Error())
-				} else {
-					conn.WriteInt(1)
-				}
-			case "mset":
-				// MSET key1 value1 key2 value2 .. keyN valueN
-				size := len(cmd.Args)
-				if size < 3 || size&1 == 0 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				var err error
-				for i := 1; i < size-1; i += 2 {
-					if err = r.cache.Put(cmd.Args[i], cmd.Args[i+1]); err != nil {
-						break
-					}
-				}
-				if err != nil {
-					conn.WriteInt(0)
-				} else {
-					conn.WriteInt((size - 1) / 2)
-				}
-			case "get":
-				if len(cmd.Args) != 2 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				val, err := r.cache.Get(cmd.Args[1])
-				if err != nil {
-					conn.WriteNull()
-				} else {
-					conn.WriteBulk(val)
-				}
-			case "mget":
-				// MGET KEY1 KEY2 .. KEYN
-				size := len(cmd.Args)
-				if size < 2 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				conn.WriteArray(size - 1)
-				for i := 1; i < size; i++ {
-					val, err := r.cache.Get(cmd.Args[i])
-					if err != nil {
-						conn.WriteNull()
-					} else {
-						conn.WriteBulk(val)
-					}
-				}
-			case "hset":
-				// HSET KEY_NAME FIELD VALUE
-				if len(cmd.Args) != 4 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				var key bytes.Buffer
-				key.Write(cmd.Args[1])
-				key.WriteByte(Delimiter)
-				key.Write(cmd.Args[2])
-				err := r.cache.Put(key.Bytes(), cmd.Args[3])
-				if err != nil {
-					conn.WriteError(err.Error())
-				} else {
-					conn.WriteInt(1)
-				}
-			case "hmset":
-				// HMSET KEY_NAME FIELD1 VALUE1 ...FIELDN VALUEN
-				size := len(cmd.Args)
-				if size < 3 || size&1 == 1 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-
-				var err error
-				var key bytes.Buffer
-				for i := 2; i < size-1; i += 2 {
-					key.Reset()
-					key.Write(cmd.Args[1])
-					key.WriteByte(Delimiter)
-					key.Write(cmd.Args[i])
-					if err = r.cache.Put(key.Bytes(), cmd.Args[i+1]); err != nil {
-						break
-					}
-				}
-				if err != nil {
-					conn.WriteInt(0)
-				} else {
-					conn.WriteInt((size - 2) / 2)
-				}
-			case "hget":
-				if len(cmd.Args) != 3 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				var key bytes.Buffer
-				key.Write(cmd.Args[1])
-				key.WriteByte(Delimiter)
-				key.Write(cmd.Args[2])
-				val, err := r.cache.Get(key.Bytes())
-				if err != nil {
-					conn.WriteNull()
-				} else {
-					conn.WriteBulk(val)
-				}
-			case "hmget":
-				//HMGET KEY_NAME FIELD1...FIELDN
-				size := len(cmd.Args)
-				if size < 3 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-
-				var key bytes.Buffer
-				conn.WriteArray(size - 2)
-				for i := 2; i < size; i++ {
-					key.Reset()
-					key.Write(cmd.Args[1])
-					key.WriteByte(Delimiter)
-					key.Write(cmd.Args[i])
-					val, err := r.cache.Get(key.Bytes())
-					if err != nil {
-						conn.WriteNull()
-					} else {
-						conn.WriteBulk(val)
-					}
-				}
-			case "del":
-				if len(cmd.Args) != 2 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				r.cache.Del(cmd.Args[1])
-				conn.WriteInt(1)
-			case "dbsize":
-				conn.WriteUint64(r.cache.Size())
-			case "scan":
-				if len(cmd.Args) != 2 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
-				count, _ := strconv.ParseInt(string(cmd.Args[1]), 10, 64)
-				if count == 0 {
-					count = 100
-				}
-				ret, err := r.cache.Scan(int(count))
-				if err != nil {
-					conn.WriteError(err.Error())
-				} else {
-					conn.WriteArray(len(ret))
-					for i := range ret {
-						conn.WriteBulk(ret[i])
-					}
-				}
+	ln, err := net.Listen(r.opts.Network, r.addr)
+	if err != nil {
+		return err
+	}
+	return r.Serve(ln)
+}
+
+// Serve serves clients on ln until Shutdown or Close, TLS is added on top of ln when configured
+func (r *RedisServer) Serve(ln net.Listener) error {
+	tlsConfig, err := r.opts.tlsConfig()
+	if err != nil {
+		_ = ln.Close()
+		return err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	server := redcon.NewServerNetwork(ln.Addr().Network(), ln.Addr().String(), r.handle, r.accept, r.closed)
+	server.AcceptError = func(err error) {
+		r.logger.logLimited(LevelError, "accept error", F("server", "redis"), F("err", err))
+	}
+
+	r.mutex.Lock()
+	if r.done {
+		r.mutex.Unlock()
+		_ = ln.Close()
+		return ErrorServerClosed
+	}
+	r.listener = ln
+	r.mutex.Unlock()
+	return server.Serve(&serverListener{Listener: ln, srv: r, server: server})
+}
+
+// serving 在第一次Accept时调用, 这时redcon已经可以Close了
+func (r *RedisServer) serving(server *redcon.Server) {
+	r.mutex.Lock()
+	if r.done {
+		r.mutex.Unlock()
+		_ = server.Close()
+		return
+	}
+	r.server = server
+	r.mutex.Unlock()
+}
+
+// Addr returns the listening address, nil before serving
+func (r *RedisServer) Addr() net.Addr {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.listener == nil {
+		return nil
+	}
+	return r.listener.Addr()
+}
+
+// Shutdown stops accepting clients, then waits for connected clients to finish the request in progress
+// and disconnect. Clients still connected when ctx is done are closed.
+func (r *RedisServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&r.inShutdown, 1)
+	r.mutex.Lock()
+	for c := range r.conns {
+		c.wake()
+	}
+	r.mutex.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if r.Stats().ConnectedClients == 0 {
+			return r.Close()
+		}
+		select {
+		case <-ctx.Done():
+			_ = r.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the server and disconnects all clients without waiting for the requests in
+// progress. The server stops receiving events of the cache, a new server can be created on the same cache.
+func (r *RedisServer) Close() error {
+	atomic.StoreInt32(&r.inShutdown, 1)
+	for _, remove := range r.removeListeners {
+		remove()
+	}
+	r.mutex.Lock()
+	r.done = true
+	server := r.server
+	// 只通知连接断开, 由使用连接的goroutine自己关闭, redcon的连接不能并发使用
+	for c := range r.conns {
+		c.kill()
+	}
+	for r.handling > 0 {
+		r.handled.Wait()
+	}
+	r.mutex.Unlock()
+
+	if server != nil {
+		return server.Close()
+	}
+	return nil
+}
+
+func (r *RedisServer) shuttingDown() bool {
+	return atomic.LoadInt32(&r.inShutdown) == 1
+}
+
+func (r *RedisServer) Stats() RedisServerStats {
+	r.mutex.Lock()
+	connected := len(r.conns)
+	r.mutex.Unlock()
+	return RedisServerStats{
+		ConnectedClients:    connected,
+		TotalConnections:    atomic.LoadUint64(&r.totalConnections),
+		RejectedConnections: atomic.LoadUint64(&r.rejectedConnections),
+		TotalCommands:       atomic.LoadUint64(&r.totalCommands),
+	}
+}
+
+func (r *RedisServer) addConn(c net.Conn) *serverConn {
+	sc := &serverConn{Conn: c, srv: r}
+	sc.scanner.maxBulkLen = r.opts.MaxBulkLen
+	sc.scanner.maxMultiBulkLen = r.opts.MaxMultiBulkLen
+	atomic.AddUint64(&r.totalConnections, 1)
+	r.mutex.Lock()
+	r.conns[sc] = struct{}{}
+	r.mutex.Unlock()
+	return sc
+}
+
+func (r *RedisServer) removeConn(c *serverConn) {
+	r.mutex.Lock()
+	delete(r.conns, c)
+	r.mutex.Unlock()
+}
+
+func (r *RedisServer) accept(conn redcon.Conn) bool {
+	if r.shuttingDown() {
+		return false
+	}
+	if r.opts.Accept != nil && !r.opts.Accept(conn.RemoteAddr()) {
+		atomic.AddUint64(&r.rejectedConnections, 1)
+		r.logger.logLimited(LevelWarn, "client rejected", F("server", "redis"), F("addr", conn.RemoteAddr()), F("reason", "not accepted"))
+		return false
+	}
+	if r.opts.MaxClients > 0 && r.Stats().ConnectedClients > r.opts.MaxClients {
+		atomic.AddUint64(&r.rejectedConnections, 1)
+		r.logger.logLimited(LevelWarn, "client rejected", F("server", "redis"), F("addr", conn.RemoteAddr()), F("reason", "max clients"))
+		// redcon关闭连接前会flush
+		conn.WriteError("ERR max number of clients reached")
+		return false
+	}
+	r.mutex.Lock()
+	if r.done {
+		r.mutex.Unlock()
+		return false
+	}
+	r.handling++
+	r.mutex.Unlock()
+	ctx := &redisConnContext{id: atomic.AddUint64(&r.nextClientID, 1), resp: 2, user: defaultUser}
+	// default用户不需要密码时直接登录
+	ctx.authenticated = r.acl.user(defaultUser).nopass
+	conn.SetContext(ctx)
+	if r.logger.enabled(LevelDebug) {
+		r.logger.logLimited(LevelDebug, "client connected", F("server", "redis"), F("id", ctx.id), F("addr", conn.RemoteAddr()))
+	}
+	return true
+}
+
+func (r *RedisServer) closed(conn redcon.Conn, err error) {
+	// 连接已经从redcon删除, detach的连接之后也不会再被redcon使用
+	r.mutex.Lock()
+	r.handling--
+	r.handled.Broadcast()
+	r.mutex.Unlock()
+	// detach也会以错误的形式通知, 这时连接并没有关闭
+	if ctx, ok := conn.Context().(*redisConnContext); ok && ctx.detached {
+		return
+	}
+	if err == nil || r.shuttingDown() {
+		if r.logger.enabled(LevelDebug) {
+			r.logger.logLimited(LevelDebug, "client disconnected", F("server", "redis"), F("addr", conn.RemoteAddr()))
+		}
+		return
+	}
+	r.logger.logLimited(LevelInfo, "client closed", F("server", "redis"), F("addr", conn.RemoteAddr()), F("err", err))
+}
+
+func (r *RedisServer) handle(conn redcon.Conn, cmd redcon.Command) {
+	atomic.AddUint64(&r.totalCommands, 1)
+	start := time.Now()
+	r.dispatch(conn, cmd)
+	r.observe(conn, cmd, time.Since(start))
+}
+
+func (r *RedisServer) dispatch(conn redcon.Conn, cmd redcon.Command) {
+	ctx := conn.Context().(*redisConnContext)
+	if msg, ok := r.authorize(ctx, cmd); !ok {
+		if ctx.multi {
+			ctx.aborted = true
+		}
+		conn.WriteError(msg)
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[0])) {
+	case "auth":
+		r.auth(conn, ctx, cmd)
+	case "acl":
+		if ctx.multi {
+			conn.WriteError("ERR " + string(cmd.Args[0]) + " inside MULTI is not allowed")
+			return
+		}
+		r.aclCommand(conn, ctx, cmd)
+	case "multi":
+		if ctx.multi {
+			conn.WriteError("ERR MULTI calls can not be nested")
+			return
+		}
+		ctx.multi = true
+		conn.WriteString("OK")
+	case "discard":
+		if !ctx.multi {
+			conn.WriteError("ERR DISCARD without MULTI")
+			return
+		}
+		ctx.reset()
+		conn.WriteString("OK")
+	case "exec":
+		if !ctx.multi {
+			conn.WriteError("ERR EXEC without MULTI")
+			return
+		}
+		r.exec(conn, ctx)
+		ctx.reset()
+	case "watch":
+		if ctx.multi {
+			conn.WriteError("ERR WATCH inside MULTI is not allowed")
+			return
+		}
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		for i := 1; i < len(cmd.Args); i++ {
+			ctx.watched = append(ctx.watched, r.cache.watch(cmd.Args[i]))
+		}
+		conn.WriteString("OK")
+	case "unwatch":
+		ctx.watched = nil
+		conn.WriteString("OK")
+	case "subscribe", "psubscribe":
+		if ctx.multi {
+			conn.WriteError("ERR " + string(cmd.Args[0]) + " inside MULTI is not allowed")
+			return
+		}
+		if ctx.detached {
+			conn.WriteError("ERR " + string(cmd.Args[0]) + " is not allowed with CLIENT TRACKING, use REDIRECT instead")
+			return
+		}
+		r.subscribe(conn, cmd)
+	case "hello", "client":
+		if ctx.multi {
+			conn.WriteError("ERR " + string(cmd.Args[0]) + " inside MULTI is not allowed")
+			return
+		}
+		if strings.ToLower(string(cmd.Args[0])) == "hello" {
+			r.hello(conn, ctx, cmd)
+		} else {
+			r.client(conn, ctx, cmd)
+		}
+	default:
+		if ctx.multi {
+			r.queue(conn, ctx, cmd)
+			return
+		}
+		r.execute(conn, r.cache, cmd)
+	}
+}
+
+func (r *RedisServer) queue(conn redcon.Conn, ctx *redisConnContext, cmd redcon.Command) {
+	if _, ok := commandKeys(cmd); !ok {
+		ctx.aborted = true
+		conn.WriteError("ERR command '" + string(cmd.Args[0]) + "' can not be used in MULTI")
+		return
+	}
+	// redcon会复用读缓冲区, 排队的命令需要拷贝一份
+	args := make([][]byte, len(cmd.Args))
+	for i := range cmd.Args {
+		args[i] = append([]byte(nil), cmd.Args[i]...)
+	}
+	ctx.queue = append(ctx.queue, redcon.Command{Args: args})
+	conn.WriteString("QUEUED")
+}
+
+// exec 锁住排队命令涉及的所有bucket后依次执行, watch的key被修改过则返回空数组
+func (r *RedisServer) exec(conn redcon.Conn, ctx *redisConnContext) {
+	if ctx.aborted {
+		conn.WriteError("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+	var keys [][]byte
+	for i := range ctx.queue {
+		k, _ := commandKeys(ctx.queue[i])
+		keys = append(keys, k...)
+	}
+	// 回复先写到缓冲区, 提交成功后才发送, 提交失败时客户端不会看到命令执行成功的回复
+	reply := newReplyBuffer(conn)
+	err := r.cache.updateWithLocks(keys, ctx.watched, func(tx *Txn) error {
+		reply.WriteArray(len(ctx.queue))
+		for i := range ctx.queue {
+			r.execute(reply, tx, ctx.queue[i])
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+		conn.WriteRaw(reply.take())
+	case ErrorTxnConflict:
+		conn.WriteRaw([]byte("*-1\r\n"))
+	default:
+		r.logger.logLimited(LevelError, "transaction failed", F("server", "redis"), F("id", ctx.id), F("err", err))
+		conn.WriteError("ERR EXEC failed: " + err.Error())
+	}
+}
+
+// commandKeys 返回命令会访问的key, 不能在事务中执行的命令返回false
+func commandKeys(cmd redcon.Command) ([][]byte, bool) {
+	args := cmd.Args
+	switch strings.ToLower(string(args[0])) {
+	case "ping", "select", "publish":
+		return nil, true
+	case "get", "set", "setex", "del":
+		if len(args) < 2 {
+			return nil, true
+		}
+		return args[1:2], true
+	case "mget":
+		return args[1:], true
+	case "mset":
+		keys := make([][]byte, 0, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys, true
+	case "hget", "hset":
+		if len(args) < 3 {
+			return nil, true
+		}
+		return [][]byte{hashFieldKey(args[1], args[2])}, true
+	case "hmget":
+		keys := make([][]byte, 0, len(args))
+		for i := 2; i < len(args); i++ {
+			keys = append(keys, hashFieldKey(args[1], args[i]))
+		}
+		return keys, true
+	case "hmset":
+		keys := make([][]byte, 0, len(args)/2)
+		for i := 2; i < len(args); i += 2 {
+			keys = append(keys, hashFieldKey(args[1], args[i]))
+		}
+		return keys, true
+	}
+	return nil, false
+}
+
+func hashFieldKey(key, field []byte) []byte {
+	ret := make([]byte, 0, len(key)+len(field)+1)
+	ret = append(ret, key...)
+	ret = append(ret, Delimiter)
+	return append(ret, field...)
+}
+
+func (r *RedisServer) execute(conn redcon.Conn, st redisStore, cmd redcon.Command) {
+	switch strings.ToLower(string(cmd.Args[0])) {
+	default:
+		conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
+	case "select":
+		conn.WriteString("OK")
+	case "ping":
+		conn.WriteString("pong")
+	case "quit", "exit":
+		conn.WriteString("OK")
+		_ = conn.Close()
+	case "set":
+		// set key value
+		// SET key value EX seconds
+		size := len(cmd.Args)
+		if size != 3 && size != 5 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		var err error
+		if size == 3 {
+			err = st.Put(cmd.Args[1], cmd.Args[2])
+		} else {
+			seconds, perr := strconv.ParseInt(string(cmd.Args[4]), 10, 64)
+			if perr != nil || !strings.EqualFold(string(cmd.Args[3]), "ex") {
+				conn.WriteError("ERR syntax error")
+				return
 			}
-		},
-		func(conn redcon.Conn) bool {
-			//fmt.Printf("accept: %s\n", conn.RemoteAddr())
-			return true
-		},
-		func(conn redcon.Conn, err error) {
-			fmt.Printf("closed: %s, err: %v\n", conn.RemoteAddr(), err)
-		},
-	)
-	return err
+			err = st.PutWithExpire(cmd.Args[1], cmd.Args[2], seconds)
+		}
+		if err != nil {
+			conn.WriteError(err.Error())
+		} else {
+			conn.WriteInt(1)
+		}
+	case "setex":
+		// SETEX key seconds value
+		if len(cmd.Args) != 4 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		seconds, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+		if err != nil {
+			conn.WriteError("ERR wrong ttl of argument for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		err = st.PutWithExpire(cmd.Args[1], cmd.Args[3], seconds)
+		if err != nil {
+			conn.WriteError(err.Error())
+		} else {
+			conn.WriteInt(1)
+		}
+	case "mset":
+		// MSET key1 value1 key2 value2 .. keyN valueN
+		size := len(cmd.Args)
+		if size < 3 || size&1 == 0 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		entries := make([]Entry, 0, (size-1)/2)
+		for i := 1; i < size-1; i += 2 {
+			entries = append(entries, Entry{Key: cmd.Args[i], Value: cmd.Args[i+1]})
+		}
+		if err := st.MultiPut(entries); err != nil {
+			conn.WriteInt(0)
+		} else {
+			conn.WriteInt((size - 1) / 2)
+		}
+	case "get":
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		r.track(conn, cmd.Args[1])
+		r.writeValue(conn, st, cmd.Args[1])
+	case "mget":
+		// MGET KEY1 KEY2 .. KEYN
+		size := len(cmd.Args)
+		if size < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		r.writeValues(conn, st, cmd.Args[1:])
+	case "hset":
+		// HSET KEY_NAME FIELD VALUE
+		if len(cmd.Args) != 4 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		var key bytes.Buffer
+		key.Write(cmd.Args[1])
+		key.WriteByte(Delimiter)
+		key.Write(cmd.Args[2])
+		err := st.Put(key.Bytes(), cmd.Args[3])
+		if err != nil {
+			conn.WriteError(err.Error())
+		} else {
+			conn.WriteInt(1)
+		}
+	case "hmset":
+		// HMSET KEY_NAME FIELD1 VALUE1 ...FIELDN VALUEN
+		size := len(cmd.Args)
+		if size < 3 || size&1 == 1 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		entries := make([]Entry, 0, (size-2)/2)
+		for i := 2; i < size-1; i += 2 {
+			entries = append(entries, Entry{Key: hashFieldKey(cmd.Args[1], cmd.Args[i]), Value: cmd.Args[i+1]})
+		}
+		if err := st.MultiPut(entries); err != nil {
+			conn.WriteInt(0)
+		} else {
+			conn.WriteInt((size - 2) / 2)
+		}
+	case "hget":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		var key bytes.Buffer
+		key.Write(cmd.Args[1])
+		key.WriteByte(Delimiter)
+		key.Write(cmd.Args[2])
+		r.track(conn, key.Bytes())
+		val, err := st.Get(key.Bytes())
+		if err != nil {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulk(val)
+		}
+	case "hmget":
+		//HMGET KEY_NAME FIELD1...FIELDN
+		size := len(cmd.Args)
+		if size < 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		keys := make([][]byte, 0, size-2)
+		for i := 2; i < size; i++ {
+			keys = append(keys, hashFieldKey(cmd.Args[1], cmd.Args[i]))
+		}
+		r.writeValues(conn, st, keys)
+	case "del":
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		st.Del(cmd.Args[1])
+		conn.WriteInt(1)
+	case "publish":
+		// PUBLISH channel message
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		conn.WriteInt(r.pubsub.publish(string(cmd.Args[1]), cmd.Args[2]))
+	case "config":
+		// CONFIG GET parameter
+		// CONFIG SET parameter value
+		r.config(conn, cmd)
+	case "dbsize":
+		conn.WriteUint64(r.cache.Size())
+	case "info":
+		r.info(conn)
+	case "latency":
+		r.latencyCommand(conn, cmd)
+	case "slowlog":
+		r.slowlogCommand(conn, cmd)
+	case "object":
+		r.object(conn, cmd)
+	case "memory":
+		r.memory(conn, cmd)
+	case "lantern":
+		r.lantern(conn, cmd)
+	case "scan":
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		count, _ := strconv.ParseInt(string(cmd.Args[1]), 10, 64)
+		if count == 0 {
+			count = 100
+		}
+		ret, err := r.cache.Scan(int(count))
+		if err != nil {
+			conn.WriteError(err.Error())
+		} else {
+			// 只返回用户有权限访问的key, 这一批可能比count少
+			if ctx, ok := conn.Context().(*redisConnContext); ok {
+				ret = r.acl.accessible(ctx.user, ret)
+			}
+			conn.WriteArray(len(ret))
+			for i := range ret {
+				conn.WriteBulk(ret[i])
+			}
+		}
+	}
+}
+
+// writeValue 在bucket的读锁下把value直接写到连接的输出缓冲区, 不存在时写null
+func (r *RedisServer) writeValue(conn redcon.Conn, st redisStore, key []byte) {
+	err := st.View(key, func(value []byte) error {
+		conn.WriteBulk(value)
+		return nil
+	})
+	if err != nil {
+		conn.WriteNull()
+	}
+}
+
+// writeValues 用MultiGet读出keys的value写成数组, 不存在的写null, value的缓冲区在连接上复用
+func (r *RedisServer) writeValues(conn redcon.Conn, st redisStore, keys [][]byte) {
+	ctx, _ := conn.Context().(*redisConnContext)
+	var dst [][]byte
+	if ctx != nil {
+		dst = ctx.values
+		for i := range dst {
+			dst[i] = dst[i][:0]
+		}
+	}
+	values, errs := st.MultiGet(keys, dst)
+	conn.WriteArray(len(keys))
+	for i := range keys {
+		r.track(conn, keys[i])
+		if errs[i] != nil {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulk(values[i])
+		}
+	}
+	if ctx != nil && len(values) <= redisReusedValues {
+		ctx.values = values
+	}
+}
+
+func (r *RedisServer) config(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	param := strings.ToLower(string(cmd.Args[2]))
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "get":
+		switch param {
+		case "notify-keyspace-events":
+			conn.WriteArray(2)
+			conn.WriteBulkString(param)
+			conn.WriteBulkString(notifyFlagsString(atomic.LoadUint32(&r.notifyFlags)))
+		case "slowlog-log-slower-than":
+			conn.WriteArray(2)
+			conn.WriteBulkString(param)
+			conn.WriteBulkString(strconv.FormatInt(atomic.LoadInt64(&r.slowlog.logSlowerThan), 10))
+		case "slowlog-max-len":
+			conn.WriteArray(2)
+			conn.WriteBulkString(param)
+			conn.WriteBulkString(strconv.FormatInt(atomic.LoadInt64(&r.slowlog.maxLen), 10))
+		case "maxmemory":
+			conn.WriteArray(2)
+			conn.WriteBulkString(param)
+			conn.WriteBulkString(strconv.FormatUint(r.cache.MaxCapacity(), 10))
+		case "bucket-count":
+			conn.WriteArray(2)
+			conn.WriteBulkString(param)
+			conn.WriteBulkString(strconv.FormatUint(uint64(r.cache.BucketCount()), 10))
+		default:
+			conn.WriteArray(0)
+		}
+	case "set":
+		if len(cmd.Args) != 4 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		switch param {
+		case "notify-keyspace-events":
+			flags, ok := parseNotifyFlags(string(cmd.Args[3]))
+			if !ok {
+				conn.WriteError("ERR Invalid argument '" + string(cmd.Args[3]) + "' for CONFIG SET '" + param + "'")
+				return
+			}
+			atomic.StoreUint32(&r.notifyFlags, flags)
+			conn.WriteString("OK")
+		case "slowlog-log-slower-than", "slowlog-max-len":
+			n, err := strconv.ParseInt(string(cmd.Args[3]), 10, 64)
+			if err != nil || (param == "slowlog-max-len" && n < 0) {
+				conn.WriteError("ERR Invalid argument '" + string(cmd.Args[3]) + "' for CONFIG SET '" + param + "'")
+				return
+			}
+			if param == "slowlog-max-len" {
+				r.slowlog.setMaxLen(n)
+			} else {
+				atomic.StoreInt64(&r.slowlog.logSlowerThan, n)
+			}
+			conn.WriteString("OK")
+		case "maxmemory":
+			// maxmemory 是cache的容量, 单位是字节, 修改时调用Resize
+			n, err := strconv.ParseUint(string(cmd.Args[3]), 10, 64)
+			if err != nil {
+				conn.WriteError("ERR Invalid argument '" + string(cmd.Args[3]) + "' for CONFIG SET '" + param + "'")
+				return
+			}
+			if err := r.cache.Resize(n); err != nil {
+				conn.WriteError("ERR CONFIG SET failed (possibly related to argument '" + param + "') - " + err.Error())
+				return
+			}
+			conn.WriteString("OK")
+		case "bucket-count":
+			// bucket-count 是bucket的数量, 必须是2的幂, 修改时调用Rebucket
+			n, err := strconv.ParseUint(string(cmd.Args[3]), 10, 32)
+			if err != nil {
+				conn.WriteError("ERR Invalid argument '" + string(cmd.Args[3]) + "' for CONFIG SET '" + param + "'")
+				return
+			}
+			if err := r.cache.Rebucket(uint32(n)); err != nil {
+				conn.WriteError("ERR CONFIG SET failed (possibly related to argument '" + param + "') - " + err.Error())
+				return
+			}
+			conn.WriteString("OK")
+		default:
+			conn.WriteError("ERR Unsupported CONFIG parameter: " + param)
+		}
+	default:
+		conn.WriteError("ERR CONFIG subcommand must be one of GET, SET")
+	}
+}
+
+func (r *RedisServer) info(conn redcon.Conn) {
+	stats := r.Stats()
+	var sb strings.Builder
+	sb.WriteString("# Clients\r\n")
+	sb.WriteString("connected_clients:" + strconv.Itoa(stats.ConnectedClients) + "\r\n")
+	sb.WriteString("maxclients:" + strconv.Itoa(r.opts.MaxClients) + "\r\n")
+	sb.WriteString("\r\n# Stats\r\n")
+	sb.WriteString("total_connections_received:" + strconv.FormatUint(stats.TotalConnections, 10) + "\r\n")
+	sb.WriteString("rejected_connections:" + strconv.FormatUint(stats.RejectedConnections, 10) + "\r\n")
+	sb.WriteString("total_commands_processed:" + strconv.FormatUint(stats.TotalCommands, 10) + "\r\n")
+	cs := r.cache.StatsSnapshot()
+	sb.WriteString("instantaneous_ops_per_sec:" + strconv.FormatInt(int64(cs.Rate1+0.5), 10) + "\r\n")
+	sb.WriteString("expired_keys:" + strconv.FormatUint(cs.Expirations, 10) + "\r\n")
+	sb.WriteString("evicted_keys:" + strconv.FormatUint(cs.Evictions, 10) + "\r\n")
+	sb.WriteString("keyspace_hits:" + strconv.FormatUint(cs.Hits, 10) + "\r\n")
+	sb.WriteString("keyspace_misses:" + strconv.FormatUint(cs.Misses, 10) + "\r\n")
+	sb.WriteString("\r\n# Keyspace\r\n")
+	sb.WriteString("db0:keys=" + strconv.FormatUint(r.cache.Size(), 10) + "\r\n")
+	conn.WriteBulkString(sb.String())
 }
@@ -1,12 +1,29 @@
 package lantern_cache
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-redis/redis/v7"
 	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/redcon"
 )
 
 func TestRedisServer(t *testing.T) {
@@ -23,6 +40,7 @@ func TestRedisServer(t *testing.T) {
 			panic(err)
 		}
 	}()
+	defer server.Close()
 	time.Sleep(time.Millisecond * 300)
 
 	client := redis.NewClient(&redis.Options{
@@ -125,3 +143,755 @@ func TestRedisServer(t *testing.T) {
 		assert.Equal(t, "", actual)
 	}
 }
+
+func TestRedisServerMulti(t *testing.T) {
+	ca := NewLanternCache(&Config{
+		BucketCount: 256,
+		MaxCapacity: 1024 * 1024 * 100,
+		// 每个bucket开始只有一个chunk, 写满后才分配
+		InitCapacity: 256 * chunkSize,
+	})
+
+	server := NewRedisServer(":6380", ca)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer server.Close()
+	time.Sleep(time.Millisecond * 300)
+
+	client := redis.NewClient(&redis.Options{
+		Addr: "localhost:6380",
+	})
+
+	{
+		cmds, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set("key", "val", 0)
+			pipe.HSet("index", "val", "key")
+			pipe.Get("key")
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(cmds))
+		assert.Equal(t, "val", cmds[2].(*redis.StringCmd).Val())
+
+		actual, err := client.HGet("index", "val").Result()
+		assert.Nil(t, err)
+		assert.Equal(t, "key", actual)
+	}
+
+	{
+		// 参数错误的命令只回复一个错误, 后面的回复不会错位
+		cmds, _ := client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Do("SETEX", "ttl", "bad", "val")
+			pipe.Do("SET", "ttl", "val", "EX", "bad")
+			pipe.Do("SETEX", "ttl", "100", "val")
+			pipe.Get("ttl")
+			return nil
+		})
+		assert.Equal(t, 4, len(cmds))
+		assert.NotNil(t, cmds[0].Err())
+		assert.Equal(t, "ERR syntax error", cmds[1].Err().Error())
+		assert.Nil(t, cmds[2].Err())
+		assert.Equal(t, "val", cmds[3].(*redis.StringCmd).Val())
+	}
+
+	{
+		err := client.Watch(func(tx *redis.Tx) error {
+			// 另一个连接修改了watch的key, EXEC需要失败
+			assert.Nil(t, client.Set("key", "changed", 0).Err())
+			_, err := tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.Set("key", "tx", 0)
+				return nil
+			})
+			return err
+		}, "key")
+		assert.Equal(t, redis.TxFailedErr, err)
+
+		actual, err := client.Get("key").Result()
+		assert.Nil(t, err)
+		assert.Equal(t, "changed", actual)
+	}
+
+	{
+		err := client.Watch(func(tx *redis.Tx) error {
+			_, err := tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.Set("key", "tx", 0)
+				return nil
+			})
+			return err
+		}, "key")
+		assert.Nil(t, err)
+
+		actual, err := client.Get("key").Result()
+		assert.Nil(t, err)
+		assert.Equal(t, "tx", actual)
+	}
+
+	{
+		// 提交失败时EXEC返回错误, 一条命令也没有执行
+		// 找一个和key在同一个bucket的key, 一个chunk放不下两个value, 需要分配新的chunk
+		same := ""
+		for i := 0; same == ""; i++ {
+			if k := "key" + strconv.Itoa(i); ca.hash.Hash([]byte(k))&255 == ca.hash.Hash([]byte("key"))&255 {
+				same = k
+			}
+		}
+		value := strings.Repeat("v", 40*1024)
+		restore := failChunkAlloc(ca)
+		_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set("other", "val", 0)
+			pipe.Set("key", value, 0)
+			pipe.Set(same, value, 0)
+			return nil
+		})
+		restore()
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "ERR EXEC failed"), err)
+
+		actual, err := client.Get("key").Result()
+		assert.Nil(t, err)
+		assert.Equal(t, "tx", actual)
+		assert.Equal(t, redis.Nil, client.Get("other").Err())
+	}
+}
+
+func TestRedisServerPubSub(t *testing.T) {
+	ca := NewLanternCache(&Config{
+		BucketCount: 256,
+		MaxCapacity: 1024 * 1024 * 100,
+	})
+
+	server := NewRedisServer(":6381", ca)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer server.Close()
+	time.Sleep(time.Millisecond * 300)
+
+	client := redis.NewClient(&redis.Options{
+		Addr: "localhost:6381",
+	})
+
+	{
+		sub := client.Subscribe("news")
+		_, err := sub.Receive()
+		assert.Nil(t, err)
+
+		n, err := client.Publish("news", "hello").Result()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), n)
+
+		msg, err := sub.ReceiveMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, "news", msg.Channel)
+		assert.Equal(t, "hello", msg.Payload)
+		assert.Nil(t, sub.Close())
+	}
+
+	{
+		err := client.ConfigSet("notify-keyspace-events", "KEA").Err()
+		assert.Nil(t, err)
+		actual, err := client.ConfigGet("notify-keyspace-events").Result()
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{"notify-keyspace-events", "AKE"}, actual)
+
+		sub := client.PSubscribe("__keyspace@0__:*")
+		_, err = sub.Receive()
+		assert.Nil(t, err)
+
+		assert.Nil(t, client.Set("key", "val", 0).Err())
+		assert.Nil(t, client.Del("key").Err())
+
+		msg, err := sub.ReceiveMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, "__keyspace@0__:key", msg.Channel)
+		assert.Equal(t, "set", msg.Payload)
+
+		msg, err = sub.ReceiveMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, "__keyspace@0__:key", msg.Channel)
+		assert.Equal(t, "del", msg.Payload)
+		assert.Nil(t, sub.Close())
+	}
+}
+
+// readResp 读取一个RESP2/RESP3的回复, 只用于测试
+func readResp(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', '-':
+		return line[1:], nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*', '>', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		ret := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := readResp(rd)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, v)
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("unknown reply %s", line)
+}
+
+func TestRedisServerTracking(t *testing.T) {
+	ca := NewLanternCache(&Config{
+		BucketCount: 256,
+		MaxCapacity: 1024 * 1024 * 100,
+	})
+
+	server := NewRedisServer(":6382", ca)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer server.Close()
+	time.Sleep(time.Millisecond * 300)
+
+	client := redis.NewClient(&redis.Options{
+		Addr: "localhost:6382",
+	})
+	assert.Nil(t, client.Set("key", "val", 0).Err())
+
+	conn, err := net.Dial("tcp", "localhost:6382")
+	assert.Nil(t, err)
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	do := func(args ...string) interface{} {
+		_, err := conn.Write(redcon.AppendArray(nil, len(args)))
+		assert.Nil(t, err)
+		for i := range args {
+			_, err = conn.Write(redcon.AppendBulkString(nil, args[i]))
+			assert.Nil(t, err)
+		}
+		v, err := readResp(rd)
+		assert.Nil(t, err)
+		return v
+	}
+
+	hello := do("HELLO", "3").([]interface{})
+	assert.Equal(t, "proto", hello[4])
+	assert.Equal(t, int64(3), hello[5])
+	assert.Equal(t, "OK", do("CLIENT", "TRACKING", "ON"))
+	assert.Equal(t, "val", do("GET", "key"))
+
+	assert.Nil(t, client.Set("key", "changed", 0).Err())
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	push, err := readResp(rd)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"invalidate", []interface{}{"key"}}, push)
+
+	// 连接detach之后普通命令仍然可用
+	assert.Equal(t, "changed", do("GET", "key"))
+}
+
+func TestRedisServerAuth(t *testing.T) {
+	ca := NewLanternCache(&Config{
+		BucketCount: 256,
+		MaxCapacity: 1024 * 1024 * 100,
+	})
+
+	server, err := NewRedisServerWithOptions(":6383", ca, &RedisServerOptions{
+		RequirePass: "secret",
+		Users: map[string][]string{
+			"reader": {"on", ">reader", "~*", "+@read"},
+		},
+	})
+	assert.Nil(t, err)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer server.Close()
+	time.Sleep(time.Millisecond * 300)
+
+	{
+		client := redis.NewClient(&redis.Options{Addr: "localhost:6383"})
+		err := client.Set("key", "val", 0).Err()
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "NOAUTH"))
+		assert.Nil(t, client.Close())
+	}
+
+	{
+		client := redis.NewClient(&redis.Options{Addr: "localhost:6383", Password: "secret"})
+		assert.Nil(t, client.Set("key", "val", 0).Err())
+		assert.Nil(t, client.Do("ACL", "SETUSER", "writer", "on", ">writer", "~w:*", "+@write").Err())
+		assert.Nil(t, client.Close())
+	}
+
+	{
+		client := redis.NewClient(&redis.Options{Addr: "localhost:6383"})
+		assert.Nil(t, client.Do("AUTH", "reader", "reader").Err())
+		actual, err := client.Do("ACL", "WHOAMI").Result()
+		assert.Nil(t, err)
+		assert.Equal(t, "reader", actual)
+		actual, err = client.Get("key").Result()
+		assert.Nil(t, err)
+		assert.Equal(t, "val", actual)
+		err = client.Set("key", "val", 0).Err()
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "NOPERM"))
+
+		assert.Nil(t, client.Do("AUTH", "writer", "writer").Err())
+		assert.Nil(t, client.Set("w:key", "val", 0).Err())
+		assert.NotNil(t, client.Set("key", "val", 0).Err())
+		assert.Nil(t, client.Close())
+	}
+
+	{
+		// 订阅以后的命令也要检查权限
+		admin := redis.NewClient(&redis.Options{Addr: "localhost:6383", Password: "secret"})
+		assert.Nil(t, admin.Do("ACL", "SETUSER", "reader", "+subscribe").Err())
+		assert.Nil(t, admin.Close())
+		client := redis.NewClient(&redis.Options{Addr: "localhost:6383", OnConnect: func(conn *redis.Conn) error {
+			return conn.Process(redis.NewStatusCmd("AUTH", "reader", "reader"))
+		}})
+		sub := client.Subscribe("news")
+		_, err := sub.Receive()
+		assert.Nil(t, err)
+		assert.Nil(t, sub.PSubscribe("news*"))
+		_, err = sub.Receive()
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "NOPERM"), err)
+		assert.Nil(t, sub.Close())
+		assert.Nil(t, client.Close())
+	}
+
+	{
+		// SCAN和BCAST的失效通知只有用户能访问的key
+		admin := redis.NewClient(&redis.Options{Addr: "localhost:6383", Password: "secret"})
+		defer admin.Close()
+		assert.Nil(t, admin.Do("ACL", "SETUSER", "app", "on", ">app", "~app:*", "+@read", "+client").Err())
+		assert.Nil(t, admin.Set("app:1", "val", 0).Err())
+
+		client := redis.NewClient(&redis.Options{Addr: "localhost:6383", OnConnect: func(conn *redis.Conn) error {
+			return conn.Process(redis.NewStatusCmd("AUTH", "app", "app"))
+		}})
+		keys, err := client.Do("SCAN", "1000").Result()
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{"app:1"}, keys)
+		assert.Nil(t, client.Close())
+
+		conn, err := net.Dial("tcp", "localhost:6383")
+		assert.Nil(t, err)
+		defer conn.Close()
+		rd := bufio.NewReader(conn)
+		do := func(args ...string) interface{} {
+			_, err := conn.Write(redcon.AppendArray(nil, len(args)))
+			assert.Nil(t, err)
+			for i := range args {
+				_, err = conn.Write(redcon.AppendBulkString(nil, args[i]))
+				assert.Nil(t, err)
+			}
+			v, err := readResp(rd)
+			assert.Nil(t, err)
+			return v
+		}
+		do("HELLO", "3", "AUTH", "app", "app")
+		assert.Equal(t, "OK", do("CLIENT", "TRACKING", "ON", "BCAST"))
+		assert.Nil(t, admin.Set("key", "changed", 0).Err())
+		assert.Nil(t, admin.Set("app:1", "changed", 0).Err())
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		push, err := readResp(rd)
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{"invalidate", []interface{}{"app:1"}}, push)
+	}
+}
+
+func TestRedisServerLatency(t *testing.T) {
+	ca := NewLanternCache(&Config{
+		BucketCount: 256,
+		MaxCapacity: 1024 * 1024 * 100,
+	})
+
+	server, err := NewRedisServerWithOptions(":6385", ca, &RedisServerOptions{SlowlogMaxLen: 2})
+	assert.Nil(t, err)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer server.Close()
+	time.Sleep(time.Millisecond * 300)
+
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6385"})
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, client.Set("key", "val", 0).Err())
+	}
+	assert.Nil(t, client.Get("key").Err())
+
+	actual, err := client.Do("LATENCY", "HISTOGRAM", "set", "none").Result()
+	assert.Nil(t, err)
+	histograms := actual.([]interface{})
+	assert.Equal(t, 2, len(histograms))
+	assert.Equal(t, "set", histograms[0])
+	set := histograms[1].([]interface{})
+	assert.Equal(t, []interface{}{"calls", int64(3), "histogram_usec"}, set[:3])
+	usec := set[3].([]interface{})
+	assert.Equal(t, int64(3), usec[len(usec)-1])
+	assert.Equal(t, uint64(1), server.CommandLatency()["get"].Count)
+
+	// 默认10ms, 这些命令都不够慢
+	n, err := client.Do("SLOWLOG", "LEN").Int64()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	assert.Nil(t, client.Do("CONFIG", "SET", "slowlog-log-slower-than", "0").Err())
+	assert.Nil(t, client.Set("key", strings.Repeat("v", 200), 0).Err())
+	assert.Nil(t, client.Get("key").Err())
+	entries, err := client.Do("SLOWLOG", "GET").Result()
+	assert.Nil(t, err)
+	// CONFIG SET本身也被记录, 最多保存2条, 最新的在前
+	assert.Equal(t, 2, len(entries.([]interface{})))
+	entry := entries.([]interface{})[0].([]interface{})
+	assert.Equal(t, 6, len(entry))
+	assert.Equal(t, []interface{}{"get", "key"}, entry[3])
+	args := entries.([]interface{})[1].([]interface{})[3].([]interface{})
+	assert.Equal(t, strings.Repeat("v", 128)+"... (72 more bytes)", args[2])
+
+	// 密码不会出现在慢日志中
+	assert.Nil(t, client.Do("ACL", "SETUSER", "alice", "on", ">secret", "~*", "+@all").Err())
+	entries, err = client.Do("SLOWLOG", "GET").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"ACL", "SETUSER", "alice", "(redacted)", "(redacted)", "(redacted)", "(redacted)"}, entries.([]interface{})[0].([]interface{})[3])
+	assert.Nil(t, client.Do("AUTH", "alice", "secret").Err())
+	assert.Nil(t, client.Do("HELLO", "2", "AUTH", "alice", "secret").Err())
+	entries, err = client.Do("SLOWLOG", "GET").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"HELLO", "2", "AUTH", "(redacted)", "(redacted)"}, entries.([]interface{})[0].([]interface{})[3])
+	assert.Equal(t, []interface{}{"AUTH", "(redacted)", "(redacted)"}, entries.([]interface{})[1].([]interface{})[3])
+
+	assert.Nil(t, client.Do("SLOWLOG", "RESET").Err())
+	n, err = client.Do("SLOWLOG", "LEN").Int64()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	values, err := client.Do("CONFIG", "GET", "slowlog-max-len").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"slowlog-max-len", "2"}, values)
+
+	// maxmemory 改变cache的容量
+	assert.Nil(t, client.Do("CONFIG", "SET", "maxmemory", "209715200").Err())
+	values, err = client.Do("CONFIG", "GET", "maxmemory").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"maxmemory", "209715200"}, values)
+	assert.NotNil(t, client.Do("CONFIG", "SET", "maxmemory", "1024").Err())
+	assert.Equal(t, uint64(209715200), ca.MaxCapacity())
+
+	// bucket-count 改变bucket的数量
+	assert.Nil(t, client.Set("key", "val", 0).Err())
+	assert.Nil(t, client.Do("CONFIG", "SET", "bucket-count", "256").Err())
+	values, err = client.Do("CONFIG", "GET", "bucket-count").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"bucket-count", "256"}, values)
+	assert.NotNil(t, client.Do("CONFIG", "SET", "bucket-count", "100").Err())
+	assert.Equal(t, "val", client.Get("key").Val())
+}
+
+func TestRedisServerHotKeys(t *testing.T) {
+	ca := NewLanternCache(&Config{
+		BucketCount:      256,
+		MaxCapacity:      1024 * 1024 * 100,
+		HotKeySampleRate: 1,
+		TrackBigKeys:     true,
+	})
+
+	server := NewRedisServer(":6386", ca)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer server.Close()
+	time.Sleep(time.Millisecond * 300)
+
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6386"})
+	defer client.Close()
+	assert.Nil(t, client.Set("big", strings.Repeat("v", 1000), 0).Err())
+	assert.Nil(t, client.Set("hot", "val", 0).Err())
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, client.Get("hot").Err())
+	}
+
+	freq, err := client.Do("OBJECT", "FREQ", "hot").Int64()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), freq)
+	assert.Equal(t, redis.Nil, client.Do("OBJECT", "FREQ", "none").Err())
+
+	usage, err := client.Do("MEMORY", "USAGE", "big").Int64()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(EntryHeadFieldSizeOf+3+1000), usage)
+	assert.Equal(t, redis.Nil, client.Do("MEMORY", "USAGE", "none").Err())
+
+	actual, err := client.Do("LANTERN", "HOTKEYS", "1").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{[]interface{}{"hot", int64(11)}}, actual)
+	actual, err = client.Do("LANTERN", "BIGKEYS").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{
+		[]interface{}{"big", int64(EntryHeadFieldSizeOf + 3 + 1000)},
+		[]interface{}{"hot", int64(EntryHeadFieldSizeOf + 3 + 3)},
+	}, actual)
+}
+
+func TestRedisServerTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	ca := NewLanternCache(&Config{
+		BucketCount: 256,
+		MaxCapacity: 1024 * 1024 * 100,
+	})
+	server, err := NewRedisServerWithOptions(":6384", ca, &RedisServerOptions{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+	})
+	assert.Nil(t, err)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer server.Close()
+	time.Sleep(time.Millisecond * 300)
+
+	client := redis.NewClient(&redis.Options{
+		Addr:      "localhost:6384",
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	assert.Nil(t, client.Set("key", "val", 0).Err())
+	actual, err := client.Get("key").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, "val", actual)
+	assert.Nil(t, client.Close())
+}
+
+func TestRedisServerShutdown(t *testing.T) {
+	ca := NewLanternCache(&Config{
+		BucketCount: 256,
+		MaxCapacity: 1024 * 1024 * 100,
+	})
+	server, err := NewRedisServerWithOptions("", ca, &RedisServerOptions{
+		MaxClients:      2,
+		MaxBulkLen:      1024,
+		MaxMultiBulkLen: 16,
+		Logger:          NoneLogger(),
+	})
+	assert.Nil(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ln)
+	}()
+	addr := ln.Addr().String()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		c, err := net.Dial("tcp", addr)
+		assert.Nil(t, err)
+		return c, bufio.NewReader(c)
+	}
+
+	// request limits
+	{
+		c, rd := dial()
+		_, err = c.Write([]byte("*2\r\n$3\r\nget\r\n$2000\r\n"))
+		assert.Nil(t, err)
+		line, _ := rd.ReadString('\n')
+		assert.Equal(t, "-ERR Protocol error: invalid bulk length\r\n", line)
+		_, err = rd.ReadString('\n')
+		assert.Equal(t, io.EOF, err)
+		_ = c.Close()
+
+		c, rd = dial()
+		_, err = c.Write([]byte("*17\r\n"))
+		assert.Nil(t, err)
+		line, _ = rd.ReadString('\n')
+		assert.Equal(t, "-ERR Protocol error: invalid multibulk length\r\n", line)
+		_ = c.Close()
+	}
+
+	// max clients
+	c1, rd1 := dial()
+	c2, rd2 := dial()
+	_, err = c1.Write([]byte("*1\r\n$4\r\nping\r\n"))
+	assert.Nil(t, err)
+	line, _ := rd1.ReadString('\n')
+	assert.Equal(t, "+pong\r\n", line)
+	_, err = c2.Write([]byte("*1\r\n$4\r\nping\r\n"))
+	assert.Nil(t, err)
+	line, _ = rd2.ReadString('\n')
+	assert.Equal(t, "+pong\r\n", line)
+	{
+		c, rd := dial()
+		line, _ := rd.ReadString('\n')
+		assert.Equal(t, "-ERR max number of clients reached\r\n", line)
+		_ = c.Close()
+	}
+
+	// a client in the middle of a request finishes it before shutdown
+	_, err = c1.Write([]byte("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n"))
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_, err = rd2.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	_, err = c1.Write([]byte("$3\r\nval\r\n"))
+	assert.Nil(t, err)
+	line, _ = rd1.ReadString('\n')
+	assert.Equal(t, ":1\r\n", line)
+	_, err = rd1.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+
+	assert.Nil(t, <-shutdown)
+	assert.Nil(t, <-served)
+	stats := server.Stats()
+	assert.Equal(t, 0, stats.ConnectedClients)
+	assert.Equal(t, uint64(5), stats.TotalConnections)
+	assert.Equal(t, uint64(1), stats.RejectedConnections)
+	val, err := ca.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "val", string(val))
+}
+
+func TestRedisServerClose(t *testing.T) {
+	ca := NewLanternCache(&Config{BucketCount: 4, MaxCapacity: 1024 * 1024})
+	server, err := NewRedisServerWithOptions("", ca, &RedisServerOptions{Logger: NoneLogger()})
+	assert.Nil(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ln)
+	}()
+
+	// 请求中途的连接, 订阅的连接和开启跟踪的连接都被断开, 连接由各自的goroutine关闭
+	var rds []*bufio.Reader
+	for _, req := range []string{
+		"*3\r\n$3\r\nset\r\n$3\r\nkey\r\n",
+		"*2\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n",
+		"*3\r\n$5\r\nhello\r\n$1\r\n3\r\n*3\r\n$6\r\nclient\r\n$8\r\ntracking\r\n$2\r\non\r\n",
+	} {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		assert.Nil(t, err)
+		defer c.Close()
+		_, err = c.Write([]byte(req))
+		assert.Nil(t, err)
+		rds = append(rds, bufio.NewReader(c))
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, server.Close())
+	assert.Nil(t, <-served)
+	for _, rd := range rds {
+		_, err := ioutil.ReadAll(rd)
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100 && server.Stats().ConnectedClients > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, server.Stats().ConnectedClients)
+}
+
+func TestRedisServerUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lantern")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lantern.sock")
+
+	ca := NewLanternCache(&Config{
+		BucketCount: 256,
+		MaxCapacity: 1024 * 1024 * 100,
+	})
+	server, err := NewRedisServerWithOptions(path, ca, &RedisServerOptions{
+		Network:     "unix",
+		IdleTimeout: 200 * time.Millisecond,
+		Logger:      NoneLogger(),
+	})
+	assert.Nil(t, err)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil {
+			panic(err)
+		}
+	}()
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	client := redis.NewClient(&redis.Options{Network: "unix", Addr: path})
+	assert.Nil(t, client.Set("key", "val", 0).Err())
+	actual, err := client.Get("key").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, "val", actual)
+	assert.Nil(t, client.Close())
+
+	// idle clients are closed
+	c, err := net.Dial("unix", path)
+	assert.Nil(t, err)
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = bufio.NewReader(c).ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	_ = c.Close()
+}
+
+func TestRedisServerCloseRemovesListeners(t *testing.T) {
+	ca := NewLanternCache(&Config{BucketCount: 1, MaxCapacity: chunkSize})
+	listeners := func() int {
+		return len(ca.events.listeners.Load().([]*registeredListener))
+	}
+	// 同一个cache上重建server, 关闭的server不再收到事件
+	for i := 0; i < 3; i++ {
+		server := NewRedisServer(":0", ca)
+		assert.Equal(t, 2, listeners())
+		assert.Nil(t, server.Close())
+		assert.Equal(t, 0, listeners())
+	}
+}
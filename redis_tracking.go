@@ -0,0 +1,287 @@
+package lantern_cache
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// replyBuffer 把回复写到缓冲区, 由调用方决定什么时候发送, 其它方法交给conn
+type replyBuffer struct {
+	redcon.Conn
+	wr *redcon.Writer
+}
+
+func newReplyBuffer(conn redcon.Conn) *replyBuffer {
+	return &replyBuffer{Conn: conn, wr: redcon.NewWriter(nil)}
+}
+
+func (c *replyBuffer) WriteString(str string)      { c.wr.WriteString(str) }
+func (c *replyBuffer) WriteBulk(bulk []byte)       { c.wr.WriteBulk(bulk) }
+func (c *replyBuffer) WriteBulkString(bulk string) { c.wr.WriteBulkString(bulk) }
+func (c *replyBuffer) WriteInt(num int)            { c.wr.WriteInt(num) }
+func (c *replyBuffer) WriteInt64(num int64)        { c.wr.WriteInt64(num) }
+func (c *replyBuffer) WriteUint64(num uint64)      { c.wr.WriteUint64(num) }
+func (c *replyBuffer) WriteError(msg string)       { c.wr.WriteError(msg) }
+func (c *replyBuffer) WriteArray(count int)        { c.wr.WriteArray(count) }
+func (c *replyBuffer) WriteNull()                  { c.wr.WriteNull() }
+func (c *replyBuffer) WriteRaw(data []byte)        { c.wr.WriteRaw(data) }
+func (c *replyBuffer) WriteAny(v interface{})      { c.wr.WriteAny(v) }
+
+// take 返回缓冲区里的回复并清空缓冲区, 没有回复时返回nil
+func (c *replyBuffer) take() []byte {
+	buf := c.wr.Buffer()
+	if len(buf) == 0 {
+		return nil
+	}
+	ret := append([]byte(nil), buf...)
+	c.wr.SetBuffer(buf[:0])
+	return ret
+}
+
+// bufferedConn 把命令的回复写到缓冲区, 再交给写goroutine发送, 这样回复和推送的失效通知不会交错
+type bufferedConn struct {
+	*replyBuffer
+	detached redcon.DetachedConn
+	closing  bool
+}
+
+func newBufferedConn(conn redcon.DetachedConn) *bufferedConn {
+	return &bufferedConn{replyBuffer: newReplyBuffer(conn), detached: conn}
+}
+
+func (c *bufferedConn) ReadCommand() (redcon.Command, error) { return c.detached.ReadCommand() }
+
+// Flush 回复由写goroutine发送
+func (c *bufferedConn) Flush() error { return nil }
+
+// Close 等缓冲区里的回复发送完再关闭
+func (c *bufferedConn) Close() error {
+	c.closing = true
+	return nil
+}
+
+func (c *bufferedConn) Detach() redcon.DetachedConn {
+	return c
+}
+
+// serveDetached 把连接从redcon中detach出来自己读命令, 之后服务端可以随时推送消息
+func (r *RedisServer) serveDetached(conn redcon.Conn, ctx *redisConnContext) *subscriber {
+	s := newSubscriber(conn.Detach())
+	ctx.detached = true
+	// detach之前写的回复还在redcon的缓冲区里, 发一个空消息触发flush
+	s.send([]byte{})
+	bc := newBufferedConn(s.conn)
+	go func() {
+		defer func() {
+			r.tracking.disable(ctx.id)
+			s.close()
+		}()
+		for {
+			cmd, err := s.conn.ReadCommand()
+			if err != nil {
+				return
+			}
+			r.handle(bc, cmd)
+			if msg := bc.take(); msg != nil {
+				select {
+				case s.out <- msg:
+				case <-s.done:
+					return
+				}
+			}
+			if bc.closing {
+				s.send(nil)
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (r *RedisServer) hello(conn redcon.Conn, ctx *redisConnContext, cmd redcon.Command) {
+	// HELLO [protover [AUTH username password]]
+	if len(cmd.Args) > 1 {
+		ver, err := strconv.Atoi(string(cmd.Args[1]))
+		if err != nil {
+			conn.WriteError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if ver != 2 && ver != 3 {
+			conn.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		ctx.resp = ver
+	}
+	if len(cmd.Args) > 2 {
+		if len(cmd.Args) != 5 || strings.ToLower(string(cmd.Args[2])) != "auth" {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		if !r.login(ctx, string(cmd.Args[3]), string(cmd.Args[4])) {
+			conn.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+			return
+		}
+	}
+	fields := []string{"server", "lantern", "version", lanternVersion, "proto", "", "id", "", "mode", "standalone", "role", "master"}
+	var buf []byte
+	if ctx.resp == 3 {
+		buf = append(buf, '%')
+		buf = strconv.AppendInt(buf, int64(len(fields)/2), 10)
+		buf = append(buf, '\r', '\n')
+	} else {
+		buf = redcon.AppendArray(buf, len(fields))
+	}
+	for i := 0; i < len(fields); i += 2 {
+		buf = redcon.AppendBulkString(buf, fields[i])
+		switch fields[i] {
+		case "proto":
+			buf = redcon.AppendInt(buf, int64(ctx.resp))
+		case "id":
+			buf = redcon.AppendUint(buf, ctx.id)
+		default:
+			buf = redcon.AppendBulkString(buf, fields[i+1])
+		}
+	}
+	conn.WriteRaw(buf)
+}
+
+func (r *RedisServer) client(conn redcon.Conn, ctx *redisConnContext, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "id":
+		conn.WriteUint64(ctx.id)
+	case "tracking":
+		r.clientTracking(conn, ctx, cmd)
+	default:
+		conn.WriteError("ERR Unknown subcommand or wrong number of arguments for '" + string(cmd.Args[1]) + "'")
+	}
+}
+
+// CLIENT TRACKING ON|OFF [REDIRECT client-id] [BCAST] [PREFIX prefix [PREFIX prefix ...]]
+func (r *RedisServer) clientTracking(conn redcon.Conn, ctx *redisConnContext, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		conn.WriteError("ERR wrong number of arguments for 'client tracking' command")
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[2])) {
+	case "off":
+		r.tracking.disable(ctx.id)
+		conn.WriteString("OK")
+		return
+	case "on":
+	default:
+		conn.WriteError("ERR syntax error")
+		return
+	}
+
+	c := &trackingClient{id: ctx.id}
+	redirect := uint64(0)
+	for i := 3; i < len(cmd.Args); i++ {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "bcast":
+			c.bcast = true
+		case "prefix":
+			if i+1 >= len(cmd.Args) {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			i++
+			c.prefixes = append(c.prefixes, append([]byte(nil), cmd.Args[i]...))
+		case "redirect":
+			if i+1 >= len(cmd.Args) {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			i++
+			id, err := strconv.ParseUint(string(cmd.Args[i]), 10, 64)
+			if err != nil {
+				conn.WriteError("ERR Invalid client ID")
+				return
+			}
+			redirect = id
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	if len(c.prefixes) > 0 && !c.bcast {
+		conn.WriteError("ERR PREFIX option requires BCAST mode to be enabled")
+		return
+	}
+	if c.bcast && len(c.prefixes) == 0 {
+		c.prefixes = [][]byte{nil}
+	}
+
+	// 只通知开启跟踪的用户有权限访问的key, 否则BCAST不带PREFIX可以收到所有key的失效通知
+	user := ctx.user
+	accessible := func(push func(keys [][]byte)) func(keys [][]byte) {
+		return func(keys [][]byte) {
+			if keys = r.acl.accessible(user, keys); len(keys) > 0 {
+				push(keys)
+			}
+		}
+	}
+	switch {
+	case redirect != 0:
+		if !r.pubsub.hasClient(redirect) {
+			conn.WriteError("ERR The client ID you want redirect to does not exist")
+			return
+		}
+		c.push = accessible(func(keys [][]byte) {
+			r.pubsub.sendTo(redirect, invalidateMessage(keys))
+		})
+	case ctx.resp == 3:
+		conn.WriteString("OK")
+		if ctx.push == nil {
+			ctx.push = r.serveDetached(conn, ctx)
+		}
+		s := ctx.push
+		c.push = accessible(func(keys [][]byte) {
+			s.send(invalidatePush(keys))
+		})
+		r.tracking.enable(c)
+		return
+	default:
+		conn.WriteError("ERR Client tracking requires RESP3 (HELLO 3) or REDIRECT")
+		return
+	}
+	r.tracking.enable(c)
+	conn.WriteString("OK")
+}
+
+// track 在读取key之前调用
+func (r *RedisServer) track(conn redcon.Conn, key []byte) {
+	ctx, ok := conn.Context().(*redisConnContext)
+	if !ok || !r.tracking.enabled(ctx.id) {
+		return
+	}
+	r.tracking.track(ctx.id, r.cache.hash.Hash(key), key)
+}
+
+// invalidatePush 是RESP3的推送消息: >2 invalidate [key ...]
+func invalidatePush(keys [][]byte) []byte {
+	msg := []byte(">2\r\n")
+	msg = redcon.AppendBulkString(msg, "invalidate")
+	msg = redcon.AppendArray(msg, len(keys))
+	for i := range keys {
+		msg = redcon.AppendBulk(msg, keys[i])
+	}
+	return msg
+}
+
+// invalidateMessage 是REDIRECT到RESP2订阅连接的消息
+func invalidateMessage(keys [][]byte) []byte {
+	msg := redcon.AppendArray(nil, 3)
+	msg = redcon.AppendBulkString(msg, "message")
+	msg = redcon.AppendBulkString(msg, "__redis__:invalidate")
+	msg = redcon.AppendArray(msg, len(keys))
+	for i := range keys {
+		msg = redcon.AppendBulk(msg, keys[i])
+	}
+	return msg
+}
@@ -0,0 +1,194 @@
+package lantern_cache
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/*
+改变容量: 每个bucket单独加写锁调整, 其它bucket照常读写
+变大: chunk表末尾加上空的chunk, 写入位置走到原来的末尾后继续写新的chunk, 之后才回到开头, entry不用移动
+变小: 把有效的entry按从旧到新的顺序重写到新的chunk里, 从最新的往前放, 放不下的最旧的entry被淘汰
+原来的chunk放回allocator, 重写时最多多占用一个bucket的内存
+重写后loop加一, 所有索引值都比原来的大, 事务的WATCH只会多冲突
+*/
+
+// Resize changes the max capacity of the cache in bytes, like Config.MaxCapacity. Buckets are
+// resized one at a time, readers and writers of the other buckets are not blocked. Growing keeps
+// every entry, shrinking keeps the newest entries that fit and evicts the others. An invalid
+// capacity returns a *ConfigError. When a chunk can't be allocated the buckets resized before
+// keep their new capacity, the others the old one, and Resize can be called again.
+func (lc *LanternCache) Resize(maxCapacity uint64) error {
+	lc.resizeMutex.Lock()
+	defer lc.resizeMutex.Unlock()
+	buckets := lc.loadLayout().buckets
+	bucketCount := uint64(len(buckets))
+	if maxCapacity/bucketCount < chunkSize {
+		return &ConfigError{Field: "MaxCapacity", Value: maxCapacity, Reason: "every bucket needs at least one chunk of 64KB"}
+	}
+	bucketMaxCapacity := (maxCapacity + bucketCount - 1) / bucketCount
+	start := time.Now()
+	evicted := 0
+	for _, b := range buckets {
+		n, err := b.resize(bucketMaxCapacity)
+		evicted += n
+		if err != nil {
+			lc.logger.log(LevelError, "cache resize failed", F("bucket", b.id), F("max_capacity", humanSize(int64(maxCapacity))), F("err", err))
+			return err
+		}
+	}
+	old := atomic.SwapUint64(&lc.maxCapacity, maxCapacity)
+	lc.logger.log(LevelInfo, "cache resized", F("old_max_capacity", humanSize(int64(old))), F("max_capacity", humanSize(int64(maxCapacity))),
+		F("evicted", evicted), F("elapsed", time.Since(start)))
+	return nil
+}
+
+// MaxCapacity returns the max capacity of the cache in bytes, Config.MaxCapacity or the capacity of the last Resize.
+func (lc *LanternCache) MaxCapacity() uint64 {
+	return atomic.LoadUint64(&lc.maxCapacity)
+}
+
+// resize 把chunk数改成能放下maxCapacity的数量, 返回淘汰的entry数
+func (b *bucket) resize(maxCapacity uint64) (int, error) {
+	chunkCount := int((maxCapacity + chunkSize - 1) / chunkSize)
+	b.lock()
+	defer b.unlock()
+	if chunkCount == len(b.chunks) {
+		return 0, nil
+	}
+	if chunkCount > len(b.chunks) {
+		chunks := make([][]byte, chunkCount)
+		copy(chunks, b.chunks)
+		b.setChunks(chunks)
+		return 0, nil
+	}
+	return b.shrinkLocked(chunkCount)
+}
+
+// shrinkLocked 调用方需要持有写锁, 分配chunk失败时bucket不变
+func (b *bucket) shrinkLocked(chunkCount int) (int, error) {
+	live, expired, corrupt := b.liveEntriesLocked(time.Now().Unix())
+	r, first, err := packRing(b.chunkAlloc, live, chunkCount, b.loop+1)
+	if err != nil {
+		b.logger.logLimited(LevelError, "bucket resize failed", F("bucket", b.id), F("err", err))
+		return 0, err
+	}
+	b.droppedLocked(live[:first], expired, corrupt)
+	b.installLocked(r, live[first:])
+	if b.logger.enabled(LevelDebug) {
+		b.logger.logLimited(LevelDebug, "bucket shrunk", F("bucket", b.id), F("chunks", chunkCount), F("keys", b.index.len()), F("evicted", first))
+	}
+	return first, nil
+}
+
+// ringEntry 重写ring时搬运的entry, v是原来的索引值, next是重写后的索引值
+type ringEntry struct {
+	keyHash, v, next uint64
+	entry            []byte
+}
+
+// liveEntriesLocked 返回索引里有效的entry, 按写入的先后排好序, 另外返回过期的和读不出来的
+// entry指向bucket的chunk, 调用方需要持有写锁
+func (b *bucket) liveEntriesLocked(now int64) (live, expired, corrupt []ringEntry) {
+	b.index.rangeAll(func(keyHash, v uint64) bool {
+		if !b.validLocked(v) {
+			return true
+		}
+		entry, err := b.readEntryLocked(v & 0x000000ffffffffff)
+		switch {
+		case err != nil:
+			corrupt = append(corrupt, ringEntry{keyHash: keyHash, v: v})
+		case readTimeStamp(entry) > 0 && readTimeStamp(entry) < now:
+			expired = append(expired, ringEntry{keyHash: keyHash, v: v, entry: entry})
+		default:
+			live = append(live, ringEntry{keyHash: keyHash, v: v, entry: entry})
+		}
+		return true
+	})
+	// 索引值的loop和offset就是写入的顺序
+	sort.Slice(live, func(i, j int) bool { return live[i].v < live[j].v })
+	return live, expired, corrupt
+}
+
+// ring 重写出来的chunk, 还没有换到bucket里
+type ring struct {
+	chunks [][]byte
+	loop   uint32
+	offset uint64
+}
+
+// packRing 把entries里最新的放得下的entry按顺序写到chunkCount个新的chunk里, 返回第一个放进去的下标
+// 写入的位置和storeLocked一样, entry不会正好写到chunk的末尾, 分配chunk失败时放回已经分配的chunk
+func packRing(alloc *chunkAllocator, entries []ringEntry, chunkCount int, loop uint32) (ring, int, error) {
+	// 从最新的entry往前按chunk分组, 放不下的更旧的entry淘汰
+	first, used, count := len(entries), 0, 1
+	for ; first > 0; first-- {
+		size := len(entries[first-1].entry)
+		if used > 0 && used+size >= chunkSize {
+			if count == chunkCount {
+				break
+			}
+			count++
+			used = 0
+		}
+		used += size
+	}
+
+	r := ring{chunks: make([][]byte, chunkCount), loop: loop}
+	for i := first; i < len(entries); i++ {
+		size := uint64(len(entries[i].entry))
+		chunkIndex := r.offset / chunkSize
+		if used := r.offset & (chunkSize - 1); used > 0 && used+size >= chunkSize {
+			wrapEndMark(r.chunks[chunkIndex][used:])
+			chunkIndex++
+			r.offset = chunkIndex * chunkSize
+		}
+		if r.chunks[chunkIndex] == nil {
+			chunk, err := alloc.getChunk()
+			if err != nil {
+				for _, chunk := range r.chunks {
+					alloc.putChunk(chunk)
+				}
+				return ring{}, 0, err
+			}
+			r.chunks[chunkIndex] = chunk
+		}
+		copy(r.chunks[chunkIndex][r.offset&(chunkSize-1):], entries[i].entry)
+		entries[i].next = (uint64(loop) << OffsetSizeOf) | r.offset
+		r.offset += size
+	}
+	return r, first, nil
+}
+
+// droppedLocked 统计重写时丢掉的entry并通知listener, 事件里的key还在原来的chunk里, 要在installLocked之前调用
+func (b *bucket) droppedLocked(evicted, expired, corrupt []ringEntry) {
+	for _, e := range evicted {
+		atomic.AddUint64(&b.statistics.Evictions, 1)
+		b.events.emit(EventEvicted, e.keyHash, readKey(e.entry))
+	}
+	for _, e := range expired {
+		atomic.AddUint64(&b.statistics.Expirations, 1)
+		b.events.emit(EventExpired, e.keyHash, readKey(e.entry))
+	}
+	for _, e := range corrupt {
+		atomic.AddUint64(&b.statistics.Corruptions, 1)
+		// 损坏的entry读不出key
+		b.events.emit(EventEvicted, e.keyHash, nil)
+	}
+}
+
+// installLocked 换上重写的ring, 索引只保留kept, 原来的chunk放回allocator, 调用方需要持有写锁
+func (b *bucket) installLocked(r ring, kept []ringEntry) {
+	b.index.reset()
+	for _, e := range kept {
+		b.index.add(e.keyHash, e.next)
+	}
+	old := b.chunks
+	b.setChunks(r.chunks)
+	b.loop = r.loop
+	b.offset = r.offset
+	for _, chunk := range old {
+		b.chunkAlloc.putChunk(chunk)
+	}
+}
@@ -0,0 +1,135 @@
+package lantern_cache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// resizeTestValue 每个entry大约1KB, 一个chunk放60多个
+func resizeTestValue(i int) []byte {
+	return []byte(fmt.Sprintf("%01000d", i))
+}
+
+func TestResizeGrow(t *testing.T) {
+	cache, err := New(&Config{}, WithBuckets(1), WithMaxCapacity(2*chunkSize), WithInitCapacity(chunkSize))
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, cache.Put([]byte(fmt.Sprintf("key%d", i)), resizeTestValue(i)))
+	}
+	assert.Nil(t, cache.Resize(8*chunkSize))
+	assert.Equal(t, uint64(8*chunkSize), cache.MaxCapacity())
+	assert.Equal(t, uint64(8*chunkSize), cache.BucketStats()[0].MaxChunkBytes)
+
+	// 原来的entry都还在, 新写入的先用新的chunk
+	for i := 100; i < 300; i++ {
+		assert.Nil(t, cache.Put([]byte(fmt.Sprintf("key%d", i)), resizeTestValue(i)))
+	}
+	for i := 0; i < 300; i++ {
+		v, err := cache.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.Nil(t, err, i)
+		assert.Equal(t, resizeTestValue(i), v)
+	}
+	assert.Equal(t, uint64(0), cache.Stats().Evictions)
+}
+
+func TestResizeShrink(t *testing.T) {
+	cache, err := New(&Config{}, WithBuckets(1), WithMaxCapacity(8*chunkSize))
+	assert.Nil(t, err)
+	var evicted []string
+	cache.AddListener(func(event EventType, keyHash uint64, key []byte) {
+		if event == EventEvicted {
+			evicted = append(evicted, string(key))
+		}
+	})
+	// 写满一轮以后再写一部分, 有效的entry跨过ring的末尾
+	const n = 700
+	for i := 0; i < n; i++ {
+		assert.Nil(t, cache.Put([]byte(fmt.Sprintf("key%d", i)), resizeTestValue(i)))
+	}
+	assert.Equal(t, uint32(1), cache.BucketStats()[0].Loop)
+	assert.Nil(t, cache.PutWithExpire([]byte("expired"), []byte("value"), -10))
+	before := cache.Size()
+	evictions := cache.Stats().Evictions
+	evicted = nil
+
+	assert.Nil(t, cache.Resize(2*chunkSize))
+	stats := cache.BucketStats()[0]
+	assert.Equal(t, uint64(2*chunkSize), stats.MaxChunkBytes)
+	assert.Equal(t, uint64(2*chunkSize), stats.ChunkBytes)
+
+	// 保留的是最新的entry, 最旧的被淘汰
+	kept := int(cache.Size())
+	assert.True(t, kept > 100 && kept < 2*chunkSize/1000, kept)
+	for i := 0; i < n; i++ {
+		v, err := cache.Get([]byte(fmt.Sprintf("key%d", i)))
+		if i < n-kept {
+			assert.Equal(t, ErrorNotFound, err, i)
+			continue
+		}
+		assert.Nil(t, err, i)
+		assert.Equal(t, resizeTestValue(i), v)
+	}
+	assert.Equal(t, uint64(1), cache.Stats().Expirations)
+	assert.Equal(t, before-1-uint64(kept), cache.Stats().Evictions-evictions)
+	assert.Equal(t, int(before)-1-kept, len(evicted))
+	assert.Equal(t, fmt.Sprintf("key%d", n-kept-1), evicted[len(evicted)-1])
+
+	// 缩小后继续写入, 绕回开头时淘汰重写过的entry
+	for i := n; i < 2*n; i++ {
+		assert.Nil(t, cache.Put([]byte(fmt.Sprintf("key%d", i)), resizeTestValue(i)))
+	}
+	v, err := cache.Get([]byte(fmt.Sprintf("key%d", 2*n-1)))
+	assert.Nil(t, err)
+	assert.Equal(t, resizeTestValue(2*n-1), v)
+	assert.True(t, cache.Size() <= uint64(kept), cache.Size())
+	assert.Equal(t, uint64(2*chunkSize), cache.BucketStats()[0].ChunkBytes)
+}
+
+func TestResizeInvalid(t *testing.T) {
+	cache, err := New(&Config{}, WithBuckets(4), WithMaxCapacity(4*chunkSize))
+	assert.Nil(t, err)
+	err = cache.Resize(3 * chunkSize)
+	var configErr *ConfigError
+	assert.True(t, errors.As(err, &configErr))
+	assert.Equal(t, "MaxCapacity", configErr.Field)
+	assert.Equal(t, uint64(4*chunkSize), cache.MaxCapacity())
+}
+
+func TestResizeConcurrent(t *testing.T) {
+	cache, err := New(&Config{}, WithBuckets(4), WithMaxCapacity(32*chunkSize), WithOptimisticReads())
+	assert.Nil(t, err)
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := []byte(fmt.Sprintf("key%d-%d", g, i%500))
+				if i%2 == 0 {
+					assert.Nil(t, cache.Put(key, key))
+				} else if v, err := cache.Get(key); err == nil {
+					assert.Equal(t, key, v)
+				}
+			}
+		}(g)
+	}
+	for i := 0; i < 20; i++ {
+		capacity := uint64(4 * chunkSize)
+		if i%2 == 1 {
+			capacity = 32 * chunkSize
+		}
+		assert.Nil(t, cache.Resize(capacity))
+	}
+	close(stop)
+	wg.Wait()
+}
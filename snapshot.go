@@ -0,0 +1,319 @@
+package lantern_cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/*
+snapshot是bucket的原样拷贝, 所有整数都是LittleEndian, 和entry保持一致
+┌──────────────────────────────────────────────────────────────────┐
+│ header: magic(8) version(4) bucket count(4) created unix time(8) │
+│         flags(4)                                                 │
+├──────────────────────────────────────────────────────────────────┤
+│ bucket: loop(4) offset(8) chunk count(4) key count(8)            │
+│         (key hash(8) index value(8)) * key count                 │
+│         (present(1) [chunk(64KB)]) * chunk count                 │
+│         crc32 of the bucket section(4)                           │
+├──────────────────────────────────────────────────────────────────┤
+│ bucket ...                                                       │
+└──────────────────────────────────────────────────────────────────┘
+恢复时不依赖原来的bucket数量和hash, 只把索引里仍然有效的entry按写入顺序重新put一遍
+*/
+const (
+	snapshotMagic = "LNTCSNAP"
+	// 2: entry头增加了checksum
+	// 3: header增加了flags
+	snapshotVersion = 3
+
+	// snapshotFlagEncrypted value是加密后的密文, 只能恢复到同样加密的cache
+	snapshotFlagEncrypted = 1 << 0
+	// snapshotFlagChecksum entry写入时计算了checksum, checksum是0的entry是坏的
+	snapshotFlagChecksum = 1 << 1
+
+	snapshotHeaderSize       = 8 + 4 + 4 + 8 + 4
+	snapshotBucketHeaderSize = 4 + 8 + 4 + 8
+	maxSnapshotBucketChunks  = 1 << OffsetSizeOf / chunkSize
+)
+
+// bucketSnapshot 是一个bucket在某一时刻的拷贝
+type bucketSnapshot struct {
+	loop   uint32
+	offset uint64
+	index  bucketIndex
+	chunks [][]byte
+}
+
+// snapshot 在读锁下拷贝bucket, 写文件的时候不阻塞读写
+func (b *bucket) snapshot() *bucketSnapshot {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	ret := &bucketSnapshot{
+		loop:   b.loop,
+		offset: b.offset,
+		index:  b.index.clone(),
+		chunks: make([][]byte, len(b.chunks)),
+	}
+	for i := range b.chunks {
+		if b.chunks[i] != nil {
+			ret.chunks[i] = append([]byte(nil), b.chunks[i]...)
+		}
+	}
+	return ret
+}
+
+// entry 和bucket.entryLocked的判断一样, 返回索引值指向的entry
+func (s *bucketSnapshot) entry(v uint64) ([]byte, bool) {
+	loop := uint32(v >> OffsetSizeOf)
+	offset := v & 0x000000ffffffffff
+	if !(loop == s.loop && offset < s.offset || (loop+1 == s.loop && offset >= s.offset)) {
+		return nil, false
+	}
+	chunkIndex := offset / chunkSize
+	if int(chunkIndex) >= len(s.chunks) || s.chunks[chunkIndex] == nil {
+		return nil, false
+	}
+	return entryAt(s.chunks[chunkIndex][offset&(chunkSize-1):])
+}
+
+// sortedIndex 按写入顺序返回索引值, 索引值是loop<<40|offset, 越小写入越早
+func (s *bucketSnapshot) sortedIndex() []uint64 {
+	ret := make([]uint64, 0, s.index.len())
+	s.index.rangeAll(func(keyHash, v uint64) bool {
+		ret = append(ret, v)
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// reverseIndex 索引值 -> key hash
+func (s *bucketSnapshot) reverseIndex() map[uint64]uint64 {
+	ret := make(map[uint64]uint64, s.index.len())
+	s.index.rangeAll(func(keyHash, v uint64) bool {
+		ret[v] = keyHash
+		return true
+	})
+	return ret
+}
+
+func (s *bucketSnapshot) writeTo(w io.Writer) error {
+	sum := crc32.NewIEEE()
+	mw := io.MultiWriter(w, sum)
+
+	var header [snapshotBucketHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:], s.loop)
+	binary.LittleEndian.PutUint64(header[4:], s.offset)
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(s.chunks)))
+	binary.LittleEndian.PutUint64(header[16:], uint64(s.index.len()))
+	if _, err := mw.Write(header[:]); err != nil {
+		return err
+	}
+
+	// keyHash冲突时同一个keyHash会出现多次
+	var kv [16]byte
+	var err error
+	s.index.rangeAll(func(keyHash, v uint64) bool {
+		binary.LittleEndian.PutUint64(kv[0:], keyHash)
+		binary.LittleEndian.PutUint64(kv[8:], v)
+		_, err = mw.Write(kv[:])
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range s.chunks {
+		present := []byte{0}
+		if chunk != nil {
+			present[0] = 1
+		}
+		if _, err := mw.Write(present); err != nil {
+			return err
+		}
+		if chunk == nil {
+			continue
+		}
+		if _, err := mw.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], sum.Sum32())
+	_, err = w.Write(crc[:])
+	return err
+}
+
+func readBucketSnapshot(r io.Reader) (*bucketSnapshot, error) {
+	sum := crc32.NewIEEE()
+	tr := io.TeeReader(r, sum)
+
+	var header [snapshotBucketHeaderSize]byte
+	if _, err := io.ReadFull(tr, header[:]); err != nil {
+		return nil, snapshotReadError(err)
+	}
+	ret := &bucketSnapshot{
+		loop:   binary.LittleEndian.Uint32(header[0:]),
+		offset: binary.LittleEndian.Uint64(header[4:]),
+	}
+	chunkCount := binary.LittleEndian.Uint32(header[12:])
+	keyCount := binary.LittleEndian.Uint64(header[16:])
+	// 索引值只有OffsetSizeOf位offset, 一个bucket不会有更多的chunk
+	if uint64(chunkCount)*chunkSize < ret.offset || uint64(chunkCount) > maxSnapshotBucketChunks {
+		return nil, ErrorSnapshotFormat
+	}
+
+	// key count来自文件, 不用它预分配
+	ret.index = newMapIndex()
+	var kv [16]byte
+	for i := uint64(0); i < keyCount; i++ {
+		if _, err := io.ReadFull(tr, kv[:]); err != nil {
+			return nil, snapshotReadError(err)
+		}
+		ret.index.add(binary.LittleEndian.Uint64(kv[0:]), binary.LittleEndian.Uint64(kv[8:]))
+	}
+
+	// chunk count也来自文件, 校验crc之前只按读到的数据增长
+	present := make([]byte, 1)
+	for i := uint32(0); i < chunkCount; i++ {
+		if _, err := io.ReadFull(tr, present); err != nil {
+			return nil, snapshotReadError(err)
+		}
+		if present[0] == 0 {
+			ret.chunks = append(ret.chunks, nil)
+			continue
+		}
+		chunk := make([]byte, chunkSize)
+		if _, err := io.ReadFull(tr, chunk); err != nil {
+			return nil, snapshotReadError(err)
+		}
+		ret.chunks = append(ret.chunks, chunk)
+	}
+
+	var crc [4]byte
+	if _, err := io.ReadFull(r, crc[:]); err != nil {
+		return nil, snapshotReadError(err)
+	}
+	if binary.LittleEndian.Uint32(crc[:]) != sum.Sum32() {
+		return nil, ErrorSnapshotChecksum
+	}
+	return ret, nil
+}
+
+// snapshotReadError 文件中途结束说明文件不完整
+func snapshotReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrorSnapshotFormat
+	}
+	return err
+}
+
+// SaveSnapshot writes the content of the cache to w.
+// Buckets are copied one at a time, so the snapshot is consistent per bucket.
+func (lc *LanternCache) SaveSnapshot(w io.Writer) error {
+	// Rebucket迁移时key会在bucket之间移动, 可能漏掉或者写两次
+	lc.resizeMutex.Lock()
+	defer lc.resizeMutex.Unlock()
+	buckets := lc.loadLayout().buckets
+	bw := bufio.NewWriter(w)
+	var header [snapshotHeaderSize]byte
+	copy(header[:], snapshotMagic)
+	binary.LittleEndian.PutUint32(header[8:], snapshotVersion)
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(buckets)))
+	binary.LittleEndian.PutUint64(header[16:], uint64(time.Now().Unix()))
+	var flags uint32
+	if lc.cipher != nil {
+		flags |= snapshotFlagEncrypted
+	}
+	if lc.bucketConfig.checksum {
+		flags |= snapshotFlagChecksum
+	}
+	binary.LittleEndian.PutUint32(header[24:], flags)
+	if _, err := bw.Write(header[:]); err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		if err := b.snapshot().writeTo(bw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadSnapshot puts the entries of a snapshot written by SaveSnapshot into the cache.
+// Overwritten, deleted and expired entries are skipped, the snapshot may come from a cache
+// with a different bucket count or capacity.
+// It fails with a *SnapshotEncryptionError when the snapshot and the cache disagree on encryption.
+func (lc *LanternCache) LoadSnapshot(r io.Reader) error {
+	sr, err := NewSnapshotReader(r)
+	if err != nil {
+		return err
+	}
+	// entry原样putRaw, 密文进了不加密的cache或者明文进了加密的cache都读不出来
+	if encrypted := lc.cipher != nil; sr.Header().Encrypted != encrypted {
+		return &SnapshotEncryptionError{Snapshot: sr.Header().Encrypted, Cache: encrypted}
+	}
+	now := time.Now().Unix()
+	for {
+		b, err := sr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		b.Live(func(e *SnapshotEntry) bool {
+			if e.Expire > 0 && e.Expire < now {
+				return true
+			}
+			keyHash := lc.hash.Hash(e.Key)
+			err = lc.bucketFor(keyHash).putRaw(keyHash, e.Key, e.Value, e.Expire)
+			for err == errBucketMoved {
+				err = lc.bucketFor(keyHash).putRaw(keyHash, e.Key, e.Value, e.Expire)
+			}
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// SaveSnapshotFile writes the snapshot to a temporary file and renames it to path,
+// so path always holds a complete snapshot.
+func (lc *LanternCache) SaveSnapshotFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err = lc.SaveSnapshot(f); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshotFile loads the snapshot at path
+func (lc *LanternCache) LoadSnapshotFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return lc.LoadSnapshot(f)
+}
@@ -0,0 +1,227 @@
+package lantern_cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// SnapshotHeader is the header of a snapshot written by SaveSnapshot
+type SnapshotHeader struct {
+	Version     uint32
+	BucketCount uint32
+	Created     time.Time
+	// Encrypted is true when the values were sealed by a cache with a KeyProvider.
+	Encrypted bool
+	// Checksum is true when the entries were written with Config.Checksum.
+	Checksum bool
+}
+
+// SnapshotReader reads a snapshot one bucket at a time without loading it into a cache.
+type SnapshotReader struct {
+	r      *bufio.Reader
+	header SnapshotHeader
+	next   uint32
+}
+
+// NewSnapshotReader reads the header of the snapshot, it fails with ErrorSnapshotFormat
+// when r is not a snapshot.
+func NewSnapshotReader(r io.Reader) (*SnapshotReader, error) {
+	ret := &SnapshotReader{r: bufio.NewReader(r)}
+	var header [snapshotHeaderSize]byte
+	if _, err := io.ReadFull(ret.r, header[:]); err != nil {
+		return nil, snapshotReadError(err)
+	}
+	if string(header[:8]) != snapshotMagic || binary.LittleEndian.Uint32(header[8:]) != snapshotVersion {
+		return nil, ErrorSnapshotFormat
+	}
+	ret.header = SnapshotHeader{
+		Version:     binary.LittleEndian.Uint32(header[8:]),
+		BucketCount: binary.LittleEndian.Uint32(header[12:]),
+		Created:     time.Unix(int64(binary.LittleEndian.Uint64(header[16:])), 0),
+		Encrypted:   binary.LittleEndian.Uint32(header[24:])&snapshotFlagEncrypted != 0,
+		Checksum:    binary.LittleEndian.Uint32(header[24:])&snapshotFlagChecksum != 0,
+	}
+	return ret, nil
+}
+
+func (s *SnapshotReader) Header() SnapshotHeader {
+	return s.header
+}
+
+// Next reads the next bucket, it returns io.EOF after the last bucket and
+// ErrorSnapshotChecksum when the bucket is corrupted.
+func (s *SnapshotReader) Next() (*SnapshotBucket, error) {
+	if s.next == s.header.BucketCount {
+		return nil, io.EOF
+	}
+	b, err := readBucketSnapshot(s.r)
+	if err != nil {
+		return nil, err
+	}
+	ret := &SnapshotBucket{
+		Index:      int(s.next),
+		Loop:       b.loop,
+		Offset:     b.offset,
+		ChunkCount: len(b.chunks),
+		Keys:       b.index.len(),
+		s:          b,
+		checksum:   s.header.Checksum,
+	}
+	for i := range b.chunks {
+		if b.chunks[i] != nil {
+			ret.AllocatedChunks++
+		}
+	}
+	s.next++
+	return ret, nil
+}
+
+// SnapshotBucket is a bucket read from a snapshot.
+// Offset is the write position of the ring, entries before it were written in Loop,
+// entries after it in Loop-1.
+type SnapshotBucket struct {
+	Index           int
+	Loop            uint32
+	Offset          uint64
+	ChunkCount      int
+	AllocatedChunks int
+	// Keys is the size of the index, it may include overwritten entries not cleaned yet.
+	Keys int
+
+	s        *bucketSnapshot
+	checksum bool
+}
+
+// SnapshotEntry is an entry of a snapshot bucket, Key and Value point into the bucket.
+type SnapshotEntry struct {
+	KeyHash uint64
+	Key     []byte
+	Value   []byte
+	// Expire is the unix time the entry expires, 0 means never.
+	Expire int64
+	Loop   uint32
+	Offset uint64
+	Size   int
+	// Live is true when the index still points to the entry.
+	Live bool
+
+	raw []byte
+}
+
+func (b *SnapshotBucket) newEntry(entry []byte, loop uint32, offset uint64) *SnapshotEntry {
+	key := readKey(entry)
+	return &SnapshotEntry{
+		Key:    key,
+		Value:  readValue(entry, uint16(len(key))),
+		Expire: readTimeStamp(entry),
+		Loop:   loop,
+		Offset: offset,
+		Size:   len(entry),
+		raw:    entry,
+	}
+}
+
+// Live calls fn for every entry the index points to in write order, including expired entries,
+// until fn returns false. Entries failing their checksum are skipped.
+func (b *SnapshotBucket) Live(fn func(e *SnapshotEntry) bool) {
+	hashes := b.s.reverseIndex()
+	for _, v := range b.s.sortedIndex() {
+		entry, ok := b.s.entry(v)
+		if !ok || !verifyEntry(entry, b.checksum) {
+			continue
+		}
+		e := b.newEntry(entry, uint32(v>>OffsetSizeOf), v&0x000000ffffffffff)
+		e.KeyHash = hashes[v]
+		e.Live = true
+		if !fn(e) {
+			return
+		}
+	}
+}
+
+// Walk calls fn for every entry stored in the chunks, live or not, in chunk order until fn returns false.
+// Entries of the previous loop behind the write position in the current chunk can't be located
+// and are skipped. Walk returns an error when an entry header runs out of its chunk.
+func (b *SnapshotBucket) Walk(fn func(e *SnapshotEntry) bool) error {
+	live := b.s.reverseIndex()
+	current := b.Offset / chunkSize
+	for i, chunk := range b.s.chunks {
+		if chunk == nil {
+			continue
+		}
+		end := len(chunk)
+		loop := b.Loop
+		if uint64(i) == current {
+			end = int(b.Offset & (chunkSize - 1))
+		} else if uint64(i) > current {
+			if b.Loop == 0 {
+				continue
+			}
+			loop = b.Loop - 1
+		}
+
+		base := uint64(i) * chunkSize
+		stop, pos := false, 0
+		walkEntries(chunk[:end], func(p int, entry []byte) bool {
+			pos = p + len(entry)
+			offset := base + uint64(p)
+			e := b.newEntry(entry, loop, offset)
+			e.KeyHash, e.Live = live[uint64(loop)<<OffsetSizeOf|offset]
+			if !fn(e) {
+				stop = true
+				return false
+			}
+			return true
+		})
+		if stop {
+			return nil
+		}
+		if err := checkChunkTail(chunk[:end], pos); err != nil {
+			return fmt.Errorf("bucket %d chunk %d: %v", b.Index, i, err)
+		}
+	}
+	return nil
+}
+
+// checkChunkTail walkEntries停下的位置后面只能是结束标记或者放不下entry头的空间
+func checkChunkTail(chunk []byte, pos int) error {
+	if pos+EntryHeadFieldSizeOf > len(chunk) {
+		return nil
+	}
+	keySize := binary.LittleEndian.Uint16(chunk[pos+EntryTimeStampFieldSizeOf:])
+	if keySize == 0 {
+		return nil
+	}
+	return fmt.Errorf("corrupt entry header at %d", pos)
+}
+
+// Verify checks the entry headers of every chunk, the checksums of entries written with
+// Config.Checksum and that every live index value points to an entry whose key hashes to
+// the indexed hash with h.
+func (b *SnapshotBucket) Verify(h Hasher) []error {
+	var ret []error
+	err := b.Walk(func(e *SnapshotEntry) bool {
+		if !verifyEntry(e.raw, b.checksum) {
+			ret = append(ret, fmt.Errorf("bucket %d: checksum mismatch of entry at %d loop %d", b.Index, e.Offset, e.Loop))
+		}
+		return true
+	})
+	if err != nil {
+		ret = append(ret, err)
+	}
+	b.s.index.rangeAll(func(hash, v uint64) bool {
+		entry, ok := b.s.entry(v)
+		if !ok {
+			// 已经被覆盖的索引还没有clean
+			return true
+		}
+		if got := h.Hash(readKey(entry)); got != hash {
+			ret = append(ret, fmt.Errorf("bucket %d: index %x points to key %q with hash %x", b.Index, hash, readKey(entry), got))
+		}
+		return true
+	})
+	return ret
+}
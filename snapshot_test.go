@@ -0,0 +1,145 @@
+package lantern_cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotSaveLoad(t *testing.T) {
+	src := NewLanternCache(&Config{
+		BucketCount: 16,
+		MaxCapacity: 1024 * 1024 * 4,
+	})
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, src.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i))))
+	}
+	assert.Nil(t, src.Put([]byte("key1"), []byte("new1")))
+	assert.Nil(t, src.PutWithExpire([]byte("ttl"), []byte("ttl"), 100))
+	assert.Nil(t, src.PutWithExpire([]byte("expired"), []byte("expired"), -10))
+	src.Del([]byte("key2"))
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, src.SaveSnapshot(buf))
+	data := buf.Bytes()
+
+	// bucket数量不同也可以恢复
+	dst := NewLanternCache(&Config{
+		BucketCount: 4,
+		MaxCapacity: 1024 * 1024 * 4,
+	})
+	assert.Nil(t, dst.LoadSnapshot(bytes.NewReader(data)))
+	assert.Equal(t, uint64(1000), dst.Size())
+	v, err := dst.Get([]byte("key1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new1", string(v))
+	v, err = dst.Get([]byte("key999"))
+	assert.Nil(t, err)
+	assert.Equal(t, "val999", string(v))
+	_, err = dst.Get([]byte("key2"))
+	assert.Equal(t, ErrorNotFound, err)
+	_, err = dst.Get([]byte("expired"))
+	assert.Equal(t, ErrorNotFound, err)
+	_, expire, err := dst.getWithExpire([]byte("ttl"))
+	assert.Nil(t, err)
+	assert.True(t, expire > 0)
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[snapshotHeaderSize+snapshotBucketHeaderSize+3] ^= 0xff
+	assert.Equal(t, ErrorSnapshotChecksum, dst.LoadSnapshot(bytes.NewReader(corrupt)))
+	assert.Equal(t, ErrorSnapshotFormat, dst.LoadSnapshot(bytes.NewReader(data[:len(data)-1])))
+	assert.Equal(t, ErrorSnapshotFormat, dst.LoadSnapshot(bytes.NewReader([]byte("LNTCSNAQ"))))
+	// chunk count在crc校验之前使用, 不能按它分配内存
+	for _, count := range []uint32{0xffffffff, maxSnapshotBucketChunks} {
+		corrupt = append(corrupt[:0], data...)
+		binary.LittleEndian.PutUint32(corrupt[snapshotHeaderSize+12:], count)
+		assert.Equal(t, ErrorSnapshotFormat, dst.LoadSnapshot(bytes.NewReader(corrupt)), count)
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lantern")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump.lsnap")
+
+	src := NewLanternCache(&Config{
+		BucketCount: 4,
+		MaxCapacity: 1024 * 1024,
+	})
+	assert.Nil(t, src.Put([]byte("foo"), []byte("bar")))
+	assert.Nil(t, src.SaveSnapshotFile(path))
+	assert.Nil(t, src.SaveSnapshotFile(path))
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+
+	dst := NewLanternCache(&Config{
+		BucketCount: 4,
+		MaxCapacity: 1024 * 1024,
+	})
+	assert.Nil(t, dst.LoadSnapshotFile(path))
+	v, err := dst.Get([]byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", string(v))
+	assert.True(t, os.IsNotExist(dst.LoadSnapshotFile(filepath.Join(dir, "missing"))))
+}
+
+func TestSnapshotReader(t *testing.T) {
+	src := NewLanternCache(&Config{
+		BucketCount: 1,
+		MaxCapacity: chunkSize * 2,
+	})
+	// 写满两轮, 一部分entry被覆盖
+	value := bytes.Repeat([]byte("v"), 1000)
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, src.Put([]byte(fmt.Sprintf("key%d", i%150)), value))
+	}
+	src.Del([]byte("key149"))
+	buf := &bytes.Buffer{}
+	assert.Nil(t, src.SaveSnapshot(buf))
+
+	sr, err := NewSnapshotReader(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), sr.Header().BucketCount)
+	b, err := sr.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), b.Loop)
+	assert.Equal(t, 2, b.AllocatedChunks)
+
+	live := 0
+	b.Live(func(e *SnapshotEntry) bool {
+		assert.True(t, e.Live)
+		assert.Equal(t, src.hash.Hash(e.Key), e.KeyHash)
+		live++
+		return true
+	})
+	assert.Equal(t, int(src.Size()), live)
+
+	walked, walkedLive := 0, 0
+	assert.Nil(t, b.Walk(func(e *SnapshotEntry) bool {
+		walked++
+		if e.Live {
+			walkedLive++
+		}
+		return true
+	}))
+	assert.Equal(t, live, walkedLive)
+	assert.True(t, walked > live)
+	assert.Nil(t, b.Verify(src.hash))
+
+	_, err = sr.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// 破坏第一个entry的key size
+	b.s.chunks[0][EntryTimeStampFieldSizeOf+1] = 0xff
+	assert.NotNil(t, b.Walk(func(e *SnapshotEntry) bool { return true }))
+	assert.True(t, len(b.Verify(src.hash)) > 0)
+}
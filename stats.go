@@ -1,14 +1,30 @@
 package lantern_cache
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
+// Stats are the counters of the cache. Every bucket counts into its own Stats so writers of
+// different buckets don't contend on a counter, LanternCache.Stats sums them.
 type Stats struct {
-	Gets       uint64
-	Puts       uint64
-	Errors     uint64
-	Hits       uint64
-	Misses     uint64
+	Gets   uint64
+	Puts   uint64
+	Errors uint64
+	Hits   uint64
+	Misses uint64
+	// Collisions counts puts of a key whose hash is used by another key and gets finding only
+	// such keys. Colliding keys are chained in the index and coexist.
 	Collisions uint64
+	// Corruptions counts entries dropped because their header or checksum is corrupt.
+	Corruptions uint64
+	// Evictions counts entries dropped from the index because the ring overwrote them.
+	Evictions uint64
+	// Expirations counts expired entries dropped when a read found them.
+	Expirations uint64
 }
 
 func (s *Stats) String() string {
@@ -19,11 +35,165 @@ func (s *Stats) String() string {
 }
 
 func (s *Stats) Raw() string {
-	return fmt.Sprintf("get:%d put:%d err:%d hit:%d miss:%d collisions:%d",
+	return fmt.Sprintf("get:%d put:%d err:%d hit:%d miss:%d collisions:%d corruptions:%d evictions:%d expirations:%d",
 		s.Gets,
 		s.Puts,
 		s.Errors,
 		s.Hits,
 		s.Misses,
-		s.Collisions)
+		s.Collisions,
+		s.Corruptions,
+		s.Evictions,
+		s.Expirations)
+}
+
+// BucketStats describes the memory layout of a bucket
+type BucketStats struct {
+	Keys          uint64 `json:"keys"`
+	MapBytes      uint64 `json:"map_bytes"`
+	ChunkBytes    uint64 `json:"chunk_bytes"`
+	MaxChunkBytes uint64 `json:"max_chunk_bytes"`
+	Loop          uint32 `json:"loop"`
+	Offset        uint64 `json:"offset"`
+	// Ops is the gets and puts of the bucket, a hot key shows as a bucket with much more than the others.
+	Ops uint64 `json:"ops"`
+}
+
+// add 原子地读取o的每个计数加到s上, 其它goroutine同时在修改o
+func (s *Stats) add(o *Stats) {
+	s.Gets += atomic.LoadUint64(&o.Gets)
+	s.Puts += atomic.LoadUint64(&o.Puts)
+	s.Errors += atomic.LoadUint64(&o.Errors)
+	s.Hits += atomic.LoadUint64(&o.Hits)
+	s.Misses += atomic.LoadUint64(&o.Misses)
+	s.Collisions += atomic.LoadUint64(&o.Collisions)
+	s.Corruptions += atomic.LoadUint64(&o.Corruptions)
+	s.Evictions += atomic.LoadUint64(&o.Evictions)
+	s.Expirations += atomic.LoadUint64(&o.Expirations)
+}
+
+func (s *Stats) reset() {
+	atomic.StoreUint64(&s.Gets, 0)
+	atomic.StoreUint64(&s.Puts, 0)
+	atomic.StoreUint64(&s.Errors, 0)
+	atomic.StoreUint64(&s.Hits, 0)
+	atomic.StoreUint64(&s.Misses, 0)
+	atomic.StoreUint64(&s.Collisions, 0)
+	atomic.StoreUint64(&s.Corruptions, 0)
+	atomic.StoreUint64(&s.Evictions, 0)
+	atomic.StoreUint64(&s.Expirations, 0)
+}
+
+// OpStats counts calls of the LanternCache methods, WriteTo counts as View and Scan includes ScanCursor.
+type OpStats struct {
+	Get           uint64
+	GetWithBuffer uint64
+	View          uint64
+	MultiGet      uint64
+	Put           uint64
+	PutWithExpire uint64
+	MultiPut      uint64
+	Del           uint64
+	Scan          uint64
+}
+
+func (s *OpStats) add(o *OpStats) {
+	s.Get += atomic.LoadUint64(&o.Get)
+	s.GetWithBuffer += atomic.LoadUint64(&o.GetWithBuffer)
+	s.View += atomic.LoadUint64(&o.View)
+	s.MultiGet += atomic.LoadUint64(&o.MultiGet)
+	s.Put += atomic.LoadUint64(&o.Put)
+	s.PutWithExpire += atomic.LoadUint64(&o.PutWithExpire)
+	s.MultiPut += atomic.LoadUint64(&o.MultiPut)
+	s.Del += atomic.LoadUint64(&o.Del)
+	s.Scan += atomic.LoadUint64(&o.Scan)
+}
+
+func (s *OpStats) reset() {
+	atomic.StoreUint64(&s.Get, 0)
+	atomic.StoreUint64(&s.GetWithBuffer, 0)
+	atomic.StoreUint64(&s.View, 0)
+	atomic.StoreUint64(&s.MultiGet, 0)
+	atomic.StoreUint64(&s.Put, 0)
+	atomic.StoreUint64(&s.PutWithExpire, 0)
+	atomic.StoreUint64(&s.MultiPut, 0)
+	atomic.StoreUint64(&s.Del, 0)
+	atomic.StoreUint64(&s.Scan, 0)
+}
+
+// StatsSnapshot is a copy of the counters of all buckets with derived values.
+// Every counter is read atomically, but counters keep changing while they are copied.
+type StatsSnapshot struct {
+	Stats
+	Ops OpStats
+	// HitRatio is Hits / Gets, 0 without gets.
+	HitRatio float64
+	// Rate1, Rate5 and Rate15 are the gets and puts per second, exponentially weighted over the
+	// last 1, 5 and 15 minutes. They are updated when StatsSnapshot is called at least 5 seconds
+	// after the last update.
+	Rate1  float64
+	Rate5  float64
+	Rate15 float64
+	// Since is when counting started, at the creation of the cache or the last ResetStats.
+	Since time.Time
+	// Latency is nil unless Config.LatencySampleRate is set.
+	Latency *LatencyStats `json:",omitempty"`
+}
+
+const rateTickInterval = 5 * time.Second
+
+var rateWindows = [3]time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// rateMeter 用操作总数的增量更新1/5/15分钟的速率, 没有后台goroutine, 读取时距离上次更新
+// 超过rateTickInterval才用这段时间的增量更新一次
+type rateMeter struct {
+	mutex   sync.Mutex
+	last    uint64
+	lastAt  time.Time
+	started bool
+	rates   [3]float64
+}
+
+func newRateMeter(now time.Time) *rateMeter {
+	return &rateMeter{lastAt: now}
+}
+
+func (m *rateMeter) tick(total uint64, now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.tickLocked(total, now)
+}
+
+func (m *rateMeter) tickLocked(total uint64, now time.Time) {
+	interval := now.Sub(m.lastAt)
+	if interval <= 0 {
+		return
+	}
+	// 计数被重置过
+	if total < m.last {
+		m.last = 0
+	}
+	instant := float64(total-m.last) / interval.Seconds()
+	m.last = total
+	m.lastAt = now
+	if !m.started {
+		m.rates = [3]float64{instant, instant, instant}
+		m.started = true
+		return
+	}
+	// 和unix的load average一样按指数衰减, 两次更新的间隔不固定, 衰减系数按间隔计算
+	for i := range m.rates {
+		alpha := 1 - math.Exp(-float64(interval)/float64(rateWindows[i]))
+		m.rates[i] += alpha * (instant - m.rates[i])
+	}
+}
+
+// get 返回速率, 需要更新时才调用total
+func (m *rateMeter) get(total func() uint64, now time.Time) [3]float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if now.Sub(m.lastAt) >= rateTickInterval {
+		m.tickLocked(total(), now)
+	}
+	return m.rates
 }
@@ -0,0 +1,117 @@
+package lantern_cache
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+const trackingTableMaxKeys = 1 << 20
+
+type trackingClient struct {
+	id       uint64
+	bcast    bool
+	prefixes [][]byte
+	// push 发送失效通知, 在bucket锁内被调用, 不能阻塞
+	push func(keys [][]byte)
+}
+
+type trackedKey struct {
+	key     []byte
+	clients map[uint64]struct{}
+}
+
+// trackingTable 记录客户端读过的key, key被修改/删除/过期/淘汰时通知客户端
+// 和redis一样, 通知一次之后就不再跟踪, 客户端再次读取时重新跟踪
+type trackingTable struct {
+	// active 开启跟踪的客户端数, 没有客户端时invalidate不加锁, 写入不会因为这把全局锁在bucket之间串行
+	active  int32
+	mutex   sync.Mutex
+	keys    map[uint64]*trackedKey
+	clients map[uint64]*trackingClient
+}
+
+func newTrackingTable() *trackingTable {
+	return &trackingTable{
+		keys:    make(map[uint64]*trackedKey),
+		clients: make(map[uint64]*trackingClient),
+	}
+}
+
+func (t *trackingTable) enable(c *trackingClient) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.clients[c.id] = c
+	atomic.StoreInt32(&t.active, int32(len(t.clients)))
+}
+
+// disable 只删除客户端, keys里残留的id在下次失效时忽略
+func (t *trackingTable) disable(id uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.clients, id)
+	atomic.StoreInt32(&t.active, int32(len(t.clients)))
+}
+
+func (t *trackingTable) enabled(id uint64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c, ok := t.clients[id]
+	return ok && !c.bcast
+}
+
+// track 需要在读取value之前调用, 否则读和写之间的修改可能收不到通知
+func (t *trackingTable) track(id uint64, keyHash uint64, key []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tk, ok := t.keys[keyHash]
+	if !ok {
+		if len(t.keys) >= trackingTableMaxKeys {
+			// 表满了随便淘汰一个key, 通知跟踪它的客户端
+			for h, old := range t.keys {
+				t.invalidateLocked(h, old)
+				break
+			}
+		}
+		tk = &trackedKey{key: append([]byte(nil), key...), clients: make(map[uint64]struct{})}
+		t.keys[keyHash] = tk
+	}
+	tk.clients[id] = struct{}{}
+}
+
+// invalidate 注册为cache的Listener
+// 客户端在track之前已经enable, 所以有key需要通知时active一定不是0
+func (t *trackingTable) invalidate(event EventType, keyHash uint64, key []byte) {
+	if atomic.LoadInt32(&t.active) == 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if tk, ok := t.keys[keyHash]; ok {
+		t.invalidateLocked(keyHash, tk)
+	}
+	if key == nil {
+		return
+	}
+	for _, c := range t.clients {
+		if !c.bcast {
+			continue
+		}
+		for i := range c.prefixes {
+			if bytes.HasPrefix(key, c.prefixes[i]) {
+				c.push([][]byte{key})
+				break
+			}
+		}
+	}
+}
+
+func (t *trackingTable) invalidateLocked(keyHash uint64, tk *trackedKey) {
+	delete(t.keys, keyHash)
+	keys := [][]byte{tk.key}
+	for id := range tk.clients {
+		if c, ok := t.clients[id]; ok && !c.bcast {
+			c.push(keys)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package lantern_cache
+
+import (
+	"testing"
+)
+
+func TestTrackingTable(t *testing.T) {
+	table := newTrackingTable()
+	h := newFowlerNollVoHasher()
+	var pushed []string
+	table.enable(&trackingClient{id: 1, push: func(keys [][]byte) {
+		for i := range keys {
+			pushed = append(pushed, string(keys[i]))
+		}
+	}})
+	key := []byte("key")
+	table.track(1, h.Hash(key), key)
+	table.invalidate(EventSet, h.Hash(key), key)
+	if len(pushed) != 1 || pushed[0] != "key" {
+		t.Fatal(pushed)
+	}
+	// 通知一次后不再跟踪
+	table.invalidate(EventDel, h.Hash(key), key)
+	if len(pushed) != 1 {
+		t.Fatal(pushed)
+	}
+
+	// clean只知道hash
+	table.track(1, h.Hash(key), key)
+	table.invalidate(EventEvicted, h.Hash(key), nil)
+	if len(pushed) != 2 || pushed[1] != "key" {
+		t.Fatal(pushed)
+	}
+
+	table.disable(1)
+	if table.active != 0 {
+		t.Fatal(table.active)
+	}
+	table.track(1, h.Hash(key), key)
+	table.invalidate(EventSet, h.Hash(key), key)
+	if len(pushed) != 2 {
+		t.Fatal(pushed)
+	}
+}
+
+func TestTrackingTableBroadcast(t *testing.T) {
+	table := newTrackingTable()
+	var pushed []string
+	table.enable(&trackingClient{id: 1, bcast: true, prefixes: [][]byte{[]byte("user:")}, push: func(keys [][]byte) {
+		for i := range keys {
+			pushed = append(pushed, string(keys[i]))
+		}
+	}})
+	table.invalidate(EventSet, 1, []byte("user:1"))
+	table.invalidate(EventSet, 2, []byte("order:1"))
+	table.invalidate(EventDel, 1, []byte("user:1"))
+	if len(pushed) != 2 || pushed[0] != "user:1" || pushed[1] != "user:1" {
+		t.Fatal(pushed)
+	}
+}
@@ -0,0 +1,391 @@
+package lantern_cache
+
+import (
+	"crypto/cipher"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type txnRead struct {
+	keyHash uint64
+	version uint64
+}
+
+type txnWrite struct {
+	keyHash uint64
+	key     []byte
+	value   []byte // nil 表示删除
+	expire  int64
+}
+
+// Txn is a transaction created by LanternCache.Update.
+// Writes are buffered until commit, reads record the version they observed and
+// the commit fails with ErrorTxnConflict if any of them was modified meanwhile.
+// A Txn must not be used outside of the Update callback.
+type Txn struct {
+	lc      *LanternCache
+	reads   []txnRead
+	writes  []txnWrite
+	pending map[string]int
+	// locked 表示涉及的bucket已经全部加锁(EXEC), 读写不再需要加锁和校验
+	locked bool
+	// versions 提交后每个写入的版本
+	versions []uint64
+}
+
+func newTxn(lc *LanternCache, locked bool) *Txn {
+	return &Txn{lc: lc, locked: locked}
+}
+
+// Watch records the current version of keys, commit fails if any of them is modified before it.
+func (tx *Txn) Watch(keys ...[]byte) {
+	if tx.locked {
+		return
+	}
+	for i := range keys {
+		tx.reads = append(tx.reads, tx.lc.watch(keys[i]))
+	}
+}
+
+func (tx *Txn) Get(key []byte) ([]byte, error) {
+	return tx.GetWithBuffer(nil, key)
+}
+
+func (tx *Txn) GetWithBuffer(dst []byte, key []byte) ([]byte, error) {
+	if i, ok := tx.pending[string(key)]; ok {
+		w := &tx.writes[i]
+		if w.value == nil {
+			return nil, ErrorNotFound
+		}
+		if w.expire > 0 && w.expire < time.Now().Unix() {
+			return nil, ErrorValueExpire
+		}
+		return append(dst, w.value...), nil
+	}
+
+	keyHash := tx.lc.hash.Hash(key)
+	if tx.locked {
+		return tx.lc.bucketFor(keyHash).getLocked(dst, keyHash, key)
+	}
+
+	bucket := tx.lc.rlockKey(keyHash)
+	version := bucket.versionLocked(keyHash)
+	v, err := bucket.getLocked(dst, keyHash, key)
+	bucket.mutex.RUnlock()
+	tx.reads = append(tx.reads, txnRead{keyHash: keyHash, version: version})
+	return v, err
+}
+
+// View is LanternCache.View inside the transaction, values written by the transaction are
+// passed to fn from its buffer.
+func (tx *Txn) View(key []byte, fn func(value []byte) error) error {
+	if i, ok := tx.pending[string(key)]; ok {
+		w := &tx.writes[i]
+		if w.value == nil {
+			return ErrorNotFound
+		}
+		if w.expire > 0 && w.expire < time.Now().Unix() {
+			return ErrorValueExpire
+		}
+		return fn(w.value)
+	}
+
+	keyHash := tx.lc.hash.Hash(key)
+	if tx.locked {
+		return tx.lc.bucketFor(keyHash).viewLocked(keyHash, key, fn)
+	}
+
+	bucket := tx.lc.rlockKey(keyHash)
+	defer bucket.mutex.RUnlock()
+	tx.reads = append(tx.reads, txnRead{keyHash: keyHash, version: bucket.versionLocked(keyHash)})
+	return bucket.viewLocked(keyHash, key, fn)
+}
+
+// getEntry 和GetWithBuffer一样, 另外返回读到的版本和过期时间, memcached的cas/touch/incr需要保留它们
+// 事务中写过的key版本为0
+func (tx *Txn) getEntry(dst []byte, key []byte) ([]byte, uint64, int64, error) {
+	if i, ok := tx.pending[string(key)]; ok {
+		w := &tx.writes[i]
+		v, err := tx.GetWithBuffer(dst, key)
+		return v, 0, w.expire, err
+	}
+
+	keyHash := tx.lc.hash.Hash(key)
+	var bucket *bucket
+	if tx.locked {
+		bucket = tx.lc.bucketFor(keyHash)
+	} else {
+		bucket = tx.lc.rlockKey(keyHash)
+		defer bucket.mutex.RUnlock()
+	}
+	version := bucket.versionLocked(keyHash)
+	v, expire, err := bucket.getEntryLocked(dst, keyHash, key)
+	if !tx.locked {
+		tx.reads = append(tx.reads, txnRead{keyHash: keyHash, version: version})
+	}
+	return v, version, expire, err
+}
+
+func (tx *Txn) Put(key, value []byte) error {
+	return tx.put(key, value, 0)
+}
+
+func (tx *Txn) PutWithExpire(key, value []byte, expire int64) error {
+	return tx.put(key, value, time.Now().Unix()+expire)
+}
+
+// MultiGet is LanternCache.MultiGet inside the transaction.
+func (tx *Txn) MultiGet(keys [][]byte, dst [][]byte) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	for i := range keys {
+		var buf []byte
+		if i < len(dst) {
+			buf = dst[i]
+		}
+		values[i], errs[i] = tx.GetWithBuffer(buf, keys[i])
+	}
+	return values, errs
+}
+
+// MultiPut buffers entries like Put, nothing is buffered when an entry is invalid.
+func (tx *Txn) MultiPut(entries []Entry) error {
+	overhead := tx.lc.cipher.overhead()
+	for i := range entries {
+		if !validEntry(entries[i].Key, entries[i].Value, overhead) {
+			return ErrorInvalidEntry
+		}
+	}
+	now := time.Now().Unix()
+	for i := range entries {
+		e := &entries[i]
+		expire := int64(0)
+		if e.Expire != 0 {
+			expire = now + e.Expire
+		}
+		tx.write(e.Key, append(make([]byte, 0, len(e.Value)), e.Value...), expire)
+	}
+	return nil
+}
+
+func (tx *Txn) Del(key []byte) {
+	tx.write(key, nil, 0)
+}
+
+func (tx *Txn) put(key, value []byte, expire int64) error {
+	if !validEntry(key, value, tx.lc.cipher.overhead()) {
+		return ErrorInvalidEntry
+	}
+	tx.write(key, append(make([]byte, 0, len(value)), value...), expire)
+	return nil
+}
+
+func (tx *Txn) write(key, value []byte, expire int64) {
+	if tx.pending == nil {
+		tx.pending = make(map[string]int)
+	}
+	w := txnWrite{
+		keyHash: tx.lc.hash.Hash(key),
+		key:     append(make([]byte, 0, len(key)), key...),
+		value:   value,
+		expire:  expire,
+	}
+	if i, ok := tx.pending[string(key)]; ok {
+		tx.writes[i] = w
+		return
+	}
+	tx.pending[string(w.key)] = len(tx.writes)
+	tx.writes = append(tx.writes, w)
+}
+
+func (tx *Txn) commit() error {
+	if len(tx.writes) == 0 {
+		return nil
+	}
+	hashes := make([]uint64, 0, len(tx.reads)+len(tx.writes))
+	for i := range tx.reads {
+		hashes = append(hashes, tx.reads[i].keyHash)
+	}
+	for i := range tx.writes {
+		hashes = append(hashes, tx.writes[i].keyHash)
+	}
+	buckets := tx.lc.lockKeys(hashes)
+	defer tx.lc.unlockBuckets(buckets)
+
+	if !tx.lc.validateLocked(tx.reads) {
+		return ErrorTxnConflict
+	}
+	return tx.apply()
+}
+
+// apply 调用方需要持有所有涉及bucket的写锁
+// 写入后还持有锁, 记下每个写入的版本, memcached返回的cas就是写入的版本而不是之后再读到的
+func (tx *Txn) apply() error {
+	if err := tx.lc.applyLocked(tx.writes); err != nil {
+		return err
+	}
+	tx.versions = make([]uint64, len(tx.writes))
+	for i := range tx.writes {
+		w := &tx.writes[i]
+		tx.versions[i] = tx.lc.bucketFor(w.keyHash).versionLocked(w.keyHash)
+	}
+	return nil
+}
+
+// committedVersion 返回提交后key的版本, 事务没有写key或者没有提交时返回0
+func (tx *Txn) committedVersion(key []byte) uint64 {
+	i, ok := tx.pending[string(key)]
+	if !ok || i >= len(tx.versions) {
+		return 0
+	}
+	return tx.versions[i]
+}
+
+// applyLocked 调用方需要持有所有涉及bucket的写锁
+// 先做完所有可能失败的事: 检查entry, 取加密的key, 预留写入需要的chunk, 之后的写入不会失败, 要么全部写入要么都不写
+func (lc *LanternCache) applyLocked(writes []txnWrite) error {
+	var keyID uint32
+	var aead cipher.AEAD
+	if lc.cipher != nil {
+		var err error
+		if keyID, aead, err = lc.cipher.current(); err != nil {
+			return err
+		}
+	}
+	overhead := lc.cipher.overhead()
+	sizes := make(map[*bucket][]uint64)
+	for i := range writes {
+		w := &writes[i]
+		if w.value == nil {
+			continue
+		}
+		if !validEntry(w.key, w.value, overhead) {
+			return ErrorInvalidEntry
+		}
+		bucket := lc.bucketFor(w.keyHash)
+		sizes[bucket] = append(sizes[bucket], uint64(EntryHeadFieldSizeOf+len(w.key)+len(w.value)+overhead))
+	}
+	reserved := make([]*bucket, 0, len(sizes))
+	defer func() {
+		for _, bucket := range reserved {
+			bucket.releaseLocked()
+		}
+	}()
+	for bucket := range sizes {
+		if err := bucket.reserveLocked(sizes[bucket]); err != nil {
+			return err
+		}
+		reserved = append(reserved, bucket)
+	}
+
+	for i := range writes {
+		w := &writes[i]
+		bucket := lc.bucketFor(w.keyHash)
+		if w.value == nil {
+			bucket.delLocked(w.keyHash, w.key)
+			continue
+		}
+		atomic.AddUint64(&bucket.statistics.Puts, 1)
+		if err := bucket.writeLocked(w.keyHash, w.key, w.value, w.expire, lc.cipher, keyID, aead); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update runs fn in a transaction and commits its writes atomically.
+// If fn returns an error or a write fails, e.g. a chunk can't be allocated, nothing is written. If a key read or watched by fn was
+// modified by someone else before the commit, ErrorTxnConflict is returned and
+// the caller may retry.
+func (lc *LanternCache) Update(fn func(tx *Txn) error) error {
+	tx := newTxn(lc, false)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// updateWithLocks 先按固定顺序锁住keys涉及的所有bucket, 校验watched后在锁内执行fn
+// fn里只能访问keys中的key
+func (lc *LanternCache) updateWithLocks(keys [][]byte, watched []txnRead, fn func(tx *Txn) error) error {
+	hashes := make([]uint64, 0, len(keys)+len(watched))
+	for i := range keys {
+		hashes = append(hashes, lc.hash.Hash(keys[i]))
+	}
+	for i := range watched {
+		hashes = append(hashes, watched[i].keyHash)
+	}
+	buckets := lc.lockKeys(hashes)
+	defer lc.unlockBuckets(buckets)
+
+	if !lc.validateLocked(watched) {
+		return ErrorTxnConflict
+	}
+	tx := newTxn(lc, true)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.apply()
+}
+
+func (lc *LanternCache) watch(key []byte) txnRead {
+	keyHash := lc.hash.Hash(key)
+	version, err := lc.bucketFor(keyHash).version(keyHash)
+	for err == errBucketMoved {
+		version, err = lc.bucketFor(keyHash).version(keyHash)
+	}
+	return txnRead{keyHash: keyHash, version: version}
+}
+
+func (lc *LanternCache) validateLocked(reads []txnRead) bool {
+	for i := range reads {
+		if lc.bucketFor(reads[i].keyHash).versionLocked(reads[i].keyHash) != reads[i].version {
+			return false
+		}
+	}
+	return true
+}
+
+// lockKeys 给hashes所在的bucket加写锁, 去重后按id从小到大加锁, 保证多个事务之间不会死锁
+// 加锁后有key被Rebucket迁移走时全部解锁重试, 返回时所有key都属于加锁的bucket
+func (lc *LanternCache) lockKeys(hashes []uint64) []*bucket {
+	for {
+		l := lc.loadLayout()
+		routed := make([]*bucket, len(hashes))
+		for i, keyHash := range hashes {
+			routed[i] = l.bucket(keyHash)
+		}
+		buckets := append([]*bucket(nil), routed...)
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].id < buckets[j].id })
+		n := 0
+		for i := range buckets {
+			if i > 0 && buckets[i] == buckets[n-1] {
+				continue
+			}
+			buckets[n] = buckets[i]
+			n++
+		}
+		buckets = buckets[:n]
+		for _, b := range buckets {
+			b.lock()
+		}
+		owned := true
+		for i, keyHash := range hashes {
+			if !routed[i].owns(keyHash) {
+				owned = false
+				break
+			}
+		}
+		if owned {
+			return buckets
+		}
+		lc.unlockBuckets(buckets)
+	}
+}
+
+func (lc *LanternCache) unlockBuckets(buckets []*bucket) {
+	for i := len(buckets) - 1; i >= 0; i-- {
+		buckets[i].unlock()
+	}
+}
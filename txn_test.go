@@ -0,0 +1,184 @@
+package lantern_cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTxnUpdate(t *testing.T) {
+	cache := NewLanternCache(&Config{BucketCount: 4, MaxCapacity: 1024 * 1024})
+	key1, key2 := []byte("key1"), []byte("key2")
+	err := cache.Update(func(tx *Txn) error {
+		if err := tx.Put(key1, []byte("val1")); err != nil {
+			return err
+		}
+		if err := tx.Put(key2, []byte("val2")); err != nil {
+			return err
+		}
+		// 事务内可以读到自己的写入
+		actual, err := tx.Get(key1)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(actual, []byte("val1")) {
+			t.Fatal("not equal")
+		}
+		// 提交前外部不可见
+		if _, err := cache.Get(key1); err != ErrorNotFound {
+			t.Fatal(err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range [][]byte{key1, key2} {
+		if _, err := cache.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = cache.Update(func(tx *Txn) error {
+		tx.Del(key1)
+		_, err := tx.Get(key1)
+		return err
+	})
+	if err != ErrorNotFound {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get(key1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	cache := NewLanternCache(&Config{BucketCount: 4, MaxCapacity: 1024 * 1024})
+	key := []byte("counter")
+	if err := cache.Put(key, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	err := cache.Update(func(tx *Txn) error {
+		if _, err := tx.Get(key); err != nil {
+			return err
+		}
+		if err := cache.Put(key, []byte("2")); err != nil {
+			return err
+		}
+		return tx.Put(key, []byte("3"))
+	})
+	if err != ErrorTxnConflict {
+		t.Fatal(err)
+	}
+	actual, err := cache.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, []byte("2")) {
+		t.Fatal("not equal")
+	}
+
+	other := []byte("other")
+	err = cache.Update(func(tx *Txn) error {
+		tx.Watch(other)
+		cache.Del(key)
+		return tx.Put(key, []byte("4"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache.Update(func(tx *Txn) error {
+		tx.Watch(other)
+		if err := cache.Put(other, []byte("1")); err != nil {
+			return err
+		}
+		return tx.Put(key, []byte("5"))
+	})
+	if err != ErrorTxnConflict {
+		t.Fatal(err)
+	}
+}
+
+func TestTxnView(t *testing.T) {
+	cache := NewLanternCache(&Config{BucketCount: 4, MaxCapacity: 1024 * 1024})
+	key1, key2 := []byte("key1"), []byte("key2")
+	if err := cache.Put(key1, []byte("val1")); err != nil {
+		t.Fatal(err)
+	}
+	err := cache.Update(func(tx *Txn) error {
+		if err := tx.Put(key2, []byte("val2")); err != nil {
+			return err
+		}
+		for _, key := range [][]byte{key1, key2} {
+			if err := tx.View(key, func(value []byte) error {
+				if len(value) != 4 {
+					t.Fatal(string(value))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		// View记录了读到的版本
+		return cache.Put(key1, []byte("new1"))
+	})
+	if err != ErrorTxnConflict {
+		t.Fatal(err)
+	}
+}
+
+// failChunkAlloc 让cache之后的chunk分配都失败, 返回恢复的函数
+func failChunkAlloc(cache *LanternCache) func() {
+	alloc := cache.bucketConfig.chunkAlloc
+	alloc.freeChunksLock.Lock()
+	defer alloc.freeChunksLock.Unlock()
+	factory, free := alloc.factory, alloc.freeChunks
+	alloc.factory, alloc.freeChunks = failingChunkFactory{}, nil
+	return func() {
+		alloc.freeChunksLock.Lock()
+		defer alloc.freeChunksLock.Unlock()
+		alloc.factory, alloc.freeChunks = factory, free
+	}
+}
+
+func TestTxnChunkAllocFailure(t *testing.T) {
+	cache, err := New(&Config{}, WithBuckets(1), WithMaxCapacity(4*chunkSize), WithInitCapacity(chunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put([]byte("key1"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	restore := failChunkAlloc(cache)
+	// 第一个chunk放不下两个value, 第二个value需要分配新的chunk
+	value := bytes.Repeat([]byte("v"), chunkSize/2)
+	err = cache.Update(func(tx *Txn) error {
+		if err := tx.Put([]byte("key1"), value); err != nil {
+			return err
+		}
+		return tx.Put([]byte("key2"), value)
+	})
+	if err != ErrorChunkAlloc {
+		t.Fatal(err)
+	}
+	if actual, err := cache.Get([]byte("key1")); err != nil || string(actual) != "old" {
+		t.Fatal(string(actual), err)
+	}
+	if _, err := cache.Get([]byte("key2")); err != ErrorNotFound {
+		t.Fatal(err)
+	}
+
+	restore()
+	err = cache.Update(func(tx *Txn) error {
+		if err := tx.Put([]byte("key1"), value); err != nil {
+			return err
+		}
+		return tx.Put([]byte("key2"), value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := cache.Get([]byte("key2")); err != nil || !bytes.Equal(actual, value) {
+		t.Fatal(err)
+	}
+}